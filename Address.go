@@ -0,0 +1,78 @@
+package epsp
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseIPPortPeerID は、「IP,ポート,ピアID」形式の文字列を分解します。IPv6アドレスは[]で囲まれていても構いません。
+func ParseIPPortPeerID(s string) (host, port, peerID string, err error) {
+	ss := strings.Split(s, `,`)
+	if len(ss) != 3 {
+		err = errors.New(`IP,ポート,ピアID 書式異常: ` + s)
+		return
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(ss[0], `[`), `]`)
+	port = ss[1]
+	peerID = ss[2]
+	return
+}
+
+// FormatIPPortPeerID は、「IP,ポート,ピアID」形式の文字列を作ります。IPv6アドレスは[]で囲みます。
+func FormatIPPortPeerID(host, port, peerID string) string {
+	if strings.Contains(host, `:`) {
+		host = `[` + host + `]`
+	}
+	return host + `,` + port + `,` + peerID
+}
+
+// IPPortPeerIDToAddr は、「IP,ポート,ピアID」形式の文字列から、接続先アドレスとピアIDを返します
+func IPPortPeerIDToAddr(s string) (addr, peerID string, err error) {
+	host, port, peerID, err := ParseIPPortPeerID(s)
+	if err != nil {
+		return
+	}
+	addr = net.JoinHostPort(host, port)
+	return
+}
+
+// PeerIDOfIPPortPeerID は、「IP,ポート,ピアID」形式の文字列のピアIDを返します。書式異常の場合は空文字列を返します。
+func PeerIDOfIPPortPeerID(s string) string {
+	_, _, peerID, err := ParseIPPortPeerID(s)
+	if err != nil {
+		return ``
+	}
+	return peerID
+}
+
+// SplitPeerList は、「:」区切りのピアリストを分割します。[]で囲まれたIPv6アドレス中の「:」では分割しません。
+func SplitPeerList(s string) (ss []string) {
+	if s == `` {
+		return
+	}
+	depth := 0
+	last := 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case ':':
+			if depth == 0 {
+				ss = append(ss, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(ss, s[last:])
+}
+
+// defaultListenAddrs は、portですべてのインターフェース(デュアルスタック)を待ち受けるアドレスを返します
+func defaultListenAddrs(port string) []string {
+	return []string{net.JoinHostPort(``, port)}
+}
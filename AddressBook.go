@@ -0,0 +1,179 @@
+package epsp
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AddressBook の既定値です
+const (
+	DefaultAddressBookSize = 200
+	addressBookMaxFailures = 3 // 続けてこれだけ接続できなければ、アドレス帳から消します
+)
+
+// AddressBookEntry は、アドレス帳の一件です
+type AddressBookEntry struct {
+	Peer     string    `json:"peer"`      // IP,ポート,ピアID
+	LastSeen time.Time `json:"last_seen"` // 最後に知らされたか、接続できた時刻
+	Failures int       `json:"failures"`  // 続けて接続できなかった回数
+}
+
+// AddressBook は、サーバや隣接ピアから知らされたピアのアドレス帳です。
+// サーバに接続できない間は、ここから接続先を選びます。ピアIDは参加しなおすと変わるので、IPアドレスとポートで区別します。
+type AddressBook struct {
+	Size int
+
+	mu      sync.Mutex
+	clock   Clock
+	entries map[string]*AddressBookEntry
+}
+
+// NewAddressBook は、AddressBook のコンストラクタです。clockがnilなら SystemClock を使います。
+func NewAddressBook(clock Clock) *AddressBook {
+	return &AddressBook{Size: DefaultAddressBookSize, clock: clockOrSystem(clock), entries: make(map[string]*AddressBookEntry)}
+}
+
+func (b *AddressBook) setClock(clock Clock) {
+	b.mu.Lock()
+	b.clock = clockOrSystem(clock)
+	b.mu.Unlock()
+}
+
+// addressBookKey は、「IP,ポート,ピアID」のIPアドレスとポートを返します。書式異常ならfalseです。
+func addressBookKey(peer string) (string, bool) {
+	host, port, peerID, err := ParseIPPortPeerID(peer)
+	if err != nil || host == `` || port == `` || peerID == `` {
+		return ``, false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// Add は、「IP,ポート,ピアID」のピアを、アドレス帳に加えるか、最後に知らされた時刻を更新します
+func (b *AddressBook) Add(peers ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	for _, p := range peers {
+		key, ok := addressBookKey(p)
+		if !ok {
+			continue
+		}
+		if e, ok := b.entries[key]; ok {
+			e.Peer = p
+			e.LastSeen = now
+			continue
+		}
+		b.entries[key] = &AddressBookEntry{Peer: p, LastSeen: now}
+	}
+	b.prune()
+}
+
+// Succeeded は、ピアに接続できたことを記録します
+func (b *AddressBook) Succeeded(peer string) {
+	key, ok := addressBookKey(peer)
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[key] = &AddressBookEntry{Peer: peer, LastSeen: b.clock.Now()}
+	b.prune()
+}
+
+// Failed は、ピアに接続できなかったことを記録します。続けて接続できなければ、アドレス帳から消します。
+func (b *AddressBook) Failed(peer string) {
+	key, ok := addressBookKey(peer)
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[key]
+	if !ok {
+		return
+	}
+	if e.Failures++; e.Failures >= addressBookMaxFailures {
+		delete(b.entries, key)
+	}
+}
+
+// Candidates は、接続先の候補を、接続に失敗した回数が少なく、最近知らされた順にn件まで返します。
+// ピアIDがmyPeerIDのものと、excludeと同じIPアドレスとポートのものは除きます。
+func (b *AddressBook) Candidates(n int, myPeerID string, exclude []string) []string {
+	skip := make(map[string]bool, len(exclude))
+	for _, p := range exclude {
+		if key, ok := addressBookKey(p); ok {
+			skip[key] = true
+		}
+	}
+	es := b.Entries()
+	var ss []string
+	for _, e := range es {
+		if len(ss) >= n {
+			break
+		}
+		key, _ := addressBookKey(e.Peer)
+		if skip[key] || PeerIDOfIPPortPeerID(e.Peer) == myPeerID {
+			continue
+		}
+		ss = append(ss, e.Peer)
+	}
+	return ss
+}
+
+// Entries は、アドレス帳を、接続に失敗した回数が少なく、最近知らされた順に返します
+func (b *AddressBook) Entries() []AddressBookEntry {
+	b.mu.Lock()
+	es := make([]AddressBookEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		es = append(es, *e)
+	}
+	b.mu.Unlock()
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Failures != es[j].Failures {
+			return es[i].Failures < es[j].Failures
+		}
+		if !es[i].LastSeen.Equal(es[j].LastSeen) {
+			return es[i].LastSeen.After(es[j].LastSeen)
+		}
+		return es[i].Peer < es[j].Peer
+	})
+	return es
+}
+
+// Len は、アドレス帳の件数を返します
+func (b *AddressBook) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// restore は、鍵ファイルから読み込んだアドレス帳にします
+func (b *AddressBook) restore(es []AddressBookEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range es {
+		if key, ok := addressBookKey(es[i].Peer); ok {
+			e := es[i]
+			b.entries[key] = &e
+		}
+	}
+	b.prune()
+}
+
+// prune は、Size を超えた分を、最後に知らされた時刻が古いものから消します
+func (b *AddressBook) prune() {
+	if b.Size <= 0 || len(b.entries) <= b.Size {
+		return
+	}
+	keys := make([]string, 0, len(b.entries))
+	for k := range b.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return b.entries[keys[i]].LastSeen.Before(b.entries[keys[j]].LastSeen) })
+	for _, k := range keys[:len(keys)-b.Size] {
+		delete(b.entries, k)
+	}
+}
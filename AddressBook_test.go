@@ -0,0 +1,117 @@
+package epsp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// addressBookPeers は、アドレス帳のピアを Entries の順に返します
+func addressBookPeers(b *AddressBook) (ss []string) {
+	for _, e := range b.Entries() {
+		ss = append(ss, e.Peer)
+	}
+	return
+}
+
+func TestAddressBookAdd(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewAddressBook(clock)
+	b.Add(`192.0.2.1,6911,10`, `192.0.2.2,6911`, `192.0.2.3,,12`, `壊れた`)
+	if got := addressBookPeers(b); !reflect.DeepEqual(got, []string{`192.0.2.1,6911,10`}) {
+		t.Fatalf(`Entries = %v`, got)
+	}
+
+	// 同じIPアドレスとポートなら、ピアIDが変わっても一件です。
+	clock.Advance(time.Minute)
+	b.Add(`192.0.2.1,6911,20`)
+	es := b.Entries()
+	if len(es) != 1 || es[0].Peer != `192.0.2.1,6911,20` || !es[0].LastSeen.Equal(clock.Now()) {
+		t.Errorf(`Entries = %+v`, es)
+	}
+}
+
+func TestAddressBookPrune(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewAddressBook(clock)
+	b.Size = 3
+	for _, p := range []string{`192.0.2.1,6911,1`, `192.0.2.2,6911,2`, `192.0.2.3,6911,3`} {
+		b.Add(p)
+		clock.Advance(time.Minute)
+	}
+
+	// 知らされなおしたものは残り、最後に知らされた時刻が古いものから消えます。
+	b.Add(`192.0.2.1,6911,1`)
+	clock.Advance(time.Minute)
+	b.Add(`192.0.2.4,6911,4`)
+	if got, want := addressBookPeers(b), []string{`192.0.2.4,6911,4`, `192.0.2.1,6911,1`, `192.0.2.3,6911,3`}; !reflect.DeepEqual(got, want) {
+		t.Errorf(`Entries = %v, want %v`, got, want)
+	}
+
+	// 鍵ファイルから読み込んだときも、Size までにします。
+	b = NewAddressBook(clock)
+	b.Size = 2
+	start := clock.Now()
+	b.restore([]AddressBookEntry{
+		{Peer: `192.0.2.1,6911,1`, LastSeen: start.Add(-3 * time.Hour)},
+		{Peer: `192.0.2.2,6911,2`, LastSeen: start.Add(-1 * time.Hour), Failures: 2},
+		{Peer: `192.0.2.3,6911,3`, LastSeen: start.Add(-2 * time.Hour)},
+		{Peer: `壊れた`, LastSeen: start},
+	})
+	if got, want := addressBookPeers(b), []string{`192.0.2.3,6911,3`, `192.0.2.2,6911,2`}; !reflect.DeepEqual(got, want) {
+		t.Errorf(`Entries = %v, want %v`, got, want)
+	}
+}
+
+func TestAddressBookFailed(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewAddressBook(clock)
+	b.Add(`192.0.2.1,6911,1`)
+	b.Failed(`192.0.2.9,6911,9`) // アドレス帳にないものは無視します
+
+	// 接続できれば、失敗した回数を戻します。
+	b.Failed(`192.0.2.1,6911,1`)
+	b.Failed(`192.0.2.1,6911,1`)
+	clock.Advance(time.Minute)
+	b.Succeeded(`192.0.2.1,6911,1`)
+	es := b.Entries()
+	if len(es) != 1 || es[0].Failures != 0 || !es[0].LastSeen.Equal(clock.Now()) {
+		t.Fatalf(`Entries = %+v`, es)
+	}
+
+	// 続けて addressBookMaxFailures 回接続できなければ消します。
+	for i := 1; i < addressBookMaxFailures; i++ {
+		b.Failed(`192.0.2.1,6911,1`)
+	}
+	if es := b.Entries(); len(es) != 1 || es[0].Failures != addressBookMaxFailures-1 {
+		t.Fatalf(`Entries = %+v`, es)
+	}
+	b.Failed(`192.0.2.1,6911,1`)
+	if b.Len() != 0 {
+		t.Errorf(`Len = %d`, b.Len())
+	}
+}
+
+func TestAddressBookCandidates(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewAddressBook(clock)
+	b.Add(`192.0.2.1,6911,1`, `192.0.2.2,6911,2`)
+	clock.Advance(time.Minute)
+	b.Add(`192.0.2.3,6911,3`, `192.0.2.4,6911,4`, `192.0.2.5,6911,5`, `[2001:db8::1],6911,6`)
+	b.Failed(`192.0.2.3,6911,3`)
+
+	// 失敗した回数が少なく、最近知らされた順です。同じ時刻ならピアの文字列順です。
+	want := []string{`192.0.2.4,6911,4`, `192.0.2.5,6911,5`, `[2001:db8::1],6911,6`, `192.0.2.1,6911,1`, `192.0.2.2,6911,2`, `192.0.2.3,6911,3`}
+	if got := b.Candidates(10, ``, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf(`Candidates = %v, want %v`, got, want)
+	}
+	if got := b.Candidates(2, ``, nil); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf(`Candidates(2) = %v`, got)
+	}
+
+	// 自分と、接続中のピアと同じIPアドレスとポートのものは除きます。ピアIDは問いません。
+	got := b.Candidates(3, `4`, []string{`192.0.2.5,6911,50`, `[2001:db8::1],6911,60`, `壊れた`})
+	if want := []string{`192.0.2.1,6911,1`, `192.0.2.2,6911,2`, `192.0.2.3,6911,3`}; !reflect.DeepEqual(got, want) {
+		t.Errorf(`Candidates = %v, want %v`, got, want)
+	}
+}
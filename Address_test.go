@@ -0,0 +1,78 @@
+package epsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPeerList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{``, nil},
+		{`192.0.2.1,6911,10`, []string{`192.0.2.1,6911,10`}},
+		{`192.0.2.1,6911,10:192.0.2.2,6912,11`, []string{`192.0.2.1,6911,10`, `192.0.2.2,6912,11`}},
+		{`[2001:db8::1],6911,10:192.0.2.2,6912,11`, []string{`[2001:db8::1],6911,10`, `192.0.2.2,6912,11`}},
+		{`[fe80::1%eth0],6911,10:[::1],6912,11`, []string{`[fe80::1%eth0],6911,10`, `[::1],6912,11`}},
+		{`2001:db8::1,6911,10`, []string{`2001`, `db8`, ``, `1,6911,10`}}, // 括弧のないIPv6アドレスは分割されます
+		{`[2001:db8::1,6911,10:192.0.2.2,6912,11`, []string{`[2001:db8::1,6911,10:192.0.2.2,6912,11`}},
+		{`a:`, []string{`a`, ``}},
+	}
+	for _, tt := range tests {
+		if got := SplitPeerList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf(`SplitPeerList(%q) = %q, want %q`, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIPPortPeerIDToAddr(t *testing.T) {
+	tests := []struct {
+		in     string
+		addr   string
+		peerID string
+		err    bool
+	}{
+		{`192.0.2.1,6911,10`, `192.0.2.1:6911`, `10`, false},
+		{`[2001:db8::1],6911,10`, `[2001:db8::1]:6911`, `10`, false},
+		{`2001:db8::1,6911,10`, `[2001:db8::1]:6911`, `10`, false},
+		{`[fe80::1%eth0],6911,10`, `[fe80::1%eth0]:6911`, `10`, false},
+		{`192.0.2.1,6911`, ``, ``, true},
+		{`192.0.2.1:6911:10`, ``, ``, true},
+		{`192.0.2.1,6911,10,1`, ``, ``, true},
+		{``, ``, ``, true},
+	}
+	for _, tt := range tests {
+		addr, peerID, err := IPPortPeerIDToAddr(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf(`IPPortPeerIDToAddr(%q) err = %v, want err %v`, tt.in, err, tt.err)
+			continue
+		}
+		if addr != tt.addr || peerID != tt.peerID {
+			t.Errorf(`IPPortPeerIDToAddr(%q) = %q, %q, want %q, %q`, tt.in, addr, peerID, tt.addr, tt.peerID)
+		}
+	}
+}
+
+func TestFormatIPPortPeerID(t *testing.T) {
+	tests := []struct {
+		host, port, peerID string
+		want               string
+	}{
+		{`192.0.2.1`, `6911`, `10`, `192.0.2.1,6911,10`},
+		{`2001:db8::1`, `6911`, `10`, `[2001:db8::1],6911,10`},
+		{`fe80::1%eth0`, `6911`, `10`, `[fe80::1%eth0],6911,10`},
+	}
+	for _, tt := range tests {
+		got := FormatIPPortPeerID(tt.host, tt.port, tt.peerID)
+		if got != tt.want {
+			t.Errorf(`FormatIPPortPeerID(%q, %q, %q) = %q, want %q`, tt.host, tt.port, tt.peerID, got, tt.want)
+		}
+		if list := SplitPeerList(got + `:` + got); len(list) != 2 || list[0] != got {
+			t.Errorf(`SplitPeerList(%q) = %q`, got+`:`+got, list)
+		}
+		if PeerIDOfIPPortPeerID(got) != tt.peerID {
+			t.Errorf(`PeerIDOfIPPortPeerID(%q) = %q`, got, PeerIDOfIPPortPeerID(got))
+		}
+	}
+}
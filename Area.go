@@ -3,6 +3,7 @@ package epsp
 import (
 	"encoding/csv"
 	"io"
+	"strconv"
 	"strings"
 )
 
@@ -45,6 +46,38 @@ func AreaForRegLatLng(regioncode string) (region []string) {
 	return
 }
 
+// AreaInfo は、地域コードの情報です
+type AreaInfo struct {
+	Code       string  `json:"code"`
+	District   string  `json:"district"`   // 地方
+	Prefecture string  `json:"prefecture"` // 都道府県
+	Name       string  `json:"name"`
+	Latitude   float64 `json:"latitude,omitempty"`
+	Longitude  float64 `json:"longitude,omitempty"`
+}
+
+// Areas は、すべての地域コードの情報を返します
+func Areas() (areas []AreaInfo) {
+	reader := csv.NewReader(strings.NewReader(epspareacsv))
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			break
+		}
+		if len(record) < 4 {
+			continue
+		}
+		a := AreaInfo{Code: record[0], District: record[1], Prefecture: record[2], Name: record[3]}
+		if len(record) > 5 {
+			a.Latitude, _ = strconv.ParseFloat(record[4], 64)
+			a.Longitude, _ = strconv.ParseFloat(record[5], 64)
+		}
+		areas = append(areas, a)
+	}
+	return
+}
+
 const epspareacsv = `900,未設定,,地域未設定
 901,不明,,地域不明
 905,外国,,日本以外
@@ -0,0 +1,54 @@
+package epsp
+
+import "time"
+
+// Clock は、現在時刻とタイマーの取得元です。Peer、P2PPeer、P2SClient はこれを通して時間を扱うので、
+// FakeClock に差し替えると、鍵の更新や無通信切断、サーバへの再接続の間隔を、待たずに進められます。
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer は、time.Timer に相当します
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker は、time.Ticker に相当します
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock は、time パッケージそのままの Clock です
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTimer(d time.Duration) Timer         { return systemTimer{time.NewTimer(d)} }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time        { return t.t.C }
+func (t systemTimer) Stop() bool                 { return t.t.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// clockOrSystem は、nilなら SystemClock を返します
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
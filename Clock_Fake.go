@@ -0,0 +1,140 @@
+package epsp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock は、Advance を呼んだときだけ進む Clock です。期限が来たタイマーとティッカーは、Advance の中で発火します。
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter は、FakeClock のタイマーとティッカーです。periodが0ならタイマーです。
+type fakeWaiter struct {
+	clock  *FakeClock
+	when   time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// NewFakeClock は、nowから始まる FakeClock を作ります
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now は、現在時刻を返します
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer は、d後に一度発火する Timer を返します
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{c.add(d, 0)}
+}
+
+// NewTicker は、d毎に発火する Ticker を返します
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic(`non-positive interval for FakeClock.NewTicker`)
+	}
+	return fakeTicker{c.add(d, d)}
+}
+
+// After は、d後に現在時刻が届くチャネルを返します
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).ch
+}
+
+// Waiters は、発火を待っているタイマーとティッカーの数を返します。
+// 別のゴルーチンがタイマーを作るまで待ってから Advance する場合に使います。
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// Advance は、時刻をd進め、その間に期限が来たものを、期限の順に発火させます
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].when.Before(c.waiters[j].when) })
+		if len(c.waiters) == 0 || c.waiters[0].when.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.when
+		select {
+		case w.ch <- w.when: // time パッケージと同じく、受け取られていなければ捨てます
+		default:
+		}
+		if w.period > 0 {
+			w.when = w.when.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{clock: c, when: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		w.ch <- c.now
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// remove は、wを待ちから外し、外したかを返します
+func (c *FakeClock) remove(w *fakeWaiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.waiters {
+		if c.waiters[i] == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct{ w *fakeWaiter }
+
+func (t fakeTimer) C() <-chan time.Time {
+	return t.w.ch
+}
+
+func (t fakeTimer) Stop() bool {
+	return t.w.clock.remove(t.w)
+}
+
+func (t fakeTimer) Reset(d time.Duration) bool {
+	c := t.w.clock
+	active := c.remove(t.w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.w.when = c.now.Add(d)
+	c.waiters = append(c.waiters, t.w)
+	return active
+}
+
+type fakeTicker struct{ w *fakeWaiter }
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.w.ch
+}
+
+func (t fakeTicker) Stop() {
+	t.w.clock.remove(t.w)
+}
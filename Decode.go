@@ -0,0 +1,221 @@
+package epsp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// EarthquakeInfo は、地震情報(551)の内容です
+type EarthquakeInfo struct {
+	Time       string           `json:"time"`       // 発生日時
+	MaxScale   string           `json:"max_scale"`  // 最大震度
+	Tsunami    string           `json:"tsunami"`    // 津波の有無 0:なし 1:あり(注意) 2:調査中 3:不明
+	InfoType   string           `json:"info_type"`  // 地震情報の種類
+	Hypocenter string           `json:"hypocenter"` // 震源
+	Depth      string           `json:"depth"`      // 深さ
+	Magnitude  string           `json:"magnitude"`  // マグニチュード
+	Corrected  bool             `json:"corrected"`  // 震度訂正
+	Latitude   string           `json:"latitude"`   // 震源の緯度
+	Longitude  string           `json:"longitude"`  // 震源の経度
+	Issuer     string           `json:"issuer"`     // 発表元
+	Points     []IntensityPoint `json:"points"`     // 各地の震度
+	Expire     string           `json:"expire"`     // 有効期限
+}
+
+// IntensityPoint は、観測点ごとの震度です
+type IntensityPoint struct {
+	Prefecture string `json:"prefecture"`
+	Scale      string `json:"scale"`
+	Name       string `json:"name"`
+}
+
+// TsunamiInfo は、津波予報(552)の内容です
+type TsunamiInfo struct {
+	Cancelled bool          `json:"cancelled"` // 津波予報の解除
+	Areas     []TsunamiArea `json:"areas"`
+	Expire    string        `json:"expire"` // 有効期限
+}
+
+// TsunamiArea は、津波予報区ごとの予報です
+type TsunamiArea struct {
+	Grade     string `json:"grade"`     // 大津波警報、津波警報、津波注意報など
+	Name      string `json:"name"`      // 津波予報区
+	Immediate bool   `json:"immediate"` // 直ちに津波が来襲すると予想されている
+}
+
+// SensingReport は、地震感知情報(555)の内容です
+type SensingReport struct {
+	PubKey string `json:"pub_key"` // 送信ピアの公開鍵
+	Time   string `json:"time"`    // 感知日時
+	Region string `json:"region"`  // 地域コード
+	Area   string `json:"area"`    // 地域名
+	Expire string `json:"expire"`  // 有効期限
+}
+
+// TraceReply は、調査エコーリプライ(635)の内容です
+type TraceReply struct {
+	Origin    string   `json:"origin"`    // 調査元のピアID
+	TraceID   string   `json:"trace_id"`  // 調査エコーの一意な数
+	Reporter  string   `json:"reporter"`  // 返答したピアのピアID
+	Connected []string `json:"connected"` // 返答したピアの接続先
+	Hops      uint64   `json:"hops"`      // 返答したピアまでの経由数
+}
+
+func decodeShiftJIS(s string) (string, error) {
+	return japanese.ShiftJIS.NewDecoder().String(s)
+}
+
+// DecodeEarthquake は、地震情報(551)のデータ部を復号します
+func DecodeEarthquake(recvdata []string) (*EarthquakeInfo, error) {
+	if len(recvdata) < 3 {
+		return nil, errors.New(`地震情報 項目不足`)
+	}
+	summary, err := decodeShiftJIS(recvdata[2])
+	if err != nil {
+		return nil, errors.Wrap(err, `地震概要 Shift_JIS`)
+	}
+	gaiyo := strings.Split(summary, `,`)
+	field := func(i int) string {
+		if i < len(gaiyo) {
+			return gaiyo[i]
+		}
+		return ``
+	}
+	e := &EarthquakeInfo{
+		Time:       field(0),
+		MaxScale:   field(1),
+		Tsunami:    field(2),
+		InfoType:   field(3),
+		Hypocenter: field(4),
+		Depth:      field(5),
+		Magnitude:  field(6),
+		Corrected:  field(7) == `1`,
+		Latitude:   field(8),
+		Longitude:  field(9),
+		Issuer:     field(10),
+		Expire:     recvdata[1],
+	}
+
+	if len(recvdata) > 3 {
+		detail, err := decodeShiftJIS(recvdata[3])
+		if err != nil {
+			return nil, errors.Wrap(err, `震度詳細 Shift_JIS`)
+		}
+		e.Points = decodeIntensityPoints(detail)
+	}
+	return e, nil
+}
+
+// decodeIntensityPoints は、「-都道府県,+震度,*観測点,...」形式の震度詳細を分解します
+func decodeIntensityPoints(detail string) (points []IntensityPoint) {
+	var pref, scale string
+	for _, item := range strings.Split(detail, `,`) {
+		if item == `` {
+			continue
+		}
+		switch item[0] {
+		case '-':
+			pref = item[1:]
+		case '+':
+			scale = item[1:]
+		case '*':
+			points = append(points, IntensityPoint{Prefecture: pref, Scale: scale, Name: item[1:]})
+		}
+	}
+	return
+}
+
+// tsunamiGrades は、津波予報の等級を表す接頭辞です
+var tsunamiGrades = map[byte]string{
+	'*': `大津波警報`,
+	'+': `津波警報`,
+	'-': `津波注意報`,
+	'?': `不明`,
+}
+
+// DecodeTsunami は、津波予報(552)のデータ部を復号します。
+// データは「等級記号予報区名[!]」をカンマで区切ったもので、末尾の「!」は直ちに来襲することを表します。「解除」は予報の解除です。
+func DecodeTsunami(recvdata []string) (*TsunamiInfo, error) {
+	if len(recvdata) < 3 {
+		return nil, errors.New(`津波予報 項目不足`)
+	}
+	body, err := decodeShiftJIS(recvdata[2])
+	if err != nil {
+		return nil, errors.Wrap(err, `津波予報 Shift_JIS`)
+	}
+	t := &TsunamiInfo{Expire: recvdata[1], Areas: []TsunamiArea{}}
+	if body == `` || body == `解除` {
+		t.Cancelled = true
+		return t, nil
+	}
+	for _, item := range strings.Split(body, `,`) {
+		if item == `` {
+			continue
+		}
+		grade, ok := tsunamiGrades[item[0]]
+		if !ok {
+			return nil, errors.New(`津波予報 等級不明: ` + item)
+		}
+		name := item[1:]
+		immediate := strings.HasSuffix(name, `!`)
+		t.Areas = append(t.Areas, TsunamiArea{Grade: grade, Name: strings.TrimSuffix(name, `!`), Immediate: immediate})
+	}
+	return t, nil
+}
+
+// DecodeSensing は、地震感知情報(555)のデータ部を復号します
+func DecodeSensing(recvdata []string) (*SensingReport, error) {
+	if len(recvdata) < 6 {
+		return nil, errors.New(`地震感知情報 項目不足`)
+	}
+	kanchidata := strings.Split(recvdata[5], `,`)
+	if len(kanchidata) < 2 {
+		return nil, errors.New(`地震感知情報 書式異常: ` + recvdata[5])
+	}
+	return &SensingReport{
+		PubKey: recvdata[2],
+		Time:   kanchidata[0],
+		Region: kanchidata[1],
+		Area:   Area(kanchidata[1]),
+		Expire: recvdata[1],
+	}, nil
+}
+
+// DecodeTraceReply は、調査エコーリプライ(635)のデータ部を復号します
+func DecodeTraceReply(recvdata []string) (*TraceReply, error) {
+	if len(recvdata) < 5 {
+		return nil, errors.New(`調査エコーリプライ 項目不足`)
+	}
+	hops, err := strconv.ParseUint(recvdata[4], 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, `調査エコーリプライ 経由数`)
+	}
+	r := &TraceReply{Origin: recvdata[0], TraceID: recvdata[1], Reporter: recvdata[2], Connected: []string{}, Hops: hops}
+	if recvdata[3] != `` {
+		r.Connected = strings.Split(recvdata[3], `,`)
+	}
+	return r, nil
+}
+
+// Decode は、コードに応じてデータ部を復号します。対応していないコードはnilを返します。
+func Decode(code string, recvdata []string) (interface{}, error) {
+	switch code {
+	case CodeEarthquake:
+		return DecodeEarthquake(recvdata)
+	case CodeTsunami:
+		return DecodeTsunami(recvdata)
+	case CodeSensing:
+		return DecodeSensing(recvdata)
+	case CodeRegionPeers:
+		if len(recvdata) < 3 {
+			return nil, errors.New(`地域ピア数 項目不足`)
+		}
+		return NewPeerCount(recvdata[2]), nil
+	case CodeTraceReply:
+		return DecodeTraceReply(recvdata)
+	}
+	return nil, nil
+}
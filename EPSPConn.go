@@ -7,6 +7,8 @@ import (
 	"math"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,116 +16,184 @@ import (
 
 // EPSPConn は、EPSPの接続情報を保持します
 type EPSPConn struct {
-	IPPort       string
-	ConnTime     *time.Time
-	PingTime     *time.Time
-	PongTime     *time.Time
-	PingPong     *time.Duration
-	PingRecvTime *time.Time
-	DiscTime     *time.Time
-	LastRXTime   *time.Time
-	Agent        []string
-	conn         *net.TCPConn
-	Tx           uint64
-	Rx           uint64
-	RxUniq       uint64
-	RxDup        uint64
+	Tx       uint64 // 64bit境界に置くため先頭に置きます
+	Rx       uint64
+	RxUniq   uint64
+	RxDup    uint64
+	IPPort   string
+	Agent    []string
+	version  uint32 // 取り決めたプロトコルバージョン(ProtocolVersion.pack)
+	conn     *net.TCPConn
+	clock    Clock
+	mu       sync.RWMutex
+	times    ConnTimes
+	onChange func() // 接続情報が変わったときに呼びます
+}
+
+// ConnTimes は、接続の時刻のスナップショットです。まだない時刻はゼロ値です。
+type ConnTimes struct {
+	Conn     time.Time     // 接続した時刻
+	Ping     time.Time     // Pingした時刻
+	Pong     time.Time     // Pingの返答を受け取った時刻
+	PingPong time.Duration // Pingの往復時間。Pongがゼロ値なら無効です
+	PingRecv time.Time     // Pingを受け取った時刻
+	Disc     time.Time     // 切断した時刻
+	LastRX   time.Time     // 最後にデータを受信した時刻
+}
+
+// timePtr は、ゼロ値ならnilを返します
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// now は、接続の Clock の現在時刻です
+func (p *EPSPConn) now() time.Time {
+	return clockOrSystem(p.clock).Now()
+}
+
+// since は、接続の Clock で、tからの経過時間を返します
+func (p *EPSPConn) since(t time.Time) time.Duration {
+	return p.now().Sub(t)
+}
+
+// setOnChange は、接続情報が変わったときに呼ぶ関数を設定します
+func (p *EPSPConn) setOnChange(f func()) {
+	p.mu.Lock()
+	p.onChange = f
+	p.mu.Unlock()
+}
+
+// changed は、接続情報が変わったことを通知します
+func (p *EPSPConn) changed() {
+	p.mu.RLock()
+	f := p.onChange
+	p.mu.RUnlock()
+	if f != nil {
+		f()
+	}
+}
+
+// setTime は、fで時刻を設定し、変化を通知します
+func (p *EPSPConn) setTime(f func(t *ConnTimes, now time.Time)) {
+	now := p.now()
+	p.mu.Lock()
+	f(&p.times, now)
+	p.mu.Unlock()
+	p.changed()
+}
+
+// Times は、接続の時刻のスナップショットを返します
+func (p *EPSPConn) Times() ConnTimes {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.times
 }
 
 // SetConnTime は、現在時刻を接続時間として設定します
 func (p *EPSPConn) SetConnTime() {
-	p.ConnTime = new(time.Time)
-	*p.ConnTime = time.Now()
+	p.setTime(func(t *ConnTimes, now time.Time) { t.Conn = now })
 }
 
 // SetDiscTime は、現在時刻を切断時間として設定します
 func (p *EPSPConn) SetDiscTime() {
-	p.DiscTime = new(time.Time)
-	*p.DiscTime = time.Now()
+	p.setTime(func(t *ConnTimes, now time.Time) { t.Disc = now })
 }
 
 // SetPingTime は、現在時刻をPingした時刻として設定します
 func (p *EPSPConn) SetPingTime() {
-	if p.PingTime == nil {
-		p.PingTime = new(time.Time)
-	}
-	*p.PingTime = time.Now()
+	p.setTime(func(t *ConnTimes, now time.Time) { t.Ping = now })
 }
 
 // SetPongTime は、現在時刻をPingの返答を受け取った時刻として設定します
 func (p *EPSPConn) SetPongTime() {
-	if p.PongTime == nil {
-		p.PongTime = new(time.Time)
-	}
-	*p.PongTime = time.Now()
-	if p.PingPong == nil {
-		p.PingPong = new(time.Duration)
-	}
-	*p.PingPong = p.PongTime.Sub(*p.PingTime)
+	p.setTime(func(t *ConnTimes, now time.Time) {
+		t.Pong = now
+		t.PingPong = now.Sub(t.Ping)
+	})
 }
 
 // SetPingRecvTime は、現在時刻をPingを受け取った時刻として設定します
 func (p *EPSPConn) SetPingRecvTime() {
-	if p.PingRecvTime == nil {
-		p.PingRecvTime = new(time.Time)
-	}
-	*p.PingRecvTime = time.Now()
+	p.setTime(func(t *ConnTimes, now time.Time) { t.PingRecv = now })
 }
 
 // SetLastRXTime は、最後にデータを受信した時刻を設定します
 func (p *EPSPConn) SetLastRXTime() {
-	if p.LastRXTime == nil {
-		p.LastRXTime = new(time.Time)
-	}
-	*p.LastRXTime = time.Now()
+	p.setTime(func(t *ConnTimes, now time.Time) { t.LastRX = now })
 }
 
 // GetConnTime は、接続した時刻を取得します
 func (p *EPSPConn) GetConnTime() *time.Time {
-	return p.ConnTime
+	return timePtr(p.Times().Conn)
 }
 
 // GetPingTime は、Pingした時刻を取得します
 func (p *EPSPConn) GetPingTime() *time.Time {
-	return p.PingTime
+	return timePtr(p.Times().Ping)
 }
 
-// GetDiscTime は、Pingした時刻を取得します
+// GetDiscTime は、切断した時刻を取得します
 func (p *EPSPConn) GetDiscTime() *time.Time {
-	return p.DiscTime
+	return timePtr(p.Times().Disc)
 }
 
 // GetPingRecv は、Pingを受信した時刻を取得します
 func (p *EPSPConn) GetPingRecv() *time.Time {
-	return p.PingRecvTime
+	return timePtr(p.Times().PingRecv)
+}
+
+// GetPingPong は、Pingの往復時間を取得します
+func (p *EPSPConn) GetPingPong() *time.Duration {
+	t := p.Times()
+	if t.Pong.IsZero() {
+		return nil
+	}
+	return &t.PingPong
 }
 
 // AddTx はTxを一つ増やします
 func (p *EPSPConn) AddTx() {
-	p.Tx++
+	atomic.AddUint64(&p.Tx, 1)
+	p.changed()
 }
 
 // AddRx はRxを一つ増やします
 func (p *EPSPConn) AddRx() {
-	p.Rx++
+	atomic.AddUint64(&p.Rx, 1)
+	p.changed()
 }
 
 // AddRxDup はRxDupを一つ増やします
 func (p *EPSPConn) AddRxDup() {
-	p.RxDup++
+	atomic.AddUint64(&p.RxDup, 1)
+	p.changed()
 }
 
 // AddRxUniq はRxUniqを一つ増やします
 func (p *EPSPConn) AddRxUniq() {
-	p.RxUniq++
+	atomic.AddUint64(&p.RxUniq, 1)
+	p.changed()
 }
 
 // GetRXUniqRate はすべての受信情報のうち、最速だったものの割合の逆数を返します
 func (p *EPSPConn) GetRXUniqRate() uint64 {
-	if p.RxUniq == 0 {
+	uniq := atomic.LoadUint64(&p.RxUniq)
+	if uniq == 0 {
 		return math.MaxUint64
 	}
-	return (p.RxUniq + p.RxDup) / p.RxUniq
+	return (uniq + atomic.LoadUint64(&p.RxDup)) / uniq
+}
+
+// Version は、この接続で取り決めたプロトコルバージョンを返します。取り決める前はゼロ値です。
+func (p *EPSPConn) Version() ProtocolVersion {
+	return unpackProtocolVersion(atomic.LoadUint32(&p.version))
+}
+
+func (p *EPSPConn) setVersion(v ProtocolVersion) {
+	atomic.StoreUint32(&p.version, v.pack())
 }
 
 // IsConn は、接続中かどうか返します
@@ -174,6 +244,21 @@ func (p *EPSPConn) Get(ctx context.Context) (string, error) {
 	}
 }
 
+// GetMessage は、データを一行取得し、Messageにします
+func (p *EPSPConn) GetMessage(ctx context.Context) (m Message, err error) {
+	rv, err := p.Get(ctx)
+	if err != nil {
+		return
+	}
+	err = m.Unmarshal(rv)
+	return
+}
+
+// WriteMessage は、Messageを一行送信します
+func (p *EPSPConn) WriteMessage(m Message) error {
+	return p.Write(m.Marshal())
+}
+
 func (p *EPSPConn) Write(strs ...string) error {
 	if !p.IsConn() {
 		return errors.New(`No Connection`)
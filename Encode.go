@@ -0,0 +1,90 @@
+package epsp
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func encodeShiftJIS(s string) (string, error) {
+	return japanese.ShiftJIS.NewEncoder().String(s)
+}
+
+// checkField は、データ部の区切り文字を含む項目を拒否します
+func checkField(name, s string) error {
+	if strings.ContainsAny(s, ",:;\r\n") {
+		return errors.New(name + ` 区切り文字を含みます: ` + s)
+	}
+	return nil
+}
+
+// EncodeEarthquake は、地震情報(551)のデータ部(地震概要と震度詳細)を、Shift_JISで作ります。DecodeEarthquake の逆です。
+func EncodeEarthquake(e *EarthquakeInfo) (summary, detail string, err error) {
+	corrected := `0`
+	if e.Corrected {
+		corrected = `1`
+	}
+	fields := []string{e.Time, e.MaxScale, e.Tsunami, e.InfoType, e.Hypocenter, e.Depth, e.Magnitude, corrected, e.Latitude, e.Longitude, e.Issuer}
+	for _, f := range fields {
+		if err = checkField(`地震概要`, f); err != nil {
+			return
+		}
+	}
+	if summary, err = encodeShiftJIS(strings.Join(fields, `,`)); err != nil {
+		err = errors.Wrap(err, `地震概要 Shift_JIS`)
+		return
+	}
+
+	var items []string
+	var pref, scale string
+	for i, p := range e.Points {
+		for _, f := range []string{p.Prefecture, p.Scale, p.Name} {
+			if err = checkField(`震度詳細`, f); err != nil {
+				return
+			}
+		}
+		if i == 0 || p.Prefecture != pref {
+			pref = p.Prefecture
+			items = append(items, `-`+pref)
+			scale = ``
+		}
+		if p.Scale != scale {
+			scale = p.Scale
+			items = append(items, `+`+scale)
+		}
+		items = append(items, `*`+p.Name)
+	}
+	if detail, err = encodeShiftJIS(strings.Join(items, `,`)); err != nil {
+		err = errors.Wrap(err, `震度詳細 Shift_JIS`)
+	}
+	return
+}
+
+// EncodeTsunami は、津波予報(552)のデータ部を、Shift_JISで作ります。DecodeTsunami の逆です。
+func EncodeTsunami(t *TsunamiInfo) (string, error) {
+	if t.Cancelled || len(t.Areas) == 0 {
+		return encodeShiftJIS(`解除`)
+	}
+	symbols := make(map[string]byte, len(tsunamiGrades))
+	for symbol, grade := range tsunamiGrades {
+		symbols[grade] = symbol
+	}
+	items := make([]string, 0, len(t.Areas))
+	for _, a := range t.Areas {
+		symbol, ok := symbols[a.Grade]
+		if !ok {
+			return ``, errors.New(`津波予報 等級不明: ` + a.Grade)
+		}
+		if err := checkField(`津波予報`, a.Name); err != nil {
+			return ``, err
+		}
+		item := string(symbol) + a.Name
+		if a.Immediate {
+			item += `!`
+		}
+		items = append(items, item)
+	}
+	body, err := encodeShiftJIS(strings.Join(items, `,`))
+	return body, errors.Wrap(err, `津波予報 Shift_JIS`)
+}
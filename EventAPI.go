@@ -0,0 +1,115 @@
+package epsp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const eventHeartbeat = 30 * time.Second
+
+// eventQuery は、クエリ文字列 codes=551,552 と、Last-Event-ID ヘッダまたは last_event_id から購読条件を取り出します
+func eventQuery(r *http.Request) (lastID uint64, codes []string) {
+	if c := r.URL.Query().Get(`codes`); c != `` {
+		codes = strings.Split(c, `,`)
+	}
+	id := r.Header.Get(`Last-Event-ID`)
+	if id == `` {
+		id = r.URL.Query().Get(`last_event_id`)
+	}
+	if id != `` {
+		lastID, _ = strconv.ParseUint(id, 10, 64)
+	}
+	return
+}
+
+// EventAPI は、受理したメッセージのイベントを、WebSocket(/ws/events)とServer-Sent Events(/events)で配信します。
+// codes=551,552 で配信するコードを絞り込み、last_event_id(SSEでは Last-Event-ID ヘッダも可)で再開できます。
+// /events/recent は、保持している直近のイベントを新しい順にn個(既定は保持しているすべて)返します。
+func (peer *Peer) EventAPI(ctx context.Context, hs *http.ServeMux) {
+	hs.HandleFunc(`/events`, func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, `streaming unsupported`, http.StatusInternalServerError)
+			return
+		}
+		lastID, codes := eventQuery(r)
+		events, cancel := peer.events.Subscribe(lastID, codes)
+		defer cancel()
+
+		w.Header().Set(`Content-Type`, `text/event-stream`)
+		w.Header().Set(`Cache-Control`, `no-cache`)
+		w.Header().Set(`Connection`, `keep-alive`)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := peer.clock.NewTicker(eventHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				bs, err := json.Marshal(ev)
+				if err != nil {
+					logln(`[WARN] イベント ` + err.Error())
+					continue
+				}
+				if _, err = w.Write([]byte(`id: ` + strconv.FormatUint(ev.ID, 10) + "\nevent: " + ev.Code + "\ndata: " + string(bs) + "\n\n")); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ticker.C():
+				if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	hs.HandleFunc(`/events/recent`, func(w http.ResponseWriter, r *http.Request) {
+		_, codes := eventQuery(r)
+		n, err := strconv.Atoi(r.URL.Query().Get(`n`))
+		if err != nil || n <= 0 || n > eventBacklog {
+			n = eventBacklog
+		}
+		evs := peer.events.Recent(n, codes...)
+		if evs == nil {
+			evs = []Event{}
+		}
+		w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+		w.Header().Set(`Cache-Control`, `no-cache`)
+		if err = json.NewEncoder(w).Encode(evs); err != nil {
+			logln(`[WARN] イベント応答 ` + err.Error())
+		}
+	})
+
+	hs.HandleFunc(`/ws/events`, func(w http.ResponseWriter, r *http.Request) {
+		lastID, codes := eventQuery(r)
+		events, cancel := peer.events.Subscribe(lastID, codes)
+		defer cancel()
+
+		next := func(stop <-chan struct{}) (interface{}, bool) {
+			select {
+			case ev, ok := <-events:
+				return ev, ok
+			case <-stop:
+				return nil, false
+			}
+		}
+		wsPump(ctx, peer.clock, w, r, next, func(conn *websocket.Conn, v interface{}) error {
+			return conn.WriteJSON(v)
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package epsp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventStreamPublishUsesClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewEventStream(clock)
+	events, cancel := s.Subscribe(0, []string{CodeEarthquake})
+	defer cancel()
+
+	s.Publish(CodeTsunami, `1`, nil)
+	clock.Advance(time.Minute)
+	ev := s.Publish(CodeEarthquake, `2`, nil)
+	if want := clock.Now(); !ev.Time.Equal(want) {
+		t.Errorf(`Time = %v, want %v`, ev.Time, want)
+	}
+	select {
+	case got := <-events:
+		if got.ID != ev.ID || got.Code != CodeEarthquake {
+			t.Errorf(`event = %+v, want %+v`, got, ev)
+		}
+	default:
+		t.Fatal(`subscriber did not receive event`)
+	}
+
+	// 再開すると、lastIDより後の保持済みイベントから受け取ります。
+	resumed, cancel2 := s.Subscribe(1, nil)
+	defer cancel2()
+	if got := <-resumed; got.ID != ev.ID {
+		t.Errorf(`resumed event ID = %d, want %d`, got.ID, ev.ID)
+	}
+}
+
+func TestEventAPIWebSocket(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := &Peer{clock: clock, events: NewEventStream(clock)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	peer.EventAPI(ctx, mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(`ws`+strings.TrimPrefix(s.URL, `http`)+`/ws/events?codes=`+CodeEarthquake, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	received := make(chan Event)
+	go func() {
+		defer close(received)
+		for {
+			var ev Event
+			if err := conn.ReadJSON(&ev); err != nil {
+				return
+			}
+			received <- ev
+		}
+	}()
+
+	peer.events.Publish(CodeTsunami, ``, nil)
+	peer.events.Publish(CodeEarthquake, `3`, `data`)
+	select {
+	case ev := <-received:
+		if ev.Code != CodeEarthquake || ev.Hops != `3` || !ev.Time.Equal(clock.Now()) {
+			t.Errorf(`event = %+v`, ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`no event received`)
+	}
+
+	// Pingは、時計の一定間隔で送ります。
+	waitUntil(t, func() bool { return clock.Waiters() > 0 })
+	clock.Advance(eventHeartbeat)
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`no ping after heartbeat interval`)
+	}
+
+	// 終了すると、接続を閉じます。
+	cancel()
+	select {
+	case _, ok := <-received:
+		if ok {
+			t.Error(`event received after shutdown`)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`connection not closed after shutdown`)
+	}
+}
+
+// waitUntil は、別のゴルーチンでcondが成り立つまで待ちます
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(`timed out waiting for condition`)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
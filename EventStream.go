@@ -0,0 +1,129 @@
+package epsp
+
+import (
+	"sync"
+	"time"
+)
+
+// eventBacklog は、再開用に保持するイベントの数です
+const eventBacklog = 256
+
+// eventSubscriberBuffer は、購読者ごとの送信待ちイベントの数です。溢れた購読者は切断します。
+const eventSubscriberBuffer = 64
+
+// Event は、受信して受理したメッセージを復号したものです
+type Event struct {
+	ID   uint64      `json:"id"`
+	Code string      `json:"code"`
+	Hops string      `json:"hops,omitempty"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type eventSubscriber struct {
+	ch    chan Event
+	codes map[string]bool
+}
+
+func newEventSubscriber(size int, codes []string) *eventSubscriber {
+	sub := &eventSubscriber{ch: make(chan Event, size)}
+	if len(codes) != 0 {
+		sub.codes = make(map[string]bool, len(codes))
+		for _, c := range codes {
+			sub.codes[c] = true
+		}
+	}
+	return sub
+}
+
+func (s *eventSubscriber) wants(code string) bool {
+	return len(s.codes) == 0 || s.codes[code]
+}
+
+// EventStream は、イベントを購読者に配信します。直近のイベントを保持し、最後に受け取ったIDからの再開ができます。
+type EventStream struct {
+	mu      sync.Mutex
+	clock   Clock
+	lastID  uint64
+	backlog []Event
+	subs    map[*eventSubscriber]struct{}
+}
+
+// NewEventStream は、EventStream のコンストラクタです。イベントの時刻はclockから取ります。clockがnilなら SystemClock を使います。
+func NewEventStream(clock Clock) *EventStream {
+	return &EventStream{clock: clockOrSystem(clock), subs: make(map[*eventSubscriber]struct{})}
+}
+
+func (s *EventStream) setClock(clock Clock) {
+	s.mu.Lock()
+	s.clock = clockOrSystem(clock)
+	s.mu.Unlock()
+}
+
+// Publish は、イベントを発行し、購読者に配信します
+func (s *EventStream) Publish(code, hops string, data interface{}) Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	ev := Event{ID: s.lastID, Code: code, Hops: hops, Time: s.clock.Now(), Data: data}
+	s.backlog = append(s.backlog, ev)
+	if len(s.backlog) > eventBacklog {
+		s.backlog = s.backlog[len(s.backlog)-eventBacklog:]
+	}
+
+	for sub := range s.subs {
+		if !sub.wants(code) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			logln(`[WARN] イベント購読者の受信遅延、切断`)
+			delete(s.subs, sub)
+			close(sub.ch)
+		}
+	}
+	return ev
+}
+
+// Subscribe は、codesのイベントを購読します。codesが空の場合はすべてのイベントを購読します。
+// lastIDより後の保持済みイベントを先に配信します。不要になったらcancelを呼んでください。
+// 受信が遅れた購読者のチャネルは閉じられます。
+func (s *EventStream) Subscribe(lastID uint64, codes []string) (events <-chan Event, cancel func()) {
+	sub := newEventSubscriber(eventSubscriberBuffer+eventBacklog, codes)
+
+	s.mu.Lock()
+	if lastID != 0 {
+		for _, ev := range s.backlog {
+			if ev.ID > lastID && sub.wants(ev.Code) {
+				sub.ch <- ev
+			}
+		}
+	}
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+
+	cancel = func() {
+		s.mu.Lock()
+		if _, ok := s.subs[sub]; ok {
+			delete(s.subs, sub)
+			close(sub.ch)
+		}
+		s.mu.Unlock()
+	}
+	return sub.ch, cancel
+}
+
+// Recent は、保持している直近のイベントのうち、codesのものを新しい順に最大n個返します
+func (s *EventStream) Recent(n int, codes ...string) (evs []Event) {
+	sub := newEventSubscriber(0, codes)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.backlog) - 1; i >= 0 && len(evs) < n; i-- {
+		if sub.wants(s.backlog[i].Code) {
+			evs = append(evs, s.backlog[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,403 @@
+package epsp
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JMAReport は、気象庁防災情報XMLを変換した結果です。地震の情報は Earthquake に、津波の情報は Tsunami に入ります。
+type JMAReport struct {
+	Title        string            `json:"title"`                // 情報の名称(震度速報、震源・震度に関する情報、津波警報・注意報・予報 など)
+	InfoType     string            `json:"info_type"`            // 発表、訂正、取消
+	Earthquake   *EarthquakeInfo   `json:"earthquake,omitempty"` // 地震情報(551)
+	Tsunami      *TsunamiInfo      `json:"tsunami,omitempty"`    // 津波予報(552)
+	RegionScales map[string]string `json:"region_scales"`        // EPSPの地域コードごとの最大震度("5-" など)
+}
+
+// jmaReport は、気象庁防災情報XMLのうち、変換に使う部分です。名前空間は問いません。
+type jmaReport struct {
+	Control struct {
+		Title            string `xml:"Title"`
+		PublishingOffice string `xml:"PublishingOffice"`
+	} `xml:"Control"`
+	Head struct {
+		Title          string `xml:"Title"`
+		TargetDateTime string `xml:"TargetDateTime"`
+		InfoType       string `xml:"InfoType"`
+	} `xml:"Head"`
+	Body struct {
+		Earthquake []struct {
+			OriginTime  string `xml:"OriginTime"`
+			ArrivalTime string `xml:"ArrivalTime"`
+			Hypocenter  struct {
+				Area struct {
+					Name       string   `xml:"Name"`
+					Coordinate []string `xml:"Coordinate"`
+				} `xml:"Area"`
+			} `xml:"Hypocenter"`
+			Magnitude []string `xml:"Magnitude"`
+		} `xml:"Earthquake"`
+		Intensity struct {
+			Observation struct {
+				MaxInt string `xml:"MaxInt"`
+				Pref   []struct {
+					Name string `xml:"Name"`
+					Area []struct {
+						Name   string `xml:"Name"`
+						Code   string `xml:"Code"`
+						MaxInt string `xml:"MaxInt"`
+						City   []struct {
+							IntensityStation []struct {
+								Name string `xml:"Name"`
+								Int  string `xml:"Int"`
+							} `xml:"IntensityStation"`
+						} `xml:"City"`
+					} `xml:"Area"`
+				} `xml:"Pref"`
+			} `xml:"Observation"`
+		} `xml:"Intensity"`
+		Tsunami struct {
+			Forecast struct {
+				Item []struct {
+					Area struct {
+						Name string `xml:"Name"`
+					} `xml:"Area"`
+					Category struct {
+						Kind struct {
+							Name string `xml:"Name"`
+						} `xml:"Kind"`
+					} `xml:"Category"`
+					FirstHeight struct {
+						Condition string `xml:"Condition"`
+					} `xml:"FirstHeight"`
+				} `xml:"Item"`
+			} `xml:"Forecast"`
+		} `xml:"Tsunami"`
+		Comments struct {
+			ForecastComment struct {
+				Code string `xml:"Code"`
+			} `xml:"ForecastComment"`
+		} `xml:"Comments"`
+	} `xml:"Body"`
+}
+
+// ParseJMAXMLFile は、気象庁防災情報XMLのファイルを変換します
+func ParseJMAXMLFile(filename string) (*JMAReport, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseJMAXML(f)
+}
+
+// ParseJMAXML は、気象庁防災情報XML(震度速報、震源に関する情報、震源・震度に関する情報、津波警報・注意報・予報)を、
+// 地震情報(551)と津波予報(552)に変換します。取り消された情報と、津波警報・注意報もその解除も含まない津波の情報はエラーです。
+func ParseJMAXML(r io.Reader) (*JMAReport, error) {
+	var doc jmaReport
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, `気象庁防災情報XML`)
+	}
+	title := doc.Head.Title
+	if title == `` {
+		title = doc.Control.Title
+	}
+	report := &JMAReport{Title: title, InfoType: doc.Head.InfoType, RegionScales: make(map[string]string)}
+
+	switch {
+	case strings.Contains(doc.Control.Title, `津波`):
+		t, err := jmaTsunami(&doc)
+		if err != nil {
+			return nil, errors.Wrap(err, title)
+		}
+		report.Tsunami = t
+	case strings.Contains(doc.Control.Title, `震度`) || strings.Contains(doc.Control.Title, `震源`):
+		if doc.Head.InfoType == `取消` {
+			return nil, errors.New(`地震情報の取消には対応していません: ` + title)
+		}
+		report.Earthquake = jmaEarthquake(&doc, report.RegionScales)
+	default:
+		return nil, errors.New(`対応していない情報です: ` + doc.Control.Title)
+	}
+	return report, nil
+}
+
+// jmaInfoTypes は、情報の名称ごとの地震情報の種類です
+var jmaInfoTypes = map[string]string{
+	`震度速報`:        `ScalePrompt`,
+	`震源に関する情報`:    `Destination`,
+	`震源・震度に関する情報`: `DetailScale`,
+	`遠地地震に関する情報`:  `Foreign`,
+}
+
+// jmaCoordinate は、ISO 6709 の「+緯度+経度-深さ/」です。深さは省略されることがあります。
+var jmaCoordinate = regexp.MustCompile(`^([+-][0-9.]+)([+-][0-9.]+)([+-][0-9]+)?/$`)
+
+func jmaEarthquake(doc *jmaReport, regionScales map[string]string) *EarthquakeInfo {
+	e := &EarthquakeInfo{
+		MaxScale: `-1`,
+		Tsunami:  jmaTsunamiComment(doc.Body.Comments.ForecastComment.Code),
+		InfoType: `Other`,
+		Issuer:   doc.Control.PublishingOffice,
+	}
+	if t, ok := jmaInfoTypes[doc.Control.Title]; ok {
+		e.InfoType = t
+	}
+	e.Corrected = doc.Head.InfoType == `訂正`
+
+	origin := doc.Head.TargetDateTime
+	if len(doc.Body.Earthquake) != 0 {
+		eq := doc.Body.Earthquake[0]
+		if eq.OriginTime != `` {
+			origin = eq.OriginTime
+		} else if eq.ArrivalTime != `` {
+			origin = eq.ArrivalTime
+		}
+		e.Hypocenter = eq.Hypocenter.Area.Name
+		for _, c := range eq.Hypocenter.Area.Coordinate {
+			if m := jmaCoordinate.FindStringSubmatch(strings.TrimSpace(c)); m != nil {
+				e.Latitude = signedCoord(m[1], `N`, `S`)
+				e.Longitude = signedCoord(m[2], `E`, `W`)
+				e.Depth = jmaDepth(m[3])
+				break
+			}
+		}
+		if len(eq.Magnitude) != 0 {
+			e.Magnitude = eq.Magnitude[0]
+			if e.Magnitude == `NaN` {
+				e.Magnitude = `不明`
+			}
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, origin); err == nil {
+		e.Time = t.In(jst).Format(`02日15時04分`)
+	}
+
+	obs := doc.Body.Intensity.Observation
+	if code := ScaleCode(obs.MaxInt); code != `` {
+		e.MaxScale = code
+	}
+	for _, pref := range obs.Pref {
+		var points []IntensityPoint
+		for _, area := range pref.Area {
+			if region := RegionOfJMAArea(area.Code); region != `` && scaleRanks[area.MaxInt] > scaleRanks[regionScales[region]] {
+				regionScales[region] = area.MaxInt
+			}
+			stations := 0
+			for _, city := range area.City {
+				for _, st := range city.IntensityStation {
+					if st.Int != `` {
+						points = append(points, IntensityPoint{Prefecture: pref.Name, Scale: st.Int, Name: st.Name})
+						stations++
+					}
+				}
+			}
+			if stations == 0 && area.MaxInt != `` { // 震度速報は、地域ごとの震度です
+				points = append(points, IntensityPoint{Prefecture: pref.Name, Scale: area.MaxInt, Name: area.Name})
+			}
+		}
+		sort.SliceStable(points, func(i, j int) bool { return scaleRanks[points[i].Scale] > scaleRanks[points[j].Scale] })
+		e.Points = append(e.Points, points...)
+	}
+	return e
+}
+
+// signedCoord は、"+35.6" を "N35.6" のようにします
+func signedCoord(v, pos, neg string) string {
+	if strings.HasPrefix(v, `-`) {
+		return neg + v[1:]
+	}
+	return pos + strings.TrimPrefix(v, `+`)
+}
+
+// jmaDepth は、"-60000" (メートル)を "60km" にします
+func jmaDepth(v string) string {
+	if v == `` {
+		return `不明`
+	}
+	m, err := strconv.Atoi(v)
+	if err != nil {
+		return `不明`
+	}
+	if m == 0 {
+		return `ごく浅い`
+	}
+	if m < 0 {
+		m = -m
+	}
+	return strconv.Itoa(m/1000) + `km`
+}
+
+// jmaTsunamiComment は、固定付加文のコードを、津波の有無(0:なし 1:あり(注意) 2:調査中 3:不明)にします
+func jmaTsunamiComment(code string) string {
+	for _, c := range strings.Fields(code) {
+		switch c {
+		case `0215`: // この地震による津波の心配はありません
+			return `0`
+		case `0211`, `0212`, `0213`, `0214`: // 津波警報等を発表中、若干の海面変動
+			return `1`
+		case `0217`: // 今後の情報に注意
+			return `2`
+		}
+	}
+	return `3`
+}
+
+// jmaTsunami は、津波警報・注意報・予報を変換します。津波予報(若干の海面変動)と解除は含めません。
+// 解除と明示された予報区があり、津波警報・注意報の予報区がなければ、解除(Cancelled)です。
+// 情報の取消は、津波警報が解除されたのではないので、エラーです。
+func jmaTsunami(doc *jmaReport) (*TsunamiInfo, error) {
+	if doc.Head.InfoType == `取消` {
+		return nil, errors.New(`津波情報の取消には対応していません`)
+	}
+	t := &TsunamiInfo{Areas: []TsunamiArea{}}
+	lifted := false
+	for _, item := range doc.Body.Tsunami.Forecast.Item {
+		kind := item.Category.Kind.Name
+		var grade string
+		switch {
+		case strings.Contains(kind, `解除`):
+			lifted = true
+			continue
+		case strings.Contains(kind, `大津波警報`):
+			grade = `大津波警報`
+		case strings.Contains(kind, `津波警報`):
+			grade = `津波警報`
+		case strings.Contains(kind, `津波注意報`):
+			grade = `津波注意報`
+		default:
+			continue
+		}
+		cond := item.FirstHeight.Condition
+		t.Areas = append(t.Areas, TsunamiArea{
+			Grade:     grade,
+			Name:      item.Area.Name,
+			Immediate: strings.Contains(cond, `ただちに`) || strings.Contains(cond, `到達`),
+		})
+	}
+	if len(t.Areas) == 0 {
+		if !lifted {
+			return nil, errors.New(`津波警報・注意報も、その解除も含みません`)
+		}
+		t.Cancelled = true
+	}
+	return t, nil
+}
+
+// scaleRanks は、震度の表記の順位です
+var scaleRanks = map[string]int{`1`: 1, `2`: 2, `3`: 3, `4`: 4, `5-`: 5, `5+`: 6, `6-`: 7, `6+`: 8, `7`: 9}
+
+// scaleCodes は、震度の表記と、地震情報(551)の最大震度のコードです
+var scaleCodes = map[string]string{`1`: `10`, `2`: `20`, `3`: `30`, `4`: `40`, `5-`: `45`, `5+`: `50`, `6-`: `55`, `6+`: `60`, `7`: `70`}
+
+// scaleNames は、震度の表記の表示名です
+var scaleNames = map[string]string{`1`: `1`, `2`: `2`, `3`: `3`, `4`: `4`, `5-`: `5弱`, `5+`: `5強`, `6-`: `6弱`, `6+`: `6強`, `7`: `7`}
+
+// ScaleCode は、気象庁の震度の表記("5-" など)を、地震情報(551)の最大震度のコード("45" など)にします。不明なら空文字列です。
+func ScaleCode(jmaInt string) string {
+	return scaleCodes[jmaInt]
+}
+
+// ScaleName は、最大震度のコード("45")か震度の表記("5-")を、表示名("5弱")にします。不明なら "不明" です。
+func ScaleName(scale string) string {
+	if name, ok := scaleNames[scale]; ok {
+		return name
+	}
+	for jmaInt, code := range scaleCodes {
+		if code == scale {
+			return scaleNames[jmaInt]
+		}
+	}
+	return `不明`
+}
+
+// RegionOfJMAArea は、気象庁の地震情報細分区域のコードを、EPSPの地域コードにします。対応がなければ空文字列です。
+func RegionOfJMAArea(code string) string {
+	return jmaAreaRegions[code]
+}
+
+// JMAAreasOfRegion は、EPSPの地域コードに含まれる、気象庁の地震情報細分区域のコードを返します
+func JMAAreasOfRegion(region string) (codes []string) {
+	for code, r := range jmaAreaRegions {
+		if r == region {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return
+}
+
+// jmaAreaRegions は、気象庁の地震情報細分区域のコードから、EPSPの地域コードへの対応です
+var jmaAreaRegions = map[string]string{
+	`100`: `010`, `101`: `010`, `102`: `010`, // 石狩
+	`105`: `015`, `106`: `015`, `107`: `015`, // 渡島
+	`110`: `020`, `119`: `020`, // 檜山、奥尻島
+	`115`: `025`, `116`: `025`, `117`: `025`, // 後志
+	`120`: `030`, `121`: `030`, `122`: `030`, // 空知
+	`125`: `035`, `126`: `035`, `127`: `035`, // 上川
+	`130`: `040`, `131`: `040`, // 留萌
+	`135`: `045`, `136`: `045`, `139`: `045`, // 宗谷、利尻礼文
+	`140`: `050`, `141`: `050`, `142`: `050`, // 網走、北見、紋別
+	`145`: `055`, `146`: `055`, // 胆振
+	`150`: `060`, `151`: `060`, `152`: `060`, // 日高
+	`155`: `065`, `156`: `065`, `157`: `065`, // 十勝
+	`160`: `070`, `161`: `070`, // 釧路
+	`165`: `075`, `166`: `075`, `167`: `075`, // 根室
+	`200`: `100`, `201`: `100`, `202`: `105`, `203`: `106`, // 青森
+	`210`: `110`, `211`: `111`, `212`: `115`, `213`: `115`, // 岩手
+	`220`: `120`, `221`: `125`, `222`: `125`, // 宮城
+	`230`: `130`, `231`: `130`, `232`: `135`, `233`: `135`, // 秋田
+	`240`: `140`, `241`: `141`, `242`: `142`, `243`: `143`, // 山形
+	`250`: `150`, `251`: `151`, `252`: `152`, // 福島
+	`300`: `200`, `301`: `205`, // 茨城
+	`310`: `210`, `311`: `215`, // 栃木
+	`320`: `220`, `321`: `225`, // 群馬
+	`330`: `230`, `331`: `231`, `332`: `232`, // 埼玉
+	`340`: `240`, `341`: `241`, `342`: `242`, // 千葉
+	`350`: `250`, `351`: `250`, `352`: `250`, // 東京
+	`354`: `255`, `355`: `255`, `356`: `255`, // 伊豆諸島北部
+	`357`: `260`, `358`: `260`, // 伊豆諸島南部
+	`359`: `265`,               // 小笠原
+	`360`: `270`, `361`: `275`, // 神奈川
+	`370`: `300`, `371`: `301`, `372`: `302`, `375`: `305`, // 新潟
+	`380`: `310`, `381`: `315`, // 富山
+	`390`: `320`, `391`: `325`, // 石川
+	`400`: `330`, `401`: `335`, // 福井
+	`411`: `345`, `412`: `340`, // 山梨
+	`420`: `350`, `421`: `351`, `422`: `355`, // 長野
+	`430`: `400`, `431`: `405`, `432`: `405`, // 岐阜
+	`440`: `410`, `441`: `411`, `442`: `415`, `443`: `416`, // 静岡
+	`450`: `420`, `451`: `425`, // 愛知
+	`460`: `430`, `461`: `430`, `462`: `435`, // 三重
+	`500`: `440`, `501`: `445`, // 滋賀
+	`510`: `450`, `511`: `455`, // 京都
+	`520`: `460`, `521`: `465`, // 大阪
+	`530`: `470`, `531`: `475`, `532`: `475`, `535`: `475`, // 兵庫
+	`540`: `480`,               // 奈良
+	`550`: `490`, `551`: `495`, // 和歌山
+	`560`: `500`, `562`: `505`, `563`: `505`, // 鳥取
+	`570`: `510`, `571`: `515`, `575`: `514`, // 島根
+	`580`: `520`, `581`: `525`, // 岡山
+	`590`: `530`, `591`: `535`, `592`: `535`, // 広島
+	`600`: `550`, `601`: `555`, // 徳島
+	`610`: `560`, `611`: `560`, // 香川
+	`620`: `570`, `621`: `575`, `622`: `576`, // 愛媛
+	`630`: `580`, `631`: `581`, `632`: `582`, // 高知
+	`700`: `540`, `702`: `541`, `703`: `545`, `704`: `545`, // 山口
+	`710`: `600`, `711`: `601`, `712`: `602`, `713`: `605`, // 福岡
+	`720`: `610`, `721`: `615`, // 佐賀
+	`730`: `620`, `731`: `625`, `732`: `625`, `735`: `630`, `736`: `630`, `737`: `635`, // 長崎
+	`740`: `640`, `741`: `641`, `742`: `645`, `743`: `646`, // 熊本
+	`750`: `650`, `751`: `651`, `752`: `656`, `753`: `655`, // 大分
+	`760`: `660`, `761`: `661`, `762`: `665`, `763`: `666`, // 宮崎
+	`770`: `670`, `775`: `670`, `771`: `675`, `774`: `680`, `776`: `680`, `777`: `680`, `778`: `685`, `779`: `685`, // 鹿児島
+	`800`: `700`, `801`: `701`, `802`: `702`, `803`: `710`, `804`: `706`, `805`: `705`, `806`: `705`, `807`: `705`, // 沖縄
+}
@@ -0,0 +1,129 @@
+package epsp
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func parseJMAFixture(t *testing.T, name string) (*JMAReport, error) {
+	t.Helper()
+	return ParseJMAXMLFile(filepath.Join(`testdata`, `jma`, name))
+}
+
+func TestParseJMAXMLScalePrompt(t *testing.T) {
+	r, err := parseJMAFixture(t, `VXSE51.xml`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Title != `震度速報` || r.InfoType != `発表` || r.Tsunami != nil {
+		t.Errorf(`report = %+v`, r)
+	}
+	want := &EarthquakeInfo{
+		Time:     `01日10時00分`, // 震源がなければ、対象日時です
+		MaxScale: `45`,
+		Tsunami:  `2`,
+		InfoType: `ScalePrompt`,
+		Issuer:   `気象庁`,
+		Points: []IntensityPoint{
+			{Prefecture: `茨城県`, Scale: `5-`, Name: `茨城県南部`},
+			{Prefecture: `茨城県`, Scale: `4`, Name: `茨城県北部`},
+			{Prefecture: `東京都`, Scale: `4`, Name: `東京都多摩東部`},
+			{Prefecture: `東京都`, Scale: `3`, Name: `東京都２３区`},
+		},
+	}
+	if !reflect.DeepEqual(r.Earthquake, want) {
+		t.Errorf("Earthquake = %+v\nwant %+v", r.Earthquake, want)
+	}
+	// 東京都２３区(3)と多摩東部(4)は、同じ地域(250)の大きいほうです。
+	if want := map[string]string{`200`: `4`, `205`: `5-`, `250`: `4`}; !reflect.DeepEqual(r.RegionScales, want) {
+		t.Errorf(`RegionScales = %v, want %v`, r.RegionScales, want)
+	}
+}
+
+func TestParseJMAXMLDetailScale(t *testing.T) {
+	r, err := parseJMAFixture(t, `VXSE53.xml`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.InfoType != `訂正` || r.Tsunami != nil {
+		t.Errorf(`report = %+v`, r)
+	}
+	want := &EarthquakeInfo{
+		Time:       `01日09時59分`,
+		MaxScale:   `45`,
+		Tsunami:    `0`,
+		InfoType:   `DetailScale`,
+		Hypocenter: `茨城県南部`,
+		Depth:      `50km`,
+		Magnitude:  `5.1`,
+		Corrected:  true,
+		Latitude:   `N36.1`,
+		Longitude:  `E140.1`,
+		Issuer:     `気象庁`,
+		Points: []IntensityPoint{
+			{Prefecture: `茨城県`, Scale: `5-`, Name: `つくば市小茎＊`},
+			{Prefecture: `茨城県`, Scale: `4`, Name: `つくば市天王台＊`},
+			{Prefecture: `東京都`, Scale: `3`, Name: `千代田区大手町`},
+		},
+	}
+	if !reflect.DeepEqual(r.Earthquake, want) {
+		t.Errorf("Earthquake = %+v\nwant %+v", r.Earthquake, want)
+	}
+	if want := map[string]string{`205`: `5-`, `250`: `3`}; !reflect.DeepEqual(r.RegionScales, want) {
+		t.Errorf(`RegionScales = %v, want %v`, r.RegionScales, want)
+	}
+}
+
+func TestParseJMAXMLTsunami(t *testing.T) {
+	tests := []struct {
+		file string
+		want *TsunamiInfo
+		err  bool
+	}{
+		{`VTSE41.xml`, &TsunamiInfo{Areas: []TsunamiArea{
+			{Grade: `大津波警報`, Name: `岩手県`, Immediate: true},
+			{Grade: `津波警報`, Name: `宮城県`},
+			{Grade: `津波注意報`, Name: `福島県`, Immediate: true},
+		}}, false},
+		{`VTSE41_lifted.xml`, &TsunamiInfo{Cancelled: true, Areas: []TsunamiArea{}}, false},
+		{`VTSE41_forecast.xml`, nil, true}, // 若干の海面変動だけなら、解除ではありません
+		{`VTSE41_cancel.xml`, nil, true},   // 情報の取消は、解除ではありません
+	}
+	for _, tt := range tests {
+		r, err := parseJMAFixture(t, tt.file)
+		if (err != nil) != tt.err {
+			t.Errorf(`%s: err = %v`, tt.file, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Earthquake != nil || !reflect.DeepEqual(r.Tsunami, tt.want) {
+			t.Errorf("%s: Tsunami = %+v\nwant %+v", tt.file, r.Tsunami, tt.want)
+		}
+	}
+}
+
+func TestParseJMAXMLCancelledEarthquake(t *testing.T) {
+	if r, err := parseJMAFixture(t, `VXSE53_cancel.xml`); err == nil {
+		t.Errorf(`report = %+v`, r)
+	}
+}
+
+func TestJMAAreaRegions(t *testing.T) {
+	if got := RegionOfJMAArea(`301`); got != `205` {
+		t.Errorf(`RegionOfJMAArea(301) = %s`, got)
+	}
+	if got := RegionOfJMAArea(`999`); got != `` {
+		t.Errorf(`RegionOfJMAArea(999) = %s`, got)
+	}
+	if got := JMAAreasOfRegion(`250`); !reflect.DeepEqual(got, []string{`350`, `351`, `352`}) {
+		t.Errorf(`JMAAreasOfRegion(250) = %v`, got)
+	}
+	for code, region := range jmaAreaRegions {
+		if Area(region) == `Undefined` {
+			t.Errorf(`JMA area %s: region %s is not in the area table`, code, region)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package epsp
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeyManager が EventStream に発行するイベントのコードです
+const (
+	KeyRenewedCode = `key_renewed` // 鍵を割り当てられた、または更新した
+	KeyExpiredCode = `key_expired` // 更新できないまま、鍵の有効期限が過ぎた
+)
+
+// KeyManager の既定値です
+const (
+	DefaultKeyRenewBefore   = 30 * time.Minute // 有効期限のこれだけ前から更新します
+	DefaultKeyRetryInterval = 1 * time.Minute  // 更新に失敗したら、この間隔から倍々に再試行します
+	keyMaxRetryInterval     = 10 * time.Minute
+)
+
+// ErrKeyExpired は、鍵がないか有効期限が過ぎているため、署名できないことを表します
+var ErrKeyExpired = errors.New(`鍵の有効期限切れ`)
+
+// KeyStatus は、鍵の状態です
+type KeyStatus struct {
+	Valid       bool      `json:"valid"`
+	Expire      time.Time `json:"expire"`
+	RenewAt     time.Time `json:"renew_at"`
+	LastRenewed time.Time `json:"last_renewed"`
+	Failures    int       `json:"failures"` // 連続して更新に失敗した回数
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// KeyManager は、サーバから割り当てられたピアの鍵を保持し、有効期限の前に更新します。
+// 有効期限はプロトコル時刻で判断し、期限切れの鍵では署名しません。
+type KeyManager struct {
+	RenewBefore   time.Duration
+	RetryInterval time.Duration
+
+	mu          sync.RWMutex
+	clock       Clock
+	protocol    *ProtocolClock
+	key         PeerKey
+	lastRenewed time.Time
+	failures    int
+	lastErr     error
+	expired     bool // 期限切れを通知済
+	changed     chan struct{}
+	handlers    []func(code string, st KeyStatus)
+}
+
+// NewKeyManager は、KeyManager のコンストラクタです。clockでタイマーを作り、protocolで有効期限を判断します。
+func NewKeyManager(clock Clock, protocol *ProtocolClock) *KeyManager {
+	return &KeyManager{
+		RenewBefore:   DefaultKeyRenewBefore,
+		RetryInterval: DefaultKeyRetryInterval,
+		clock:         clockOrSystem(clock),
+		protocol:      protocol,
+		changed:       make(chan struct{}, 1),
+	}
+}
+
+// setClock は、時計を差し替えます
+func (m *KeyManager) setClock(clock Clock, protocol *ProtocolClock) {
+	m.mu.Lock()
+	m.clock = clockOrSystem(clock)
+	m.protocol = protocol
+	m.mu.Unlock()
+}
+
+// OnEvent は、鍵の更新(KeyRenewedCode)と期限切れ(KeyExpiredCode)のときに呼ばれる関数を登録します
+func (m *KeyManager) OnEvent(f func(code string, st KeyStatus)) {
+	m.mu.Lock()
+	m.handlers = append(m.handlers, f)
+	m.mu.Unlock()
+}
+
+// Key は、鍵と、それが有効かを返します
+func (m *KeyManager) Key() (PeerKey, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.key, m.validLocked()
+}
+
+// Valid は、鍵があり、有効期限内かを返します
+func (m *KeyManager) Valid() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.validLocked()
+}
+
+func (m *KeyManager) validLocked() bool {
+	return m.key.SecKey != `` && m.protocol.Now().Before(m.key.Expire)
+}
+
+// NeedsRenewal は、鍵がないか、有効期限の RenewBefore 前を過ぎているかを返します
+func (m *KeyManager) NeedsRenewal() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.key.SecKey == `` || !m.protocol.Now().Before(m.key.Expire.Add(-m.RenewBefore))
+}
+
+// Status は、鍵の状態を返します
+func (m *KeyManager) Status() KeyStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.statusLocked()
+}
+
+func (m *KeyManager) statusLocked() KeyStatus {
+	st := KeyStatus{
+		Valid:       m.validLocked(),
+		Expire:      m.key.Expire,
+		LastRenewed: m.lastRenewed,
+		Failures:    m.failures,
+	}
+	if !m.key.Expire.IsZero() {
+		st.RenewAt = m.key.Expire.Add(-m.RenewBefore)
+	}
+	if m.lastErr != nil {
+		st.LastError = m.lastErr.Error()
+	}
+	return st
+}
+
+// Set は、サーバから割り当てられた鍵にして、KeyRenewedCode を通知します
+func (m *KeyManager) Set(k PeerKey) {
+	m.mu.Lock()
+	m.key = k
+	m.lastRenewed = m.clock.Now()
+	m.failures = 0
+	m.lastErr = nil
+	m.expired = false
+	st, handlers := m.statusLocked(), m.handlers
+	m.mu.Unlock()
+
+	m.wake()
+	logln(`[INFO] 鍵更新 有効期限 ` + FormatProtocolTime(k.Expire))
+	for _, f := range handlers {
+		f(KeyRenewedCode, st)
+	}
+}
+
+// restore は、鍵ファイルから読み込んだ鍵にします。通知はしません。
+func (m *KeyManager) restore(k PeerKey) {
+	m.mu.Lock()
+	m.key = k
+	m.mu.Unlock()
+	m.wake()
+}
+
+func (m *KeyManager) wake() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// SignData は、有効な鍵の秘密鍵で、データ署名を作ります。鍵が期限切れなら ErrKeyExpired です。
+// このパッケージは地震感知情報(555)を送出しないので、送出するアプリケーションのためのAPIです。
+func (m *KeyManager) SignData(expDate, dataBody string) (string, error) {
+	k, valid := m.Key()
+	if !valid {
+		return ``, ErrKeyExpired
+	}
+	key, err := parsePeerSecKey(k.SecKey)
+	if err != nil {
+		return ``, err
+	}
+	return SignData(key, expDate, dataBody)
+}
+
+// parsePeerSecKey は、サーバから割り当てられた秘密鍵(PKCS#8またはPKCS#1 DERのBASE64)を復号します
+func parsePeerSecKey(secKey string) (*rsa.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(secKey)
+	if err != nil {
+		return nil, errors.Wrap(err, `秘密鍵BASE64`)
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(b); err == nil {
+		if rsakey, ok := k.(*rsa.PrivateKey); ok {
+			return rsakey, nil
+		}
+		return nil, errors.New(`秘密鍵がRSAではない`)
+	}
+	k, err := x509.ParsePKCS1PrivateKey(b)
+	return k, errors.Wrap(err, `秘密鍵復号`)
+}
+
+// Run は、ctxが終わるまで、有効期限の RenewBefore 前にrenewで鍵を更新します。
+// 失敗したら RetryInterval から倍々に間隔をあけて再試行し、更新できないまま期限が過ぎたら KeyExpiredCode を通知します。
+// 鍵がまだなければ、Set されるまで待ちます。
+func (m *KeyManager) Run(ctx context.Context, renew func(ctx context.Context) error) {
+	var retry time.Duration
+	for {
+		m.mu.RLock()
+		clock := m.clock
+		m.mu.RUnlock()
+
+		var timer Timer
+		var timerC <-chan time.Time
+		if wait, ok := m.next(retry); ok {
+			timer = clock.NewTimer(wait)
+			timerC = timer.C()
+		}
+		fired := false
+		select {
+		case <-ctx.Done():
+		case <-m.changed: // 鍵が変わったので、待ち時間を決めなおします
+			retry = 0
+		case <-timerC:
+			fired = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !fired {
+			continue
+		}
+
+		m.notifyExpired()
+		if !m.NeedsRenewal() {
+			continue
+		}
+		if err := m.renewOnce(ctx, renew); err != nil {
+			if retry == 0 {
+				retry = m.RetryInterval
+			} else if retry *= 2; retry > keyMaxRetryInterval {
+				retry = keyMaxRetryInterval
+			}
+			logln(`[WARN] 鍵更新 ` + err.Error() + ` 再試行 ` + retry.String())
+		} else {
+			retry = 0
+		}
+	}
+}
+
+// next は、次に起きるまでの時間を返します。鍵がなければfalseです。
+// 再試行中でも、有効期限が来たら期限切れを通知するために起きます。
+func (m *KeyManager) next(retry time.Duration) (time.Duration, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.key.SecKey == `` {
+		return 0, false
+	}
+	untilExpire := m.protocol.Until(m.key.Expire)
+	wait := m.protocol.Until(m.key.Expire.Add(-m.RenewBefore))
+	if retry > 0 {
+		wait = retry
+		if !m.expired && untilExpire > 0 && untilExpire < wait {
+			wait = untilExpire
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// renewOnce は、renewを一回試します。鍵の有効期限が延びなければ失敗です。
+func (m *KeyManager) renewOnce(ctx context.Context, renew func(ctx context.Context) error) error {
+	m.mu.RLock()
+	before := m.key.Expire
+	m.mu.RUnlock()
+
+	err := renew(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil && !m.key.Expire.After(before) {
+		err = errors.New(`鍵が更新されませんでした`)
+	}
+	if err != nil {
+		m.failures++
+		m.lastErr = err
+	}
+	return err
+}
+
+// notifyExpired は、鍵が期限切れになっていれば、一度だけ KeyExpiredCode を通知します
+func (m *KeyManager) notifyExpired() {
+	m.mu.Lock()
+	if m.key.SecKey == `` || m.validLocked() || m.expired {
+		m.mu.Unlock()
+		return
+	}
+	m.expired = true
+	st, handlers := m.statusLocked(), m.handlers
+	m.mu.Unlock()
+
+	logln(`[WARN] 鍵の有効期限切れ ` + FormatProtocolTime(st.Expire))
+	for _, f := range handlers {
+		f(KeyExpiredCode, st)
+	}
+}
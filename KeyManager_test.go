@@ -0,0 +1,191 @@
+package epsp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func newTestKeyManager() (*KeyManager, *FakeClock) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	return NewKeyManager(clock, NewProtocolClock(clock)), clock
+}
+
+// runKeyManager は、renewで更新する Run を始めます。戻り値で止めます。
+func runKeyManager(m *KeyManager, renew func(ctx context.Context) error) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, renew)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestKeyManagerRenewal(t *testing.T) {
+	m, clock := newTestKeyManager()
+	renewed := make(chan time.Time, 10)
+	stop := runKeyManager(m, func(context.Context) error {
+		renewed <- clock.Now()
+		m.Set(PeerKey{SecKey: `c2Vj`, Expire: clock.Now().Add(time.Hour)})
+		return nil
+	})
+	defer stop()
+
+	// 鍵がなければ、Set されるまで待ちます。
+	time.Sleep(10 * time.Millisecond)
+	if clock.Waiters() != 0 {
+		t.Fatal(`timer without a key`)
+	}
+	start := clock.Now()
+	m.Set(PeerKey{SecKey: `c2Vj`, Expire: start.Add(time.Hour)})
+	waitUntil(t, func() bool { return clock.Waiters() == 1 })
+	if st := m.Status(); !st.Valid || !st.RenewAt.Equal(start.Add(30*time.Minute)) || !st.LastRenewed.Equal(start) {
+		t.Fatalf(`Status = %+v`, st)
+	}
+
+	// 有効期限の RenewBefore 前に更新します。
+	clock.Advance(30*time.Minute - time.Second)
+	select {
+	case at := <-renewed:
+		t.Fatalf(`renewed early at %v`, at)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if at := <-renewed; !at.Equal(start.Add(30 * time.Minute)) {
+		t.Errorf(`renewed at %v`, at)
+	}
+
+	// 更新した鍵も、有効期限の RenewBefore 前に更新します。
+	waitUntil(t, func() bool { return clock.Waiters() == 1 })
+	clock.Advance(30 * time.Minute)
+	if at := <-renewed; !at.Equal(start.Add(time.Hour)) {
+		t.Errorf(`renewed at %v`, at)
+	}
+	if st := m.Status(); !st.Valid || st.Failures != 0 || !st.Expire.Equal(start.Add(2*time.Hour)) {
+		t.Errorf(`Status = %+v`, st)
+	}
+}
+
+func TestKeyManagerRenewNearExpiry(t *testing.T) {
+	m, clock := newTestKeyManager()
+	renewed := make(chan time.Time, 10)
+	stop := runKeyManager(m, func(context.Context) error {
+		renewed <- clock.Now()
+		m.Set(PeerKey{SecKey: `c2Vj`, Expire: clock.Now().Add(time.Hour)})
+		return nil
+	})
+	defer stop()
+
+	// 有効期限まで RenewBefore より短い鍵は、すぐに更新します。
+	m.restore(PeerKey{SecKey: `c2Vj`, Expire: clock.Now().Add(10 * time.Minute)})
+	if !m.NeedsRenewal() || !m.Valid() {
+		t.Fatalf(`NeedsRenewal = %v, Valid = %v`, m.NeedsRenewal(), m.Valid())
+	}
+	if at := <-renewed; !at.Equal(clock.Now()) {
+		t.Errorf(`renewed at %v`, at)
+	}
+	waitUntil(t, func() bool { return !m.NeedsRenewal() })
+}
+
+func TestKeyManagerBackoffAndExpiry(t *testing.T) {
+	m, clock := newTestKeyManager()
+	start := clock.Now()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secKey := base64.StdEncoding.EncodeToString(der)
+
+	var mu sync.Mutex
+	var attempts []time.Duration
+	var events []string
+	fail := true
+	m.OnEvent(func(code string, st KeyStatus) {
+		mu.Lock()
+		events = append(events, code+` `+clock.Now().Sub(start).String())
+		mu.Unlock()
+	})
+	stop := runKeyManager(m, func(context.Context) error {
+		mu.Lock()
+		attempts = append(attempts, clock.Now().Sub(start))
+		f := fail
+		mu.Unlock()
+		if f {
+			return errors.New(`サーバに接続できません`)
+		}
+		m.Set(PeerKey{SecKey: secKey, Expire: clock.Now().Add(time.Hour)})
+		return nil
+	})
+	defer stop()
+
+	m.restore(PeerKey{SecKey: secKey, Expire: start.Add(time.Hour)})
+	waitUntil(t, func() bool { return clock.Waiters() == 1 })
+	if _, err := m.SignData(`2026/01/01 10-00-00`, `body`); err != nil {
+		t.Fatal(err)
+	}
+
+	// 失敗したら、1分から倍々に、10分まで間隔をあけます。有効期限には、期限切れを通知するために起きます。
+	for i := 0; i < 75; i++ {
+		clock.Advance(time.Minute)
+		waitUntil(t, func() bool { return clock.Waiters() == 1 })
+	}
+	mu.Lock()
+	want := []time.Duration{30, 31, 33, 37, 45, 55, 60, 70}
+	if len(attempts) != len(want) {
+		t.Fatalf(`attempts = %v`, attempts)
+	}
+	for i := range want {
+		if attempts[i] != want[i]*time.Minute {
+			t.Errorf(`attempt %d at %v, want %v`, i, attempts[i], want[i]*time.Minute)
+		}
+	}
+	if len(events) != 1 || events[0] != KeyExpiredCode+` 1h0m0s` {
+		t.Errorf(`events = %v`, events)
+	}
+	mu.Unlock()
+
+	st := m.Status()
+	if st.Valid || st.Failures != len(want) || st.LastError == `` {
+		t.Errorf(`Status = %+v`, st)
+	}
+	if _, err := m.SignData(`2026/01/01 10-00-00`, `body`); err != ErrKeyExpired {
+		t.Errorf(`SignData with expired key: %v`, err)
+	}
+
+	// 更新できたら、署名でき、失敗回数を戻します。
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	clock.Advance(5 * time.Minute) // 70分の次は80分です
+	waitUntil(t, func() bool { return m.Valid() })
+	sig, err := m.SignData(`2026/01/01 10-00-00`, `body`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DataSignatureCheck(&key.PublicKey, sig, `2026/01/01 10-00-00`, `body`); err != nil {
+		t.Error(err)
+	}
+	mu.Lock()
+	if len(events) != 2 || events[1] != KeyRenewedCode+` 1h20m0s` {
+		t.Errorf(`events = %v`, events)
+	}
+	mu.Unlock()
+	if st := m.Status(); st.Failures != 0 || st.LastError != `` {
+		t.Errorf(`Status = %+v`, st)
+	}
+}
@@ -0,0 +1,126 @@
+package epsp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// クライアント(ピア)からサーバへのコードです
+const (
+	CodeClientVersion         = `131` // プロトコルバージョン返信
+	CodeTemporaryIDRequest    = `113` // ピアID暫定割当要求
+	CodePortCheckRequest      = `114` // ポート開放確認要求
+	CodePeerListRequest       = `115` // 接続先ピア情報要求(ピア間でも使います)
+	CodeRegistrationRequest   = `116` // ピアID本割当要求
+	CodeKeyRequest            = `117` // 鍵割当要求
+	CodeTimeRequest           = `118` // プロトコル時刻要求
+	CodeEndRequest            = `119` // 通信の終了要求
+	CodeEchoRequest           = `123` // エコー要求
+	CodeKeyReassignRequest    = `124` // 鍵再割当要求
+	CodeRegionCountRequest    = `127` // 各地域ピア数要求
+	CodeConnectedPeersRequest = `155` // 接続できたピアの通知(返信なし)
+)
+
+// サーバからクライアント(ピア)へのコードです
+const (
+	CodeServerVersionRequest = `211` // プロトコルバージョン要求
+	CodeServerVersion        = `212` // プロトコルバージョン受領
+	CodeTemporaryID          = `233` // ピアID暫定割当
+	CodePortCheck            = `234` // ポート開放確認結果
+	CodePeerList             = `235` // 接続先ピア情報(ピア間でも使います)
+	CodeRegistered           = `236` // ピアID本割当完了
+	CodeKey                  = `237` // 鍵割当
+	CodeTime                 = `238` // プロトコル時刻
+	CodeEnd                  = `239` // 通信の終了
+	CodeEcho                 = `243` // エコー返信
+	CodeKeyReassigned        = `244` // 鍵再割当
+	CodeRegionCount          = `247` // 各地域ピア数
+	CodeKeyAssigned          = `295` // 鍵割当済
+	CodeBadRequest           = `298` // 要求異常
+	CodeRejoin               = `299` // 参加しなおし
+)
+
+// ピア間でリレーするコードです
+const (
+	CodeEarthquake  = `551` // 地震情報
+	CodeTsunami     = `552` // 津波予報
+	CodeSensing     = `555` // 地震感知情報
+	CodeRegionPeers = `561` // 地域ピア数
+	CodeTrace       = `615` // 調査エコー
+	CodeTraceReply  = `635` // 調査エコーリプライ
+)
+
+// ピア間でリレーしないコードです
+const (
+	CodePeerEchoRequest     = `611` // ピアエコー要求
+	CodePeerIDRequest       = `612` // ピアID要求
+	CodePeerVersionRequest  = `614` // ピアプロトコルバージョン要求
+	CodePeerEcho            = `631` // ピアエコー返答
+	CodePeerID              = `632` // ピアID返答
+	CodePeerVersion         = `634` // ピアプロトコルバージョン返答
+	CodeVersionIncompatible = `694` // プロトコルバージョン非互換
+)
+
+// Message は、EPSPの一行「コード 経由数 データ」です。データは「:」区切りで Fields に入ります。
+type Message struct {
+	Code   string
+	Hops   uint64
+	Fields []string
+}
+
+// NewMessage は、経由数1のMessageを作ります
+func NewMessage(code string, fields ...string) Message {
+	return Message{Code: code, Hops: 1, Fields: fields}
+}
+
+// Data は、データ部(「:」区切り)を返します
+func (m Message) Data() string {
+	return strings.Join(m.Fields, `:`)
+}
+
+// Marshal は、送信する一行にします。データがなければ「コード 経由数」だけにします。
+func (m Message) Marshal() string {
+	s := m.Code + ` ` + strconv.FormatUint(m.Hops, 10)
+	if len(m.Fields) != 0 {
+		s += ` ` + m.Data()
+	}
+	return s
+}
+
+func (m Message) String() string {
+	return m.Marshal()
+}
+
+// Unmarshal は、受信した一行を分解します
+func (m *Message) Unmarshal(line string) error {
+	retval := strings.SplitN(strings.TrimRight(line, "\r\n"), ` `, 3)
+	switch {
+	case retval[0] == ``:
+		return errors.New(`空行`)
+	case len(retval[0]) != 3:
+		return errors.New(`Unknown command: ` + line)
+	case len(retval) == 1:
+		return errors.New(`経由数なし: ` + line)
+	}
+	hops, err := strconv.ParseUint(retval[1], 10, 64)
+	if err != nil {
+		return errors.New(`経由数書式異常 ` + line)
+	}
+	m.Code, m.Hops, m.Fields = retval[0], hops, nil
+	if len(retval) == 3 {
+		m.Fields = strings.Split(retval[2], `:`)
+	}
+	return nil
+}
+
+// IsRelayed は、ピア間でリレーするメッセージかを返します
+func (m Message) IsRelayed() bool {
+	return m.Code[0] == '5' || m.Code == CodeTrace || m.Code == CodeTraceReply
+}
+
+// IsSigned は、データ署名と有効期限がついたメッセージ(5xx)かを返します
+func (m Message) IsSigned() bool {
+	return m.Code[0] == '5'
+}
@@ -0,0 +1,314 @@
+package epsp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 要求と応答のデータ部です。それぞれ Fields で Message のデータ項目にし、Parse〜 で Message.Fields から戻します。
+// エージェント(131, 212, 614, 634)は、Message.Fields がそのままエージェント名です。
+
+// fieldsN は、データ項目がn個あるか確かめます
+func fieldsN(name string, fields []string, n int) error {
+	if len(fields) != n {
+		return errors.Errorf(`%s 項目数異常(%d): %s`, name, len(fields), strings.Join(fields, `:`))
+	}
+	return nil
+}
+
+// PeerIDPayload は、ピアIDだけのデータ(115, 117, 233, 632)です
+type PeerIDPayload struct {
+	PeerID string
+}
+
+// Fields は、データ項目にします
+func (p PeerIDPayload) Fields() []string {
+	return []string{p.PeerID}
+}
+
+// ParsePeerIDPayload は、データ項目を PeerIDPayload にします
+func ParsePeerIDPayload(fields []string) (p PeerIDPayload, err error) {
+	if err = fieldsN(`ピアID`, fields, 1); err != nil {
+		return
+	}
+	if fields[0] == `` {
+		err = errors.New(`ピアIDが空です`)
+		return
+	}
+	p.PeerID = fields[0]
+	return
+}
+
+// PortCheckRequest は、ポート開放確認要求(114)のデータです
+type PortCheckRequest struct {
+	PeerID string
+	Port   int
+}
+
+// Fields は、データ項目にします
+func (p PortCheckRequest) Fields() []string {
+	return []string{p.PeerID, strconv.Itoa(p.Port)}
+}
+
+// ParsePortCheckRequest は、データ項目を PortCheckRequest にします
+func ParsePortCheckRequest(fields []string) (p PortCheckRequest, err error) {
+	if err = fieldsN(`ポート開放確認要求`, fields, 2); err != nil {
+		return
+	}
+	p.PeerID = fields[0]
+	if p.Port, err = parsePort(fields[1]); err != nil {
+		err = errors.Wrap(err, `ポート開放確認要求`)
+	}
+	return
+}
+
+// PortCheckResult は、ポート開放確認結果(234)のデータです
+type PortCheckResult struct {
+	Open bool
+}
+
+// Fields は、データ項目にします
+func (p PortCheckResult) Fields() []string {
+	if p.Open {
+		return []string{`1`}
+	}
+	return []string{`0`}
+}
+
+// ParsePortCheckResult は、データ項目を PortCheckResult にします
+func ParsePortCheckResult(fields []string) (p PortCheckResult, err error) {
+	if err = fieldsN(`ポート開放確認結果`, fields, 1); err != nil {
+		return
+	}
+	switch fields[0] {
+	case `1`:
+		p.Open = true
+	case `0`:
+	default:
+		err = errors.New(`ポート開放確認結果異常: ` + fields[0])
+	}
+	return
+}
+
+// PeerListPayload は、接続先ピア情報(235)のデータです。Peers は「IP,ポート,ピアID」です。
+type PeerListPayload struct {
+	Peers []string
+}
+
+// Fields は、データ項目にします
+func (p PeerListPayload) Fields() []string {
+	return p.Peers
+}
+
+// ParsePeerListPayload は、データ項目を PeerListPayload にします。[]で囲まれたIPv6アドレス中の「:」では分割しません。
+func ParsePeerListPayload(fields []string) (p PeerListPayload, err error) {
+	p.Peers = SplitPeerList(strings.Join(fields, `:`))
+	return
+}
+
+// RegistrationRequest は、ピアID本割当要求(116)のデータです
+type RegistrationRequest struct {
+	PeerID      string
+	Port        int
+	Region      string
+	Connections uint64
+	Incoming    uint64
+}
+
+// Fields は、データ項目にします
+func (r RegistrationRequest) Fields() []string {
+	return []string{r.PeerID, strconv.Itoa(r.Port), r.Region, strconv.FormatUint(r.Connections, 10), strconv.FormatUint(r.Incoming, 10)}
+}
+
+// ParseRegistrationRequest は、データ項目を RegistrationRequest にします
+func ParseRegistrationRequest(fields []string) (r RegistrationRequest, err error) {
+	if err = fieldsN(`ピアID本割当要求`, fields, 5); err != nil {
+		return
+	}
+	r.PeerID, r.Region = fields[0], fields[2]
+	if r.Port, err = strconv.Atoi(fields[1]); err != nil { // 待ち受けないピアは0です
+		err = errors.Wrap(err, `ピアID本割当要求 ポート`)
+		return
+	}
+	if r.Connections, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+		err = errors.Wrap(err, `ピアID本割当要求 接続数`)
+		return
+	}
+	if r.Incoming, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+		err = errors.Wrap(err, `ピアID本割当要求 受入数`)
+	}
+	return
+}
+
+// RegistrationResult は、ピアID本割当完了(236)のデータです
+type RegistrationResult struct {
+	NumOfPeers uint64 // 参加ピア数
+}
+
+// Fields は、データ項目にします
+func (r RegistrationResult) Fields() []string {
+	return []string{strconv.FormatUint(r.NumOfPeers, 10)}
+}
+
+// ParseRegistrationResult は、データ項目を RegistrationResult にします
+func ParseRegistrationResult(fields []string) (r RegistrationResult, err error) {
+	if err = fieldsN(`ピアID本割当完了`, fields, 1); err != nil {
+		return
+	}
+	r.NumOfPeers, err = strconv.ParseUint(fields[0], 10, 64)
+	err = errors.Wrap(err, `ピアID本割当完了 参加ピア数`)
+	return
+}
+
+// KeyReassignRequest は、鍵再割当要求(124)のデータ「ピアID+秘密鍵」です
+type KeyReassignRequest struct {
+	PeerID string
+	SecKey string
+}
+
+// Fields は、データ項目にします
+func (k KeyReassignRequest) Fields() []string {
+	return []string{k.PeerID + `+` + k.SecKey}
+}
+
+// ParseKeyReassignRequest は、データ項目を KeyReassignRequest にします。「ピアID:秘密鍵」も受け付けます。
+func ParseKeyReassignRequest(fields []string) (k KeyReassignRequest, err error) {
+	data := strings.Join(fields, `:`)
+	i := strings.IndexAny(data, `:+`)
+	if i <= 0 {
+		err = errors.New(`鍵再割当要求書式異常: ` + data)
+		return
+	}
+	k.PeerID, k.SecKey = data[:i], data[i+1:]
+	return
+}
+
+// Fields は、鍵割当(237)、鍵再割当(244)のデータ項目(秘密鍵:公開鍵:有効期限:鍵署名)にします
+func (k PeerKey) Fields() []string {
+	return []string{k.SecKey, k.PubKey, FormatProtocolTime(k.Expire), k.KeySig}
+}
+
+// ParsePeerKey は、鍵割当(237)、鍵再割当(244)のデータ項目を PeerKey にします
+func ParsePeerKey(fields []string) (k PeerKey, err error) {
+	if err = fieldsN(`鍵`, fields, 4); err != nil {
+		return
+	}
+	k.SecKey, k.PubKey, k.KeySig = fields[0], fields[1], fields[3]
+	if k.Expire, err = ParseProtocolTimeString(fields[2]); err != nil {
+		err = errors.Wrap(err, `鍵 有効期限`)
+	}
+	return
+}
+
+// ProtocolTime は、プロトコル時刻(238)のデータです
+type ProtocolTime struct {
+	Time time.Time
+}
+
+// Fields は、データ項目にします
+func (t ProtocolTime) Fields() []string {
+	return []string{FormatProtocolTime(t.Time)}
+}
+
+// ParseProtocolTime は、データ項目を ProtocolTime にします
+func ParseProtocolTime(fields []string) (t ProtocolTime, err error) {
+	if err = fieldsN(`プロトコル時刻`, fields, 1); err != nil {
+		return
+	}
+	t.Time, err = ParseProtocolTimeString(fields[0])
+	err = errors.Wrap(err, `プロトコル時刻`)
+	return
+}
+
+// EchoRequest は、エコー要求(123)のデータです
+type EchoRequest struct {
+	PeerID      string
+	Connections uint64
+}
+
+// Fields は、データ項目にします
+func (e EchoRequest) Fields() []string {
+	return []string{e.PeerID, strconv.FormatUint(e.Connections, 10)}
+}
+
+// ParseEchoRequest は、データ項目を EchoRequest にします
+func ParseEchoRequest(fields []string) (e EchoRequest, err error) {
+	if err = fieldsN(`エコー要求`, fields, 2); err != nil {
+		return
+	}
+	e.PeerID = fields[0]
+	e.Connections, err = strconv.ParseUint(fields[1], 10, 64)
+	err = errors.Wrap(err, `エコー要求 接続数`)
+	return
+}
+
+// Fields は、各地域ピア数(247)のデータ項目にします
+func (p PeerCounts) Fields() []string {
+	return []string{p.Encode()}
+}
+
+// ParsePeerCounts は、各地域ピア数(247)のデータ項目を PeerCounts にします
+func ParsePeerCounts(fields []string) (PeerCounts, error) {
+	if len(fields) > 1 {
+		return nil, errors.Errorf(`各地域ピア数 項目数異常(%d): %s`, len(fields), strings.Join(fields, `:`))
+	}
+	return parsePeerCount(strings.Join(fields, `:`))
+}
+
+// ConnectedPeers は、接続できたピアの通知(155)のデータです
+type ConnectedPeers struct {
+	PeerIDs []string
+}
+
+// Fields は、データ項目にします
+func (c ConnectedPeers) Fields() []string {
+	return c.PeerIDs
+}
+
+// ParseConnectedPeers は、データ項目を ConnectedPeers にします
+func ParseConnectedPeers(fields []string) (c ConnectedPeers, err error) {
+	c.PeerIDs = fields
+	return
+}
+
+// TraceRequest は、調査エコー(615)のデータです
+type TraceRequest struct {
+	Origin  string   // 送信元のピアID
+	TraceID string   // 一意な数
+	Extra   []string // 知らない項目。リレーで落とさないよう、そのまま持ちます
+}
+
+// Fields は、データ項目にします
+func (t TraceRequest) Fields() []string {
+	return append([]string{t.Origin, t.TraceID}, t.Extra...)
+}
+
+// ParseTraceRequest は、データ項目を TraceRequest にします
+func ParseTraceRequest(fields []string) (t TraceRequest, err error) {
+	if len(fields) < 2 {
+		err = errors.New(`調査エコー 項目不足: ` + strings.Join(fields, `:`))
+		return
+	}
+	t.Origin, t.TraceID = fields[0], fields[1]
+	if len(fields) > 2 {
+		t.Extra = append([]string(nil), fields[2:]...)
+	}
+	return
+}
+
+// Fields は、調査エコーリプライ(635)のデータ項目にします
+func (r TraceReply) Fields() []string {
+	return []string{r.Origin, r.TraceID, r.Reporter, strings.Join(r.Connected, `,`), strconv.FormatUint(r.Hops, 10)}
+}
+
+// parsePort は、ポート番号を確かめます
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.New(`ポート番号異常: ` + s)
+	}
+	return port, nil
+}
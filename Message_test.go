@@ -0,0 +1,172 @@
+package epsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageUnmarshal(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+		err  bool
+	}{
+		{"611 1\r\n", Message{Code: `611`, Hops: 1}, false},
+		{`615 3 100:12345`, Message{Code: `615`, Hops: 3, Fields: []string{`100`, `12345`}}, false},
+		{`247 1 `, Message{Code: `247`, Hops: 1, Fields: []string{``}}, false},
+		{`551 2 a b:c`, Message{Code: `551`, Hops: 2, Fields: []string{`a b`, `c`}}, false}, // データ中の空白は分割しません
+		{``, Message{}, true},
+		{"\r\n", Message{}, true},
+		{`61`, Message{}, true},
+		{`6111 1`, Message{}, true},
+		{`611`, Message{}, true},      // 経由数なし
+		{`611 x`, Message{}, true},    // 経由数書式異常
+		{`611 -1`, Message{}, true},   // 経由数書式異常
+		{`611  1:2`, Message{}, true}, // 経由数が空
+	}
+	for _, tt := range tests {
+		var m Message
+		err := m.Unmarshal(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf(`Unmarshal(%q) err = %v, want err %v`, tt.line, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(m, tt.want) {
+			t.Errorf(`Unmarshal(%q) = %+v, want %+v`, tt.line, m, tt.want)
+		}
+	}
+}
+
+func TestMessageMarshal(t *testing.T) {
+	tests := []struct {
+		m    Message
+		want string
+	}{
+		{NewMessage(CodePeerEchoRequest), `611 1`},
+		{NewMessage(CodeTrace, `100`, `12345`), `615 1 100:12345`},
+		{Message{Code: CodeEarthquake, Hops: 7, Fields: []string{`a`, ``, `b`}}, `551 7 a::b`},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Marshal(); got != tt.want {
+			t.Errorf(`Marshal(%+v) = %q, want %q`, tt.m, got, tt.want)
+		}
+		var m Message
+		if err := m.Unmarshal(tt.m.Marshal()); err != nil || !reflect.DeepEqual(m, tt.m) {
+			t.Errorf(`round trip of %q = %+v, %v`, tt.want, m, err)
+		}
+	}
+}
+
+// payloadFields は、Fieldsのある要求と応答のデータです
+type payloadFields interface {
+	Fields() []string
+}
+
+func mustProtocolTime(t *testing.T, s string) ProtocolTime {
+	t.Helper()
+	tm, err := ParseProtocolTimeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ProtocolTime{Time: tm}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	expire := mustProtocolTime(t, `2026/01/02 03-04-05`).Time
+	tests := []struct {
+		name  string
+		code  string
+		p     payloadFields
+		parse func([]string) (payloadFields, error)
+	}{
+		{`peer id`, CodeTemporaryID, PeerIDPayload{PeerID: `123`}, func(f []string) (payloadFields, error) { return ParsePeerIDPayload(f) }},
+		{`port check request`, CodePortCheckRequest, PortCheckRequest{PeerID: `123`, Port: 6911}, func(f []string) (payloadFields, error) { return ParsePortCheckRequest(f) }},
+		{`port open`, CodePortCheck, PortCheckResult{Open: true}, func(f []string) (payloadFields, error) { return ParsePortCheckResult(f) }},
+		{`port closed`, CodePortCheck, PortCheckResult{}, func(f []string) (payloadFields, error) { return ParsePortCheckResult(f) }},
+		{`peer list`, CodePeerList, PeerListPayload{Peers: []string{`192.0.2.1,6911,1`, `[2001:db8::1],6911,2`}}, func(f []string) (payloadFields, error) { return ParsePeerListPayload(f) }},
+		{`registration`, CodeRegistrationRequest, RegistrationRequest{PeerID: `123`, Port: 6911, Region: `250`, Connections: 4, Incoming: 8}, func(f []string) (payloadFields, error) { return ParseRegistrationRequest(f) }},
+		{`registration without port`, CodeRegistrationRequest, RegistrationRequest{PeerID: `123`, Region: `901`}, func(f []string) (payloadFields, error) { return ParseRegistrationRequest(f) }},
+		{`registered`, CodeRegistered, RegistrationResult{NumOfPeers: 1234}, func(f []string) (payloadFields, error) { return ParseRegistrationResult(f) }},
+		{`key reassign`, CodeKeyReassignRequest, KeyReassignRequest{PeerID: `123`, SecKey: `c2Vj/a+b=`}, func(f []string) (payloadFields, error) { return ParseKeyReassignRequest(f) }},
+		{`key`, CodeKey, PeerKey{SecKey: `c2Vj`, PubKey: `cHVi`, Expire: expire, KeySig: `c2ln`}, func(f []string) (payloadFields, error) { return ParsePeerKey(f) }},
+		{`protocol time`, CodeTime, ProtocolTime{Time: expire}, func(f []string) (payloadFields, error) { return ParseProtocolTime(f) }},
+		{`echo`, CodeEchoRequest, EchoRequest{PeerID: `123`, Connections: 3}, func(f []string) (payloadFields, error) { return ParseEchoRequest(f) }},
+		{`peer counts`, CodeRegionCount, NewPeerCountsFromMap(map[string]uint64{`250`: 10, `901`: 2}), func(f []string) (payloadFields, error) { return ParsePeerCounts(f) }},
+		{`no peer counts`, CodeRegionCount, PeerCounts(nil), func(f []string) (payloadFields, error) { return ParsePeerCounts(f) }},
+		{`connected peers`, CodeConnectedPeersRequest, ConnectedPeers{PeerIDs: []string{`1`, `2`, `3`}}, func(f []string) (payloadFields, error) { return ParseConnectedPeers(f) }},
+		{`trace`, CodeTrace, TraceRequest{Origin: `100`, TraceID: `12345`}, func(f []string) (payloadFields, error) { return ParseTraceRequest(f) }},
+		{`trace keeps extra fields`, CodeTrace, TraceRequest{Origin: `100`, TraceID: `12345`, Extra: []string{`x`, ``, `y`}}, func(f []string) (payloadFields, error) { return ParseTraceRequest(f) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := NewMessage(tt.code, tt.p.Fields()...).Marshal()
+			var m Message
+			if err := m.Unmarshal(line); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.parse(m.Fields)
+			if err != nil {
+				t.Fatalf(`%q: %v`, line, err)
+			}
+			if !reflect.DeepEqual(got, tt.p) {
+				t.Errorf(`%q = %+v, want %+v`, line, got, tt.p)
+			}
+			if again := NewMessage(tt.code, got.Fields()...).Marshal(); again != line {
+				t.Errorf(`remarshal = %q, want %q`, again, line)
+			}
+		})
+	}
+}
+
+func TestParsePeerCounts(t *testing.T) {
+	tests := []struct {
+		data string
+		want PeerCounts
+	}{
+		{``, nil},
+		{`250,10`, PeerCounts{{Region: `250`, Count: 10}}},
+		{`250,10;275,1`, PeerCounts{{Region: `250`, Count: 10}, {Region: `275`, Count: 1}}},
+		{`250,10;`, PeerCounts{{Region: `250`, Count: 10}}},                                  // 末尾の区切り
+		{`250,10;;275,1`, PeerCounts{{Region: `250`, Count: 10}, {Region: `275`, Count: 1}}}, // 空の地域
+		{`;`, nil},
+	}
+	for _, tt := range tests {
+		got, err := ParsePeerCounts([]string{tt.data})
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf(`ParsePeerCounts(%q) = %v, %v, want %v`, tt.data, got, err, tt.want)
+		}
+	}
+}
+
+func TestPayloadMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []string
+		parse func([]string) error
+	}{
+		{`empty peer id`, []string{``}, func(f []string) error { _, err := ParsePeerIDPayload(f); return err }},
+		{`extra peer id`, []string{`1`, `2`}, func(f []string) error { _, err := ParsePeerIDPayload(f); return err }},
+		{`short port check`, []string{`123`}, func(f []string) error { _, err := ParsePortCheckRequest(f); return err }},
+		{`port out of range`, []string{`123`, `65536`}, func(f []string) error { _, err := ParsePortCheckRequest(f); return err }},
+		{`port check result`, []string{`2`}, func(f []string) error { _, err := ParsePortCheckResult(f); return err }},
+		{`short registration`, []string{`123`, `6911`, `250`, `4`}, func(f []string) error { _, err := ParseRegistrationRequest(f); return err }},
+		{`registration connections`, []string{`123`, `6911`, `250`, `x`, `8`}, func(f []string) error { _, err := ParseRegistrationRequest(f); return err }},
+		{`registered`, []string{`many`}, func(f []string) error { _, err := ParseRegistrationResult(f); return err }},
+		{`key reassign`, []string{`+sec`}, func(f []string) error { _, err := ParseKeyReassignRequest(f); return err }},
+		{`short key`, []string{`sec`, `pub`, `2026/01/02 03-04-05`}, func(f []string) error { _, err := ParsePeerKey(f); return err }},
+		{`key expire`, []string{`sec`, `pub`, `tomorrow`, `sig`}, func(f []string) error { _, err := ParsePeerKey(f); return err }},
+		{`protocol time`, []string{`2026/01/02 03:04:05`}, func(f []string) error { _, err := ParseProtocolTime(f); return err }},
+		{`short echo`, []string{`123`}, func(f []string) error { _, err := ParseEchoRequest(f); return err }},
+		{`echo connections`, []string{`123`, `-1`}, func(f []string) error { _, err := ParseEchoRequest(f); return err }},
+		{`peer counts without count`, []string{`250,10;275`}, func(f []string) error { _, err := ParsePeerCounts(f); return err }},
+		{`peer counts count`, []string{`250,ten`}, func(f []string) error { _, err := ParsePeerCounts(f); return err }},
+		{`peer counts region`, []string{`,10`}, func(f []string) error { _, err := ParsePeerCounts(f); return err }},
+		{`peer counts fields`, []string{`250,10`, `275,1`}, func(f []string) error { _, err := ParsePeerCounts(f); return err }},
+		{`short trace`, []string{`100`}, func(f []string) error { _, err := ParseTraceRequest(f); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.parse(tt.data); err == nil {
+			t.Errorf(`%s: %q parsed without error`, tt.name, tt.data)
+		}
+	}
+}
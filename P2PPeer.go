@@ -1,6 +1,7 @@
 package epsp
 
 import (
+	"net"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -48,19 +49,22 @@ func (p *P2PPeer) WriteTo(ss ...string) (err error) {
 	return
 }
 
-// GetIPPortPeerID は、IP,Port,PeerID 形式の文字列を返します
+// GetIPPortPeerID は、IP,Port,PeerID 形式の文字列を返します。IPv6アドレスは[]で囲みます。
 func (p *P2PPeer) GetIPPortPeerID() string {
-	boundipport := strings.LastIndex(p.IPPort, `:`) // need to consider ipv6
-	return p.IPPort[:boundipport] + `,` + p.IPPort[boundipport+1:] + `,` + p.GetPeerID()
+	host, port, err := net.SplitHostPort(p.IPPort)
+	if err != nil {
+		return FormatIPPortPeerID(p.IPPort, ``, p.GetPeerID())
+	}
+	return FormatIPPortPeerID(host, port, p.GetPeerID())
 }
 
 // StringAgent は、エージェント名の文字列を返します
-func (p P2PPeer) StringAgent() string {
+func (p *P2PPeer) StringAgent() string {
 	return strings.Join(p.Agent, `:`)
 }
 
 func (p *P2PPeer) sendPing() error {
-	if err := p.Write(`611`, `1`); err != nil { // ピアエコー要求
+	if err := p.WriteMessage(NewMessage(CodePeerEchoRequest)); err != nil { // ピアエコー要求
 		return errors.Wrap(err, `ピアエコー要求送信不能`)
 	}
 	logln("[ECHO] ピア" + p.GetPeerIDorIPPort() + `: ピアエコー要求`)
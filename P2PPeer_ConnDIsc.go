@@ -10,9 +10,10 @@ import (
 	net "github.com/toyo/go-net"
 )
 
-// NewP2PServer は、ピアからの接続を待ちます
-func NewP2PServer(ctx context.Context, l *traditionalnet.TCPListener, myagent []string) (ps *P2PPeer, err error) {
+// NewP2PServer は、ピアからの接続を待ちます。clockがnilなら SystemClock を使います。
+func NewP2PServer(ctx context.Context, l *traditionalnet.TCPListener, myagent []string, clock Clock) (ps *P2PPeer, err error) {
 	ps = new(P2PPeer)
+	ps.clock = clock
 	ps.conn, err = l.AcceptTCP()
 	if err != nil {
 		if ne, ok := err.(traditionalnet.Error); ok {
@@ -31,7 +32,7 @@ func NewP2PServer(ctx context.Context, l *traditionalnet.TCPListener, myagent []
 	logln(`[INFO] ピア` + ps.IPPort + `: TCP接続受理`)
 	ps.EPSPConn.SetConnTime()
 
-	if err = ps.Write(`614`, `1`, strings.Join(myagent, `:`)); err != nil { // バージョン要求
+	if err = ps.WriteMessage(NewMessage(CodePeerVersionRequest, myagent...)); err != nil { // バージョン要求
 		ps.Close()
 		return
 	}
@@ -40,21 +41,24 @@ func NewP2PServer(ctx context.Context, l *traditionalnet.TCPListener, myagent []
 	return
 }
 
-// NewP2PClient は、他のピアと接続します。
-func NewP2PClient(ctx context.Context, ipportpeerid string, connectedIPPortPeersList func() []string) (pc *P2PPeer, err error) {
-	ipportpeerids := strings.Split(ipportpeerid, `,`)
+// NewP2PClient は、他のピアと接続します。clockがnilなら SystemClock を使います。
+func NewP2PClient(ctx context.Context, ipportpeerid string, connectedIPPortPeersList func() []string, clock Clock) (pc *P2PPeer, err error) {
+	addr, peerID, err := IPPortPeerIDToAddr(ipportpeerid)
+	if err != nil {
+		return
+	}
 
 	for _, connedctedipportpeerid := range connectedIPPortPeersList() {
-		connedctedipportpeerids := strings.Split(connedctedipportpeerid, `,`)
-		if ipportpeerids[2] == connedctedipportpeerids[2] {
+		if peerID == PeerIDOfIPPortPeerID(connedctedipportpeerid) {
 			err = errors.New(`PeerID重複: ` + ipportpeerid + ` == ` + connedctedipportpeerid)
 			return
 		}
 	}
 
 	pc = new(P2PPeer)
-	pc.IPPort = ipportpeerids[0] + `:` + ipportpeerids[1]
-	pc.PeerID = ipportpeerids[2]
+	pc.clock = clock
+	pc.IPPort = addr
+	pc.PeerID = peerID
 
 	ctxtimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
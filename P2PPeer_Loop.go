@@ -27,8 +27,8 @@ func (p *P2PPeer) chanGet(ctx context.Context, retvalch chan string, errch chan
 }
 
 // NetLoop は、接続済みTCP接続からデータの読み書きします
-func (p *P2PPeer) NetLoop(ctx context.Context, mypeerid string, agent []string, peers func() []string, codep2mp func(peer *P2PPeer, retval []string) (err error)) (err error) {
-	timer := time.NewTicker(5 * time.Minute)
+func (p *P2PPeer) NetLoop(ctx context.Context, mypeerid string, agent []string, peers func() []string, codep2mp func(peer *P2PPeer, m Message) (err error)) (err error) {
+	timer := clockOrSystem(p.clock).NewTicker(5 * time.Minute)
 	defer timer.Stop()
 	retvalch := make(chan string)
 	errch := make(chan error)
@@ -37,7 +37,7 @@ func (p *P2PPeer) NetLoop(ctx context.Context, mypeerid string, agent []string,
 outerloop:
 	for {
 		select {
-		case <-timer.C: // timeout
+		case <-timer.C(): // timeout
 			if err = p.sendPing(); err != nil { // ピアエコー要求
 				err = errors.Wrap(err, `ピアエコー要求`)
 				break outerloop
@@ -54,7 +54,7 @@ outerloop:
 			}
 
 			if p.PeerID == `` {
-				if err = p.Write(`612`, `1`); err != nil { // ピアID要求
+				if err = p.WriteMessage(NewMessage(CodePeerIDRequest)); err != nil { // ピアID要求
 					err = errors.Wrap(err, `ピアIDTCP要求送信エラー`)
 					break outerloop
 				}
@@ -71,55 +71,56 @@ outerloop:
 }
 
 // loop は、送られてきた文字列に対する処理を行います
-func (p *P2PPeer) loop(retval string, mypeerid string, myagent []string, peers func() []string, codep2mp func(peer *P2PPeer, retval []string) (err error)) error {
-	retvals := strings.SplitN(retval, ` `, 3)
-	switch {
-	case len(retvals) == 0:
-		return errors.New(`空行`)
-	case len(retvals) == 1:
-		return errors.New(`経由数なし: ` + retval)
-	case len(retvals[0]) != 3:
-		return errors.New(`Unknown command: ` + retval)
-	case retvals[0][0] == '5' || retvals[0] == `615` || retvals[0] == `635`:
-		return errors.Wrap(codep2mp(p, retvals), `codep2mp`) // relay message.
-	default:
-		return errors.Wrap(p.p2pcmd(myagent, mypeerid, peers, retvals), `p2pcmd`) // Not relayed.
+func (p *P2PPeer) loop(retval string, mypeerid string, myagent []string, peers func() []string, codep2mp func(peer *P2PPeer, m Message) (err error)) error {
+	var m Message
+	if err := m.Unmarshal(retval); err != nil {
+		return err
+	}
+	if m.IsRelayed() || m.Code == CodePeerList { // 接続先ピア情報は、アドレス帳に加えるためにPeerへ渡します
+		return errors.Wrap(codep2mp(p, m), `codep2mp`) // relay message.
 	}
+	return errors.Wrap(p.p2pcmd(myagent, mypeerid, peers, m), `p2pcmd`) // Not relayed.
 }
 
-func (p *P2PPeer) p2pcmd(myagent []string, mypeerid string, peers func() []string, retval []string) error {
-	switch retval[0] {
-	case `115`:
+func (p *P2PPeer) p2pcmd(myagent []string, mypeerid string, peers func() []string, m Message) error {
+	switch m.Code {
+	case CodePeerListRequest:
 		return p.code115(peers())
-	case "611":
+	case CodePeerEchoRequest:
 		return p.code611()
-	case "612":
+	case CodePeerIDRequest:
 		return p.code612(mypeerid)
-	case "614":
-		return p.code614(retval, myagent)
-	case `631`:
+	case CodePeerVersionRequest:
+		return p.code614(m, myagent)
+	case CodePeerEcho:
 		return p.code631()
-	case `632`:
-		return p.code632(retval, peers)
-	case `634`:
-		return p.code634(retval)
-	case `694`: // Protocol_version_incompatible
-		return p.code694()
+	case CodePeerID:
+		return p.code632(m, peers)
+	case CodePeerVersion:
+		return p.code634(m, myagent)
+	case CodeVersionIncompatible: // Protocol_version_incompatible
+		return p.code694(m)
 	default:
-		logln("[ERROR] ピア" + p.GetPeerIDorIPPort() + ": Recv " + strings.Join(retval, ` `))
+		logln("[ERROR] ピア" + p.GetPeerIDorIPPort() + ": Recv " + m.Marshal())
 		return nil
 	}
 }
 
+// RequestPeers は、相手に接続先ピア情報を要求します。返答(235)は codep2mp に渡されます。
+func (p *P2PPeer) RequestPeers() error {
+	logln(`[DEBUG] ピア` + p.GetPeerIDorIPPort() + `: 接続先ピア情報要求`)
+	return p.WriteMessage(NewMessage(CodePeerListRequest))
+}
+
 func (p *P2PPeer) code115(peers []string) error {
-	return p.Write(`235`, `1`, strings.Join(peers, `:`))
+	return p.WriteMessage(NewMessage(CodePeerList, PeerListPayload{Peers: peers}.Fields()...))
 }
 
 func (p *P2PPeer) code611() error {
 	logln("[ECHO] ピア" + p.GetPeerIDorIPPort() + ": エコー要求受領")
 	p.SetPingRecvTime()
 
-	if err := p.Write(`631`, `1`); err != nil {
+	if err := p.WriteMessage(NewMessage(CodePeerEcho)); err != nil {
 		return errors.Wrap(err, `エコー返答エラー`)
 	}
 	logln(`[ECHO] ピア` + p.GetPeerIDorIPPort() + `: エコー返答`)
@@ -128,7 +129,7 @@ func (p *P2PPeer) code611() error {
 
 func (p *P2PPeer) code612(mypeerid string) error {
 	logln("[DEBUG] ピア" + p.GetPeerIDorIPPort() + ": ピアID要求")
-	if err := p.Write(`632`, `1`, mypeerid); err != nil {
+	if err := p.WriteMessage(NewMessage(CodePeerID, PeerIDPayload{PeerID: mypeerid}.Fields()...)); err != nil {
 		return errors.Wrap(err, `ピアID返答エラー`)
 	}
 	logln(`[DEBUG] ピア` + p.GetPeerIDorIPPort() + `: ピアID返答`)
@@ -138,10 +139,13 @@ func (p *P2PPeer) code612(mypeerid string) error {
 	return nil
 }
 
-func (p *P2PPeer) code614(retval []string, myagent []string) error {
-	p.Agent = strings.Split(retval[2], `:`)
+func (p *P2PPeer) code614(m Message, myagent []string) error {
+	p.Agent = m.Fields
 	logln("[DEBUG] ピア" + p.GetPeerIDorIPPort() + ": ピアプロトコルバージョン要求: " + strings.Join(p.Agent, `:`))
-	if err := p.Write(`634`, `1`, strings.Join(myagent, `:`)); err != nil {
+	if err := p.negotiate(myagent); err != nil {
+		return err
+	}
+	if err := p.WriteMessage(NewMessage(CodePeerVersion, myagent...)); err != nil {
 		return errors.Wrap(err, `ピアプロトコルバージョン返答エラー`)
 	}
 	logln(`[DEBUG] ピア` + p.GetPeerIDorIPPort() + `: ピアプロトコルバージョン返答: ` + strings.Join(myagent, `:`))
@@ -154,18 +158,23 @@ func (p *P2PPeer) code631() error {
 	return nil
 }
 
-func (p *P2PPeer) code632(retval []string, peers func() []string) error {
-	logln("[INFO] ピア" + retval[2] + ": ピアID返答受領" + p.EPSPConn.IPPort)
+func (p *P2PPeer) code632(m Message, peers func() []string) error {
+	id, err := ParsePeerIDPayload(m.Fields)
+	if err != nil {
+		return errors.Wrap(err, `ピアID返答`)
+	}
+	logln("[INFO] ピア" + id.PeerID + ": ピアID返答受領" + p.EPSPConn.IPPort)
 	if p.PeerID == `` {
 		for _, v := range peers() {
-			if strings.Split(v, `,`)[2] == retval[2] {
+			if PeerIDOfIPPortPeerID(v) == id.PeerID {
 				return fmt.Errorf(`ピアID重複 %s %s`, v, p.GetIPPortPeerID())
 			}
 		}
-		p.PeerID = retval[2]
+		p.PeerID = id.PeerID
+		p.changed()
 	} else {
-		if p.PeerID != retval[2] {
-			return errors.New(`ピアID矛盾` + retval[2])
+		if p.PeerID != id.PeerID {
+			return errors.New(`ピアID矛盾` + id.PeerID)
 		}
 	}
 	if p.GetPingTime() == nil {
@@ -176,12 +185,35 @@ func (p *P2PPeer) code632(retval []string, peers func() []string) error {
 	return nil
 }
 
-func (p *P2PPeer) code634(retval []string) error {
+func (p *P2PPeer) code634(m Message, myagent []string) error {
 	logln("[DEBUG] ピア" + p.GetPeerIDorIPPort() + ": ピアプロトコルバージョン受領")
-	p.Agent = strings.Split(retval[2], `:`)
+	p.Agent = m.Fields
+	return p.negotiate(myagent)
+}
+
+func (p *P2PPeer) code694(m Message) error {
+	return errors.New(`こちらのプロトコルバージョンが古い ` + m.Data())
+}
+
+// negotiate は、相手のエージェント名から、この接続のプロトコルバージョンを決めます。
+// 相手が非互換なら、694を送って切断します。
+func (p *P2PPeer) negotiate(myagent []string) error {
+	v, err := negotiateVersion(myagent, p.Agent)
+	if err != nil {
+		logln(`[INFO] ピア` + p.GetPeerIDorIPPort() + `: ` + err.Error())
+		if werr := p.WriteMessage(NewMessage(CodeVersionIncompatible, myagent...)); werr != nil {
+			err = errors.Wrap(werr, `プロトコルバージョン非互換送信エラー`)
+		}
+		p.Close()
+		return err
+	}
+	p.setVersion(v)
+	p.changed()
+	logln(`[DEBUG] ピア` + p.GetPeerIDorIPPort() + `: プロトコルバージョン ` + v.String())
 	return nil
 }
 
-func (p *P2PPeer) code694() error {
-	return errors.New(`こちらのプロトコルバージョンが古い`)
+// Supports は、相手がcodeを理解するかを、取り決めたプロトコルバージョンで判断します
+func (p *P2PPeer) Supports(code string) bool {
+	return p.Version().Supports(code)
 }
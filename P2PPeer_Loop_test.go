@@ -0,0 +1,152 @@
+package epsp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair は、つながったTCP接続の両端を返します
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	local, err := net.Dial(`tcp`, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local.(*net.TCPConn), remote.(*net.TCPConn)
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func TestNetLoopEcho(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(remote)
+
+	p := newTestP2PPeer(clock, remote.LocalAddr().String())
+	p.PeerID = `2`
+	p.conn = local
+	p.SetConnTime()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.NetLoop(ctx, `1`, []string{`0.34r`}, func() []string { return nil }, func(*P2PPeer, Message) error { return nil })
+	}()
+	waitUntil(t, func() bool { return clock.Waiters() == 1 })
+
+	// 5分毎に、ピアエコーを要求します。
+	clock.Advance(5*time.Minute - time.Second)
+	if p.GetPingTime() != nil {
+		t.Fatal(`ping before 5 minutes`)
+	}
+	clock.Advance(time.Second)
+	if line := readLine(t, r); line != `611 1` {
+		t.Fatalf(`sent %q`, line)
+	}
+	pinged := clock.Now()
+	waitUntil(t, func() bool { return p.GetPingTime() != nil })
+	if !p.GetPingTime().Equal(pinged) {
+		t.Errorf(`PingTime = %v, want %v`, p.GetPingTime(), pinged)
+	}
+
+	clock.Advance(40 * time.Millisecond)
+	if _, err := remote.Write([]byte("631 1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return p.GetPingPong() != nil })
+	if got := *p.GetPingPong(); got != 40*time.Millisecond {
+		t.Errorf(`PingPong = %v`, got)
+	}
+
+	// 相手からのピアエコー要求には返答します。
+	if _, err := remote.Write([]byte("611 1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line := readLine(t, r); line != `631 1` {
+		t.Fatalf(`sent %q`, line)
+	}
+	if recv := p.GetPingRecv(); recv == nil || !recv.Equal(clock.Now()) {
+		t.Errorf(`PingRecv = %v`, recv)
+	}
+
+	clock.Advance(5 * time.Minute)
+	if line := readLine(t, r); line != `611 1` {
+		t.Fatalf(`sent %q`, line)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`NetLoop did not return`)
+	}
+	if p.IsConn() || clock.Waiters() != 0 {
+		t.Errorf(`IsConn = %v, Waiters = %d`, p.IsConn(), clock.Waiters())
+	}
+}
+
+func TestDeleteUnusedPeer(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	var pps P2PPeers
+	silent := newTestP2PPeer(clock, `192.0.2.1:6911`) // エコー要求を受け取っていない
+	silent.SetConnTime()
+	pinged := newTestP2PPeer(clock, `192.0.2.2:6911`) // 30分後にエコー要求を受け取る
+	pinged.SetConnTime()
+	pps.add(silent)
+	pps.add(pinged)
+
+	clock.Advance(30 * time.Minute)
+	pinged.SetPingRecvTime()
+	clock.Advance(30 * time.Minute)
+	pps.deleteUnusedPeer()
+	if !silent.IsConn() || !pinged.IsConn() {
+		t.Fatalf(`closed within an hour: %v %v`, silent.IsConn(), pinged.IsConn())
+	}
+
+	// 接続から1時間を超えてエコー要求がなければ、切断します。
+	clock.Advance(time.Second)
+	pps.deleteUnusedPeer()
+	if silent.IsConn() || !pinged.IsConn() {
+		t.Fatalf(`after an hour: %v %v`, silent.IsConn(), pinged.IsConn())
+	}
+
+	// 最後のエコー要求から1時間を超えても、切断します。
+	clock.Advance(30 * time.Minute)
+	pps.deleteUnusedPeer()
+	if pinged.IsConn() {
+		t.Fatal(`not closed an hour after the last ping`)
+	}
+
+	// 切断から1分を超えたら、一覧から除きます。
+	pps.deleteClosedFromList()
+	if got := pps.Snapshot(); len(got) != 1 || got[0] != pinged {
+		t.Fatalf(`Snapshot = %v`, got)
+	}
+	clock.Advance(time.Minute + time.Second)
+	pps.deleteClosedFromList()
+	if got := pps.Snapshot(); len(got) != 0 {
+		t.Fatalf(`Snapshot = %v`, got)
+	}
+}
@@ -3,98 +3,210 @@ package epsp
 import (
 	"context"
 	"net"
-	traditionalnet "net"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-// P2PPeers is array of *P2PPeer
-type P2PPeers []*P2PPeer
+// P2PPeers の変化の種類です。StatusFeed の StatusMessage.Type と同じです。
+const (
+	PeerAdded   = `peer_added`
+	PeerUpdated = `peer_updated`
+	PeerRemoved = `peer_removed`
+)
 
-// NewP2PServers は、P2PServerを立ち上げます
-func (pps *P2PPeers) NewP2PServers(ctx context.Context, mypeerid string, myagent []string, port int, codep2mp func(from *P2PPeer, retval []string) error, ConnectedIPPortPeersList func() []string, incoming uint64) (global bool, err error) {
+// P2PPeers は、ピア接続の一覧です。追加と削除は一覧ごとに排他します。
+type P2PPeers struct {
+	mu        sync.RWMutex
+	peers     []*P2PPeer
+	observers []func(change string, p *P2PPeer)
+	notifyMu  sync.Mutex // 通知を、追加と削除の順に揃えます
+}
 
-	laddr, err := traditionalnet.ResolveTCPAddr("tcp", "127.0.0.1:"+strconv.Itoa(port))
-	if err != nil {
-		err = errors.Wrap(err, "ResolveTCPAddr")
-		return
+// Snapshot は、ピア接続の一覧の複製を返します
+func (pps *P2PPeers) Snapshot() []*P2PPeer {
+	pps.mu.RLock()
+	defer pps.mu.RUnlock()
+	return append([]*P2PPeer(nil), pps.peers...)
+}
+
+// OnChange は、ピア接続の追加(PeerAdded)、接続情報の変化(PeerUpdated)、削除(PeerRemoved)のときに呼ばれる関数を登録します。
+// 通知は一つずつ順に呼ばれます。fの中で、接続情報を変えないでください。
+func (pps *P2PPeers) OnChange(f func(change string, p *P2PPeer)) {
+	pps.mu.Lock()
+	pps.observers = append(pps.observers, f)
+	pps.mu.Unlock()
+}
+
+// notifyLocked は、登録された関数に通知します。notifyMu を取って呼んでください。
+func (pps *P2PPeers) notifyLocked(change string, p *P2PPeer) {
+	pps.mu.RLock()
+	observers := pps.observers
+	pps.mu.RUnlock()
+	for _, f := range observers {
+		f(change, p)
+	}
+}
+
+func (pps *P2PPeers) contains(p *P2PPeer) bool {
+	pps.mu.RLock()
+	defer pps.mu.RUnlock()
+	for _, q := range pps.peers {
+		if q == p {
+			return true
+		}
 	}
-	laddr.IP = nil
+	return false
+}
+
+// add は、ピア接続を一覧に加えます。以降、一覧から除くまで、接続情報が変わると PeerUpdated を通知します。
+func (pps *P2PPeers) add(p *P2PPeer) {
+	pps.notifyMu.Lock()
+	defer pps.notifyMu.Unlock()
+	pps.mu.Lock()
+	pps.peers = append(pps.peers, p)
+	pps.mu.Unlock()
+	p.setOnChange(func() { pps.updated(p) })
+	pps.notifyLocked(PeerAdded, p)
+}
 
-	l, err := net.ListenTCP(`tcp`, laddr)
+func (pps *P2PPeers) updated(p *P2PPeer) {
+	pps.notifyMu.Lock()
+	defer pps.notifyMu.Unlock()
+	if pps.contains(p) { // 除いた後に遅れて届いた変化は通知しません
+		pps.notifyLocked(PeerUpdated, p)
+	}
+}
+
+// remove は、ピア接続を一覧から除きます
+func (pps *P2PPeers) remove(p *P2PPeer) {
+	pps.notifyMu.Lock()
+	defer pps.notifyMu.Unlock()
+	pps.mu.Lock()
+	found := false
+	for i := range pps.peers {
+		if pps.peers[i] == p {
+			pps.peers = append(pps.peers[:i], pps.peers[i+1:]...)
+			found = true
+			break
+		}
+	}
+	pps.mu.Unlock()
+	if found {
+		p.setOnChange(nil)
+		pps.notifyLocked(PeerRemoved, p)
+	}
+}
+
+// NewP2PServers は、P2PServerを立ち上げます。laddrsの各アドレス(host:port)で待ち受けます。
+// hostが空の場合はデュアルスタックで、[::]のようなIPv6アドレスやIPv4アドレスの場合はそのアドレスで待ち受けます。
+func (pps *P2PPeers) NewP2PServers(ctx context.Context, mypeerid string, myagent []string, laddrs []string, codep2mp func(from *P2PPeer, m Message) error, ConnectedIPPortPeersList func() []string, incoming uint64, clock Clock) (global bool, err error) {
+
+	var ls []*net.TCPListener
+	for _, addr := range laddrs {
+		var laddr *net.TCPAddr
+		laddr, err = net.ResolveTCPAddr(`tcp`, addr)
+		if err != nil {
+			err = errors.Wrap(err, "ResolveTCPAddr")
+			break
+		}
+
+		var l *net.TCPListener
+		l, err = net.ListenTCP(`tcp`, laddr)
+		if err != nil {
+			err = errors.Wrap(err, "ListenTCP")
+			break
+		}
+		ls = append(ls, l)
+		global = global || laddr.IP.IsGlobalUnicast()
+
+		logln(`[DEBUG] LitenTCP: `, l.Addr(), ` `, strings.Join(myagent, `:`))
+	}
+	if err == nil && len(ls) == 0 {
+		err = errors.New(`待受アドレスがありません`)
+	}
 	if err != nil {
-		err = errors.Wrap(err, "ListenTCP")
+		for _, l := range ls {
+			_ = l.Close()
+		}
+		global = false
 		return
 	}
 
-	logln(`[DEBUG] LitenTCP: `, laddr, len(laddr.IP), strings.Join(myagent, `:`))
-
 	pschan := make(chan *P2PPeer)
-	go func(l *traditionalnet.TCPListener) {
-		for {
-			if ps, err := NewP2PServer(ctx, l, myagent); err != nil {
-				logln(`[WARN] `, err)
-			} else {
-				pschan <- ps
+	for _, l := range ls {
+		go func(l *net.TCPListener) {
+			for {
+				ps, err := NewP2PServer(ctx, l, myagent, clock)
+				if err != nil {
+					if ne, ok := errors.Cause(err).(net.Error); ok && ne.Temporary() {
+						logln(`[WARN] `, err)
+						continue
+					}
+					select {
+					case <-ctx.Done():
+					default:
+						logln(`[WARN] `, err)
+					}
+					return
+				}
+				select {
+				case pschan <- ps:
+				case <-ctx.Done():
+					ps.Close()
+					return
+				}
 			}
-		}
-	}(l)
+		}(l)
+	}
 
 	go func() {
-		var mu sync.Mutex
-		timer := time.NewTicker(1 * time.Minute)
+		timer := clockOrSystem(clock).NewTicker(1 * time.Minute)
 		for {
 			select {
 			case ps := <-pschan:
 				go func() {
-					mu.Lock()
-					*pps = append(*pps, ps)
-					mu.Unlock()
-					err = ps.NetLoop(ctx, mypeerid, myagent, ConnectedIPPortPeersList, codep2mp)
+					pps.add(ps)
+					err := ps.NetLoop(ctx, mypeerid, myagent, ConnectedIPPortPeersList, codep2mp)
 					if err != nil {
 						logln(`[INFO] ピア`, ps.PeerID+`: サーバ通信異常終了 `+strings.Join(ps.Agent, `:`), err)
 					} else {
 						logln(`[INFO] ピア`, ps.PeerID+`: サーバ通信正常終了 `+strings.Join(ps.Agent, `:`))
 					}
 				}()
-			case <-timer.C:
-				mu.Lock()
+			case <-timer.C():
 				pps.deleteClosedFromList()
 				pps.deleteUnusedPeer()
 				pps.deleteManyDuplicatePeer(incoming, 100)
-				mu.Unlock()
 			case <-ctx.Done():
 				timer.Stop()
+				for _, l := range ls {
+					_ = l.Close()
+				}
 				return
 			}
 		}
 	}()
 
-	global = len(laddr.IP) != 0
-	err = nil
 	return
 }
 
 // AddP2PClients は、P2PClientsを追加します
-func (pps *P2PPeers) AddP2PClients(ctx context.Context, mypeerid string, otherPeers []string, myagent []string, codep2mp func(from *P2PPeer, retval []string) error, ConnectedIPPortPeersList func() []string, incoming uint64) {
+func (pps *P2PPeers) AddP2PClients(ctx context.Context, mypeerid string, otherPeers []string, myagent []string, codep2mp func(from *P2PPeer, m Message) error, ConnectedIPPortPeersList func() []string, incoming uint64, clock Clock) {
 
 	var wg sync.WaitGroup
-	var mu sync.Mutex
 	for i := range otherPeers {
 		wg.Add(1)
 		go func(i int) {
-			pc, err := NewP2PClient(ctx, otherPeers[i], ConnectedIPPortPeersList)
+			pc, err := NewP2PClient(ctx, otherPeers[i], ConnectedIPPortPeersList, clock)
 			if err != nil {
 				logln(`[INFO] ピア`+pc.GetPeerIDorIPPort()+`: 接続失敗 `, err)
 				wg.Done()
 			} else {
-				mu.Lock()
-				*pps = append(*pps, pc)
-				mu.Unlock()
+				pps.add(pc)
 				wg.Done()
 				err = pc.NetLoop(ctx, mypeerid, myagent, ConnectedIPPortPeersList, codep2mp)
 				if err != nil {
@@ -113,31 +225,34 @@ func (pps *P2PPeers) AddP2PClients(ctx context.Context, mypeerid string, otherPe
 }
 
 func (pps *P2PPeers) deleteClosedFromList() {
-	for i := 0; i < len(*pps); i++ {
-		if !(*pps)[i].IsConn() && time.Since(*(*pps)[i].GetDiscTime()) > 1*time.Minute {
-			*pps = append((*pps)[:i], (*pps)[i+1:]...)
-			i--
+	for _, p := range pps.Snapshot() {
+		if disc := p.GetDiscTime(); disc != nil && p.since(*disc) > 1*time.Minute {
+			pps.remove(p)
 		}
 	}
 }
 
 func (pps *P2PPeers) deleteUnusedPeer() {
-	for i := 0; i < len(*pps); i++ {
-		if ((*pps)[i].GetPingRecv() != nil && (time.Since(*(*pps)[i].GetPingRecv()) > 1*time.Hour)) || // Delete connection after 1hour from last pong.
-			((*pps)[i].GetPingRecv() == nil && (time.Since(*(*pps)[i].GetConnTime()) > 1*time.Hour)) { // Delete conntction if no pong and 1hour past.
-			(*pps)[i].Close()
-			logln(`[INFO] ピア` + (*pps)[i].PeerID + `: 未通信、終了`)
+	for _, p := range pps.Snapshot() {
+		if !p.IsConn() {
+			continue // 切断済の接続を閉じなおすと切断時刻が変わり、一覧から除けなくなります
+		}
+		t := p.Times()
+		if (!t.PingRecv.IsZero() && p.since(t.PingRecv) > 1*time.Hour) || // Delete connection after 1hour from last pong.
+			(t.PingRecv.IsZero() && p.since(t.Conn) > 1*time.Hour) { // Delete conntction if no pong and 1hour past.
+			p.Close()
+			logln(`[INFO] ピア` + p.PeerID + `: 未通信、終了`)
 		}
 	}
 }
 
 func (pps *P2PPeers) deleteManyDuplicatePeer(incoming, rxdup uint64) {
 	// Close connection to the peers who send many duplicate
-	for i := range *pps {
-		if (*pps)[i].RxDup > rxdup && (*pps)[i].IsConn() {
-			if (*pps)[i].GetRXUniqRate() > incoming/2 {
-				(*pps)[i].Close()
-				logln(`[INFO] ピア` + (*pps)[i].PeerID + `: 重複過多、終了`)
+	for _, p := range pps.Snapshot() {
+		if atomic.LoadUint64(&p.RxDup) > rxdup && p.IsConn() {
+			if p.GetRXUniqRate() > incoming/2 {
+				p.Close()
+				logln(`[INFO] ピア` + p.PeerID + `: 重複過多、終了`)
 			}
 		}
 	}
@@ -145,8 +260,9 @@ func (pps *P2PPeers) deleteManyDuplicatePeer(incoming, rxdup uint64) {
 
 // NumOfConnectedPeers は、接続中ピアの数を返します
 func (pps *P2PPeers) NumOfConnectedPeers() (n uint64) {
-	for i := range *pps {
-		if (*pps)[i].IsConn() {
+	ps := pps.Snapshot()
+	for i := range ps {
+		if ps[i].IsConn() {
 			n++
 		}
 	}
@@ -155,9 +271,10 @@ func (pps *P2PPeers) NumOfConnectedPeers() (n uint64) {
 
 // ConnectedPeersList は、接続中ピアのピアIDのリストを返します
 func (pps *P2PPeers) ConnectedPeersList() (ss []string) {
-	for i := range *pps {
-		if (*pps)[i].IsConn() && (*pps)[i].PeerID != `` {
-			ss = append(ss, (*pps)[i].PeerID)
+	ps := pps.Snapshot()
+	for i := range ps {
+		if ps[i].IsConn() && ps[i].PeerID != `` {
+			ss = append(ss, ps[i].PeerID)
 		}
 	}
 	return
@@ -165,9 +282,10 @@ func (pps *P2PPeers) ConnectedPeersList() (ss []string) {
 
 // ConnectedIPPortPeersList は、接続中ピアのIPアドレス,ポート,ピアIDのリストを返します
 func (pps *P2PPeers) ConnectedIPPortPeersList() (ss []string) {
-	for i := range *pps {
-		if (*pps)[i].IsConn() {
-			ss = append(ss, (*pps)[i].GetIPPortPeerID())
+	ps := pps.Snapshot()
+	for i := range ps {
+		if ps[i].IsConn() {
+			ss = append(ss, ps[i].GetIPPortPeerID())
 		}
 	}
 	return
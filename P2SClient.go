@@ -2,8 +2,6 @@ package epsp
 
 import (
 	"context"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,34 +14,54 @@ type P2SClient struct {
 }
 
 // GetPeerID は、相手のPeerIDを返すものですが、サーバにはPeerIDがないので、IPとポートを返します。
-func (p2s P2SClient) GetPeerID() string {
+func (p2s *P2SClient) GetPeerID() string {
 	return p2s.IPPort
 }
 
+// request は、要求を送り、応答を一つ受け取ります
+func (p2s *P2SClient) request(ctx context.Context, req Message) (m Message, err error) {
+	if err = p2s.EPSPConn.WriteMessage(req); err != nil {
+		err = errors.Wrap(err, `要求不能`)
+		return
+	}
+	if m, err = p2s.EPSPConn.GetMessage(ctx); err != nil {
+		err = errors.Wrap(err, `応答受信`)
+	}
+	return
+}
+
 func (p2s *P2SClient) code211(myagent []string) error {
 	logln(`[DEBUG] サーバ` + p2s.EPSPConn.IPPort + `: バージョン要求`)
-	if err := p2s.EPSPConn.Write(`131`, `1`, strings.Join(myagent, `:`)); err != nil {
+	m := NewMessage(CodeClientVersion, myagent...)
+	if err := p2s.EPSPConn.WriteMessage(m); err != nil {
 		return errors.Wrap(err, `バージョン要求不能`)
 	}
-	logln(`[DEBUG] サーバ` + p2s.EPSPConn.IPPort + `: バージョン返信 ` + strings.Join([]string{`131`, `1`, strings.Join(myagent, `:`)}, ` `))
+	logln(`[DEBUG] サーバ` + p2s.EPSPConn.IPPort + `: バージョン返信 ` + m.Marshal())
 	return nil
 }
 
-func (p2s *P2SClient) code212(myagent, retval []string) (myagent0 []string) {
-	logln(`[DEBUG] サーバ` + p2s.EPSPConn.IPPort + `: バージョン受領 ` + retval[2])
+// code212 は、サーバのエージェント名から、この接続のプロトコルバージョン(古い方)を決めます
+func (p2s *P2SClient) code212(myagent []string, m Message) error {
+	logln(`[DEBUG] サーバ` + p2s.EPSPConn.IPPort + `: バージョン受領 ` + m.Data())
 
-	p2s.EPSPConn.Agent = strings.Split(retval[2], `:`)
-	if myagent[0] > p2s.EPSPConn.Agent[0] {
-		myagent[0] = p2s.EPSPConn.Agent[0]
-		logln(`[DEBUG] エージェント名変更: ` + strings.Join(myagent, `:`))
+	p2s.EPSPConn.Agent = m.Fields
+	v, err := negotiateVersion(myagent, p2s.EPSPConn.Agent)
+	if err != nil {
+		return err
 	}
-	return myagent
+	p2s.setVersion(v)
+	logln(`[DEBUG] サーバ` + p2s.EPSPConn.IPPort + `: プロトコルバージョン ` + v.String())
+	return nil
 }
 
-// NewP2SClient は、サーバ接続用のクライアントです
-func NewP2SClient(ctx context.Context, paddr string, myagent0 []string) (p2s *P2SClient, myagent []string, err error) {
-	myagent = myagent0
+// ErrRejoin は、サーバから参加しなおし(299)を求められたことを表します
+var ErrRejoin = errors.New(`参加しなおし要求(IPアドレスが変わったかも)`)
+
+// NewP2SClient は、サーバ接続用のクライアントです。clockがnilなら SystemClock を使います。
+// サーバのプロトコルバージョンが非互換なら、エラーです。
+func NewP2SClient(ctx context.Context, paddr string, myagent []string, clock Clock) (p2s *P2SClient, err error) {
 	p2s = new(P2SClient)
+	p2s.EPSPConn.clock = clock
 	p2s.EPSPConn.IPPort = paddr
 	p2s.EPSPConn.conn, err = net.DialContext(ctx, `tcp`, p2s.EPSPConn.IPPort)
 	if err != nil {
@@ -56,26 +74,29 @@ func NewP2SClient(ctx context.Context, paddr string, myagent0 []string) (p2s *P2
 
 outerloop:
 	for {
-		var rv string
-		if rv, err = p2s.EPSPConn.Get(ctx); err != nil { // バージョン要求がこないよ
+		var m Message
+		if m, err = p2s.EPSPConn.GetMessage(ctx); err != nil { // バージョン要求がこないよ
 			p2s.Close(ctx)
-			err = errors.Wrap(err, `バージョン要求なし: `+rv)
+			err = errors.Wrap(err, `バージョン要求なし`)
 			p2s = nil
 			return
 		}
-		retval := strings.SplitN(rv, ` `, 3)
-		switch retval[0] {
-		case `211`: // バージョン要求
+		switch m.Code {
+		case CodeServerVersionRequest: // バージョン要求
 			if err = p2s.code211(myagent); err != nil {
 				p2s.Close(ctx)
 				p2s = nil
+				return
+			}
+		case CodeServerVersion: // バージョン受領
+			if err = p2s.code212(myagent, m); err != nil {
+				p2s.Close(ctx)
+				p2s = nil
 			}
-		case `212`: // バージョン受領
-			myagent = p2s.code212(myagent, retval)
 			break outerloop
 		default:
 			p2s.Close(ctx)
-			err = errors.Wrap(err, `コマンド受領エラー `+strings.Join(retval, ` `))
+			err = errors.New(`コマンド受領エラー ` + m.Marshal())
 			p2s = nil
 			break outerloop
 		}
@@ -84,25 +105,23 @@ outerloop:
 }
 
 // GetTemporaryPeerID は、サーバから暫定ピアIDを取得します
-func (p2s P2SClient) GetTemporaryPeerID(ctx context.Context) (peerID string, err error) {
+func (p2s *P2SClient) GetTemporaryPeerID(ctx context.Context) (peerID string, err error) {
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: ピアID暫定割当要求`)
-	if err = p2s.EPSPConn.Write(`113`, `1`); err != nil {
-		err = errors.Wrap(err, `ピアID暫定割当要求`)
-		return
-	}
-
-	var rv string
-	if rv, err = p2s.Get(ctx); err != nil {
-		err = errors.Wrap(err, "ピアID暫定割当受信")
+	m, err := p2s.request(ctx, NewMessage(CodeTemporaryIDRequest))
+	if err != nil {
+		err = errors.Wrap(err, `ピアID暫定割当`)
 		return
 	}
-	retval := strings.SplitN(rv, ` `, 3)
 
-	switch retval[0] {
-	case `233`:
-		peerID = retval[2]
+	switch m.Code {
+	case CodeTemporaryID:
+		var p PeerIDPayload
+		if p, err = ParsePeerIDPayload(m.Fields); err != nil {
+			err = errors.Wrap(err, `ピアID暫定割当`)
+			return
+		}
+		peerID = p.PeerID
 		logln(`[DEBUG] サーバ` + p2s.IPPort + `: ピアID暫定割当: ` + peerID)
-		err = nil
 		return
 	default:
 		err = errors.New(`ピアID暫定割当がこないよ`)
@@ -111,113 +130,93 @@ func (p2s P2SClient) GetTemporaryPeerID(ctx context.Context) (peerID string, err
 }
 
 // GetPeers は、サーバから接続可能なピア情報を取得します
-func (p2s P2SClient) GetPeers(ctx context.Context, peerID string) (peers []string, err error) {
-	err = p2s.EPSPConn.Write(`115`, `1`, peerID)
-	if err != nil {
-		err = errors.Wrap(err, `接続先ピア情報要求不能`)
-		return
-	}
+func (p2s *P2SClient) GetPeers(ctx context.Context, peerID string) (peers []string, err error) {
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: 接続先ピア情報要求`)
-
-	rv, err := p2s.Get(ctx)
+	m, err := p2s.request(ctx, NewMessage(CodePeerListRequest, PeerIDPayload{PeerID: peerID}.Fields()...))
 	if err != nil {
-		err = errors.Wrap(err, "接続先ピア情報要求受信")
+		err = errors.Wrap(err, `接続先ピア情報要求`)
 		return
 	}
 
-	retval := strings.SplitN(rv, ` `, 3)
-	switch retval[0] {
-	case `235`:
-		peers = strings.Split(retval[2], `:`)
+	switch m.Code {
+	case CodePeerList:
+		var p PeerListPayload
+		if p, err = ParsePeerListPayload(m.Fields); err != nil {
+			err = errors.Wrap(err, `接続先ピア情報`)
+			return
+		}
+		peers = p.Peers
 		logln(`[DEBUG] サーバ`+p2s.IPPort+`: 接続先ピア情報の取得:`, len(peers), `peers`)
 		return
 	default:
-		err = errors.New(`接続先ピア情報がこないよ: ` + retval[0])
+		err = errors.New(`接続先ピア情報がこないよ: ` + m.Code)
 		return
 	}
 }
 
 // Regist は、ピアIDの本割り当てを要求します
-func (p2s P2SClient) Regist(ctx context.Context, peerID string, port int, region string, numofpeers uint64, incoming uint64) (err error) {
-	err = p2s.EPSPConn.Write(`116`, `1`, peerID+`:`+strconv.Itoa(port)+`:`+region+`:`+strconv.FormatUint(numofpeers, 10)+`:`+strconv.FormatUint(incoming, 10))
-	if err != nil {
-		err = errors.Wrap(err, `ピアID本割当要求不能`)
-		return
-	}
+func (p2s *P2SClient) Regist(ctx context.Context, peerID string, port int, region string, numofpeers uint64, incoming uint64) (err error) {
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: ピアID本割当要求`)
-
-	rv, err := p2s.Get(ctx)
+	req := RegistrationRequest{PeerID: peerID, Port: port, Region: region, Connections: numofpeers, Incoming: incoming}
+	m, err := p2s.request(ctx, NewMessage(CodeRegistrationRequest, req.Fields()...))
 	if err != nil {
-		err = errors.Wrap(err, `ピアID本割当受信`)
+		err = errors.Wrap(err, `ピアID本割当`)
 		return
 	}
 
-	retval := strings.SplitN(rv, ` `, 3)
-	switch retval[0] {
-	case `236`:
-		logln(`[DEBUG] サーバ`+p2s.IPPort+`: ピアID本割当完了 参加ピア数: `, retval[2])
+	switch m.Code {
+	case CodeRegistered:
+		var r RegistrationResult
+		if r, err = ParseRegistrationResult(m.Fields); err != nil {
+			return
+		}
+		logln(`[DEBUG] サーバ`+p2s.IPPort+`: ピアID本割当完了 参加ピア数: `, r.NumOfPeers)
 		return
 	default:
-		err = errors.New(`ピアID本割当できないよ: ` + retval[0])
+		err = errors.New(`ピアID本割当できないよ: ` + m.Code)
 		return
 	}
 }
 
 // GetKey は、キーを取得します
-func (p2s P2SClient) GetKey(ctx context.Context, peer *Peer, echo bool) (err error) {
+func (p2s *P2SClient) GetKey(ctx context.Context, peer *Peer, echo bool) (err error) {
 
-	if time.Now().After(peer.keyExpire.Add(-30 * time.Minute)) {
+	if peer.keys.NeedsRenewal() { // 鍵の有効期限は、プロトコル時刻で比べます
+		var req Message
 		if echo {
-			if err = p2s.EPSPConn.Write(`124`, `1`, peer.PeerID+`+`+peer.secKey); err != nil { // 鍵の再割り当てを要求します。
-				err = errors.Wrap(err, `鍵再割当要求不能`)
-				return
-			}
+			cur, _ := peer.keys.Key()
+			req = NewMessage(CodeKeyReassignRequest, KeyReassignRequest{PeerID: peer.PeerID(), SecKey: cur.SecKey}.Fields()...) // 鍵の再割り当てを要求します。
 			logln(`[DEBUG] サーバ` + p2s.IPPort + `: 鍵再割当要求`)
 		} else {
-			if err = p2s.EPSPConn.Write(`117`, `1`, peer.PeerID); err != nil { // 鍵の割り当てを要求します。
-				err = errors.Wrap(err, `鍵割当要求不能`)
-				return
-			}
+			req = NewMessage(CodeKeyRequest, PeerIDPayload{PeerID: peer.PeerID()}.Fields()...) // 鍵の割り当てを要求します。
 			logln(`[DEBUG] サーバ` + p2s.IPPort + `: 鍵割当要求`)
 		}
 
-		var rv string
-		if rv, err = p2s.Get(ctx); err != nil {
-			err = errors.Wrap(err, "鍵割当要求応答受信")
+		var m Message
+		if m, err = p2s.request(ctx, req); err != nil {
+			err = errors.Wrap(err, `鍵割当要求`)
 			return
 		}
 
-		retval := strings.SplitN(rv, ` `, 3)
-		switch retval[0] {
-		case "237":
-			fallthrough
-		case "244":
+		switch m.Code {
+		case CodeKey, CodeKeyReassigned:
 			logln(`[INFO] サーバ` + p2s.IPPort + `: 鍵の取得`)
-			keyslice := strings.Split(retval[2], `:`)
-			peer.secKey = keyslice[0]
-			peer.pubKey = keyslice[1]
-			peer.keySig = keyslice[3]
-
-			loc, err := time.LoadLocation("Asia/Tokyo")
-			if err != nil {
-				loc = time.FixedZone("Asia/Tokyo", 9*60*60)
-			}
-			peer.keyExpire, err = time.ParseInLocation(`2006/01/02 15-04-05`, keyslice[2], loc)
-			if err != nil {
+			var k PeerKey
+			if k, err = ParsePeerKey(m.Fields); err != nil {
 				return err
 			}
+			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 秘密鍵`, k.SecKey)
+			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 公開鍵`, k.PubKey)
+			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 有効期限`, k.Expire)
+			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 鍵署名`, k.KeySig)
 
-			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 秘密鍵`, peer.secKey)
-			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 公開鍵`, peer.pubKey)
-			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 有効期限`, peer.keyExpire)
-			logln(`[DEBUG] サーバ`+p2s.IPPort+`: 鍵署名`, peer.keySig)
-
+			peer.keys.Set(k)
 			peer.SaveKey()
 
-		case "295":
+		case CodeKeyAssigned:
 			logln(`[DEBUG] サーバ` + p2s.IPPort + `: キー割当済`)
 		default:
-			logln(`[DEBUG] サーバ` + p2s.IPPort + `: エラー` + strings.Join(retval, ` `))
+			logln(`[DEBUG] サーバ` + p2s.IPPort + `: エラー` + m.Marshal())
 		}
 	}
 
@@ -226,153 +225,109 @@ func (p2s P2SClient) GetKey(ctx context.Context, peer *Peer, echo bool) (err err
 
 // Echo は、エコーを送信し、返信を受け取ります
 func (p2s *P2SClient) Echo(ctx context.Context, peerID string, peercount uint64) (err error) {
+	ctxtimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	logln(`[DEBUG] サーバ` + p2s.IPPort + `: エコー要求送信 PeerID: ` + peerID)
+	p2s.SetPingTime()
+	m, err := p2s.request(ctxtimeout, NewMessage(CodeEchoRequest, EchoRequest{PeerID: peerID, Connections: peercount}.Fields()...))
+	if err != nil {
+		return errors.Wrap(err, `エコー`)
+	}
 
-	if err = p2s.EPSPConn.Write(`123`, `1`, peerID+":"+strconv.FormatUint(peercount, 10)); err == nil {
-		logln(`[DEBUG] サーバ` + p2s.IPPort + `: エコー要求送信 PeerID: ` + peerID)
-		p2s.SetPingTime()
-		var rv string
-		ctxtimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-		if rv, err = p2s.Get(ctxtimeout); err == nil {
-			retval := strings.SplitN(rv, ` `, 3)
-			switch retval[0] {
-			case `243`:
-				logln(`[DEBUG] サーバ` + p2s.IPPort + `: エコー返信`)
-				p2s.SetPongTime()
-				return nil
-			case `299`: // エコー時のIPアドレスが参加時と変わっている場合、コード299が返されることがあります。この場合、一旦ネットワークから切断し、参加しなおしてください。
-				return errors.New(`IPアドレスが変わったかも`)
-			default:
-				return errors.New(`エコーがこないよ ` + retval[0])
-			}
-		} else {
-			return errors.Wrap(err, `エコー返信受信`)
-		}
-	} else {
-		return errors.Wrap(err, `エコー要求送信不能`)
+	switch m.Code {
+	case CodeEcho:
+		logln(`[DEBUG] サーバ` + p2s.IPPort + `: エコー返信`)
+		p2s.SetPongTime()
+		return nil
+	case CodeRejoin: // エコー時のIPアドレスが参加時と変わっている場合、コード299が返されることがあります。この場合、一旦ネットワークから切断し、参加しなおしてください。
+		return ErrRejoin
+	default:
+		return errors.New(`エコーがこないよ ` + m.Code)
 	}
 }
 
 // CheckPortOpen は、ポート開放をサーバに確認します
-func (p2s P2SClient) CheckPortOpen(ctx context.Context, peerID string, peercount int) (open bool, err error) {
-
-	if err = p2s.EPSPConn.Write(`114`, `1`, peerID+":"+strconv.Itoa(peercount)); err != nil {
-		err = errors.Wrap(err, `ポート開放確認不能`)
-		return
-	}
+func (p2s *P2SClient) CheckPortOpen(ctx context.Context, peerID string, port int) (open bool, err error) {
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: ポート開放確認`)
-	var rv string
-	rv, err = p2s.Get(ctx)
+	m, err := p2s.request(ctx, NewMessage(CodePortCheckRequest, PortCheckRequest{PeerID: peerID, Port: port}.Fields()...))
 	if err != nil {
 		err = errors.Wrap(err, `ポート開放確認不能`)
 		return
 	}
 
-	retval := strings.SplitN(rv, ` `, 3)
-	switch retval[0] {
-	case `234`:
-		switch retval[2] {
-		case `1`:
+	switch m.Code {
+	case CodePortCheck:
+		var r PortCheckResult
+		if r, err = ParsePortCheckResult(m.Fields); err != nil {
+			return
+		}
+		if open = r.Open; open {
 			logln(`[DEBUG] サーバ` + p2s.IPPort + `: ポート開放成功`)
-			open = true
-		case `0`:
+		} else {
 			logln(`[DEBUG] サーバ` + p2s.IPPort + `: ポート開放失敗`)
 		}
-		err = nil
 		return
 	default:
-		err = errors.New(`ポート開放確認がこないよ ` + retval[0])
+		err = errors.New(`ポート開放確認がこないよ ` + m.Code)
 		return
 	}
 }
 
 // PeerCountByRegion は、地域ごとのピア数を取得します
-func (p2s P2SClient) PeerCountByRegion(ctx context.Context, code5xx func(from *P2PPeer, retval []string) error) (peerCountByName PeerCounts, err error) {
-
-	if err = p2s.EPSPConn.Write(`127`, `1`); err != nil {
-		err = errors.Wrap(err, `各地域ピア数要求不能`)
-		return
-	}
+func (p2s *P2SClient) PeerCountByRegion(ctx context.Context, code5xx func(from *P2PPeer, m Message) error) (peerCountByName PeerCounts, err error) {
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: 各地域ピア数要求`)
-
-	var rv string
-	rv, err = p2s.Get(ctx)
+	m, err := p2s.request(ctx, NewMessage(CodeRegionCountRequest))
 	if err != nil {
-		err = errors.Wrap(err, "サーバ")
+		err = errors.Wrap(err, `各地域ピア数要求`)
 		return
 	}
-	retval := strings.SplitN(rv, ` `, 3)
 
-	switch retval[0] {
-	case `247`:
+	switch m.Code {
+	case CodeRegionCount:
 		logln(`[DEBUG] サーバ` + p2s.IPPort + `: 各地域ピア数受信`)
-		err = nil
-		peerCountByName = NewPeerCount(retval[2])
-		return
+		return ParsePeerCounts(m.Fields)
 	default:
 		err = errors.New(`[DEBUG] サーバ` + p2s.IPPort + `: 各地域ピア数がこないよ`)
 		return
 	}
-
 }
 
 // GetTime は、プロトコル時刻を取得します
-func (p2s P2SClient) GetTime(ctx context.Context) (t time.Time, err error) {
-
-	err = p2s.EPSPConn.Write(`118`, `1`)
-	if err != nil {
-		err = errors.Wrap(err, `プロトコル時刻要求不能`)
-		return
-	}
+func (p2s *P2SClient) GetTime(ctx context.Context) (t time.Time, err error) {
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: プロトコル時刻要求`)
-
-	rv, err := p2s.Get(ctx)
+	m, err := p2s.request(ctx, NewMessage(CodeTimeRequest))
 	if err != nil {
 		err = errors.Wrap(err, `プロトコル時刻取得不能`)
 		return
 	}
 
-	retval := strings.SplitN(rv, ` `, 3)
-	if retval[0] != "238" {
-		err = errors.New(`プロトコル時刻がこないよ[` + retval[0] + `]`)
+	if m.Code != CodeTime {
+		err = errors.New(`プロトコル時刻がこないよ[` + m.Code + `]`)
 		return
 	}
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: プロトコル時刻返戻`)
 
-	loc, err := time.LoadLocation("Asia/Tokyo")
-	if err != nil {
-		loc = time.FixedZone("Asia/Tokyo", 9*60*60)
-	}
-	t, err = time.ParseInLocation(`2006/01/02 15-04-05`, retval[2], loc)
-
+	pt, err := ParseProtocolTime(m.Fields)
+	t = pt.Time
 	return
 }
 
 // Close は、サーバとの接続を終了します
 func (p2s *P2SClient) Close(ctx context.Context) {
-	var err error
 	if p2s == nil {
-		logln(`[INFO] サーバ` + p2s.IPPort + `: P2SClient close 通信の終了済`)
+		logln(`[INFO] サーバ: P2SClient close 通信の終了済`)
 		return
 	}
 
-	if err = p2s.EPSPConn.Write(`119`, `1`); err != nil { // 通信の終了を要求します。
-		logln(`[WARN] サーバ` + p2s.IPPort + `: P2SClient close 通信の終了要求不能`)
-		p2s.EPSPConn.Close()
-		return
-	}
 	logln(`[DEBUG] サーバ` + p2s.IPPort + `: 通信の終了要求`)
-
-	var rv string
-	if rv, err = p2s.Get(ctx); err != nil {
-		logln(`[WARN] サーバ` + p2s.IPPort + `: P2SClient close 通信の終了不着`)
+	m, err := p2s.request(ctx, NewMessage(CodeEndRequest)) // 通信の終了を要求します。
+	if err != nil {
+		logln(`[WARN] サーバ` + p2s.IPPort + `: P2SClient close ` + err.Error())
 		p2s.EPSPConn.Close()
 		return
 	}
 
-	retval := strings.SplitN(rv, ` `, 3)
-
-	if retval[0] != "239" {
+	if m.Code != CodeEnd {
 		logln(`[WARN] サーバ` + p2s.IPPort + `: P2SClient close 通信の終了がこないよ`)
 		p2s.EPSPConn.Close()
 		return
@@ -382,12 +337,13 @@ func (p2s *P2SClient) Close(ctx context.Context) {
 }
 
 // TellPeer は、ピアとの接続状況を、サーバに伝えます
-func (p2s P2SClient) TellPeer(ps P2PPeers, limited []string) (err error) {
+// psは、P2PPeers.Snapshot で得た一覧です。
+func (p2s *P2SClient) TellPeer(ps []*P2PPeer, limited []string) (err error) {
 	var peerlists []string
 
 	for j := range limited {
 		for i := range ps {
-			if ps[i].IsConn() && ps[i].PeerID == strings.Split(limited[j], `,`)[2] {
+			if ps[i].IsConn() && ps[i].PeerID == PeerIDOfIPPortPeerID(limited[j]) {
 				peerlists = append(peerlists, ps[i].PeerID)
 				break
 			}
@@ -395,10 +351,9 @@ func (p2s P2SClient) TellPeer(ps P2PPeers, limited []string) (err error) {
 	}
 
 	if len(peerlists) != 0 {
-		peerlist := strings.Join(peerlists, `:`)
-		logln(`[DEBUG] サーバ` + p2s.IPPort + `: Send Peerlist: ` + peerlist)
-		err = p2s.EPSPConn.Write(`155`, `1`, peerlist)
-		if err != nil {
+		m := NewMessage(CodeConnectedPeersRequest, ConnectedPeers{PeerIDs: peerlists}.Fields()...)
+		logln(`[DEBUG] サーバ` + p2s.IPPort + `: Send Peerlist: ` + m.Data())
+		if err = p2s.EPSPConn.WriteMessage(m); err != nil {
 			err = errors.Wrap(err, `Send Peerlist不能`)
 			return
 		}
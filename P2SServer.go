@@ -0,0 +1,375 @@
+package epsp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// P2SServer の既定値です
+const (
+	DefaultServerKeyLifetime      = 1 * time.Hour
+	DefaultServerKeyBits          = 1024
+	DefaultServerEchoTimeout      = 30 * time.Minute // ピアのエコー間隔は最長10分です
+	DefaultServerTemporaryLimit   = 10 * time.Minute
+	DefaultServerTemporaryPerHost = 10 // 接続元ごとの、本割当前の暫定ピアIDの上限です
+	DefaultServerPeerListSize     = 5
+	serverIdleTimeout             = 1 * time.Minute
+	serverPortCheckTimeout        = 5 * time.Second
+	serverSweepInterval           = 1 * time.Minute
+)
+
+// P2SServer は、EPSPサーバです。ピアIDの割当、ポート開放確認、接続先ピアの紹介、鍵の発行、
+// 地域ごとのピア数、プロトコル時刻、エコーを扱います。Peer.Loop から、そのまま接続できます。
+type P2SServer struct {
+	Agent            []string
+	Registry         *Registry
+	CAKey            *rsa.PrivateKey // ピア鍵認証局の秘密鍵。ピアの NewPeer にはこの公開鍵を渡します。
+	KeyLifetime      time.Duration
+	KeyBits          int
+	EchoTimeout      time.Duration
+	TemporaryTimeout time.Duration
+	TemporaryPerHost int // 接続元ごとの、本割当前の暫定ピアIDの上限です。0なら上限はありません。
+	PeerListSize     int
+	Clock            Clock // ピアの期限や鍵の有効期限の時刻の取得元です。nilなら SystemClock を使います。
+
+	wg sync.WaitGroup
+}
+
+// NewP2SServer は、P2SServer のコンストラクタです
+func NewP2SServer(registry *Registry, caKey *rsa.PrivateKey) *P2SServer {
+	return &P2SServer{
+		Agent:            []string{`0.34r`, `github.com/toyo/epsp`, `20190310`},
+		Registry:         registry,
+		CAKey:            caKey,
+		KeyLifetime:      DefaultServerKeyLifetime,
+		KeyBits:          DefaultServerKeyBits,
+		EchoTimeout:      DefaultServerEchoTimeout,
+		TemporaryTimeout: DefaultServerTemporaryLimit,
+		TemporaryPerHost: DefaultServerTemporaryPerHost,
+		PeerListSize:     DefaultServerPeerListSize,
+		Clock:            SystemClock,
+	}
+}
+
+func (s *P2SServer) clock() Clock {
+	return clockOrSystem(s.Clock)
+}
+
+// ListenAndServe は、addrで待ち受けて、ctxが終わるまでピアの要求に応えます
+func (s *P2SServer) ListenAndServe(ctx context.Context, addr string) error {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, `tcp`, addr)
+	if err != nil {
+		return errors.Wrap(err, `Listen`)
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve は、lで接続を受け付けて、ctxが終わるまでピアの要求に応えます。期限切れのピアを定期的に消し、登録簿を保存します。
+func (s *P2SServer) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.sweep(ctx)
+	}()
+
+	var err error
+	for {
+		var conn net.Conn
+		if conn, err = l.Accept(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && ctx.Err() == nil {
+				select {
+				case <-ctx.Done():
+				case <-s.clock().After(100 * time.Millisecond):
+				}
+				continue
+			}
+			break
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+	cancel()
+	s.wg.Wait()
+	if serr := s.Registry.Save(); serr != nil {
+		logln(`[WARN] ` + serr.Error())
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.Wrap(err, `Accept`)
+}
+
+// sweep は、期限切れのピアを消し、登録簿を保存します
+func (s *P2SServer) sweep(ctx context.Context) {
+	ticker := s.clock().NewTicker(serverSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C():
+			if expired := s.Registry.Expire(now, s.EchoTimeout, s.TemporaryTimeout); len(expired) != 0 {
+				logln(`[INFO] ピアID期限切れ `, strings.Join(expired, `,`))
+			}
+			if err := s.Registry.Save(); err != nil {
+				logln(`[WARN] ` + err.Error())
+			}
+		}
+	}
+}
+
+// p2sSession は、一つのピアとの接続です。要求は続けて届くことがあるので、同じReaderで読みます。
+type p2sSession struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	host   string
+	peerID string // この接続で扱ったピアID
+}
+
+// write と read のソケットの期限は、Clock ではなく実時間です
+func (ss *p2sSession) write(code string, fields ...string) error {
+	if err := ss.conn.SetWriteDeadline(time.Now().Add(serverIdleTimeout)); err != nil {
+		return err
+	}
+	_, err := ss.conn.Write([]byte(NewMessage(code, fields...).Marshal() + "\r\n"))
+	return errors.Wrap(err, `conn.Write`)
+}
+
+func (ss *p2sSession) read() (string, error) {
+	if err := ss.conn.SetReadDeadline(time.Now().Add(serverIdleTimeout)); err != nil {
+		return ``, err
+	}
+	line, err := ss.r.ReadString('\n')
+	return line, errors.Wrap(err, `ReadLine`)
+}
+
+// serveConn は、バージョンを交換し、ピアが通信の終了(119)を要求するか切断するまで、要求に応えます
+func (s *P2SServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	ss := &p2sSession{conn: conn, r: bufio.NewReader(conn), host: host}
+	done := make(chan struct{})
+	defer close(done)
+	go func() { // サーバを止めるときに、読み書きを打ち切ります。接続が終われば、このgoroutineも終わります。
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err = ss.write(CodeServerVersionRequest, s.Agent[0]); err != nil { // バージョン要求
+		return
+	}
+	var m Message
+	line, err := ss.read()
+	if err != nil || m.Unmarshal(line) != nil || m.Code != CodeClientVersion {
+		logln(`[DEBUG] ピア` + host + `: バージョン返信なし`)
+		return
+	}
+	if err = ss.write(CodeServerVersion, s.Agent...); err != nil { // バージョン受領
+		return
+	}
+	logln(`[DEBUG] ピア` + host + `: 接続 ` + m.Data())
+
+	for {
+		if line, err = ss.read(); err != nil {
+			return
+		}
+		if err = m.Unmarshal(line); err != nil {
+			logln(`[DEBUG] ピア` + host + `: ` + err.Error())
+			if err = ss.write(CodeBadRequest); err != nil {
+				return
+			}
+			continue
+		}
+		if m.Code == CodeEndRequest { // 通信の終了
+			_ = ss.write(CodeEnd)
+			return
+		}
+		if err = s.handle(ctx, ss, m); err != nil {
+			logln(`[DEBUG] ピア` + host + `: ` + err.Error())
+			return
+		}
+	}
+}
+
+// handle は、一つの要求に応えます
+func (s *P2SServer) handle(ctx context.Context, ss *p2sSession, m Message) error {
+	now := s.clock().Now()
+
+	switch m.Code {
+	case CodeTemporaryIDRequest: // ピアID暫定割当
+		p, err := s.Registry.Temporary(ss.host, now, s.TemporaryPerHost)
+		if err != nil {
+			logln(`[WARN] ` + err.Error())
+			return ss.write(CodeBadRequest)
+		}
+		ss.peerID = p.PeerID
+		logln(`[INFO] ピア` + ss.host + `: ピアID暫定割当 ` + p.PeerID)
+		return ss.write(CodeTemporaryID, PeerIDPayload{PeerID: p.PeerID}.Fields()...)
+
+	case CodePortCheckRequest: // ポート開放確認 ピアID:ポート
+		req, err := ParsePortCheckRequest(m.Fields)
+		if err != nil || !s.owns(ss, req.PeerID) {
+			return ss.write(CodeBadRequest)
+		}
+		open := checkPortOpen(ctx, ss.host, strconv.Itoa(req.Port))
+		s.Registry.Update(req.PeerID, func(p *RegistryPeer) {
+			p.Port = req.Port
+			p.Global = open
+		})
+		logln(`[DEBUG] ピア`+req.PeerID+`: ポート開放 `, open)
+		return ss.write(CodePortCheck, PortCheckResult{Open: open}.Fields()...)
+
+	case CodePeerListRequest: // 接続先ピア情報
+		req, err := ParsePeerIDPayload(m.Fields)
+		if err != nil || !s.owns(ss, req.PeerID) {
+			return ss.write(CodeBadRequest)
+		}
+		return ss.write(CodePeerList, PeerListPayload{Peers: s.Registry.Candidates(req.PeerID, s.PeerListSize)}.Fields()...)
+
+	case CodeRegistrationRequest: // ピアID本割当 ピアID:ポート:地域:接続数:受入数
+		req, err := ParseRegistrationRequest(m.Fields)
+		if err != nil || !s.owns(ss, req.PeerID) || Area(req.Region) == `Undefined` {
+			return ss.write(CodeBadRequest)
+		}
+		s.Registry.Update(req.PeerID, func(p *RegistryPeer) {
+			p.Registered = true
+			p.Port = req.Port
+			p.Region = req.Region
+			p.Connections = req.Connections
+			p.Incoming = req.Incoming
+			p.LastSeen = now
+		})
+		logln(`[INFO] ピア` + req.PeerID + `: ピアID本割当 ` + Area(req.Region))
+		return ss.write(CodeRegistered, RegistrationResult{NumOfPeers: s.Registry.NumOfRegistered()}.Fields()...)
+
+	case CodeKeyRequest: // 鍵割当 ピアID
+		req, err := ParsePeerIDPayload(m.Fields)
+		if err != nil || !s.owns(ss, req.PeerID) {
+			return ss.write(CodeBadRequest)
+		}
+		p, _ := s.Registry.Get(req.PeerID)
+		if p.KeyHash != `` && now.Before(p.KeyExpire) {
+			return ss.write(CodeKeyAssigned) // 鍵割当済
+		}
+		return s.issueKey(ss, req.PeerID, CodeKey, now)
+
+	case CodeKeyReassignRequest: // 鍵再割当 ピアID+秘密鍵 (ピアID:秘密鍵も受け付けます)
+		req, err := ParseKeyReassignRequest(m.Fields)
+		if err != nil || !s.owns(ss, req.PeerID) {
+			return ss.write(CodeBadRequest)
+		}
+		p, _ := s.Registry.Get(req.PeerID)
+		if p.KeyHash != `` && p.KeyHash != secKeyHash(req.SecKey) && now.Before(p.KeyExpire) {
+			return ss.write(CodeKeyAssigned) // 別の鍵が有効です
+		}
+		return s.issueKey(ss, req.PeerID, CodeKeyReassigned, now)
+
+	case CodeTimeRequest: // プロトコル時刻
+		return ss.write(CodeTime, ProtocolTime{Time: now}.Fields()...)
+
+	case CodeEchoRequest: // エコー ピアID:接続数
+		req, err := ParseEchoRequest(m.Fields)
+		if err != nil {
+			return ss.write(CodeBadRequest)
+		}
+		ok := false
+		s.Registry.Update(req.PeerID, func(p *RegistryPeer) {
+			if p.Registered && p.Host == ss.host {
+				p.LastSeen = now
+				p.Connections = req.Connections
+				ok = true
+			}
+		})
+		if !ok { // 未登録か期限切れ、またはIPアドレスが変わったので、参加しなおしてもらいます
+			logln(`[DEBUG] ピア` + req.PeerID + `: エコー拒否`)
+			return ss.write(CodeRejoin)
+		}
+		ss.peerID = req.PeerID
+		return ss.write(CodeEcho)
+
+	case CodeRegionCountRequest: // 各地域ピア数
+		return ss.write(CodeRegionCount, s.Registry.PeerCountsByRegion().Fields()...)
+
+	case CodeConnectedPeersRequest: // 接続できたピアの通知 (返信なし)
+		if ss.peerID != `` {
+			c, _ := ParseConnectedPeers(m.Fields)
+			s.Registry.Update(ss.peerID, func(p *RegistryPeer) { p.Neighbors = c.PeerIDs })
+		}
+		return nil
+
+	default:
+		logln(`[DEBUG] ピア` + ss.host + `: 不明な要求 ` + m.Marshal())
+		return ss.write(CodeBadRequest)
+	}
+}
+
+// owns は、ピアIDが登録簿にあり、この接続元のものかを返します
+func (s *P2SServer) owns(ss *p2sSession, peerID string) bool {
+	p, ok := s.Registry.Get(peerID)
+	if !ok || p.Host != ss.host {
+		return false
+	}
+	ss.peerID = peerID
+	return true
+}
+
+// issueKey は、鍵を発行して、codeで返します
+func (s *P2SServer) issueKey(ss *p2sSession, peerID, code string, now time.Time) error {
+	k, err := IssuePeerKey(s.CAKey, s.KeyBits, now.Add(s.KeyLifetime))
+	if err != nil {
+		logln(`[WARN] ` + err.Error())
+		return ss.write(CodeBadRequest)
+	}
+	s.Registry.Update(peerID, func(p *RegistryPeer) {
+		p.KeyHash = secKeyHash(k.SecKey)
+		p.KeyExpire = k.Expire
+	})
+	logln(`[INFO] ピア` + peerID + `: 鍵発行`)
+	return ss.write(code, k.Fields()...)
+}
+
+// checkPortOpen は、host:portに接続し、ピアがバージョン要求(614)を送ってくるかを確かめます
+func checkPortOpen(ctx context.Context, host, port string) bool {
+	ctx, cancel := context.WithTimeout(ctx, serverPortCheckTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, `tcp`, net.JoinHostPort(host, port))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if err = conn.SetReadDeadline(time.Now().Add(serverPortCheckTimeout)); err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	var m Message
+	return m.Unmarshal(line) == nil && m.Code == CodePeerVersionRequest
+}
@@ -0,0 +1,144 @@
+package epsp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PeerKey は、サーバがピアに発行する鍵です
+type PeerKey struct {
+	SecKey string    // 秘密鍵(PKCS#8 DERのBASE64)
+	PubKey string    // 公開鍵(PKIX DERのBASE64)
+	Expire time.Time // 有効期限
+	KeySig string    // 公開鍵と有効期限に対する、ピア鍵認証局の署名(BASE64)
+}
+
+// String は、237/244の書式(秘密鍵:公開鍵:有効期限:鍵署名)にします
+func (k PeerKey) String() string {
+	return k.SecKey + `:` + k.PubKey + `:` + FormatProtocolTime(k.Expire) + `:` + k.KeySig
+}
+
+// IssuePeerKey は、bits長のRSA鍵を作り、有効期限expireとともにピア鍵認証局の秘密鍵caで署名します。
+// 署名は KeySignatureCheck で照合できます。
+func IssuePeerKey(ca *rsa.PrivateKey, bits int, expire time.Time) (k PeerKey, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		err = errors.Wrap(err, `鍵生成`)
+		return
+	}
+	sec, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		err = errors.Wrap(err, `秘密鍵変換`)
+		return
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		err = errors.Wrap(err, `公開鍵変換`)
+		return
+	}
+	k.Expire = expire.Truncate(time.Second)
+
+	hasher := sha1.New() // #nosec G401
+	hasher.Write(pub)
+	hasher.Write([]byte(FormatProtocolTime(k.Expire)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ca, crypto.SHA1, hasher.Sum(nil))
+	if err != nil {
+		err = errors.Wrap(err, `鍵署名`)
+		return
+	}
+
+	k.SecKey = base64.StdEncoding.EncodeToString(sec)
+	k.PubKey = base64.StdEncoding.EncodeToString(pub)
+	k.KeySig = base64.StdEncoding.EncodeToString(sig)
+	return
+}
+
+// secKeyHash は、登録簿に記録する秘密鍵のハッシュです
+func secKeyHash(secKey string) string {
+	h := sha256.Sum256([]byte(secKey))
+	return hex.EncodeToString(h[:])
+}
+
+// DecryptPrivateKey は、PEM形式のRSA秘密鍵(PKCS#1またはPKCS#8)を復号します
+func DecryptPrivateKey(key []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New(`秘密鍵書式異常`)
+	}
+	switch block.Type {
+	case `RSA PRIVATE KEY`:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case `PRIVATE KEY`:
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsakey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New(`秘密鍵がRSAではない`)
+		}
+		return rsakey, nil
+	default:
+		return nil, errors.Errorf(`秘密鍵種類異常 : %s`, block.Type)
+	}
+}
+
+// EncodePublicKey は、RSA公開鍵を、NewPeer に渡せるPEM形式にします
+func EncodePublicKey(key *rsa.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, `公開鍵変換`)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: `PUBLIC KEY`, Bytes: b}), nil
+}
+
+// EncodePrivateKey は、RSA秘密鍵をPEM形式(PKCS#8)にします
+func EncodePrivateKey(key *rsa.PrivateKey) ([]byte, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, `秘密鍵変換`)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: `PRIVATE KEY`, Bytes: b}), nil
+}
+
+// LoadOrCreatePrivateKey は、filenameからRSA秘密鍵を読み込みます。ファイルがなければbits長の鍵を作って書き込み、公開鍵を filename.pub に書き出して、createdをtrueにします。
+func LoadOrCreatePrivateKey(filename string, bits int) (key *rsa.PrivateKey, created bool, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err == nil {
+		key, err = DecryptPrivateKey(b)
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	if key, err = rsa.GenerateKey(rand.Reader, bits); err != nil {
+		err = errors.Wrap(err, `鍵生成`)
+		return
+	}
+	if b, err = EncodePrivateKey(key); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filename, b, 0600); err != nil {
+		return
+	}
+	if b, err = EncodePublicKey(&key.PublicKey); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filename+`.pub`, b, 0644); err != nil { // #nosec G306
+		return
+	}
+	created = true
+	return
+}
@@ -0,0 +1,238 @@
+package epsp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxPeerID は、割り当てるピアIDの最大値です。超えたら1に戻り、使われていないIDを探します。
+const maxPeerID = 99999
+
+// RegistryPeer は、サーバが管理するピアの情報です
+type RegistryPeer struct {
+	PeerID      string    `json:"peer_id"`
+	Host        string    `json:"host"` // 暫定割当を要求した接続元のIPアドレス
+	Port        int       `json:"port,omitempty"`
+	Region      string    `json:"region,omitempty"`
+	Incoming    uint64    `json:"incoming,omitempty"`    // 受け入れるピア数の上限(ポート未開放なら0)
+	Connections uint64    `json:"connections,omitempty"` // 本割当とエコーで通知された接続数
+	Global      bool      `json:"global"`                // ポート開放確認に成功した
+	Registered  bool      `json:"registered"`            // 本割当済
+	Created     time.Time `json:"created"`
+	LastSeen    time.Time `json:"last_seen"`
+	Neighbors   []string  `json:"neighbors,omitempty"`  // 155で通知された接続先のピアID
+	KeyHash     string    `json:"key_hash,omitempty"`   // 発行した秘密鍵のSHA-256
+	KeyExpire   time.Time `json:"key_expire,omitempty"` // 発行した鍵の有効期限
+}
+
+// Registry は、サーバのピア登録簿です。ファイル名を指定すると、JSONで保存します。
+type Registry struct {
+	mu       sync.Mutex
+	filename string
+	dirty    bool
+	NextID   int                      `json:"next_id"`
+	Peers    map[string]*RegistryPeer `json:"peers"`
+}
+
+// LoadRegistry は、filenameからピア登録簿を読み込みます。ファイルがなければ空の登録簿を返します。filenameが空ならメモリだけに保持します。
+func LoadRegistry(filename string) (*Registry, error) {
+	r := &Registry{filename: filename, NextID: 1, Peers: make(map[string]*RegistryPeer)}
+	if filename == `` {
+		return r, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, `ピア登録簿読込`)
+	}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrap(err, `ピア登録簿解析`)
+	}
+	if r.Peers == nil {
+		r.Peers = make(map[string]*RegistryPeer)
+	}
+	if r.NextID < 1 || r.NextID > maxPeerID {
+		r.NextID = 1
+	}
+	return r, nil
+}
+
+// Save は、変更があればピア登録簿をファイルに書き込みます。一時ファイルに書いてから置き換えます。
+func (r *Registry) Save() error {
+	r.mu.Lock()
+	if r.filename == `` || !r.dirty {
+		r.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(r, ``, `  `)
+	r.dirty = false
+	r.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, `ピア登録簿変換`)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.filename), filepath.Base(r.filename)+`.*`)
+	if err != nil {
+		return errors.Wrap(err, `ピア登録簿保存`)
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, `ピア登録簿保存`)
+	}
+	return nil
+}
+
+// Temporary は、hostに暫定ピアIDを割り当てます。hostに本割当前の暫定ピアIDがすでにlimit個あれば、新しいIDは使わず、
+// そのうち最も古いものを割り当てなおします。一つの接続元がIDを使い尽くさないようにするためです。limitが0以下なら上限はありません。
+func (r *Registry) Temporary(host string, now time.Time, limit int) (RegistryPeer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limit > 0 {
+		var oldest *RegistryPeer
+		pending := 0
+		for _, p := range r.Peers {
+			if p.Registered || p.Host != host {
+				continue
+			}
+			pending++
+			if oldest == nil || p.Created.Before(oldest.Created) || (p.Created.Equal(oldest.Created) && p.PeerID < oldest.PeerID) {
+				oldest = p
+			}
+		}
+		if pending >= limit {
+			*oldest = RegistryPeer{PeerID: oldest.PeerID, Host: host, Created: now, LastSeen: now}
+			r.dirty = true
+			return *oldest, nil
+		}
+	}
+	for i := 0; i < maxPeerID; i++ {
+		id := strconv.Itoa(r.NextID)
+		if r.NextID++; r.NextID > maxPeerID {
+			r.NextID = 1
+		}
+		if _, used := r.Peers[id]; !used {
+			p := &RegistryPeer{PeerID: id, Host: host, Created: now, LastSeen: now}
+			r.Peers[id] = p
+			r.dirty = true
+			return *p, nil
+		}
+	}
+	return RegistryPeer{}, errors.New(`ピアIDの空きがありません`)
+}
+
+// Get は、ピアIDの情報の写しを返します
+func (r *Registry) Get(peerID string) (RegistryPeer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.Peers[peerID]
+	if !ok {
+		return RegistryPeer{}, false
+	}
+	return *p, true
+}
+
+// Update は、ピアIDの情報をfで更新します。ピアIDがなければfalseを返します。
+func (r *Registry) Update(peerID string, f func(p *RegistryPeer)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.Peers[peerID]
+	if !ok {
+		return false
+	}
+	f(p)
+	r.dirty = true
+	return true
+}
+
+// Remove は、ピアIDを登録簿から消します
+func (r *Registry) Remove(peerID string) {
+	r.mu.Lock()
+	if _, ok := r.Peers[peerID]; ok {
+		delete(r.Peers, peerID)
+		r.dirty = true
+	}
+	r.mu.Unlock()
+}
+
+// Expire は、本割当後echoTimeoutの間エコーがないピアと、暫定割当後temporaryTimeoutの間本割当がないピアを消し、消したピアIDを返します
+func (r *Registry) Expire(now time.Time, echoTimeout, temporaryTimeout time.Duration) (expired []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, p := range r.Peers {
+		if (p.Registered && now.Sub(p.LastSeen) > echoTimeout) || (!p.Registered && now.Sub(p.Created) > temporaryTimeout) {
+			delete(r.Peers, id)
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) != 0 {
+		r.dirty = true
+		sort.Strings(expired)
+	}
+	return
+}
+
+// NumOfRegistered は、本割当済のピア数を返します
+func (r *Registry) NumOfRegistered() (n uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.Peers {
+		if p.Registered {
+			n++
+		}
+	}
+	return
+}
+
+// PeerCountsByRegion は、本割当済のピアの地域ごとの数を返します
+func (r *Registry) PeerCountsByRegion() PeerCounts {
+	r.mu.Lock()
+	counts := make(map[string]uint64)
+	for _, p := range r.Peers {
+		if p.Registered && p.Region != `` {
+			counts[p.Region]++
+		}
+	}
+	r.mu.Unlock()
+	return NewPeerCountsFromMap(counts)
+}
+
+// Candidates は、exceptを除く、接続を受け入れられるピアを最大n個、接続数の少ない順(同数なら無作為)に、「IP,ポート,ピアID」形式で返します
+func (r *Registry) Candidates(except string, n int) []string {
+	r.mu.Lock()
+	var ps []RegistryPeer
+	for id, p := range r.Peers {
+		if id != except && p.Registered && p.Global && p.Port != 0 && p.Connections < p.Incoming {
+			ps = append(ps, *p)
+		}
+	}
+	r.mu.Unlock()
+
+	rand.Shuffle(len(ps), func(i, j int) { ps[i], ps[j] = ps[j], ps[i] })
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].Connections < ps[j].Connections })
+	if len(ps) > n {
+		ps = ps[:n]
+	}
+	list := make([]string, 0, len(ps))
+	for _, p := range ps {
+		list = append(list, FormatIPPortPeerID(p.Host, strconv.Itoa(p.Port), p.PeerID))
+	}
+	return list
+}
@@ -0,0 +1,200 @@
+package epsp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r, err := LoadRegistry(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRegistryTemporaryWrapAround(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newTestRegistry(t)
+	r.NextID = maxPeerID
+	r.Peers[`1`] = &RegistryPeer{PeerID: `1`, Registered: true}
+
+	// 最大値の次は1に戻り、使われているIDは飛ばします。
+	var ids []string
+	for i := 0; i < 3; i++ {
+		p, err := r.Temporary(`192.0.2.1`, now, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, p.PeerID)
+	}
+	if want := []string{`99999`, `2`, `3`}; !reflect.DeepEqual(ids, want) {
+		t.Errorf(`ids = %v, want %v`, ids, want)
+	}
+
+	// 消したIDは、一周したら使いなおします。
+	for i := 4; i <= maxPeerID-1; i++ {
+		r.Peers[strconv.Itoa(i)] = &RegistryPeer{PeerID: strconv.Itoa(i)}
+	}
+	r.Remove(`2`)
+	if p, err := r.Temporary(`192.0.2.1`, now, 0); err != nil || p.PeerID != `2` {
+		t.Errorf(`Temporary = %+v, %v`, p, err)
+	}
+	if p, err := r.Temporary(`192.0.2.1`, now, 0); err == nil {
+		t.Errorf(`Temporary on a full registry = %+v`, p)
+	}
+}
+
+func TestRegistryTemporaryPerHost(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := newTestRegistry(t)
+	temporary := func(host string) RegistryPeer {
+		t.Helper()
+		p, err := r.Temporary(host, clock.Now(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Second)
+		return p
+	}
+	first := temporary(`192.0.2.1`)
+	second := temporary(`192.0.2.1`)
+	r.Update(second.PeerID, func(p *RegistryPeer) { p.Port = 6911 })
+
+	// 上限に達したら、最も古い暫定ピアIDを割り当てなおします。
+	reused := temporary(`192.0.2.1`)
+	if reused.PeerID != first.PeerID || !reused.Created.Equal(first.Created.Add(2*time.Second)) {
+		t.Errorf(`reused = %+v`, reused)
+	}
+	if again := temporary(`192.0.2.1`); again.PeerID != second.PeerID || again.Port != 0 {
+		t.Errorf(`reused = %+v`, again)
+	}
+
+	// 本割当済のIDと、他の接続元のIDは数えません。
+	r.Update(first.PeerID, func(p *RegistryPeer) { p.Registered = true })
+	if p := temporary(`192.0.2.1`); p.PeerID == first.PeerID || p.PeerID == second.PeerID {
+		t.Errorf(`reused = %+v`, p)
+	}
+	if p := temporary(`192.0.2.2`); p.PeerID != `4` {
+		t.Errorf(`other host = %+v`, p)
+	}
+	if len(r.Peers) != 4 {
+		t.Errorf(`Peers = %d`, len(r.Peers))
+	}
+}
+
+func TestRegistryExpire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newTestRegistry(t)
+	r.Peers = map[string]*RegistryPeer{
+		`1`:  {PeerID: `1`, Registered: true, Created: now.Add(-2 * time.Hour), LastSeen: now.Add(-31 * time.Minute)},
+		`2`:  {PeerID: `2`, Registered: true, Created: now.Add(-2 * time.Hour), LastSeen: now.Add(-30 * time.Minute)},
+		`3`:  {PeerID: `3`, Created: now.Add(-11 * time.Minute), LastSeen: now},
+		`4`:  {PeerID: `4`, Created: now.Add(-10 * time.Minute), LastSeen: now.Add(-10 * time.Minute)},
+		`10`: {PeerID: `10`, Registered: true, LastSeen: now.Add(-time.Hour)},
+	}
+	if got := r.Expire(now, 30*time.Minute, 10*time.Minute); !reflect.DeepEqual(got, []string{`1`, `10`, `3`}) {
+		t.Errorf(`expired = %v`, got)
+	}
+	if _, ok := r.Get(`2`); !ok || len(r.Peers) != 2 || !r.dirty {
+		t.Errorf(`Peers = %v, dirty = %v`, r.Peers, r.dirty)
+	}
+	r.dirty = false
+	if got := r.Expire(now, 30*time.Minute, 10*time.Minute); got != nil || r.dirty {
+		t.Errorf(`expired = %v, dirty = %v`, got, r.dirty)
+	}
+}
+
+func TestRegistryCandidates(t *testing.T) {
+	r := newTestRegistry(t)
+	r.Peers = map[string]*RegistryPeer{
+		`1`: {PeerID: `1`, Host: `192.0.2.1`, Port: 6911, Registered: true, Global: true, Incoming: 10, Connections: 5},
+		`2`: {PeerID: `2`, Host: `192.0.2.2`, Port: 6911, Registered: true, Global: true, Incoming: 10, Connections: 1},
+		`3`: {PeerID: `3`, Host: `2001:db8::3`, Port: 6912, Registered: true, Global: true, Incoming: 10, Connections: 3},
+		`4`: {PeerID: `4`, Host: `192.0.2.4`, Port: 6911, Registered: true, Incoming: 10},                              // ポート未開放
+		`5`: {PeerID: `5`, Host: `192.0.2.5`, Port: 6911, Registered: true, Global: true, Incoming: 2, Connections: 2}, // 受入数いっぱい
+		`6`: {PeerID: `6`, Host: `192.0.2.6`, Port: 6911, Global: true, Incoming: 10},                                  // 本割当前
+		`7`: {PeerID: `7`, Host: `192.0.2.7`, Registered: true, Global: true, Incoming: 10},                            // ポート不明
+	}
+	want := []string{`192.0.2.2,6911,2`, `[2001:db8::3],6912,3`, `192.0.2.1,6911,1`}
+	if got := r.Candidates(``, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf(`Candidates = %v, want %v`, got, want)
+	}
+	if got := r.Candidates(`2`, 10); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf(`Candidates except 2 = %v`, got)
+	}
+	if got := r.Candidates(``, 2); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf(`Candidates(2) = %v`, got)
+	}
+	if got := newTestRegistry(t).Candidates(``, 10); got == nil || len(got) != 0 {
+		t.Errorf(`Candidates of empty registry = %#v`, got)
+	}
+}
+
+func TestRegistrySaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, `registry.json`)
+
+	// ファイルがなければ空の登録簿で、変更がなければ書き込みません。
+	r, err := LoadRegistry(filename)
+	if err != nil || r.NextID != 1 || len(r.Peers) != 0 {
+		t.Fatalf(`LoadRegistry = %+v, %v`, r, err)
+	}
+	if err = r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf(`saved without changes: %v`, err)
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p, err := r.Temporary(`192.0.2.1`, now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Update(p.PeerID, func(p *RegistryPeer) {
+		p.Registered = true
+		p.Port = 6911
+		p.Region = `250`
+		p.Neighbors = []string{`2`, `3`}
+		p.KeyHash = secKeyHash(`c2Vj`)
+		p.KeyExpire = now.Add(time.Hour)
+	})
+	if err = r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRegistry(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NextID != 2 || !reflect.DeepEqual(loaded.Peers, r.Peers) {
+		t.Errorf(`loaded = %+v, want %+v`, loaded.Peers[`1`], r.Peers[`1`])
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf(`temporary files left: %d files`, len(files))
+	}
+
+	// 範囲外の次のIDは1に戻し、壊れたファイルはエラーです。
+	if err = ioutil.WriteFile(filename, []byte(`{"next_id":100000}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = LoadRegistry(filename); err != nil || r.NextID != 1 || r.Peers == nil {
+		t.Errorf(`LoadRegistry = %+v, %v`, r, err)
+	}
+	if err = ioutil.WriteFile(filename, []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadRegistry(filename); err == nil {
+		t.Error(`loaded a broken registry`)
+	}
+}
@@ -0,0 +1,177 @@
+package epsp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestSession は、接続元がhostのセッションと、サーバの返答を読む Reader を返します
+func newTestSession(t *testing.T, host string) (*p2sSession, *bufio.Reader) {
+	t.Helper()
+	local, remote := tcpPair(t)
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return &p2sSession{conn: local, r: bufio.NewReader(local), host: host}, bufio.NewReader(remote)
+}
+
+// reply は、サーバの返答を一つ読みます
+func reply(t *testing.T, r *bufio.Reader) Message {
+	t.Helper()
+	var m Message
+	if err := m.Unmarshal(readLine(t, r)); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestP2SServerKeyRules(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewP2SServer(newTestRegistry(t), caKey)
+	s.Clock = clock
+	s.Registry.Peers[`1`] = &RegistryPeer{PeerID: `1`, Host: `192.0.2.1`, Registered: true}
+	ss, r := newTestSession(t, `192.0.2.1`)
+
+	request := func(code string, fields ...string) Message {
+		t.Helper()
+		if err := s.handle(context.Background(), ss, NewMessage(code, fields...)); err != nil {
+			t.Fatal(err)
+		}
+		return reply(t, r)
+	}
+	issued := func(m Message, code string) PeerKey {
+		t.Helper()
+		if m.Code != code {
+			t.Fatalf(`reply = %s, want %s`, m.Marshal(), code)
+		}
+		k, err := ParsePeerKey(m.Fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := s.Registry.Get(`1`)
+		if p.KeyHash != secKeyHash(k.SecKey) || !p.KeyExpire.Equal(clock.Now().Add(s.KeyLifetime)) || !k.Expire.Equal(p.KeyExpire) {
+			t.Errorf(`registry = %+v, key expire %v`, p, k.Expire)
+		}
+		return k
+	}
+
+	// 117: 有効な鍵がなければ発行し、あれば鍵割当済です。
+	first := issued(request(CodeKeyRequest, `1`), CodeKey)
+	if m := request(CodeKeyRequest, `1`); m.Code != CodeKeyAssigned {
+		t.Errorf(`second key request = %s`, m.Marshal())
+	}
+
+	// 124: 発行した鍵と同じ秘密鍵なら、有効期限内でも発行しなおします。
+	second := issued(request(CodeKeyReassignRequest, KeyReassignRequest{PeerID: `1`, SecKey: first.SecKey}.Fields()...), CodeKeyReassigned)
+	if second.SecKey == first.SecKey {
+		t.Error(`same key reissued`)
+	}
+
+	// 124: 別の鍵が有効なら、鍵割当済です。
+	if m := request(CodeKeyReassignRequest, KeyReassignRequest{PeerID: `1`, SecKey: first.SecKey}.Fields()...); m.Code != CodeKeyAssigned {
+		t.Errorf(`reassign with an old key = %s`, m.Marshal())
+	}
+
+	// 有効期限を過ぎれば、どの秘密鍵でも発行しなおします。
+	clock.Advance(s.KeyLifetime)
+	issued(request(CodeKeyReassignRequest, KeyReassignRequest{PeerID: `1`, SecKey: first.SecKey}.Fields()...), CodeKeyReassigned)
+	clock.Advance(s.KeyLifetime)
+	issued(request(CodeKeyRequest, `1`), CodeKey)
+
+	// 他の接続元のピアIDと、登録簿にないピアIDには発行しません。
+	other, otherReply := newTestSession(t, `192.0.2.2`)
+	for _, m := range []Message{NewMessage(CodeKeyRequest, `1`), NewMessage(CodeKeyReassignRequest, KeyReassignRequest{PeerID: `1`, SecKey: first.SecKey}.Fields()...)} {
+		if err := s.handle(context.Background(), other, m); err != nil {
+			t.Fatal(err)
+		}
+		if got := reply(t, otherReply); got.Code != CodeBadRequest {
+			t.Errorf(`%s from another host = %s`, m.Code, got.Marshal())
+		}
+	}
+	if m := request(CodeKeyRequest, `2`); m.Code != CodeBadRequest {
+		t.Errorf(`unknown peer = %s`, m.Marshal())
+	}
+}
+
+// portCheckListener は、接続を受け付けるとgreetingを送って切断するピアを起動し、そのポートを返します
+func portCheckListener(t *testing.T, greeting string) string {
+	t.Helper()
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(greeting))
+			conn.Close()
+		}
+	}()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestCheckPortOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		port string
+		want bool
+	}{
+		{`peer`, portCheckListener(t, "614 1\r\n"), true},
+		{`other message`, portCheckListener(t, "611 1\r\n"), false},
+		{`not EPSP`, portCheckListener(t, "SSH-2.0-OpenSSH\r\n"), false},
+		{`silent`, portCheckListener(t, ``), false},
+		{`closed`, closedPort(t), false},
+	}
+	for _, tt := range tests {
+		if got := checkPortOpen(context.Background(), `127.0.0.1`, tt.port); got != tt.want {
+			t.Errorf(`%s: checkPortOpen = %v, want %v`, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeConnReleasesGoroutines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewP2SServer(newTestRegistry(t), nil)
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(ctx, l) }()
+	time.Sleep(10 * time.Millisecond)
+	base := runtime.NumGoroutine()
+
+	// 接続が終われば、サーバを止めなくても、接続ごとのgoroutineは残りません。
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial(`tcp`, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		readLine(t, r)
+		if _, err = conn.Write([]byte("131 1 0.34r\r\n119 1\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		readLine(t, r)
+		if line := readLine(t, r); line != CodeEnd+` 1` {
+			t.Fatalf(`end = %q`, line)
+		}
+		conn.Close()
+	}
+	waitUntil(t, func() bool { return runtime.NumGoroutine() <= base })
+}
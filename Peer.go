@@ -1,6 +1,7 @@
 package epsp
 
 import (
+	"context"
 	"crypto/rsa"
 	"os"
 	"strings"
@@ -12,30 +13,50 @@ import (
 
 // Peer はピアに関するデータを保持します。
 type Peer struct {
-	PeerID             string
-	BootTime           time.Time
-	ProtocolTimeDiff   time.Duration
-	MyAgent            []string
-	EPSPServer         *P2SClient
-	Clients            P2PPeers
-	Servers            P2PPeers
-	hosts              []string
-	region             string
-	incoming           uint64
-	serverKey          *rsa.PublicKey
-	peerKey            *rsa.PublicKey
-	keyfilename        string
-	secKey             string
-	pubKey             string
-	keyExpire          time.Time
-	keySig             string
-	PeerCountsByRegion PeerCounts
-	sigmap             sync.Map
-	traceecho          sync.Map
-	serverIsRunning    sync.Once
-	serverErrorCount   uint16
-	candidatePeers     []string
-	Global             bool
+	peerID           string
+	BootTime         time.Time
+	MyAgent          []string
+	EPSPServer       *P2SClient
+	Clients          P2PPeers
+	Servers          P2PPeers
+	hosts            []string
+	region           string
+	incoming         uint64
+	serverKey        *rsa.PublicKey
+	peerKey          *rsa.PublicKey
+	keyfilename      string
+	keyfileMu        sync.Mutex // 鍵ファイルの書き込みを直列にします。鍵の更新は、別のgoroutineから保存します
+	keys             *KeyManager
+	regionCounts     PeerCounts
+	sigmap           sync.Map
+	traceecho        sync.Map
+	traces           sync.Map
+	traceMu          sync.Mutex
+	lastTrace        time.Time       // TraceLimited で最後に調査エコーを送った時刻です
+	netCtx           context.Context // 待ち受けとピア接続の context です。参加しなおすときに終了させます
+	stopNet          context.CancelFunc
+	serversRunning   bool
+	serverErrorCount uint16
+	candidatePeers   []string
+	addressBook      *AddressBook
+	serverless       bool
+	listenAddrs      []string
+	advertisedPort   int
+	portMapper       PortMapper
+	mappedPort       int
+	mappedTime       time.Time
+	global           bool
+	state            PeerState
+	lastEcho         time.Time
+	stateHandlers    []func(from, to PeerState)
+	statusHandlers   []func(regions bool)
+	stateMu          sync.RWMutex
+	events           *EventStream
+	lastSession      *ServerSession
+	sensing          *SensingAggregator
+	peerCounts       *PeerCountSeries
+	clock            Clock
+	protocolClock    *ProtocolClock
 
 	usercmd func(code string, retval ...string)
 }
@@ -49,8 +70,15 @@ func NewPeer(hosts []string, region string, incoming uint64, serverKey, peerKey
 	peer.usercmd = usercmd
 	peer.region = region
 	peer.incoming = incoming
-	peer.Clients = make([]*P2PPeer, 0)
-	peer.Servers = make([]*P2PPeer, 0)
+	peer.sensing = NewSensingAggregator(peer)
+	peer.clock = SystemClock
+	peer.peerCounts = NewPeerCountSeries(peer.clock)
+	peer.protocolClock = NewProtocolClock(peer.clock)
+	peer.events = NewEventStream(peer.clock)
+	peer.keys = NewKeyManager(peer.clock, peer.protocolClock)
+	peer.addressBook = NewAddressBook(peer.clock)
+	peer.peerCounts.OnOutage(func(o RegionOutage) { peer.events.Publish(RegionOutageCode, ``, o) })
+	peer.keys.OnEvent(func(code string, st KeyStatus) { peer.events.Publish(code, ``, st) })
 
 	if len(hosts) == 0 {
 		return nil, errors.New(`No hosts`)
@@ -71,57 +99,108 @@ func NewPeer(hosts []string, region string, incoming uint64, serverKey, peerKey
 	if err != nil {
 		logln(`[WARN] LoadKey ` + err.Error())
 	}
-	peer.BootTime = time.Now()
+	peer.BootTime = peer.clock.Now()
 
 	return peer, nil
 
 }
 
+// SetListenAddrs は、ピアからの接続を待ち受けるアドレス(host:port)を設定します。
+// 設定しない場合は、Loopに渡されたポートで、すべてのインターフェースをデュアルスタックで待ち受けます。
+// IPv4とIPv6で別々に待ち受けるには、"0.0.0.0:6911", "[::]:6911" のように複数指定します。
+func (peer *Peer) SetListenAddrs(addrs ...string) {
+	peer.listenAddrs = addrs
+}
+
+// Sensing は、地震感知情報(555)をまとめる SensingAggregator を返します
+func (peer *Peer) Sensing() *SensingAggregator {
+	return peer.sensing
+}
+
+// PeerCounts は、地域ごとのピア数の時系列を返します
+func (peer *Peer) PeerCounts() *PeerCountSeries {
+	return peer.peerCounts
+}
+
+// SetClock は、時刻とタイマーの取得元を設定します。Loop を呼ぶ前に設定してください。
+func (peer *Peer) SetClock(c Clock) {
+	peer.clock = clockOrSystem(c)
+	peer.protocolClock = NewProtocolClock(peer.clock)
+	peer.keys.setClock(peer.clock, peer.protocolClock)
+	peer.addressBook.setClock(peer.clock)
+	peer.events.setClock(peer.clock)
+	peer.peerCounts.setClock(peer.clock)
+	peer.BootTime = peer.clock.Now()
+}
+
+// ProtocolClock は、サーバのプロトコル時刻に合わせた時計を返します
+func (peer *Peer) ProtocolClock() *ProtocolClock {
+	return peer.protocolClock
+}
+
+// Keys は、サーバから割り当てられた鍵を管理する KeyManager を返します
+func (peer *Peer) Keys() *KeyManager {
+	return peer.keys
+}
+
+// AddressBook は、サーバや隣接ピアから知らされたピアのアドレス帳を返します
+func (peer *Peer) AddressBook() *AddressBook {
+	return peer.addressBook
+}
+
+// Events は、受理したメッセージのイベントを配信するEventStreamを返します
+func (peer *Peer) Events() *EventStream {
+	return peer.events
+}
+
 // NumOfConnectedPeers は、接続中ピアの数を返します
 func (peer *Peer) NumOfConnectedPeers() (n uint64) {
 	return peer.Clients.NumOfConnectedPeers() + peer.Servers.NumOfConnectedPeers()
 }
 
-// WriteExceptFrom は、from以外へssを送信します
-func (peer *Peer) WriteExceptFrom(from *P2PPeer, ss ...string) {
-	for i := range peer.Clients {
-		if from != nil && peer.Clients[i].GetPeerID() == from.GetPeerID() {
-			logln("[DEBUG] ピア" + peer.Clients[i].GetPeerID() + `: 送出しない `)
-		} else if peer.Clients[i].IsConn() {
-			if err := peer.Clients[i].Write(ss...); err == nil {
-				logln("[DEBUG] ピア" + peer.Clients[i].GetPeerID() + `: 送出 `)
-			} else {
-				logln("[WARN] ピア" + peer.Clients[i].GetPeerID() + `: 送出不可 ` + err.Error())
-			}
-		} else {
-			logln("[DEBUG] ピア" + peer.Clients[i].GetPeerID() + `: 未接続`)
-		}
+// WriteExceptFrom は、from以外へmを送信します。相手のプロトコルバージョンが理解しないコードなら送りません。
+func (peer *Peer) WriteExceptFrom(from *P2PPeer, m Message) {
+	line := m.Marshal()
+	clients, servers := peer.Clients.Snapshot(), peer.Servers.Snapshot()
+	for i := range clients {
+		peer.writeTo(clients[i], from, m.Code, line)
 	}
-	for i := range peer.Servers {
-		if from != nil && peer.Servers[i].GetPeerID() == from.GetPeerID() {
-			logln("[DEBUG] ピア" + peer.Servers[i].GetPeerID() + `: 送出しない `)
-		} else if peer.Servers[i].IsConn() {
-			if err := peer.Servers[i].Write(ss...); err == nil {
-				logln("[DEBUG] ピア" + peer.Servers[i].GetPeerID() + `: 送出 `)
-			} else {
-				logln("[WARN] ピア" + peer.Servers[i].GetPeerID() + `: 送出不可 ` + err.Error())
-			}
-		} else {
-			logln("[DEBUG] ピア" + peer.Servers[i].GetPeerID() + `: 未接続`)
-		}
+	for i := range servers {
+		peer.writeTo(servers[i], from, m.Code, line)
+	}
+}
+
+func (peer *Peer) writeTo(p, from *P2PPeer, code, line string) {
+	if from != nil && p.GetPeerID() == from.GetPeerID() {
+		logln("[DEBUG] ピア" + p.GetPeerID() + `: 送出しない `)
+		return
+	}
+	if !p.IsConn() {
+		logln("[DEBUG] ピア" + p.GetPeerID() + `: 未接続`)
+		return
+	}
+	if !p.Supports(code) {
+		logln("[DEBUG] ピア" + p.GetPeerID() + `: プロトコルバージョン ` + p.Version().String() + ` には送出しない ` + code)
+		return
+	}
+	if err := p.Write(line); err == nil {
+		logln("[DEBUG] ピア" + p.GetPeerID() + `: 送出 `)
+	} else {
+		logln("[WARN] ピア" + p.GetPeerID() + `: 送出不可 ` + err.Error())
 	}
 }
 
 // PeerIDToP2PPeer は、peeridに対応するP2PPeerを返します。対応するP2PPeerがなければnilを返します。
 func (peer *Peer) PeerIDToP2PPeer(peerid string) *P2PPeer {
-	for i := range peer.Clients {
-		if peer.Clients[i].PeerID == peerid {
-			return peer.Clients[i]
+	clients, servers := peer.Clients.Snapshot(), peer.Servers.Snapshot()
+	for i := range clients {
+		if clients[i].PeerID == peerid {
+			return clients[i]
 		}
 	}
-	for i := range peer.Servers {
-		if peer.Servers[i].PeerID == peerid {
-			return peer.Servers[i]
+	for i := range servers {
+		if servers[i].PeerID == peerid {
+			return servers[i]
 		}
 	}
 	return nil
@@ -5,6 +5,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
 type peerCount struct {
@@ -44,6 +46,9 @@ func (p PeerCounts) GoogleChart() []byte {
 func NewPeerCount(recvdata2 string) (peerCountByRegion PeerCounts) {
 	for _, regpeer := range strings.Split(recvdata2, `;`) {
 		rp := strings.Split(regpeer, `,`)
+		if len(rp) != 2 {
+			continue // ピアがいない場合は空です
+		}
 		if peerct, err := strconv.ParseUint(rp[1], 10, 64); err == nil {
 			pct := peerCount{Region: rp[0], Count: peerct}
 			peerCountByRegion = append(peerCountByRegion, pct)
@@ -52,6 +57,44 @@ func NewPeerCount(recvdata2 string) (peerCountByRegion PeerCounts) {
 	return
 }
 
+// parsePeerCount は、NewPeerCount と同じ書式を読みます。書式が異なる地域があれば、エラーにします。
+// 空の区切り(ピアがいない場合、末尾の「;」、「;;」)は飛ばします。
+func parsePeerCount(recvdata2 string) (peerCountByRegion PeerCounts, err error) {
+	for _, regpeer := range strings.Split(recvdata2, `;`) {
+		if regpeer == `` {
+			continue
+		}
+		rp := strings.Split(regpeer, `,`)
+		if len(rp) != 2 || rp[0] == `` {
+			return nil, errors.New(`地域ピア数 書式異常: ` + regpeer)
+		}
+		peerct, err := strconv.ParseUint(rp[1], 10, 64)
+		if err != nil {
+			return nil, errors.New(`地域ピア数 ピア数異常: ` + regpeer)
+		}
+		peerCountByRegion = append(peerCountByRegion, peerCount{Region: rp[0], Count: peerct})
+	}
+	return
+}
+
+// NewPeerCountsFromMap は、地域コードごとのピア数からPeerCountsを作ります。地域コード順に並べます。
+func NewPeerCountsFromMap(m map[string]uint64) (p PeerCounts) {
+	for region, count := range m {
+		p = append(p, peerCount{Region: region, Count: count})
+	}
+	sort.Slice(p, func(i, j int) bool { return p[i].Region < p[j].Region })
+	return
+}
+
+// Encode は、561/247の書式(地域,ピア数;...)にします
+func (p PeerCounts) Encode() string {
+	ss := make([]string, 0, len(p))
+	for _, v := range p {
+		ss = append(ss, v.GetRegion()+`,`+strconv.FormatUint(v.GetCount(), 10))
+	}
+	return strings.Join(ss, `;`)
+}
+
 func (p PeerCounts) String() string {
 
 	const maxregion = 8
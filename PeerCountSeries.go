@@ -0,0 +1,247 @@
+package epsp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RegionOutageCode は、PeerCountSeries が EventStream に発行する地域障害のイベントのコードです
+const RegionOutageCode = `outage`
+
+const (
+	// DefaultPeerCountRetention は、地域ごとのピア数を保持する期間です
+	DefaultPeerCountRetention = 7 * 24 * time.Hour
+	// DefaultOutageDrop は、地域障害と見なすピア数の減少率です
+	DefaultOutageDrop = 0.5
+	// DefaultOutageMinPeers は、地域障害を判定する地域の最小ピア数です。これより少ない地域は揺らぎが大きいので判定しません。
+	DefaultOutageMinPeers = 5
+	// outageBaseline は、地域障害の判定で比較する直前の期間です
+	outageBaseline = 1 * time.Hour
+)
+
+// PeerCountSample は、ある時刻の地域ごとのピア数です
+type PeerCountSample struct {
+	Time    time.Time         `json:"time"`
+	Total   uint64            `json:"total"`
+	Regions map[string]uint64 `json:"regions"`
+}
+
+// RegionOutage は、地域のピア数の急な減少です
+type RegionOutage struct {
+	Time   time.Time `json:"time"`
+	Region string    `json:"region"`
+	Area   string    `json:"area"`
+	Before uint64    `json:"before"` // 直前の平均ピア数
+	After  uint64    `json:"after"`
+	Drop   float64   `json:"drop"` // 減少率
+}
+
+// PeerCountSeries は、561と各地域ピア数(247)から、地域ごとのピア数の時系列を保持します。
+// 地域のピア数が直前の平均から OutageDrop 以上減った場合は、地域障害として通知します。
+type PeerCountSeries struct {
+	Retention  time.Duration
+	OutageDrop float64
+	MinPeers   uint64
+
+	clock    Clock
+	mu       sync.RWMutex
+	samples  []PeerCountSample
+	handlers []func(RegionOutage)
+}
+
+// NewPeerCountSeries は、PeerCountSeries のコンストラクタです。ServeHTTP の現在時刻はclockから取ります。clockがnilなら SystemClock を使います。
+func NewPeerCountSeries(clock Clock) *PeerCountSeries {
+	return &PeerCountSeries{
+		Retention:  DefaultPeerCountRetention,
+		OutageDrop: DefaultOutageDrop,
+		MinPeers:   DefaultOutageMinPeers,
+		clock:      clockOrSystem(clock),
+	}
+}
+
+func (s *PeerCountSeries) setClock(clock Clock) {
+	s.mu.Lock()
+	s.clock = clockOrSystem(clock)
+	s.mu.Unlock()
+}
+
+// OnOutage は、地域障害を受け取る関数を登録します
+func (s *PeerCountSeries) OnOutage(f func(RegionOutage)) {
+	s.mu.Lock()
+	s.handlers = append(s.handlers, f)
+	s.mu.Unlock()
+}
+
+// Add は、時刻tの地域ごとのピア数を加え、検出した地域障害を返します
+func (s *PeerCountSeries) Add(t time.Time, pc PeerCounts) (outages []RegionOutage) {
+	sample := PeerCountSample{Time: t, Regions: make(map[string]uint64, len(pc))}
+	for _, c := range pc {
+		sample.Regions[c.GetRegion()] += c.GetCount()
+		sample.Total += c.GetCount()
+	}
+
+	s.mu.Lock()
+	outages = s.detect(sample)
+	s.samples = append(s.samples, sample)
+	i := sort.Search(len(s.samples), func(i int) bool { return t.Sub(s.samples[i].Time) <= s.Retention })
+	s.samples = append([]PeerCountSample(nil), s.samples[i:]...)
+	handlers := s.handlers
+	s.mu.Unlock()
+
+	for _, o := range outages {
+		logln(`[WARN] 地域障害 `+o.Area+` `, o.Before, ` -> `, o.After)
+		for _, f := range handlers {
+			f(o)
+		}
+	}
+	return
+}
+
+// detect は、直前の期間の平均と比べて、ピア数が急に減った地域を返します
+func (s *PeerCountSeries) detect(sample PeerCountSample) (outages []RegionOutage) {
+	sums := make(map[string]uint64)
+	n := 0
+	for i := len(s.samples) - 1; i >= 0 && sample.Time.Sub(s.samples[i].Time) <= outageBaseline; i-- {
+		for r, c := range s.samples[i].Regions {
+			sums[r] += c
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	regions := make([]string, 0, len(sums))
+	for r := range sums {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	for _, r := range regions {
+		before := sums[r] / uint64(n)
+		after := sample.Regions[r]
+		if before < s.MinPeers || after >= before {
+			continue
+		}
+		if drop := float64(before-after) / float64(before); drop >= s.OutageDrop {
+			outages = append(outages, RegionOutage{Time: sample.Time, Region: r, Area: Area(r), Before: before, After: after, Drop: drop})
+		}
+	}
+	return
+}
+
+// Query は、fromからtoまでの時系列を返します。stepが0でなければ、step毎の平均に間引きます。
+// regionsを指定すると、その地域だけを返します(Totalはすべての地域の合計のままです)。
+func (s *PeerCountSeries) Query(from, to time.Time, step time.Duration, regions ...string) []PeerCountSample {
+	s.mu.RLock()
+	var raw []PeerCountSample
+	for _, sample := range s.samples {
+		if (from.IsZero() || !sample.Time.Before(from)) && (to.IsZero() || !sample.Time.After(to)) {
+			raw = append(raw, sample)
+		}
+	}
+	s.mu.RUnlock()
+
+	if step > 0 {
+		raw = downsample(raw, step)
+	}
+	out := make([]PeerCountSample, 0, len(raw))
+	for _, sample := range raw {
+		rs := make(map[string]uint64)
+		for r, c := range sample.Regions {
+			if len(regions) == 0 || containsString(regions, r) {
+				rs[r] = c
+			}
+		}
+		out = append(out, PeerCountSample{Time: sample.Time, Total: sample.Total, Regions: rs})
+	}
+	return out
+}
+
+// downsample は、step毎の平均にします。時刻は区間の始まりです。
+func downsample(samples []PeerCountSample, step time.Duration) (out []PeerCountSample) {
+	for i := 0; i < len(samples); {
+		start := samples[i].Time.Truncate(step)
+		sums := make(map[string]uint64)
+		var total uint64
+		n := 0
+		for ; i < len(samples) && samples[i].Time.Truncate(step).Equal(start); i++ {
+			for r, c := range samples[i].Regions {
+				sums[r] += c
+			}
+			total += samples[i].Total
+			n++
+		}
+		avg := PeerCountSample{Time: start, Total: total / uint64(n), Regions: make(map[string]uint64, len(sums))}
+		for r, c := range sums {
+			avg.Regions[r] = c / uint64(n)
+		}
+		out = append(out, avg)
+	}
+	return
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseQueryTime は、RFC3339の時刻か、"24h" のような現在からの期間を時刻にします
+func parseQueryTime(v string, now time.Time) (time.Time, error) {
+	if v == `` {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// ServeHTTP は、時系列をJSONで返します。
+// from, to はRFC3339の時刻か "24h" のような現在からの期間、step は "10m" のような間引く間隔、region は地域コード(カンマ区切り)です。
+func (s *PeerCountSeries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set(`Allow`, `GET, HEAD`)
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	s.mu.RLock()
+	now := s.clock.Now()
+	s.mu.RUnlock()
+	from, err := parseQueryTime(q.Get(`from`), now)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, `from`).Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(q.Get(`to`), now)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, `to`).Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if v := q.Get(`step`); v != `` {
+		if step, err = time.ParseDuration(v); err != nil || step < 0 {
+			http.Error(w, `step: `+v, http.StatusBadRequest)
+			return
+		}
+	}
+	var regions []string
+	if v := q.Get(`region`); v != `` {
+		regions = strings.Split(v, `,`)
+	}
+
+	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	w.Header().Set(`Cache-Control`, `no-cache`)
+	if err = json.NewEncoder(w).Encode(s.Query(from, to, step, regions...)); err != nil {
+		logln(`[WARN] ピア数応答 ` + err.Error())
+	}
+}
@@ -0,0 +1,206 @@
+package epsp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var seriesBase = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestSeries() *PeerCountSeries {
+	s := NewPeerCountSeries(nil)
+	s.Add(seriesBase, NewPeerCountsFromMap(map[string]uint64{`250`: 10, `275`: 4}))
+	s.Add(seriesBase.Add(5*time.Minute), NewPeerCountsFromMap(map[string]uint64{`250`: 13, `275`: 5}))
+	s.Add(seriesBase.Add(10*time.Minute), NewPeerCountsFromMap(map[string]uint64{`250`: 20}))
+	s.Add(seriesBase.Add(12*time.Minute), NewPeerCountsFromMap(map[string]uint64{`250`: 21, `901`: 1}))
+	return s
+}
+
+func TestDownsample(t *testing.T) {
+	s := newTestSeries()
+	got := downsample(s.Query(time.Time{}, time.Time{}, 0), 10*time.Minute)
+	want := []PeerCountSample{
+		{Time: seriesBase, Total: 16, Regions: map[string]uint64{`250`: 11, `275`: 4}},                       // (14+18)/2, (10+13)/2, (4+5)/2
+		{Time: seriesBase.Add(10 * time.Minute), Total: 21, Regions: map[string]uint64{`250`: 20, `901`: 0}}, // (20+22)/2, (20+21)/2, 1/2
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf(`downsample = %+v, want %+v`, got, want)
+	}
+	if got := downsample(nil, time.Minute); got != nil {
+		t.Errorf(`downsample(nil) = %+v`, got)
+	}
+}
+
+func TestParseQueryTime(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{``, time.Time{}, false},
+		{`24h`, now.Add(-24 * time.Hour), false},
+		{`90m`, now.Add(-90 * time.Minute), false},
+		{`2026-01-01T09:00:00+09:00`, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{`2026-01-01`, time.Time{}, true},
+		{`yesterday`, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseQueryTime(tt.in, now)
+		if (err != nil) != tt.err {
+			t.Errorf(`parseQueryTime(%q) err = %v, want err %v`, tt.in, err, tt.err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf(`parseQueryTime(%q) = %v, want %v`, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPeerCountSeriesServeHTTP(t *testing.T) {
+	s := newTestSeries()
+	at := func(d time.Duration) string { return seriesBase.Add(d).Format(time.RFC3339) }
+	tests := []struct {
+		name  string
+		query string
+		want  []PeerCountSample
+	}{
+		{`all`, ``, []PeerCountSample{
+			{Time: seriesBase, Total: 14, Regions: map[string]uint64{`250`: 10, `275`: 4}},
+			{Time: seriesBase.Add(5 * time.Minute), Total: 18, Regions: map[string]uint64{`250`: 13, `275`: 5}},
+			{Time: seriesBase.Add(10 * time.Minute), Total: 20, Regions: map[string]uint64{`250`: 20}},
+			{Time: seriesBase.Add(12 * time.Minute), Total: 22, Regions: map[string]uint64{`250`: 21, `901`: 1}},
+		}},
+		{`from and to are inclusive`, `from=` + at(5*time.Minute) + `&to=` + at(10*time.Minute), []PeerCountSample{
+			{Time: seriesBase.Add(5 * time.Minute), Total: 18, Regions: map[string]uint64{`250`: 13, `275`: 5}},
+			{Time: seriesBase.Add(10 * time.Minute), Total: 20, Regions: map[string]uint64{`250`: 20}},
+		}},
+		{`region keeps total`, `region=275,901`, []PeerCountSample{
+			{Time: seriesBase, Total: 14, Regions: map[string]uint64{`275`: 4}},
+			{Time: seriesBase.Add(5 * time.Minute), Total: 18, Regions: map[string]uint64{`275`: 5}},
+			{Time: seriesBase.Add(10 * time.Minute), Total: 20, Regions: map[string]uint64{}},
+			{Time: seriesBase.Add(12 * time.Minute), Total: 22, Regions: map[string]uint64{`901`: 1}},
+		}},
+		{`step averages buckets`, `step=10m`, []PeerCountSample{
+			{Time: seriesBase, Total: 16, Regions: map[string]uint64{`250`: 11, `275`: 4}},
+			{Time: seriesBase.Add(10 * time.Minute), Total: 21, Regions: map[string]uint64{`250`: 20, `901`: 0}},
+		}},
+		{`step after from`, `from=` + at(5*time.Minute) + `&step=1h&region=250`, []PeerCountSample{
+			{Time: seriesBase, Total: 20, Regions: map[string]uint64{`250`: 18}},
+		}},
+		{`empty range`, `from=` + at(time.Hour), []PeerCountSample{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/api/peer_counts?`+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf(`status = %d %s`, w.Code, w.Body)
+			}
+			var got []PeerCountSample
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for i := range got {
+				got[i].Time = got[i].Time.UTC()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf(`got %+v, want %+v`, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerCountSeriesServeHTTPRelative(t *testing.T) {
+	clock := NewFakeClock(seriesBase.Add(15 * time.Minute))
+	s := NewPeerCountSeries(clock)
+	for _, sample := range newTestSeries().Query(time.Time{}, time.Time{}, 0) {
+		s.Add(sample.Time, NewPeerCountsFromMap(sample.Regions))
+	}
+	query := func(q string) (times []time.Time) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/api/peer_counts?`+q, nil))
+		var got []PeerCountSample
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf(`%s: %v %s`, q, err, w.Body)
+		}
+		for _, g := range got {
+			times = append(times, g.Time.UTC())
+		}
+		return
+	}
+
+	// 期間は、時系列の時計の現在時刻から数えます。
+	if got, want := query(`from=5m`), []time.Time{seriesBase.Add(10 * time.Minute), seriesBase.Add(12 * time.Minute)}; !reflect.DeepEqual(got, want) {
+		t.Errorf(`from=5m = %v, want %v`, got, want)
+	}
+	if got, want := query(`from=15m&to=10m`), []time.Time{seriesBase, seriesBase.Add(5 * time.Minute)}; !reflect.DeepEqual(got, want) {
+		t.Errorf(`from=15m&to=10m = %v, want %v`, got, want)
+	}
+	clock.Advance(time.Hour)
+	if got := query(`from=5m`); len(got) != 0 {
+		t.Errorf(`from=5m after an hour = %v`, got)
+	}
+}
+
+func TestPeerCountSeriesServeHTTPErrors(t *testing.T) {
+	s := newTestSeries()
+	tests := []struct {
+		method, query string
+		code          int
+	}{
+		{http.MethodGet, `from=yesterday`, http.StatusBadRequest},
+		{http.MethodGet, `to=2026-01-01`, http.StatusBadRequest},
+		{http.MethodGet, `step=often`, http.StatusBadRequest},
+		{http.MethodGet, `step=-10m`, http.StatusBadRequest},
+		{http.MethodPost, ``, http.StatusMethodNotAllowed},
+		{http.MethodHead, ``, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, `/api/peer_counts?`+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf(`%s ?%s: status = %d, want %d`, tt.method, tt.query, w.Code, tt.code)
+		}
+	}
+}
+
+func TestPeerCountSeriesOutage(t *testing.T) {
+	s := NewPeerCountSeries(nil)
+	var notified []RegionOutage
+	s.OnOutage(func(o RegionOutage) { notified = append(notified, o) })
+
+	s.Add(seriesBase, NewPeerCountsFromMap(map[string]uint64{`250`: 20, `275`: 4}))
+	s.Add(seriesBase.Add(10*time.Minute), NewPeerCountsFromMap(map[string]uint64{`250`: 20, `275`: 4}))
+	// 275は MinPeers より少ないので判定しません。
+	outages := s.Add(seriesBase.Add(20*time.Minute), NewPeerCountsFromMap(map[string]uint64{`250`: 9, `275`: 0}))
+	if len(outages) != 1 || outages[0].Region != `250` || outages[0].Before != 20 || outages[0].After != 9 || outages[0].Drop != 0.55 {
+		t.Fatalf(`outages = %+v`, outages)
+	}
+	if !reflect.DeepEqual(notified, outages) {
+		t.Errorf(`notified = %+v`, notified)
+	}
+
+	// 直前の期間より前のサンプルとは比べません。
+	s = NewPeerCountSeries(nil)
+	s.Add(seriesBase, NewPeerCountsFromMap(map[string]uint64{`250`: 20}))
+	if outages := s.Add(seriesBase.Add(2*time.Hour), NewPeerCountsFromMap(map[string]uint64{`250`: 1})); len(outages) != 0 {
+		t.Errorf(`outages = %+v`, outages)
+	}
+}
+
+func TestPeerCountSeriesRetention(t *testing.T) {
+	s := NewPeerCountSeries(nil)
+	s.Retention = time.Hour
+	s.Add(seriesBase, NewPeerCountsFromMap(map[string]uint64{`250`: 1}))
+	s.Add(seriesBase.Add(time.Hour), NewPeerCountsFromMap(map[string]uint64{`250`: 2}))
+	s.Add(seriesBase.Add(time.Hour+time.Second), NewPeerCountsFromMap(map[string]uint64{`250`: 3}))
+	got := s.Query(time.Time{}, time.Time{}, 0)
+	if len(got) != 2 || got[0].Regions[`250`] != 2 {
+		t.Errorf(`Query = %+v`, got)
+	}
+}
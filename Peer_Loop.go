@@ -3,7 +3,6 @@ package epsp
 import (
 	"context"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,7 +10,18 @@ import (
 
 // Loop は、EPSPサーバと定期的な接続を行うことで、ピアとの接続を維持するメソッドです。
 func (peer *Peer) Loop(ctx context.Context, port int) (err error) {
-	peerIsRegistered := peer.PeerID != ``
+	if peer.PeerID() != `` {
+		peer.transit(PeerStateJoined) // 鍵ファイルのピアIDで、エコーから再開します。
+	}
+	defer peer.transit(PeerStateOffline)
+	defer peer.unmapPort(port)
+
+	keysCtx, stopKeys := context.WithCancel(ctx)
+	defer stopKeys()
+	go peer.keys.Run(keysCtx, peer.renewKey) // サーバへの定期接続とは別に、有効期限の前に鍵を更新します。
+
+	peer.netCtx, peer.stopNet = context.WithCancel(ctx)
+	defer func() { peer.stopNet() }()
 
 restart:
 	for i := 0; ; i++ {
@@ -21,148 +31,220 @@ restart:
 		}
 		ctxtimeout, cancel := context.WithTimeout(ctx, 2*time.Second)
 		defer cancel()
-		peer.EPSPServer, peer.MyAgent, err = NewP2SClient(ctxtimeout, peer.hosts[i], peer.MyAgent)
+		peer.EPSPServer, err = NewP2SClient(ctxtimeout, peer.hosts[i], peer.MyAgent, peer.clock)
 
 		if err == nil {
+			peer.setServerless(false)
+			if peer.protocolClock.NeedsRefresh() { // エコーと鍵の有効期限の判断の前に、プロトコル時刻に合わせます。
+				peer.syncClock(ctx)
+			}
 
-			gotTempPeerID := false
-			if peerIsRegistered {
-				if err = peer.EPSPServer.Echo(ctx, peer.PeerID, peer.NumOfConnectedPeers()); err != nil {
+			if peer.State() == PeerStateJoined {
+				if err = peer.EPSPServer.Echo(ctx, peer.PeerID(), peer.NumOfConnectedPeers()); errors.Cause(err) == ErrRejoin {
+					peer.rejoin(ctx, port)
+					continue restart
+				} else if err != nil {
 					logln(`[DEBUG] PeerID expired. P2S Restart`, err)
-					peerIsRegistered = false
-					peer.EPSPServer.Close(ctx)
+					peer.transit(PeerStateOffline)
+					peer.closeServer(ctx, err)
 					continue restart
 				}
+				peer.setLastEcho(peer.clock.Now())
 				if err = peer.EPSPServer.GetKey(ctx, peer, true); err != nil { // 鍵の再割り当てを要求します。
 					logln(`[WARN] GetKey ` + err.Error())
+					peer.closeServer(ctx, err)
 					continue restart
 				}
 			} else {
-				if peer.PeerID, err = peer.EPSPServer.GetTemporaryPeerID(ctx); err != nil {
+				peer.transit(PeerStateOffline)
+				var peerID string
+				if peerID, err = peer.EPSPServer.GetTemporaryPeerID(ctx); err != nil {
 					logln(`[WARN] GetTemporaryPeerID ` + err.Error())
-					peer.EPSPServer.Close(ctx)
+					peer.closeServer(ctx, err)
 					continue restart
 				}
-				gotTempPeerID = true
+				peer.setPeerID(peerID)
+				peer.transit(PeerStateTemporaryID)
 			}
+			joining := peer.State() != PeerStateJoined
 
-			peer.Clients.AddP2PClients(ctx, peer.PeerID, peer.candidatePeers, peer.MyAgent, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming)
+			peer.Clients.AddP2PClients(peer.netCtx, peer.PeerID(), peer.candidatePeers, peer.MyAgent, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming, peer.clock)
 			peer.candidatePeers = []string{}
 
-			peer.serverIsRunning.Do(func() {
-				_, err := peer.Servers.NewP2PServers(ctx, peer.PeerID, peer.MyAgent, port, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming)
-				if err != nil {
-					logln(`[ERROR] NewP2PServers Error`, err)
-					return
-				}
-				if gotTempPeerID {
-					if peer.Global, err = peer.EPSPServer.CheckPortOpen(ctx, peer.PeerID, port); err != nil {
-						logln(`[WARNING] CheckPortOpen Error`, err)
-						return
-					}
-				}
+			peer.mapPort(ctx, port) // ポート開放確認の前に、ルータにポート転送を要求します。
 
-				logln(`[DEBUG] PortOpen: `, peer.Global, ` Clients: `, peer.Clients.NumOfConnectedPeers())
-			})
+			if !peer.serversRunning {
+				peer.startServers(port, joining)
+			}
 
-			if gotTempPeerID ||
+			if joining ||
 				(peer.Servers.NumOfConnectedPeers() != 0 && peer.Clients.NumOfConnectedPeers()*3 < peer.incoming) ||
 				(peer.Servers.NumOfConnectedPeers() == 0 && peer.Clients.NumOfConnectedPeers()*3 < peer.incoming*2) {
 
+				peer.transit(PeerStatePeerDiscovery)
+
 				var getPeers []string
 
-				if getPeers, err = peer.EPSPServer.GetPeers(ctx, peer.PeerID); err != nil {
+				if getPeers, err = peer.EPSPServer.GetPeers(ctx, peer.PeerID()); err != nil {
 					logln(`[WARN] GetPeers ` + err.Error())
-					peer.EPSPServer.Close(ctx)
+					peer.leaveJoining(joining)
+					peer.closeServer(ctx, err)
 					continue restart
 				}
-				peer.Clients.AddP2PClients(ctx, peer.PeerID, getPeers, peer.MyAgent, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming)
-				if err = peer.EPSPServer.TellPeer(peer.Clients, getPeers); err != nil { // 新たに接続出来たピアのIDを通知します。
+				peer.addressBook.Add(getPeers...)
+				peer.Clients.AddP2PClients(peer.netCtx, peer.PeerID(), getPeers, peer.MyAgent, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming, peer.clock)
+				if err = peer.EPSPServer.TellPeer(peer.Clients.Snapshot(), getPeers); err != nil { // 新たに接続出来たピアのIDを通知します。
 					logln(`[WARN] TellPeer ` + err.Error())
-					peer.EPSPServer.Close(ctx)
+					peer.leaveJoining(joining)
+					peer.closeServer(ctx, err)
 					continue restart
 				}
 			}
 
-			if gotTempPeerID {
-				if peer.Global {
-					if err = peer.EPSPServer.Regist(ctx, peer.PeerID, port, peer.region, peer.NumOfConnectedPeers(), peer.incoming); err != nil {
-						logln(`[WARN] Regist ` + err.Error())
-						peer.EPSPServer.Close(ctx)
-						continue restart
-					}
-				} else {
-					if err = peer.EPSPServer.Regist(ctx, peer.PeerID, port, peer.region, peer.NumOfConnectedPeers(), 0); err != nil {
-						logln(`[WARN] Regist ` + err.Error())
-						peer.EPSPServer.Close(ctx)
-						continue restart
-					}
+			if joining {
+				peer.transit(PeerStateRegistration)
+				incoming := uint64(0)
+				if peer.Global() {
+					incoming = peer.incoming
+				}
+				if err = peer.EPSPServer.Regist(ctx, peer.PeerID(), peer.publicPort(port), peer.region, peer.NumOfConnectedPeers(), incoming); err != nil {
+					logln(`[WARN] Regist ` + err.Error())
+					peer.transit(PeerStateOffline)
+					peer.closeServer(ctx, err)
+					continue restart
 				}
-				peerIsRegistered = true
 
+				peer.transit(PeerStateKeyAssignment)
 				if err = peer.EPSPServer.GetKey(ctx, peer, false); err != nil { // 必要に応じて鍵の割り当てを要求します。
 					logln(`[WARN] GetKey ` + err.Error())
-					peer.EPSPServer.Close(ctx)
+					peer.transit(PeerStateOffline)
+					peer.closeServer(ctx, err)
 					continue restart
 				}
 
-				if peer.PeerCountsByRegion == nil || peer.ProtocolTimeDiff == 0 {
-					var err error
-					if peer.PeerCountsByRegion, err = peer.EPSPServer.PeerCountByRegion(ctx, peer.codep2mp); err != nil {
+				if peer.RegionCounts() == nil {
+					if pc, err := peer.EPSPServer.PeerCountByRegion(ctx, peer.codep2mp); err != nil {
 						logln(`[DEBUG] PeerCountByRegion`, err)
-					}
-				}
-
-				if peer.ProtocolTimeDiff == 0 {
-					var t time.Time
-					if t, err = peer.EPSPServer.GetTime(ctx); err == nil {
-						peer.ProtocolTimeDiff = time.Until(t)
-						logln(`[DEBUG] Protocol Time`, t, `Diff=`, peer.ProtocolTimeDiff)
 					} else {
-						logln(err)
+						peer.setPeerCounts(pc)
 					}
 				}
 			}
+			peer.transit(PeerStateJoined)
 		} else {
 			logln(`[WARNING] サーバ`+peer.hosts[i]+`: ESPSサーバ接続エラー`, err)
+			now := peer.clock.Now()
+			peer.recordServerSession(ServerSession{Server: peer.hosts[i], Started: now, Ended: now, State: peer.State(), Err: err})
 			peer.serverErrorCount++
 			if peer.serverErrorCount <= uint16(len(peer.hosts)) {
 				continue restart
 			} else {
 				logln(`[WARNING] サーバ` + peer.hosts[i] + `: ESPS全サーバ接続エラー`)
-				if peer.NumOfConnectedPeers() == 0 {
+				if !peer.maintainWithoutServer(ctx) { // サーバが復旧するまで、隣接ピアとだけでメッシュを維持します。
 					return
 				}
 			}
 		}
 		peer.serverErrorCount = 0
-		peer.EPSPServer.Close(ctx) // close p2s connection
+		peer.closeServer(ctx, nil) // close p2s connection
 
 		peer.SaveKey()
-		duration := 10 * time.Minute * time.Duration(peer.NumOfConnectedPeers()) / time.Duration(peer.incoming)
-		if duration > 1*time.Minute {
-			duration = 10 * time.Minute
-		}
-
-		timer := time.NewTimer(duration)
+		timer := peer.clock.NewTimer(serverInterval(peer.NumOfConnectedPeers(), peer.incoming))
 		select {
 		case <-ctx.Done():
+			timer.Stop()
+			peer.transit(PeerStateLeaving)
 			return ctx.Err()
-		case <-timer.C:
+		case <-timer.C():
 			continue restart
 		}
 	}
 }
 
-func isExpired(recvdata []string) bool {
-	expiredate, err := time.Parse(`2006/01/02 15-04-05`, recvdata[1])
+// serverInterval は、次にサーバへ接続するまでの時間です。接続中のピアが少ないほど早く接続し、ピアを探します。
+func serverInterval(connected, incoming uint64) time.Duration {
+	if incoming == 0 {
+		return 10 * time.Minute
+	}
+	duration := 10 * time.Minute * time.Duration(connected) / time.Duration(incoming)
+	if duration > 1*time.Minute {
+		duration = 10 * time.Minute
+	} else if duration < 10*time.Second {
+		duration = 10 * time.Second // 接続中のピアがいなくても、サーバへの接続を繰り返しすぎないようにします。
+	}
+	return duration
+}
+
+// startServers は、ピアからの接続の待ち受けを始めます。参加手続き中であれば、ポート開放を確認します。
+func (peer *Peer) startServers(port int, joining bool) {
+	laddrs := peer.listenAddrs
+	if len(laddrs) == 0 {
+		laddrs = defaultListenAddrs(strconv.Itoa(port))
+	}
+	_, err := peer.Servers.NewP2PServers(peer.netCtx, peer.PeerID(), peer.MyAgent, laddrs, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming, peer.clock)
 	if err != nil {
-		return true
+		logln(`[ERROR] NewP2PServers Error`, err)
+		return
 	}
-	if expired := time.Now().After(expiredate); expired {
-		return true
+	peer.serversRunning = true
+	if joining {
+		peer.transit(PeerStatePortCheck)
+		global, err := peer.EPSPServer.CheckPortOpen(peer.netCtx, peer.PeerID(), peer.publicPort(port))
+		if err != nil {
+			logln(`[WARNING] CheckPortOpen Error`, err)
+			return
+		}
+		peer.setGlobal(global)
+	}
+
+	logln(`[DEBUG] PortOpen: `, peer.Global(), ` Clients: `, peer.Clients.NumOfConnectedPeers())
+}
+
+// leaveJoining は、参加手続き中の失敗であれば未参加に戻します。参加中であれば状態を戻します。
+func (peer *Peer) leaveJoining(joining bool) {
+	if joining {
+		peer.transit(PeerStateOffline)
+	} else {
+		peer.transit(PeerStateJoined)
 	}
-	return false
+}
+
+// syncClock は、サーバのプロトコル時刻で時計を合わせます
+func (peer *Peer) syncClock(ctx context.Context) {
+	sent := peer.clock.Now()
+	t, err := peer.EPSPServer.GetTime(ctx)
+	if err != nil {
+		logln(`[WARN] GetTime ` + err.Error())
+		return
+	}
+	peer.protocolClock.Update(t, sent, peer.clock.Now())
+}
+
+// renewKey は、サーバに接続して、鍵の再割り当てを要求します。参加中でなければ失敗します。
+func (peer *Peer) renewKey(ctx context.Context) (err error) {
+	if peer.State() != PeerStateJoined {
+		return errors.New(`未参加`)
+	}
+	for _, host := range peer.hosts {
+		ctxtimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+		var p2s *P2SClient
+		p2s, err = NewP2SClient(ctxtimeout, host, peer.MyAgent, peer.clock)
+		if err == nil {
+			err = p2s.GetKey(ctxtimeout, peer, true)
+			p2s.Close(ctxtimeout)
+		}
+		cancel()
+		if err == nil {
+			return nil
+		}
+		logln(`[DEBUG] サーバ` + host + `: 鍵更新 ` + err.Error())
+	}
+	return
+}
+
+// isExpired は、データの有効期限が、プロトコル時刻で過ぎているかを返します
+func (peer *Peer) isExpired(recvdata []string) bool {
+	return peer.protocolClock.Expired(recvdata[1])
 }
 
 func (peer *Peer) isDuplicate(from *P2PPeer, recvdata []string) bool {
@@ -193,9 +275,15 @@ func (peer *Peer) checkSignature(cmd string, recvdata []string) (err error) {
 		fallthrough
 	case '6':
 
+		if len(recvdata) < 6 {
+			return errors.New(`項目不足`)
+		}
 		pubKey := recvdata[2]
 		keySig := recvdata[3]
 		keyExpDate := recvdata[4]
+		if peer.protocolClock.Expired(keyExpDate) {
+			return errors.New(`鍵期限切れ`)
+		}
 
 		if peerPubKey, err := KeySignatureCheck(peer.peerKey, pubKey, keySig, keyExpDate); err == nil {
 			dataSig := recvdata[0]
@@ -213,18 +301,31 @@ func (peer *Peer) checkSignature(cmd string, recvdata []string) (err error) {
 }
 
 func (peer *Peer) code561(recvdata []string) {
-	peer.PeerCountsByRegion = NewPeerCount(recvdata[2])
-	peer.SaveKey()
+	peer.setPeerCounts(NewPeerCount(recvdata[2]))
 }
 
-func (peer *Peer) code615(from *P2PPeer, recvdata []string, hops string) error {
-	if recvdata[0] == peer.PeerID {
+// setPeerCounts は、地域ごとのピア数を更新し、時系列に加えます
+func (peer *Peer) setPeerCounts(pc PeerCounts) {
+	peer.stateMu.Lock()
+	peer.regionCounts = pc
+	peer.stateMu.Unlock()
+	peer.statusChanged(true)
+	peer.peerCounts.Add(peer.clock.Now(), pc)
+}
+
+func (peer *Peer) code615(from *P2PPeer, m Message) error {
+	t, err := ParseTraceRequest(m.Fields)
+	if err != nil {
+		return errors.Wrap(err, `615`)
+	}
+	if t.Origin == peer.PeerID() {
 		return nil // do nothing because 615 from me.
 	}
-	if _, ok := peer.traceecho.LoadOrStore(recvdata[1], from); !ok {
+	if _, ok := peer.traceecho.LoadOrStore(t.TraceID, from); !ok {
 		// 過去の調査エコーバッファと比較し、新規エコーだった場合のみ処理を続けます。
 		// 「一意な数」と「送信元（ソケット番号など、後で送り返しするために必要な値）」を新たにバッファに追加します。
-		err := from.WriteTo(`635`, `1`, strings.Join(recvdata, `:`)+`:`+peer.PeerID+`:`+strings.Join(peer.ConnectedPeersList(), `,`)+`:`+hops)
+		reply := TraceReply{Origin: t.Origin, TraceID: t.TraceID, Reporter: peer.PeerID(), Connected: peer.ConnectedPeersList(), Hops: m.Hops}
+		err := from.WriteTo(NewMessage(CodeTraceReply, reply.Fields()...).Marshal())
 		// 送信元に対し、「調査エコーリプライ(コード635)」を送信します。
 		if err != nil {
 			from.Close()
@@ -234,14 +335,18 @@ func (peer *Peer) code615(from *P2PPeer, recvdata []string, hops string) error {
 	return nil
 }
 
-func (peer *Peer) code635(retval []string) (sent bool, err error) {
-	recvdata := strings.Split(retval[2], `:`)
-
-	if recvdata[0] == peer.PeerID {
-		go peer.usercmd(retval[0], recvdata...)
+func (peer *Peer) code635(m Message) (sent bool, err error) {
+	if len(m.Fields) < 2 {
+		return false, errors.New(`635 項目不足`)
+	}
+	if m.Fields[0] == peer.PeerID() {
+		peer.publish(m)
+		if !peer.deliverTrace(m.Fields) {
+			go peer.usercmd(m.Code, m.Fields...)
+		}
 		return true, nil // do usercmd because 635 for me.
 	}
-	origp, ok := peer.traceecho.Load(recvdata[1])
+	origp, ok := peer.traceecho.Load(m.Fields[1])
 	if !ok { // 一致するバッファがあった場合のみ処理を続けます。
 		return false, nil
 	}
@@ -249,8 +354,8 @@ func (peer *Peer) code635(retval []string) (sent bool, err error) {
 	if !ok {
 		return false, errors.New(`[ERROR] Type assertion on 635`)
 	}
-	logln(`[DEBUG] ピア` + peer.PeerID + `: ユニキャスト送信:` + origpeer.GetPeerID() + ` ` + strings.Join(retval[:2], ` `))
-	err = origpeer.WriteTo(retval...)
+	logln(`[DEBUG] ピア` + peer.PeerID() + `: ユニキャスト送信:` + origpeer.GetPeerID() + ` ` + m.Code)
+	err = origpeer.WriteTo(m.Marshal())
 	// 過去の調査エコーバッファで記憶されている「送信元」に対し、調査エコーリプライをリレーします。
 	if err == nil {
 		return true, nil
@@ -259,48 +364,64 @@ func (peer *Peer) code635(retval []string) (sent bool, err error) {
 	return false, nil
 }
 
-func (peer *Peer) mpReSent(from *P2PPeer, retval []string) error {
-	if hops, err := strconv.ParseUint(retval[1], 10, 64); err == nil {
-		if peer.PeerCountsByRegion.NumOfAllPeers() >= hops {
-			retval[1] = strconv.FormatUint(hops+1, 10) // Hop count add
-			logln(`[DEBUG] ピア` + peer.PeerID + `: マルチキャスト送信:` + strings.Join(retval[:2], ` `))
-			go peer.WriteExceptFrom(from, retval...)
-		} else {
-			return errors.Errorf(`総参加ピア数(%d) < 経由数(%d)`, peer.PeerCountsByRegion.NumOfAllPeers(), hops)
-		}
-	} else {
-		return errors.New(`経由数書式異常 ` + strings.Join(retval, ` `))
+func (peer *Peer) mpReSent(from *P2PPeer, m Message) error {
+	if peer.RegionCounts().NumOfAllPeers() < m.Hops {
+		return errors.Errorf(`総参加ピア数(%d) < 経由数(%d)`, peer.RegionCounts().NumOfAllPeers(), m.Hops)
 	}
+	m.Hops++ // Hop count add
+	logln(`[DEBUG] ピア` + peer.PeerID() + `: マルチキャスト送信:` + m.Code + ` ` + strconv.FormatUint(m.Hops, 10))
+	go peer.WriteExceptFrom(from, m)
 	return nil
 }
 
-func (peer *Peer) codep2mp(from *P2PPeer, retval []string) error {
-	recvdata := strings.Split(retval[2], `:`)
+// publish は、受理したメッセージを復号し、イベントとして配信します
+func (peer *Peer) publish(m Message) {
+	data, err := Decode(m.Code, m.Fields)
+	if err != nil {
+		logln(`[DEBUG] ` + m.Code + ` 復号不能 ` + err.Error())
+		data = m.Fields
+	} else if data == nil {
+		data = m.Fields
+	}
+	peer.events.Publish(m.Code, strconv.FormatUint(m.Hops, 10), data)
+	if r, ok := data.(*SensingReport); ok {
+		peer.sensing.Add(r, peer.clock.Now())
+	}
+}
 
-	if retval[0][0] == '5' {
-		if isExpired(recvdata) {
-			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 期限切れ" + strings.Join(retval, ` `))
+func (peer *Peer) codep2mp(from *P2PPeer, m Message) error {
+	if m.Code == CodePeerList {
+		return peer.code235(from, m)
+	}
+	if m.IsSigned() {
+		if len(m.Fields) < 3 {
+			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 項目不足 " + m.Marshal())
+			return nil
+		}
+		if peer.isExpired(m.Fields) {
+			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 期限切れ" + m.Marshal())
 			return nil
 		}
-		if peer.isDuplicate(from, recvdata) {
-			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 重複" + strings.Join(retval, ` `))
+		if peer.isDuplicate(from, m.Fields) {
+			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 重複" + m.Marshal())
 			return nil
 		}
-		if err := peer.checkSignature(retval[0], recvdata); err != nil {
-			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 署名 " + err.Error() + `:` + strings.Join(retval, ` `))
+		if err := peer.checkSignature(m.Code, m.Fields); err != nil {
+			logln(`[DEBUG] ピア` + from.GetPeerIDorIPPort() + ": 署名 " + err.Error() + `:` + m.Marshal())
 			return nil
 		}
+		peer.publish(m)
 	}
 
-	switch retval[0] {
-	case `561`:
-		peer.code561(recvdata)
-	case `615`:
-		if err := peer.code615(from, recvdata, retval[1]); err != nil {
+	switch m.Code {
+	case CodeRegionPeers:
+		peer.code561(m.Fields)
+	case CodeTrace:
+		if err := peer.code615(from, m); err != nil {
 			return err
 		}
-	case `635`:
-		sent, err := peer.code635(retval)
+	case CodeTraceReply:
+		sent, err := peer.code635(m)
 		if err != nil {
 			return err
 		}
@@ -308,8 +429,8 @@ func (peer *Peer) codep2mp(from *P2PPeer, retval []string) error {
 			return nil
 		}
 	default:
-		go peer.usercmd(retval[0], recvdata...)
+		go peer.usercmd(m.Code, m.Fields...)
 	}
 
-	return peer.mpReSent(from, retval)
+	return peer.mpReSent(from, m)
 }
@@ -0,0 +1,261 @@
+package epsp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerInterval(t *testing.T) {
+	tests := []struct {
+		connected, incoming uint64
+		want                time.Duration
+	}{
+		{0, 10, 10 * time.Second}, // ピアがいなくても、10秒はあけます
+		{1, 100, 10 * time.Second},
+		{1, 20, 30 * time.Second},
+		{1, 10, 1 * time.Minute},
+		{2, 10, 10 * time.Minute}, // 1分を超えたら、10分毎のエコーです
+		{10, 10, 10 * time.Minute},
+		{3, 0, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := serverInterval(tt.connected, tt.incoming); got != tt.want {
+			t.Errorf(`serverInterval(%d, %d) = %v, want %v`, tt.connected, tt.incoming, got, tt.want)
+		}
+	}
+}
+
+// newLoopTestServer は、clockで動くEPSPサーバを起動し、そのアドレスとピア鍵認証局の公開鍵(PEM)を返します
+func newLoopTestServer(t *testing.T, ctx context.Context, clock Clock) (*P2SServer, string, []byte) {
+	t.Helper()
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPub, err := EncodePublicKey(&caKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := LoadRegistry(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewP2SServer(reg, caKey)
+	s.Clock = clock
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(ctx, l) }()
+	return s, l.Addr().String(), caPub
+}
+
+func TestPeerLoopEchoAndRejoin(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, addr, caPub := newLoopTestServer(t, ctx, clock)
+
+	peer, err := NewPeer([]string{addr}, `250`, 10, caPub, caPub, func(string, ...string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.keyfilename = filepath.Join(dir, `peer.json`)
+	peer.SetClock(clock)
+	peer.SetListenAddrs(`127.0.0.1:0`)
+	var changes []AddressChange
+	events, unsubscribe := peer.events.Subscribe(0, []string{AddressChangedCode})
+	defer unsubscribe()
+
+	done := make(chan error, 1)
+	go func() { done <- peer.Loop(ctx, 0) }()
+
+	// 参加したら、鍵を保存して、次の接続まで待ちます。
+	waitUntil(t, func() bool {
+		_, err := os.Stat(peer.keyfilename)
+		return peer.State() == PeerStateJoined && err == nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	joined := clock.Now()
+	peerID := peer.PeerID()
+	if !peer.keys.Valid() {
+		t.Fatal(`no key after joining`)
+	}
+	lastSeen := func() time.Time {
+		p, _ := s.Registry.Get(peerID)
+		return p.LastSeen
+	}
+	if !lastSeen().Equal(joined) {
+		t.Fatalf(`LastSeen = %v, want %v`, lastSeen(), joined)
+	}
+
+	// 接続中のピアがいないので、10秒後にエコーします。
+	for i := 0; i < 9; i++ {
+		clock.Advance(time.Second)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !lastSeen().Equal(joined) {
+		t.Fatalf(`echo before 10s: LastSeen = %v`, lastSeen())
+	}
+	clock.Advance(time.Second)
+	waitUntil(t, func() bool { return lastSeen().Equal(joined.Add(10 * time.Second)) })
+	waitUntil(t, func() bool { return peer.Status().LastEcho.Equal(joined.Add(10 * time.Second)) })
+
+	// 登録簿から消えていれば、次のエコーで参加しなおします。
+	time.Sleep(50 * time.Millisecond)
+	s.Registry.Remove(peerID)
+	clock.Advance(10 * time.Second)
+	waitUntil(t, func() bool {
+		select {
+		case ev := <-events:
+			changes = append(changes, ev.Data.(AddressChange))
+		default:
+		}
+		return len(changes) == 1 && peer.State() == PeerStateJoined && peer.PeerID() != `` && peer.PeerID() != peerID
+	})
+	if changes[0].OldPeerID != peerID || changes[0].Server != addr || !changes[0].Time.Equal(joined.Add(20*time.Second)) {
+		t.Errorf(`AddressChange = %+v`, changes[0])
+	}
+	if p, ok := s.Registry.Get(peer.PeerID()); !ok || !p.Registered {
+		t.Errorf(`registry = %+v`, p)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Loop did not return`)
+	}
+}
+
+// scriptedServer は、要求コードごとに決まった応答を返すEPSPサーバです。接続ごとに、受け取った要求コードを送ります。
+func scriptedServer(t *testing.T, ctx context.Context, replies map[string]string) (string, <-chan []string) {
+	t.Helper()
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	sessions := make(chan []string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				var codes []string
+				defer func() {
+					select {
+					case sessions <- codes:
+					case <-ctx.Done():
+					}
+				}()
+				if _, err := conn.Write([]byte("211 1 0.34r\r\n")); err != nil {
+					return
+				}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					code := line[:3]
+					codes = append(codes, code)
+					reply := replies[code]
+					switch code {
+					case CodeClientVersion:
+						reply = "212 1 0.34r:github.com/toyo/epsp:20190310"
+					case CodeEndRequest:
+						reply = "239 1"
+					}
+					if _, err := conn.Write([]byte(reply + "\r\n")); err != nil || code == CodeEndRequest {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), sessions
+}
+
+func TestPeerLoopClosesServerOnKeyError(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	addr, sessions := scriptedServer(t, ctx, map[string]string{
+		CodeTimeRequest:        `238 1 ` + FormatProtocolTime(clock.Now()),
+		CodeEchoRequest:        `243 1`,
+		CodeKeyReassignRequest: `244 1 壊れた鍵`,
+	})
+
+	_, _, caPub := newLoopTestServer(t, ctx, clock)
+	peer, err := NewPeer([]string{addr}, `250`, 10, caPub, caPub, func(string, ...string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.keyfilename = filepath.Join(dir, `peer.json`)
+	peer.SetClock(clock)
+	peer.setPeerID(`100`)
+	peer.keys.restore(PeerKey{SecKey: `c2Vj`, Expire: clock.Now().Add(10 * time.Minute)}) // 更新が必要な鍵
+
+	done := make(chan error, 1)
+	go func() { done <- peer.Loop(ctx, 0) }()
+
+	// エコーの後の鍵の再割当に失敗しても、サーバとの接続は終了します。
+	var codes []string
+	for codes == nil {
+		select {
+		case s := <-sessions:
+			if len(s) != 0 && s[len(s)-1] != CodeEndRequest {
+				t.Fatalf(`session without end request: %v`, s)
+			}
+			for _, c := range s {
+				if c == CodeEchoRequest {
+					codes = s
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(`no echo session closed`)
+		}
+	}
+	if want := []string{CodeClientVersion, CodeTimeRequest, CodeEchoRequest, CodeKeyReassignRequest, CodeEndRequest}; !reflect.DeepEqual(codes, want) {
+		t.Errorf(`codes = %v, want %v`, codes, want)
+	}
+	waitUntil(t, func() bool {
+		s, ok := peer.LastServerSession()
+		return ok && s.Err != nil
+	})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Loop did not return`)
+	}
+}
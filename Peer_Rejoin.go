@@ -0,0 +1,49 @@
+package epsp
+
+import (
+	"context"
+	"time"
+)
+
+// AddressChangedCode は、サーバから参加しなおし(299)を求められたときに EventStream に発行するイベントのコードです
+const AddressChangedCode = `address_changed`
+
+// AddressChange は、参加しなおしのイベントの内容です
+type AddressChange struct {
+	OldPeerID string    `json:"old_peer_id"`
+	Server    string    `json:"server"`
+	WasGlobal bool      `json:"was_global"` // 参加しなおす前に、ポートが開放されていたか
+	Time      time.Time `json:"time"`
+}
+
+// rejoin は、IPアドレスが変わったとして、ネットワークから切断します。
+// 待ち受けとピア接続、ポート転送を終了してピアIDとポート開放状態を忘れるので、次の接続で、暫定ID割当、ポート開放確認、本割当からやりなおします。
+func (peer *Peer) rejoin(ctx context.Context, port int) {
+	ev := AddressChange{OldPeerID: peer.PeerID(), WasGlobal: peer.Global(), Time: peer.clock.Now()}
+	if peer.EPSPServer != nil {
+		ev.Server = peer.EPSPServer.IPPort
+	}
+	logln(`[INFO] サーバ` + ev.Server + `: 参加しなおし要求 ピアID ` + ev.OldPeerID + ` を破棄します`)
+
+	peer.transit(PeerStateOffline)
+	peer.closeServer(ctx, ErrRejoin)
+
+	peer.stopNet() // 待ち受けと、古いピアIDで接続したピアを終了します。
+	for _, pps := range []*P2PPeers{&peer.Clients, &peer.Servers} {
+		for _, p := range pps.Snapshot() {
+			p.Close()
+			pps.remove(p)
+		}
+	}
+	peer.netCtx, peer.stopNet = context.WithCancel(ctx)
+	peer.serversRunning = false
+
+	peer.unmapPort(port) // 新しいアドレスで、ポート転送を要求しなおします。
+
+	peer.setPeerID(``)
+	peer.setGlobal(false)
+	peer.candidatePeers = nil
+	peer.SaveKey()
+
+	peer.events.Publish(AddressChangedCode, ``, ev)
+}
@@ -0,0 +1,52 @@
+package epsp
+
+import (
+	"context"
+	"time"
+)
+
+// ServerSession は、EPSPサーバとの一回の通信の記録です
+type ServerSession struct {
+	Server  string         // サーバのアドレス
+	Agent   []string       // サーバのエージェント名
+	Started time.Time      // 接続した時刻
+	Ended   time.Time      // 切断した時刻
+	State   PeerState      // 切断時のピアの状態
+	EchoRTT *time.Duration // エコーの往復時間
+	Err     error          // 失敗した場合のエラー
+}
+
+// LastServerSession は、最後に終了したEPSPサーバとの通信の記録を返します。まだ通信していない場合はfalseを返します。
+func (peer *Peer) LastServerSession() (ServerSession, bool) {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	if peer.lastSession == nil {
+		return ServerSession{}, false
+	}
+	return *peer.lastSession, true
+}
+
+func (peer *Peer) recordServerSession(s ServerSession) {
+	peer.stateMu.Lock()
+	peer.lastSession = &s
+	peer.stateMu.Unlock()
+}
+
+// closeServer は、EPSPサーバとの接続を終了し、通信の記録を残します。errは通信が失敗した理由です。
+func (peer *Peer) closeServer(ctx context.Context, err error) {
+	p2s := peer.EPSPServer
+	if p2s == nil {
+		return
+	}
+	p2s.Close(ctx)
+	s := ServerSession{
+		Server:  p2s.IPPort,
+		Agent:   p2s.Agent,
+		Ended:   peer.clock.Now(),
+		State:   peer.State(),
+		EchoRTT: p2s.GetPingPong(),
+		Started: p2s.Times().Conn,
+		Err:     err,
+	}
+	peer.recordServerSession(s)
+}
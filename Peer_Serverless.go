@@ -0,0 +1,115 @@
+package epsp
+
+import (
+	"context"
+	"time"
+)
+
+// ServerlessCode は、サーバなしでメッシュを維持しはじめたとき、サーバに接続できてやめたときに EventStream に発行するイベントのコードです
+const ServerlessCode = `serverless`
+
+// serverlessMinPeers は、サーバなしのとき、アドレス帳から接続して保つ、接続先ピアの数です
+const serverlessMinPeers = 4
+
+// serverlessExchangeWait は、隣接ピアにピアリストを要求してから、返答を待つ時間です
+const serverlessExchangeWait = 3 * time.Second
+
+// ServerlessStatus は、サーバなしの状態が変わったときのイベントの内容です
+type ServerlessStatus struct {
+	Serverless     bool      `json:"serverless"`
+	ConnectedPeers uint64    `json:"connected_peers"`
+	AddressBook    int       `json:"address_book"`
+	Time           time.Time `json:"time"`
+}
+
+// setServerless は、サーバなしの状態を設定し、変わったらイベントを発行します
+func (peer *Peer) setServerless(serverless bool) {
+	peer.stateMu.Lock()
+	changed := peer.serverless != serverless
+	peer.serverless = serverless
+	peer.stateMu.Unlock()
+	if !changed {
+		return
+	}
+	if serverless {
+		logln(`[WARN] サーバなしで、隣接ピアとだけ接続を維持します`)
+	} else {
+		logln(`[INFO] サーバ復旧`)
+	}
+	peer.events.Publish(ServerlessCode, ``, ServerlessStatus{
+		Serverless:     serverless,
+		ConnectedPeers: peer.NumOfConnectedPeers(),
+		AddressBook:    peer.addressBook.Len(),
+		Time:           peer.clock.Now(),
+	})
+}
+
+// maintainWithoutServer は、サーバに接続できない間、隣接ピアに接続先ピア情報(115)を要求してアドレス帳を広げ、
+// アドレス帳のピアに接続して、メッシュを維持します。維持できる見込みがなければ(接続中のピアがなく、アドレス帳も空か、未参加)false を返します。
+func (peer *Peer) maintainWithoutServer(ctx context.Context) bool {
+	if peer.PeerID() == `` { // ピアIDがなければ、他のピアに名乗れません。
+		return peer.NumOfConnectedPeers() != 0
+	}
+	if peer.NumOfConnectedPeers() == 0 && peer.addressBook.Len() == 0 {
+		return false
+	}
+	peer.setServerless(true)
+
+	clients, servers := peer.Clients.Snapshot(), peer.Servers.Snapshot()
+	asked := 0
+	for _, p := range append(clients, servers...) {
+		if p.IsConn() && p.RequestPeers() == nil {
+			asked++
+		}
+	}
+	if asked != 0 {
+		timer := peer.clock.NewTimer(serverlessExchangeWait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return true
+		case <-timer.C():
+		}
+	}
+
+	need := serverlessMinPeers - int(peer.Clients.NumOfConnectedPeers())
+	if need <= 0 {
+		return true
+	}
+	candidates := peer.addressBook.Candidates(need, peer.PeerID(), peer.ConnectedIPPortPeersList())
+	if len(candidates) == 0 {
+		return peer.NumOfConnectedPeers() != 0 || peer.addressBook.Len() != 0
+	}
+	logln(`[INFO] アドレス帳から接続 `, len(candidates), `件`)
+	peer.Clients.AddP2PClients(peer.netCtx, peer.PeerID(), candidates, peer.MyAgent, peer.codep2mp, peer.ConnectedIPPortPeersList, peer.incoming, peer.clock)
+
+	connected := make(map[string]bool)
+	for _, p := range peer.Clients.Snapshot() {
+		if p.IsConn() {
+			connected[p.PeerID] = true
+		}
+	}
+	for _, c := range candidates {
+		if connected[PeerIDOfIPPortPeerID(c)] {
+			peer.addressBook.Succeeded(c)
+		} else {
+			peer.addressBook.Failed(c)
+		}
+	}
+	return true
+}
+
+// code235 は、隣接ピアからの接続先ピア情報を、自分を除いてアドレス帳に加えます。リレーはしません。
+func (peer *Peer) code235(from *P2PPeer, m Message) error {
+	pl, err := ParsePeerListPayload(m.Fields)
+	if err != nil {
+		return err
+	}
+	logln(`[DEBUG] ピア`+from.GetPeerIDorIPPort()+`: 接続先ピア情報 `, len(pl.Peers), `件`)
+	for _, p := range pl.Peers {
+		if PeerIDOfIPPortPeerID(p) != peer.PeerID() {
+			peer.addressBook.Add(p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package epsp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newServerlessTestPeer は、ピアIDがpeerIDで、サーバなしでメッシュを維持できるだけの Peer を返します
+func newServerlessTestPeer(t *testing.T, clock Clock, peerID string) *Peer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	peer := &Peer{
+		clock:         clock,
+		protocolClock: NewProtocolClock(clock),
+		events:        NewEventStream(clock),
+		addressBook:   NewAddressBook(clock),
+		netCtx:        ctx,
+		MyAgent:       []string{`0.34r`, `github.com/toyo/epsp`, `20190310`},
+	}
+	peer.keys = NewKeyManager(clock, peer.protocolClock)
+	peer.setPeerID(peerID)
+	return peer
+}
+
+// listenPeer は、接続を受け付けるだけのピアを起動し、そのポートを返します
+func listenPeer(t *testing.T) string {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// closedPort は、接続を受け付けないポートを返します
+func closedPort(t *testing.T) string {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	return port
+}
+
+func TestMaintainWithoutServerGivesUp(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// 未参加なら、他のピアに名乗れません。
+	peer := newServerlessTestPeer(t, clock, ``)
+	peer.addressBook.Add(`192.0.2.1,6911,1`)
+	if peer.maintainWithoutServer(context.Background()) {
+		t.Error(`maintained without a peer ID`)
+	}
+
+	// 接続中のピアがなく、アドレス帳も空なら、維持できません。
+	peer = newServerlessTestPeer(t, clock, `100`)
+	events, unsubscribe := peer.events.Subscribe(0, []string{ServerlessCode})
+	defer unsubscribe()
+	if peer.maintainWithoutServer(context.Background()) {
+		t.Error(`maintained with an empty address book`)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf(`event = %+v`, ev)
+	default:
+	}
+}
+
+func TestMaintainWithoutServerConnects(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := newServerlessTestPeer(t, clock, `100`)
+	events, unsubscribe := peer.events.Subscribe(0, []string{ServerlessCode})
+	defer unsubscribe()
+
+	alive := `127.0.0.1,` + listenPeer(t) + `,1`
+	dead := `127.0.0.1,` + closedPort(t) + `,2`
+	peer.addressBook.Add(alive, dead, `192.0.2.100,6911,100`) // 自分には接続しません
+
+	if !peer.maintainWithoutServer(context.Background()) {
+		t.Fatal(`gave up`)
+	}
+	select {
+	case ev := <-events:
+		if st := ev.Data.(ServerlessStatus); !st.Serverless || st.AddressBook != 3 || !st.Time.Equal(clock.Now()) {
+			t.Errorf(`ServerlessStatus = %+v`, st)
+		}
+	default:
+		t.Error(`no serverless event`)
+	}
+	if !peer.Status().Serverless {
+		t.Error(`not serverless`)
+	}
+
+	// 接続できたピアは失敗した回数を戻し、できなかったピアは数えます。
+	failures := make(map[string]int)
+	for _, e := range peer.addressBook.Entries() {
+		failures[e.Peer] = e.Failures
+	}
+	if failures[alive] != 0 || failures[dead] != 1 || len(failures) != 3 {
+		t.Errorf(`failures = %v`, failures)
+	}
+	if got := peer.Clients.NumOfConnectedPeers(); got != 1 {
+		t.Errorf(`connected = %d`, got)
+	}
+}
+
+func TestMaintainWithoutServerExchange(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := newServerlessTestPeer(t, clock, `100`)
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	neighbor := newTestP2PPeer(clock, remote.LocalAddr().String())
+	neighbor.PeerID = `3`
+	neighbor.conn = local
+	neighbor.SetConnTime()
+	peer.Servers.add(neighbor)
+	defer neighbor.Close()
+
+	// 隣接ピアに接続先ピア情報を要求し、serverlessExchangeWait の間、返答を待ちます。
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan bool, 1)
+	go func() { done <- peer.maintainWithoutServer(ctx) }()
+	if line := readLine(t, bufio.NewReader(remote)); line != CodePeerListRequest+` 1` {
+		t.Fatalf(`sent %q`, line)
+	}
+	waitUntil(t, func() bool { return clock.Waiters() == 1 })
+
+	alive := `127.0.0.1,` + listenPeer(t) + `,1`
+	m := NewMessage(CodePeerList, PeerListPayload{Peers: []string{alive, `192.0.2.100,6911,100`}}.Fields()...)
+	if err := peer.code235(neighbor, m); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(serverlessExchangeWait - time.Second)
+	select {
+	case <-done:
+		t.Fatal(`returned before serverlessExchangeWait`)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal(`gave up`)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`maintainWithoutServer did not return`)
+	}
+
+	// 返答で知ったピアに接続します。自分はアドレス帳に加えません。
+	if got := addressBookPeers(peer.addressBook); len(got) != 1 || got[0] != alive {
+		t.Errorf(`Entries = %v`, got)
+	}
+	if got := peer.Clients.NumOfConnectedPeers(); got != 1 {
+		t.Errorf(`connected = %d`, got)
+	}
+
+	// 待っている間に止められたら、接続せずに戻ります。
+	peer = newServerlessTestPeer(t, clock, `100`)
+	peer.Servers.add(neighbor)
+	peer.addressBook.Add(alive)
+	waitUntil(t, func() bool { return clock.Waiters() == 1 }) // 先に接続したピアのエコーのタイマーです
+	cancel()
+	if !peer.maintainWithoutServer(ctx) || peer.Clients.NumOfConnectedPeers() != 0 || clock.Waiters() != 1 {
+		t.Errorf(`connected = %d, Waiters = %d`, peer.Clients.NumOfConnectedPeers(), clock.Waiters())
+	}
+}
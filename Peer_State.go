@@ -0,0 +1,205 @@
+package epsp
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PeerState は、EPSPネットワークへの参加状態です
+type PeerState int
+
+// EPSPピアの参加状態
+const (
+	PeerStateOffline       PeerState = iota // 未参加
+	PeerStateTemporaryID                    // 暫定ピアID取得済
+	PeerStatePortCheck                      // ポート開放確認中
+	PeerStatePeerDiscovery                  // 接続先ピア探索中
+	PeerStateRegistration                   // ピアID本割当要求中
+	PeerStateKeyAssignment                  // 鍵割当要求中
+	PeerStateJoined                         // 参加中(エコー、鍵再割当)
+	PeerStateLeaving                        // 離脱中
+)
+
+var peerStateNames = map[PeerState]string{
+	PeerStateOffline:       `offline`,
+	PeerStateTemporaryID:   `temporary-id`,
+	PeerStatePortCheck:     `port-check`,
+	PeerStatePeerDiscovery: `peer-discovery`,
+	PeerStateRegistration:  `registration`,
+	PeerStateKeyAssignment: `key-assignment`,
+	PeerStateJoined:        `joined`,
+	PeerStateLeaving:       `leaving`,
+}
+
+// peerStateTransitions は、許される状態遷移です。未参加と離脱中へは、どの状態からも遷移できます。
+var peerStateTransitions = map[PeerState][]PeerState{
+	PeerStateOffline:       {PeerStateTemporaryID, PeerStateJoined},
+	PeerStateTemporaryID:   {PeerStatePortCheck, PeerStatePeerDiscovery},
+	PeerStatePortCheck:     {PeerStatePeerDiscovery},
+	PeerStatePeerDiscovery: {PeerStateRegistration, PeerStateJoined},
+	PeerStateRegistration:  {PeerStateKeyAssignment},
+	PeerStateKeyAssignment: {PeerStateJoined},
+	PeerStateJoined:        {PeerStatePeerDiscovery},
+	PeerStateLeaving:       {},
+}
+
+func (s PeerState) String() string {
+	if name, ok := peerStateNames[s]; ok {
+		return name
+	}
+	return `unknown`
+}
+
+// MarshalText は、状態を文字列で表現します
+func (s PeerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s PeerState) canTransitTo(next PeerState) bool {
+	if s == next || next == PeerStateOffline || next == PeerStateLeaving {
+		return true
+	}
+	for _, v := range peerStateTransitions[s] {
+		if v == next {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerStatus は、ピアの状態のスナップショットです
+type PeerStatus struct {
+	State            PeerState
+	PeerID           string
+	KeyExpire        time.Time
+	KeyValid         bool
+	LastEcho         time.Time
+	Global           bool
+	ProtocolTimeDiff time.Duration
+	ProtocolDrift    float64
+	Serverless       bool // サーバに接続できず、隣接ピアとだけでメッシュを維持しているか
+}
+
+// Status は、ピアの状態のスナップショットを返します
+func (peer *Peer) Status() PeerStatus {
+	keyStatus := peer.keys.Status()
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return PeerStatus{
+		State:            peer.state,
+		PeerID:           peer.peerID,
+		KeyExpire:        keyStatus.Expire,
+		KeyValid:         keyStatus.Valid,
+		LastEcho:         peer.lastEcho,
+		Global:           peer.global,
+		ProtocolTimeDiff: peer.protocolClock.Offset(),
+		ProtocolDrift:    peer.protocolClock.Drift(),
+		Serverless:       peer.serverless,
+	}
+}
+
+// PeerID は、サーバから割り当てられたピアIDを返します。未参加なら空です。
+func (peer *Peer) PeerID() string {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.peerID
+}
+
+func (peer *Peer) setPeerID(id string) {
+	peer.stateMu.Lock()
+	peer.peerID = id
+	peer.stateMu.Unlock()
+	peer.statusChanged(false)
+}
+
+// Global は、ポートが開放されているかを返します
+func (peer *Peer) Global() bool {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.global
+}
+
+func (peer *Peer) setGlobal(global bool) {
+	peer.stateMu.Lock()
+	peer.global = global
+	peer.stateMu.Unlock()
+}
+
+// RegionCounts は、サーバまたは地域ピア数(561)で知った、地域ごとのピア数を返します
+func (peer *Peer) RegionCounts() PeerCounts {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.regionCounts
+}
+
+// PeerCountsByRegion は、地域ごとのピア数を返します。
+//
+// Deprecated: 以前のフィールド PeerCountsByRegion の代わりです。RegionCounts を使ってください。
+func (peer *Peer) PeerCountsByRegion() PeerCounts {
+	return peer.RegionCounts()
+}
+
+// State は、現在の参加状態を返します
+func (peer *Peer) State() PeerState {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.state
+}
+
+// OnStateChange は、参加状態が変わったときに呼ばれる関数を登録します
+func (peer *Peer) OnStateChange(f func(from, to PeerState)) {
+	peer.stateMu.Lock()
+	peer.stateHandlers = append(peer.stateHandlers, f)
+	peer.stateMu.Unlock()
+}
+
+// onStatusChange は、ピアID(regionsがfalse)か、地域ごとのピア数(regionsがtrue)が変わったときに呼ばれる関数を登録します
+func (peer *Peer) onStatusChange(f func(regions bool)) {
+	peer.stateMu.Lock()
+	peer.statusHandlers = append(peer.statusHandlers, f)
+	peer.stateMu.Unlock()
+}
+
+func (peer *Peer) statusChanged(regions bool) {
+	peer.stateMu.RLock()
+	handlers := peer.statusHandlers
+	peer.stateMu.RUnlock()
+	for _, f := range handlers {
+		f(regions)
+	}
+}
+
+// setState は、参加状態を遷移させ、登録された関数に通知します
+func (peer *Peer) setState(next PeerState) error {
+	peer.stateMu.Lock()
+	prev := peer.state
+	if !prev.canTransitTo(next) {
+		peer.stateMu.Unlock()
+		return errors.Errorf(`不正な状態遷移 %s -> %s`, prev, next)
+	}
+	peer.state = next
+	handlers := peer.stateHandlers
+	peer.stateMu.Unlock()
+
+	if prev != next {
+		logln(`[DEBUG] ピア` + peer.PeerID() + `: 状態遷移 ` + prev.String() + ` -> ` + next.String())
+		for _, f := range handlers {
+			f(prev, next)
+		}
+	}
+	return nil
+}
+
+// transit は、setStateのエラーをログに出力します
+func (peer *Peer) transit(next PeerState) {
+	if err := peer.setState(next); err != nil {
+		logln(`[ERROR] ` + err.Error())
+	}
+}
+
+func (peer *Peer) setLastEcho(t time.Time) {
+	peer.stateMu.Lock()
+	peer.lastEcho = t
+	peer.stateMu.Unlock()
+}
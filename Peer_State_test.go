@@ -0,0 +1,102 @@
+package epsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+var allPeerStates = []PeerState{
+	PeerStateOffline, PeerStateTemporaryID, PeerStatePortCheck, PeerStatePeerDiscovery,
+	PeerStateRegistration, PeerStateKeyAssignment, PeerStateJoined, PeerStateLeaving,
+}
+
+func TestPeerStateCanTransitTo(t *testing.T) {
+	// 同じ状態と、未参加・離脱中以外に許される遷移です。
+	allowed := map[[2]PeerState]bool{
+		{PeerStateOffline, PeerStateTemporaryID}:        true,
+		{PeerStateOffline, PeerStateJoined}:             true, // 鍵ファイルのピアIDで参加しなおします
+		{PeerStateTemporaryID, PeerStatePortCheck}:      true,
+		{PeerStateTemporaryID, PeerStatePeerDiscovery}:  true, // ポート開放確認を省きます
+		{PeerStatePortCheck, PeerStatePeerDiscovery}:    true,
+		{PeerStatePeerDiscovery, PeerStateRegistration}: true,
+		{PeerStatePeerDiscovery, PeerStateJoined}:       true,
+		{PeerStateRegistration, PeerStateKeyAssignment}: true,
+		{PeerStateKeyAssignment, PeerStateJoined}:       true,
+		{PeerStateJoined, PeerStatePeerDiscovery}:       true,
+	}
+	for _, from := range allPeerStates {
+		for _, to := range allPeerStates {
+			want := from == to || to == PeerStateOffline || to == PeerStateLeaving || allowed[[2]PeerState{from, to}]
+			if got := from.canTransitTo(to); got != want {
+				t.Errorf(`%s -> %s = %v, want %v`, from, to, got, want)
+			}
+		}
+	}
+	if len(peerStateTransitions) != len(allPeerStates) {
+		t.Errorf(`peerStateTransitions has %d states`, len(peerStateTransitions))
+	}
+}
+
+func TestPeerStateString(t *testing.T) {
+	for _, s := range allPeerStates {
+		if b, err := s.MarshalText(); err != nil || string(b) != peerStateNames[s] || string(b) == `unknown` {
+			t.Errorf(`MarshalText(%d) = %s, %v`, s, b, err)
+		}
+	}
+	if got := PeerState(100).String(); got != `unknown` {
+		t.Errorf(`String = %s`, got)
+	}
+}
+
+func TestPeerSetState(t *testing.T) {
+	peer := &Peer{}
+	var first, second [][2]PeerState
+	peer.OnStateChange(func(from, to PeerState) { first = append(first, [2]PeerState{from, to}) })
+	peer.OnStateChange(func(from, to PeerState) { second = append(second, [2]PeerState{from, to}) })
+
+	steps := []struct {
+		to      PeerState
+		wantErr bool
+	}{
+		{PeerStateTemporaryID, false},
+		{PeerStateTemporaryID, false}, // 同じ状態なら、通知しません
+		{PeerStateJoined, true},       // 本割当と鍵割当を飛ばせません
+		{PeerStatePortCheck, false},
+		{PeerStatePeerDiscovery, false},
+		{PeerStateRegistration, false},
+		{PeerStateKeyAssignment, false},
+		{PeerStateJoined, false},
+		{PeerStateRegistration, true},
+		{PeerStateLeaving, false},
+		{PeerStateJoined, true}, // 離脱中からは、未参加へしか戻れません
+		{PeerStateOffline, false},
+	}
+	for _, s := range steps {
+		prev := peer.State()
+		err := peer.setState(s.to)
+		if (err != nil) != s.wantErr {
+			t.Errorf(`%s -> %s: err = %v`, prev, s.to, err)
+		}
+		want := s.to
+		if s.wantErr {
+			want = prev // 拒否した遷移では、状態を変えません
+		}
+		if peer.State() != want {
+			t.Errorf(`%s -> %s: State = %s`, prev, s.to, peer.State())
+		}
+	}
+
+	want := [][2]PeerState{
+		{PeerStateOffline, PeerStateTemporaryID},
+		{PeerStateTemporaryID, PeerStatePortCheck},
+		{PeerStatePortCheck, PeerStatePeerDiscovery},
+		{PeerStatePeerDiscovery, PeerStateRegistration},
+		{PeerStateRegistration, PeerStateKeyAssignment},
+		{PeerStateKeyAssignment, PeerStateJoined},
+		{PeerStateJoined, PeerStateLeaving},
+		{PeerStateLeaving, PeerStateOffline},
+	}
+	if !reflect.DeepEqual(first, want) || !reflect.DeepEqual(second, want) {
+		t.Errorf("notified %v and %v\nwant %v", first, second, want)
+	}
+}
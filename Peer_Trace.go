@@ -0,0 +1,140 @@
+package epsp
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var traceSeq uint64
+
+// MinTraceInterval は、TraceLimited で調査エコーを送る最小間隔です。ネットワークに調査エコーを送りすぎないよう、手動の調査とスナップショットで共有します。
+const MinTraceInterval = 10 * time.Minute
+
+// traceIntervalSlack は、定期実行のタイマーの揺れで最小間隔に満たなくならないよう、見逃す差です
+const traceIntervalSlack = time.Second
+
+// ErrTraceTooSoon は、前回の調査エコーから MinTraceInterval 経っていないことを表します
+var ErrTraceTooSoon = errors.Errorf(`前回の調査エコーから%v経っていません`, MinTraceInterval)
+
+type traceReply struct {
+	connected []string
+	hops      uint64
+	latency   time.Duration
+}
+
+// traceCollector は、一つの調査エコーに対する調査エコーリプライを集めます
+type traceCollector struct {
+	clock   Clock
+	started time.Time
+	mu      sync.Mutex
+	replies map[string]traceReply
+}
+
+func (c *traceCollector) add(recvdata []string) {
+	if len(recvdata) < 5 {
+		return
+	}
+	hops, err := strconv.ParseUint(recvdata[4], 10, 64)
+	if err != nil {
+		return
+	}
+	var connected []string
+	if recvdata[3] != `` {
+		connected = strings.Split(recvdata[3], `,`)
+	}
+	c.mu.Lock()
+	if _, dup := c.replies[recvdata[2]]; !dup {
+		c.replies[recvdata[2]] = traceReply{connected: connected, hops: hops, latency: c.clock.Now().Sub(c.started)}
+	}
+	c.mu.Unlock()
+}
+
+// newTraceID は、調査エコーの一意な数を返します
+func newTraceID(now time.Time) string {
+	return strconv.FormatInt(now.UnixNano()+int64(atomic.AddUint64(&traceSeq, 1)), 10)
+}
+
+// Trace は、調査エコー(615)を送信し、timeoutの間に届いた調査エコーリプライ(635)からネットワーク構成を返します。
+// 複数のTraceを同時に実行できます。
+func (peer *Peer) Trace(ctx context.Context, timeout time.Duration) (*Topology, error) {
+	if err := peer.canTrace(); err != nil {
+		return nil, err
+	}
+
+	now := peer.clock.Now()
+	traceID := newTraceID(now)
+	c := &traceCollector{clock: peer.clock, started: now, replies: make(map[string]traceReply)}
+	peer.traces.Store(traceID, c)
+	defer peer.traces.Delete(traceID)
+
+	logln(`[DEBUG] ピア` + peer.PeerID() + `: 調査エコー送信 ` + traceID)
+	peer.WriteExceptFrom(nil, NewMessage(CodeTrace, TraceRequest{Origin: peer.PeerID(), TraceID: traceID}.Fields()...))
+
+	timer := peer.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C():
+	}
+
+	c.mu.Lock()
+	t := newTopology(traceID, peer.PeerID(), c.started, peer.ConnectedPeersList(), c.replies)
+	c.mu.Unlock()
+
+	for i := range t.Nodes {
+		if t.Nodes[i].PeerID == peer.PeerID() {
+			t.Nodes[i].Agent = peer.MyAgent
+		} else if p := peer.PeerIDToP2PPeer(t.Nodes[i].PeerID); p != nil {
+			t.Nodes[i].Agent = p.Agent
+		}
+	}
+	return t, nil
+}
+
+// TraceLimited は、前回の TraceLimited から MinTraceInterval 経っている場合だけ Trace を行います。経っていなければ ErrTraceTooSoon を返します。
+// 送信できない場合は、間隔の計算に含めません。
+func (peer *Peer) TraceLimited(ctx context.Context, timeout time.Duration) (*Topology, error) {
+	if err := peer.canTrace(); err != nil {
+		return nil, err
+	}
+	peer.traceMu.Lock()
+	now := peer.clock.Now()
+	if !peer.lastTrace.IsZero() && now.Sub(peer.lastTrace) < MinTraceInterval-traceIntervalSlack {
+		peer.traceMu.Unlock()
+		return nil, ErrTraceTooSoon
+	}
+	peer.lastTrace = now
+	peer.traceMu.Unlock()
+	return peer.Trace(ctx, timeout)
+}
+
+// canTrace は、調査エコーを送信できなければ、その理由を返します
+func (peer *Peer) canTrace() error {
+	if peer.PeerID() == `` {
+		return errors.New(`ピアIDがありません`)
+	}
+	if peer.NumOfConnectedPeers() == 0 {
+		return errors.New(`接続中のピアがありません`)
+	}
+	return nil
+}
+
+// deliverTrace は、自ピア宛の調査エコーリプライを、実行中のTraceに渡します。該当するTraceがなければfalseを返します。
+func (peer *Peer) deliverTrace(recvdata []string) bool {
+	if len(recvdata) < 2 {
+		return false
+	}
+	c, ok := peer.traces.Load(recvdata[1])
+	if !ok {
+		return false
+	}
+	c.(*traceCollector).add(recvdata)
+	return true
+}
@@ -0,0 +1,112 @@
+package epsp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTraceConcurrent(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer, r := newTraceTestPeer(t, clock)
+	peer.events = NewEventStream(clock)
+	usercmd := make(chan []string, 1)
+	peer.usercmd = func(code string, retval ...string) { usercmd <- append([]string{code}, retval...) }
+
+	// 二つの調査エコーを同時に送り、それぞれの一意な数を読みます。
+	results := make([]chan *Topology, 2)
+	var ids []string
+	for i := range results {
+		results[i] = make(chan *Topology, 1)
+		go func(ch chan *Topology) {
+			topo, err := peer.Trace(context.Background(), time.Second)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- topo
+		}(results[i])
+		var m Message
+		if err := m.Unmarshal(readLine(t, r)); err != nil {
+			t.Fatal(err)
+		}
+		req, err := ParseTraceRequest(m.Fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, req.TraceID)
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf(`same trace ID %s`, ids[0])
+	}
+	waitUntil(t, func() bool { return clock.Waiters() == 2 })
+
+	reply := func(traceID, reporter string, connected []string, hops uint64) {
+		t.Helper()
+		m := NewMessage(CodeTraceReply, TraceReply{Origin: `1`, TraceID: traceID, Reporter: reporter, Connected: connected, Hops: hops}.Fields()...)
+		if sent, err := peer.code635(m); !sent || err != nil {
+			t.Fatalf(`code635 = %v, %v`, sent, err)
+		}
+	}
+	clock.Advance(30 * time.Millisecond)
+	reply(ids[0], `2`, []string{`1`, `3`}, 1)
+	reply(ids[0], `3`, []string{`2`}, 2)
+	clock.Advance(20 * time.Millisecond)
+	reply(ids[1], `2`, []string{`1`, `4`}, 1)
+	reply(ids[0], `2`, []string{`1`}, 1) // 重複したリプライは、最初のものを使います
+
+	// 実行中でない調査エコーのリプライは、利用者に渡します。
+	reply(`999`, `5`, []string{`1`}, 1)
+	select {
+	case got := <-usercmd:
+		if want := []string{CodeTraceReply, `1`, `999`, `5`, `1`, `1`}; !reflect.DeepEqual(got, want) {
+			t.Errorf(`usercmd = %v`, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`unknown trace reply not passed to usercmd`)
+	}
+
+	clock.Advance(time.Second - 50*time.Millisecond)
+	tests := []struct {
+		nodes []TopologyNode
+		edges []TopologyEdge
+	}{
+		{
+			[]TopologyNode{
+				{PeerID: `1`, Replied: true},
+				{PeerID: `2`, Hops: 1, Latency: 30 * time.Millisecond, Replied: true},
+				{PeerID: `3`, Hops: 2, Latency: 30 * time.Millisecond, Replied: true},
+			},
+			[]TopologyEdge{{`1`, `2`}, {`2`, `3`}},
+		},
+		{
+			[]TopologyNode{
+				{PeerID: `1`, Replied: true},
+				{PeerID: `2`, Hops: 1, Latency: 50 * time.Millisecond, Replied: true},
+				{PeerID: `4`, Hops: 2}, // リプライがなくても、接続先から分かります
+			},
+			[]TopologyEdge{{`1`, `2`}, {`2`, `4`}},
+		},
+	}
+	for i, tt := range tests {
+		topo := <-results[i]
+		if topo == nil {
+			t.Fatalf(`trace %d failed`, i)
+		}
+		if topo.TraceID != ids[i] || topo.Origin != `1` || !topo.Started.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf(`trace %d = %+v`, i, topo)
+		}
+		if !reflect.DeepEqual(topo.Nodes, tt.nodes) {
+			t.Errorf("trace %d: Nodes = %+v\nwant %+v", i, topo.Nodes, tt.nodes)
+		}
+		if !reflect.DeepEqual(topo.Edges, tt.edges) {
+			t.Errorf(`trace %d: Edges = %v, want %v`, i, topo.Edges, tt.edges)
+		}
+	}
+
+	// 終わった調査エコーは残しません。
+	peer.traces.Range(func(k, _ interface{}) bool {
+		t.Errorf(`trace %v left`, k)
+		return true
+	})
+}
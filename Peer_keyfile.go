@@ -2,8 +2,10 @@ package epsp
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,42 +18,85 @@ type keyFile struct {
 	Global            bool
 	PeerCountByRegion PeerCounts
 	Peers             []string
+	AddressBook       []AddressBookEntry
 }
 
 // SaveKey は、キーをセーブするメソッドです。
 func (peer *Peer) SaveKey() {
 	var k keyFile
-	k.Expire = peer.keyExpire
-	k.KeySig = peer.keySig
-	k.PeerID = peer.PeerID
-	k.PubKey = peer.pubKey
-	k.SecKey = peer.secKey
-	k.Global = peer.Global
-	k.PeerCountByRegion = peer.PeerCountsByRegion
+	pk, _ := peer.keys.Key()
+	k.Expire = pk.Expire
+	k.KeySig = pk.KeySig
+	k.PeerID = peer.PeerID()
+	k.PubKey = pk.PubKey
+	k.SecKey = pk.SecKey
+	k.Global = peer.Global()
+	k.PeerCountByRegion = peer.RegionCounts()
 
+	clients := peer.Clients.Snapshot()
 	maxRxUniq := uint64(0)
-	for i := range peer.Clients {
-		rxUniq := peer.Clients[i].RxUniq
+	for i := range clients {
+		rxUniq := atomic.LoadUint64(&clients[i].RxUniq)
 		if maxRxUniq < rxUniq {
 			maxRxUniq = rxUniq
 		}
 	}
 
-	for i := range peer.Clients {
-		if maxRxUniq < 10 || peer.Clients[i].RxUniq <= maxRxUniq/10 { // maxRxUniq < 10 or save only useful peers.
-			k.Peers = append(k.Peers, strings.Replace(peer.Clients[i].IPPort, `:`, `,`, 1)+`,`+peer.Clients[i].PeerID)
+	for i := range clients {
+		if maxRxUniq < 10 || atomic.LoadUint64(&clients[i].RxUniq) <= maxRxUniq/10 { // maxRxUniq < 10 or save only useful peers.
+			k.Peers = append(k.Peers, clients[i].GetIPPortPeerID())
 		}
 	}
 
-	keyfile, err := os.Create(peer.keyfilename)
+	peer.addressBook.Add(peer.Clients.ConnectedIPPortPeersList()...) // 接続できているピアは、アドレス帳でも新しくします。
+	k.AddressBook = peer.addressBook.Entries()
+
+	b, err := json.Marshal(k)
 	if err != nil {
-		logln(`[WARN] SaveKey OpenFile` + err.Error())
-		return
-	}
-	if err = json.NewEncoder(keyfile).Encode(k); err != nil {
 		logln(`[WARN] SaveKey Encode` + err.Error())
 		return
 	}
+	if err = peer.writeKeyFile(b); err != nil {
+		logln(`[WARN] SaveKey ` + err.Error())
+	}
+}
+
+// writeKeyFile は、鍵ファイルを書き換えます。秘密鍵を含むので、所有者だけが読める一時ファイルに書いてから置き換え、
+// 書き込みが重なったり途中で止まったりしても、壊れた鍵ファイルを残しません。
+func (peer *Peer) writeKeyFile(b []byte) error {
+	peer.keyfileMu.Lock()
+	defer peer.keyfileMu.Unlock()
+	tmp, err := ioutil.TempFile(filepath.Dir(peer.keyfilename), filepath.Base(peer.keyfilename)+`.*`) // 0600 で作ります
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(b, '\n')); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), peer.keyfilename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// SetKeyFile は、鍵ファイルの保存先を設定し、その鍵ファイルを読み込みます。
+// 設定しない場合は、一時ディレクトリにサーバ名から決めたファイル名で保存します。
+func (peer *Peer) SetKeyFile(filename string) error {
+	peer.keyfilename = filename
+	peers, err := peer.LoadKey()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	peer.candidatePeers = peers
+	return nil
 }
 
 // LoadKey は、キーをロードするメソッドです。
@@ -61,16 +106,18 @@ func (peer *Peer) LoadKey() (peers []string, err error) {
 	if err != nil {
 		return nil, err
 	}
+	defer keyfile.Close()
 	if err = json.NewDecoder(keyfile).Decode(&k); err != nil {
 		return nil, err
 	}
 	logln(`[INFO] ノード: 証明書有効期限`, k.Expire)
-	peer.keyExpire = k.Expire
-	peer.keySig = k.KeySig
-	peer.PeerID = k.PeerID
-	peer.pubKey = k.PubKey
-	peer.secKey = k.SecKey
-	peer.Global = k.Global
-	peer.PeerCountsByRegion = k.PeerCountByRegion
+	peer.keys.restore(PeerKey{SecKey: k.SecKey, PubKey: k.PubKey, Expire: k.Expire, KeySig: k.KeySig})
+	peer.stateMu.Lock()
+	peer.peerID = k.PeerID
+	peer.global = k.Global
+	peer.regionCounts = k.PeerCountByRegion
+	peer.stateMu.Unlock()
+	peer.addressBook.restore(k.AddressBook)
+	peer.addressBook.Add(k.Peers...)
 	return k.Peers, nil
 }
@@ -0,0 +1,141 @@
+package epsp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newKeyfileTestPeer は、鍵ファイルを読み書きできるだけの Peer を返します
+func newKeyfileTestPeer(clock Clock, keyfilename string) *Peer {
+	return &Peer{
+		clock:       clock,
+		keys:        NewKeyManager(clock, NewProtocolClock(clock)),
+		addressBook: NewAddressBook(clock),
+		keyfilename: keyfilename,
+	}
+}
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfilename := filepath.Join(dir, `peer.json`)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	saved := newKeyfileTestPeer(clock, keyfilename)
+	key := PeerKey{SecKey: `c2Vj`, PubKey: `cHVi`, Expire: clock.Now().Add(time.Hour), KeySig: `c2ln`}
+	saved.keys.restore(key)
+	saved.setPeerID(`100`)
+	saved.setGlobal(true)
+	saved.regionCounts = PeerCounts{{Region: `250`, Count: 3}, {Region: `901`, Count: 1}}
+	saved.addressBook.restore([]AddressBookEntry{{Peer: `192.0.2.9,6911,9`, LastSeen: clock.Now().Add(-time.Hour), Failures: 2}})
+	client := newTestP2PPeer(clock, `192.0.2.1:6911`)
+	client.PeerID = `1`
+	saved.Clients.add(client)
+
+	clock.Advance(time.Minute)
+	saved.SaveKey()
+
+	// 読み込んだときの時刻で、前回の接続先をアドレス帳に加えます。アドレス帳の他の記録は、そのまま戻します。
+	clock.Advance(time.Hour)
+	loaded := newKeyfileTestPeer(clock, keyfilename)
+	peers, err := loaded.LoadKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, []string{`192.0.2.1,6911,1`}) {
+		t.Errorf(`peers = %v`, peers)
+	}
+	if got, _ := loaded.keys.Key(); !got.Expire.Equal(key.Expire) || got.SecKey != key.SecKey || got.PubKey != key.PubKey || got.KeySig != key.KeySig {
+		t.Errorf(`Key = %+v`, got)
+	}
+	if loaded.PeerID() != `100` || !loaded.Global() || !reflect.DeepEqual(loaded.RegionCounts(), saved.RegionCounts()) {
+		t.Errorf(`PeerID = %s, Global = %v, RegionCounts = %v`, loaded.PeerID(), loaded.Global(), loaded.RegionCounts())
+	}
+	want := []AddressBookEntry{
+		{Peer: `192.0.2.1,6911,1`, LastSeen: clock.Now()},
+		{Peer: `192.0.2.9,6911,9`, LastSeen: clock.Now().Add(-2*time.Hour - time.Minute), Failures: 2},
+	}
+	es := loaded.addressBook.Entries()
+	if len(es) != len(want) {
+		t.Fatalf(`Entries = %+v`, es)
+	}
+	for i := range want {
+		if es[i].Peer != want[i].Peer || !es[i].LastSeen.Equal(want[i].LastSeen) || es[i].Failures != want[i].Failures {
+			t.Errorf(`Entries[%d] = %+v, want %+v`, i, es[i], want[i])
+		}
+	}
+}
+
+func TestSetKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 鍵ファイルがなければ、そのまま始めます。
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := newKeyfileTestPeer(clock, ``)
+	if err := peer.SetKeyFile(filepath.Join(dir, `none.json`)); err != nil || peer.candidatePeers != nil {
+		t.Errorf(`SetKeyFile = %v, candidatePeers = %v`, err, peer.candidatePeers)
+	}
+
+	broken := filepath.Join(dir, `broken.json`)
+	if err := ioutil.WriteFile(broken, []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SetKeyFile(broken); err == nil {
+		t.Error(`loaded a broken key file`)
+	}
+}
+
+func TestSaveKeyConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfilename := filepath.Join(dir, `peer.json`)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := newKeyfileTestPeer(clock, keyfilename)
+	peer.keys.restore(PeerKey{SecKey: `c2Vj`, Expire: clock.Now().Add(time.Hour)})
+	peer.setPeerID(`100`)
+	for i := 0; i < 50; i++ {
+		peer.addressBook.Add(`192.0.2.` + strconv.Itoa(i) + `,6911,` + strconv.Itoa(i))
+	}
+
+	// 鍵の更新とメインループが同時に保存しても、読み込める鍵ファイルが残ります。
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peer.SaveKey()
+		}()
+	}
+	wg.Wait()
+
+	if _, err := newKeyfileTestPeer(clock, keyfilename).LoadKey(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(keyfilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf(`mode = %v`, fi.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf(`temporary files left: %d files`, len(files))
+	}
+}
@@ -0,0 +1,82 @@
+package epsp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// portMappingLifetime は、ポートマッピングの有効期間です。有効期間の半分を過ぎたら更新します。
+const portMappingLifetime = 1 * time.Hour
+
+// PortMapper は、NATルータにTCPポートの転送を要求します。UPnP-IGDとNAT-PMPの実装があります。
+type PortMapper interface {
+	// AddPortMapping は、外部ポートexternalから内部ポートinternalへの転送を要求し、割り当てられた外部ポートを返します
+	AddPortMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, error)
+	// DeletePortMapping は、転送を削除します
+	DeletePortMapping(ctx context.Context, internal, external int) error
+	// ExternalIP は、ルータの外部IPアドレスを返します
+	ExternalIP(ctx context.Context) (net.IP, error)
+}
+
+// SetAdvertisedPort は、サーバに通知するポート番号を設定します。
+// NATやDocker(-P)で、外部から見えるポートが待受ポートと異なる場合に設定します。
+func (peer *Peer) SetAdvertisedPort(port int) {
+	peer.advertisedPort = port
+}
+
+// SetPortMapper は、ポート開放確認の前にポート転送を要求するPortMapperを設定します
+func (peer *Peer) SetPortMapper(m PortMapper) {
+	peer.portMapper = m
+}
+
+// publicPort は、サーバに通知するポート番号を返します
+func (peer *Peer) publicPort(port int) int {
+	if peer.mappedPort != 0 {
+		return peer.mappedPort
+	}
+	if peer.advertisedPort != 0 {
+		return peer.advertisedPort
+	}
+	return port
+}
+
+// mapPort は、必要に応じてポート転送を要求、更新します
+func (peer *Peer) mapPort(ctx context.Context, port int) {
+	if peer.portMapper == nil || peer.clock.Now().Sub(peer.mappedTime) < portMappingLifetime/2 {
+		return
+	}
+	external := peer.mappedPort
+	if external == 0 {
+		external = peer.publicPort(port)
+	}
+	ctxtimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mapped, err := peer.portMapper.AddPortMapping(ctxtimeout, port, external, portMappingLifetime)
+	if err != nil {
+		logln(`[WARN] ポート転送要求 ` + err.Error())
+		return
+	}
+	if ip, err := peer.portMapper.ExternalIP(ctxtimeout); err == nil {
+		logln(`[INFO] ポート転送: `, net.JoinHostPort(ip.String(), strconv.Itoa(mapped)), ` -> `, port)
+	} else {
+		logln(`[INFO] ポート転送: `, mapped, ` -> `, port)
+	}
+	peer.mappedPort = mapped
+	peer.mappedTime = peer.clock.Now()
+}
+
+// unmapPort は、ポート転送を削除します
+func (peer *Peer) unmapPort(port int) {
+	if peer.portMapper == nil || peer.mappedPort == 0 {
+		return
+	}
+	ctxtimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := peer.portMapper.DeletePortMapping(ctxtimeout, port, peer.mappedPort); err != nil {
+		logln(`[WARN] ポート転送削除 ` + err.Error())
+	}
+	peer.mappedPort = 0
+	peer.mappedTime = time.Time{}
+}
@@ -0,0 +1,106 @@
+package epsp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	natpmpPort         = `5351`
+	natpmpOpExternalIP = 0
+	natpmpOpMapTCP     = 2
+	natpmpRetry        = 9 // RFC 6886 3.1 250ms から倍々で9回
+)
+
+// NATPMPClient は、NAT-PMP(RFC 6886)でゲートウェイにポート転送を要求します
+type NATPMPClient struct {
+	Gateway string
+}
+
+// NewNATPMPClient は、ゲートウェイのアドレスからNATPMPClientを作ります。
+// ポートを省略した場合は5351番を使います。テスト用の偽ゲートウェイには、host:portで指定します。
+func NewNATPMPClient(gateway string) *NATPMPClient {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, natpmpPort)
+	}
+	return &NATPMPClient{Gateway: gateway}
+}
+
+// request は、要求を送信し、opに対応する応答を返します
+func (c *NATPMPClient) request(ctx context.Context, req []byte, op byte, size int) ([]byte, error) {
+	conn, err := net.Dial(`udp`, c.Gateway)
+	if err != nil {
+		return nil, errors.Wrap(err, `NAT-PMP Dial`)
+	}
+	defer conn.Close()
+
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 16)
+	for i := 0; i < natpmpRetry; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, errors.Wrap(err, `NAT-PMP Write`)
+		}
+		deadline := time.Now().Add(wait)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, errors.Wrap(err, `NAT-PMP SetReadDeadline`)
+		}
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < size || buf[0] != 0 || buf[1] != op|0x80 {
+				continue // 他の要求への応答
+			}
+			if result := binary.BigEndian.Uint16(buf[2:4]); result != 0 {
+				return nil, errors.Errorf(`NAT-PMP 結果コード %d`, result)
+			}
+			return buf[:n], nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), `NAT-PMP`)
+		default:
+		}
+		wait *= 2
+	}
+	return nil, errors.Wrap(err, `NAT-PMP 応答なし`)
+}
+
+// AddPortMapping は、外部ポートexternalから内部ポートinternalへのTCP転送を要求し、割り当てられた外部ポートを返します
+func (c *NATPMPClient) AddPortMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, error) {
+	req := make([]byte, 12)
+	req[1] = natpmpOpMapTCP
+	binary.BigEndian.PutUint16(req[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:8], uint16(external))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	res, err := c.request(ctx, req, natpmpOpMapTCP, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(res[10:12])), nil
+}
+
+// DeletePortMapping は、TCP転送を削除します。有効期間0の転送要求で削除します。
+func (c *NATPMPClient) DeletePortMapping(ctx context.Context, internal, external int) error {
+	_, err := c.AddPortMapping(ctx, internal, 0, 0)
+	return err
+}
+
+// ExternalIP は、ゲートウェイの外部IPアドレスを返します
+func (c *NATPMPClient) ExternalIP(ctx context.Context) (net.IP, error) {
+	res, err := c.request(ctx, []byte{0, natpmpOpExternalIP}, natpmpOpExternalIP, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
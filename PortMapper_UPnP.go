@@ -0,0 +1,271 @@
+package epsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ssdpAddr     = `239.255.255.250:1900`
+	upnpIGDType  = `urn:schemas-upnp-org:device:InternetGatewayDevice:1`
+	upnpDescribe = `epsp`
+)
+
+// UPnPClient は、UPnP-IGDのWANIPConnection/WANPPPConnectionサービスにポート転送を要求します
+type UPnPClient struct {
+	ControlURL  string
+	ServiceType string
+	LocalIP     net.IP
+	httpClient  *http.Client
+}
+
+// DiscoverUPnP は、SSDPでLAN内のインターネットゲートウェイを探し、UPnPClientを返します
+func DiscoverUPnP(ctx context.Context) (*UPnPClient, error) {
+	conn, err := net.ListenPacket(`udp4`, `:0`)
+	if err != nil {
+		return nil, errors.Wrap(err, `SSDP ListenPacket`)
+	}
+	defer conn.Close()
+
+	raddr, err := net.ResolveUDPAddr(`udp4`, ssdpAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, `SSDP ResolveUDPAddr`)
+	}
+	msearch := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + upnpIGDType + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(msearch), raddr); err != nil {
+		return nil, errors.Wrap(err, `SSDP M-SEARCH`)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, errors.Wrap(err, `SSDP SetReadDeadline`)
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.Wrap(err, `インターネットゲートウェイが見つかりません`)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := res.Header.Get(`Location`)
+		if location == `` {
+			continue
+		}
+		if c, err := NewUPnPClient(ctx, location); err == nil {
+			return c, nil
+		}
+		logln(`[DEBUG] UPnP: 対応サービスなし ` + location)
+	}
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+func (d upnpDevice) findWANConnection() (upnpService, bool) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, `:WANIPConnection:`) || strings.Contains(s.ServiceType, `:WANPPPConnection:`) {
+			return s, true
+		}
+	}
+	for _, dd := range d.Devices {
+		if s, ok := dd.findWANConnection(); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// NewUPnPClient は、デバイス記述のURLからUPnPClientを作ります。ゲートウェイが分かっている場合やテスト用の偽ゲートウェイに使います。
+func NewUPnPClient(ctx context.Context, descURL string) (*UPnPClient, error) {
+	c := &UPnPClient{httpClient: &http.Client{Timeout: 5 * time.Second}}
+
+	req, err := http.NewRequest(http.MethodGet, descURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP デバイス記述`)
+	}
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP デバイス記述取得`)
+	}
+	defer res.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err = xml.NewDecoder(res.Body).Decode(&root); err != nil {
+		return nil, errors.Wrap(err, `UPnP デバイス記述解析`)
+	}
+	service, ok := root.Device.findWANConnection()
+	if !ok {
+		return nil, errors.New(`UPnP WANIPConnectionがありません`)
+	}
+
+	base, err := url.Parse(descURL)
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP URL`)
+	}
+	if root.URLBase != `` {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, errors.Wrap(err, `UPnP URLBase`)
+		}
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP controlURL`)
+	}
+	c.ControlURL = control.String()
+	c.ServiceType = service.ServiceType
+
+	// ゲートウェイへの経路のローカルアドレスを、転送先とします。
+	host := control.Host
+	if control.Port() == `` {
+		host = net.JoinHostPort(control.Hostname(), `80`)
+	}
+	udp, err := net.Dial(`udp`, host)
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP ローカルアドレス`)
+	}
+	c.LocalIP = udp.LocalAddr().(*net.UDPAddr).IP
+	_ = udp.Close()
+
+	logln(`[DEBUG] UPnP: ` + c.ServiceType + ` ` + c.ControlURL)
+	return c, nil
+}
+
+// soap は、SOAPアクションを呼び出し、応答の要素を返します
+func (c *UPnPClient) soap(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + c.ServiceType + `">`)
+	for _, arg := range args {
+		body.WriteString(`<` + arg[0] + `>`)
+		if err := xml.EscapeText(&body, []byte(arg[1])); err != nil {
+			return nil, err
+		}
+		body.WriteString(`</` + arg[0] + `>`)
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest(http.MethodPost, c.ControlURL, &body)
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP `+action)
+	}
+	req.Header.Set(`Content-Type`, `text/xml; charset="utf-8"`)
+	req.Header.Set(`SOAPAction`, `"`+c.ServiceType+`#`+action+`"`)
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP `+action)
+	}
+	defer res.Body.Close()
+
+	values, err := soapValues(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, `UPnP `+action+` 応答解析`)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(`UPnP %s: %s %s %s`, action, res.Status, values[`errorCode`], values[`errorDescription`])
+	}
+	return values, nil
+}
+
+// soapValues は、SOAP応答中の葉要素を名前と値の組にします
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	dec := xml.NewDecoder(r)
+	var name string
+	var text []byte
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text = text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = strings.TrimSpace(string(text))
+			}
+			name = ``
+		}
+	}
+}
+
+// AddPortMapping は、外部ポートexternalから内部ポートinternalへのTCP転送を要求します
+func (c *UPnPClient) AddPortMapping(ctx context.Context, internal, external int, lifetime time.Duration) (int, error) {
+	_, err := c.soap(ctx, `AddPortMapping`, [][2]string{
+		{`NewRemoteHost`, ``},
+		{`NewExternalPort`, strconv.Itoa(external)},
+		{`NewProtocol`, `TCP`},
+		{`NewInternalPort`, strconv.Itoa(internal)},
+		{`NewInternalClient`, c.LocalIP.String()},
+		{`NewEnabled`, `1`},
+		{`NewPortMappingDescription`, upnpDescribe},
+		{`NewLeaseDuration`, strconv.Itoa(int(lifetime / time.Second))},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return external, nil
+}
+
+// DeletePortMapping は、TCP転送を削除します
+func (c *UPnPClient) DeletePortMapping(ctx context.Context, internal, external int) error {
+	_, err := c.soap(ctx, `DeletePortMapping`, [][2]string{
+		{`NewRemoteHost`, ``},
+		{`NewExternalPort`, strconv.Itoa(external)},
+		{`NewProtocol`, `TCP`},
+	})
+	return err
+}
+
+// ExternalIP は、ゲートウェイの外部IPアドレスを返します
+func (c *UPnPClient) ExternalIP(ctx context.Context) (net.IP, error) {
+	values, err := c.soap(ctx, `GetExternalIPAddress`, nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(values[`NewExternalIPAddress`])
+	if ip == nil {
+		return nil, errors.New(`UPnP 外部IPアドレス書式異常: ` + values[`NewExternalIPAddress`])
+	}
+	return ip, nil
+}
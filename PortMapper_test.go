@@ -0,0 +1,409 @@
+package epsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATPMP は、テスト用のNAT-PMPゲートウェイです。外部ポートは、要求されたポートにoffsetを足して割り当てます。
+type fakeNATPMP struct {
+	conn   net.PacketConn
+	ip     net.IP
+	offset int
+
+	mu       sync.Mutex
+	mappings map[int]int // 内部ポート -> 外部ポート
+	requests int
+}
+
+func newFakeNATPMP(t *testing.T, offset int) *fakeNATPMP {
+	conn, err := net.ListenPacket(`udp4`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeNATPMP{conn: conn, ip: net.IPv4(203, 0, 113, 7), offset: offset, mappings: make(map[int]int)}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+	return g
+}
+
+func (g *fakeNATPMP) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 || buf[0] != 0 {
+			continue
+		}
+		g.mu.Lock()
+		g.requests++
+		var res []byte
+		switch buf[1] {
+		case natpmpOpExternalIP:
+			res = make([]byte, 12)
+			copy(res[8:12], g.ip.To4())
+		case natpmpOpMapTCP:
+			if n < 12 {
+				g.mu.Unlock()
+				continue
+			}
+			internal := int(binary.BigEndian.Uint16(buf[4:6]))
+			external := int(binary.BigEndian.Uint16(buf[6:8]))
+			lifetime := binary.BigEndian.Uint32(buf[8:12])
+			res = make([]byte, 16)
+			copy(res[4:6], buf[4:6])
+			if lifetime == 0 {
+				delete(g.mappings, internal)
+			} else {
+				external += g.offset
+				g.mappings[internal] = external
+				binary.BigEndian.PutUint16(res[10:12], uint16(external))
+				binary.BigEndian.PutUint32(res[12:16], lifetime)
+			}
+		default:
+			res = make([]byte, 8)
+			binary.BigEndian.PutUint16(res[2:4], 5) // Unsupported opcode
+		}
+		g.mu.Unlock()
+		res[1] = buf[1] | 0x80
+		g.conn.WriteTo(res, addr)
+	}
+}
+
+func (g *fakeNATPMP) mapping(internal int) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	external, ok := g.mappings[internal]
+	return external, ok
+}
+
+func (g *fakeNATPMP) requestCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+func TestNATPMPClient(t *testing.T) {
+	g := newFakeNATPMP(t, 1000)
+	c := NewNATPMPClient(g.conn.LocalAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ip, err := c.ExternalIP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(g.ip) {
+		t.Errorf(`ExternalIP = %v, want %v`, ip, g.ip)
+	}
+
+	mapped, err := c.AddPortMapping(ctx, 6911, 6911, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped != 7911 {
+		t.Errorf(`AddPortMapping = %d, want 7911`, mapped)
+	}
+	if external, ok := g.mapping(6911); !ok || external != 7911 {
+		t.Errorf(`gateway mapping = %d, %v`, external, ok)
+	}
+
+	if err = c.DeletePortMapping(ctx, 6911, mapped); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mapping(6911); ok {
+		t.Error(`mapping remains after DeletePortMapping`)
+	}
+}
+
+func TestNATPMPClientNoResponse(t *testing.T) {
+	conn, err := net.ListenPacket(`udp4`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewNATPMPClient(conn.LocalAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.ExternalIP(ctx); err == nil {
+		t.Error(`ExternalIP succeeded without gateway response`)
+	}
+}
+
+func TestNewNATPMPClientDefaultPort(t *testing.T) {
+	if c := NewNATPMPClient(`192.0.2.1`); c.Gateway != `192.0.2.1:5351` {
+		t.Errorf(`Gateway = %q`, c.Gateway)
+	}
+	if c := NewNATPMPClient(`192.0.2.1:15351`); c.Gateway != `192.0.2.1:15351` {
+		t.Errorf(`Gateway = %q`, c.Gateway)
+	}
+}
+
+// fakeIGD は、テスト用のUPnPインターネットゲートウェイです。WANIPConnectionは、WANDevice の下の WANConnectionDevice にあります。
+type fakeIGD struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	mappings map[string]string // 外部ポート -> 内部クライアント:内部ポート
+}
+
+const fakeIGDServiceType = `urn:schemas-upnp-org:service:WANIPConnection:1`
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	g := &fakeIGD{mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/desc.xml`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/xml`)
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+ <device>
+  <deviceType>`+upnpIGDType+`</deviceType>
+  <serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/l3f</controlURL></service></serviceList>
+  <deviceList><device>
+   <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+   <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+    <serviceList><service><serviceType>`+fakeIGDServiceType+`</serviceType><controlURL>/ctl/IPConn</controlURL></service></serviceList>
+   </device></deviceList>
+  </device></deviceList>
+ </device>
+</root>`)
+	})
+	mux.HandleFunc(`/ctl/IPConn`, g.control)
+	g.server = httptest.NewServer(mux)
+	t.Cleanup(g.server.Close)
+	return g
+}
+
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := soapValues(bytes.NewReader(b))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.Header.Get(`SOAPAction`)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	w.Header().Set(`Content-Type`, `text/xml; charset="utf-8"`)
+	switch action {
+	case `"` + fakeIGDServiceType + `#GetExternalIPAddress"`:
+		fmt.Fprint(w, soapResponse(`GetExternalIPAddress`, `<NewExternalIPAddress>203.0.113.9</NewExternalIPAddress>`))
+	case `"` + fakeIGDServiceType + `#AddPortMapping"`:
+		if args[`NewProtocol`] != `TCP` || args[`NewLeaseDuration`] != `3600` {
+			soapFault(w, `402`, `Invalid Args`)
+			return
+		}
+		g.mappings[args[`NewExternalPort`]] = net.JoinHostPort(args[`NewInternalClient`], args[`NewInternalPort`])
+		fmt.Fprint(w, soapResponse(`AddPortMapping`, ``))
+	case `"` + fakeIGDServiceType + `#DeletePortMapping"`:
+		if _, ok := g.mappings[args[`NewExternalPort`]]; !ok {
+			soapFault(w, `714`, `NoSuchEntryInArray`)
+			return
+		}
+		delete(g.mappings, args[`NewExternalPort`])
+		fmt.Fprint(w, soapResponse(`DeletePortMapping`, ``))
+	default:
+		soapFault(w, `401`, `Invalid Action`)
+	}
+}
+
+func (g *fakeIGD) mapping(external int) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.mappings[strconv.Itoa(external)]
+	return m, ok
+}
+
+func soapResponse(action, body string) string {
+	return `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<u:` + action + `Response xmlns:u="` + fakeIGDServiceType + `">` + body + `</u:` + action + `Response>` +
+		`</s:Body></s:Envelope>`
+}
+
+func soapFault(w http.ResponseWriter, code, desc string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>`+code+`</errorCode><errorDescription>`+desc+`</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`)
+}
+
+func TestUPnPClient(t *testing.T) {
+	g := newFakeIGD(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := NewUPnPClient(ctx, g.server.URL+`/desc.xml`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServiceType != fakeIGDServiceType || c.ControlURL != g.server.URL+`/ctl/IPConn` {
+		t.Fatalf(`service = %q %q`, c.ServiceType, c.ControlURL)
+	}
+	if !c.LocalIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf(`LocalIP = %v`, c.LocalIP)
+	}
+
+	ip, err := c.ExternalIP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(203, 0, 113, 9)) {
+		t.Errorf(`ExternalIP = %v`, ip)
+	}
+
+	mapped, err := c.AddPortMapping(ctx, 6911, 16911, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped != 16911 {
+		t.Errorf(`AddPortMapping = %d, want 16911`, mapped)
+	}
+	if m, ok := g.mapping(16911); !ok || m != `127.0.0.1:6911` {
+		t.Errorf(`gateway mapping = %q, %v`, m, ok)
+	}
+
+	if err = c.DeletePortMapping(ctx, 6911, 16911); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mapping(16911); ok {
+		t.Error(`mapping remains after DeletePortMapping`)
+	}
+	err = c.DeletePortMapping(ctx, 6911, 16911)
+	if err == nil {
+		t.Fatal(`DeletePortMapping of unknown mapping succeeded`)
+	}
+	if want := `714 NoSuchEntryInArray`; !strings.Contains(err.Error(), want) {
+		t.Errorf(`error = %q, want it to contain %q`, err, want)
+	}
+}
+
+func TestNewUPnPClientNoWANConnection(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<root><device><deviceType>`+upnpIGDType+`</deviceType></device></root>`)
+	}))
+	defer s.Close()
+	if _, err := NewUPnPClient(context.Background(), s.URL); err == nil {
+		t.Error(`NewUPnPClient succeeded without WANIPConnection`)
+	}
+}
+
+func TestPeerPublicPort(t *testing.T) {
+	peer := &Peer{clock: SystemClock}
+	if got := peer.publicPort(6911); got != 6911 {
+		t.Errorf(`publicPort = %d, want 6911`, got)
+	}
+	peer.SetAdvertisedPort(16911)
+	if got := peer.publicPort(6911); got != 16911 {
+		t.Errorf(`publicPort with advertised port = %d, want 16911`, got)
+	}
+	peer.mappedPort = 26911
+	if got := peer.publicPort(6911); got != 26911 {
+		t.Errorf(`publicPort with mapped port = %d, want 26911`, got)
+	}
+}
+
+func TestPeerMapPortNATPMP(t *testing.T) {
+	g := newFakeNATPMP(t, 1000)
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := &Peer{clock: clock}
+	peer.SetPortMapper(NewNATPMPClient(g.conn.LocalAddr().String()))
+	peer.SetAdvertisedPort(16911)
+	ctx := context.Background()
+
+	peer.mapPort(ctx, 6911)
+	if got := peer.publicPort(6911); got != 17911 {
+		t.Fatalf(`publicPort = %d, want 17911`, got)
+	}
+	if external, ok := g.mapping(6911); !ok || external != 17911 {
+		t.Fatalf(`gateway mapping = %d, %v`, external, ok)
+	}
+
+	// 有効期間の半分までは、要求しなおしません。
+	n := g.requestCount()
+	clock.Advance(portMappingLifetime/2 - time.Second)
+	peer.mapPort(ctx, 6911)
+	if g.requestCount() != n {
+		t.Error(`mapping renewed before half of its lifetime`)
+	}
+
+	// 半分を過ぎたら、割り当てられた外部ポートで更新します。
+	clock.Advance(time.Second)
+	peer.mapPort(ctx, 6911)
+	if g.requestCount() == n {
+		t.Error(`mapping not renewed after half of its lifetime`)
+	}
+	if got := peer.publicPort(6911); got != 18911 {
+		t.Errorf(`publicPort after renewal = %d, want 18911`, got)
+	}
+
+	peer.unmapPort(6911)
+	if _, ok := g.mapping(6911); ok {
+		t.Error(`mapping remains after unmapPort`)
+	}
+	if got := peer.publicPort(6911); got != 16911 {
+		t.Errorf(`publicPort after unmapPort = %d, want 16911`, got)
+	}
+}
+
+func TestPeerMapPortUPnP(t *testing.T) {
+	g := newFakeIGD(t)
+	c, err := NewUPnPClient(context.Background(), g.server.URL+`/desc.xml`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &Peer{clock: NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))}
+	peer.SetPortMapper(c)
+
+	peer.mapPort(context.Background(), 6911)
+	if got := peer.publicPort(6911); got != 6911 {
+		t.Fatalf(`publicPort = %d, want 6911`, got)
+	}
+	if m, ok := g.mapping(6911); !ok || m != `127.0.0.1:6911` {
+		t.Fatalf(`gateway mapping = %q, %v`, m, ok)
+	}
+
+	peer.unmapPort(6911)
+	if _, ok := g.mapping(6911); ok {
+		t.Error(`mapping remains after unmapPort`)
+	}
+}
+
+func TestPeerMapPortFailure(t *testing.T) {
+	g := newFakeIGD(t)
+	c, err := NewUPnPClient(context.Background(), g.server.URL+`/desc.xml`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ServiceType = `urn:schemas-upnp-org:service:WANIPConnection:9` // 偽ゲートウェイが知らないアクションにします
+	peer := &Peer{clock: NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))}
+	peer.SetPortMapper(c)
+	peer.SetAdvertisedPort(16911)
+
+	peer.mapPort(context.Background(), 6911)
+	if got := peer.publicPort(6911); got != 16911 {
+		t.Errorf(`publicPort after failed mapping = %d, want 16911`, got)
+	}
+	if !peer.mappedTime.IsZero() {
+		t.Error(`mappedTime set after failed mapping`)
+	}
+}
@@ -0,0 +1,165 @@
+package epsp
+
+import (
+	"sync"
+	"time"
+)
+
+// ProtocolClock の既定値です
+const (
+	DefaultClockRefreshInterval = 1 * time.Hour
+	clockMaxSamples             = 8
+	clockMinDriftSpan           = 30 * time.Minute // これより短い間隔の標本からは、ずれの速さを求めません
+	clockMaxDrift               = 1e-3             // 1000ppmを超えるずれの速さは、標本の誤差とみなします
+)
+
+// protocolTimeFormat は、プロトコル時刻と鍵の有効期限の書式です(日本時間)
+const protocolTimeFormat = `2006/01/02 15-04-05`
+
+// jst は、日本時間です。時刻を変換するたびにタイムゾーン情報を読まないよう、一度だけ読み込みます。
+var jst = loadJST()
+
+// loadJST は、日本時間を読み込みます。タイムゾーン情報がなければ、UTC+9の固定時差にします。
+func loadJST() *time.Location {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		loc = time.FixedZone("Asia/Tokyo", 9*60*60)
+	}
+	return loc
+}
+
+// ParseProtocolTimeString は、EPSPの時刻(プロトコル時刻、有効期限)を、日本時間として解釈します
+func ParseProtocolTimeString(s string) (time.Time, error) {
+	return time.ParseInLocation(protocolTimeFormat, s, jst)
+}
+
+// FormatProtocolTime は、時刻をEPSPの書式(日本時間)にします
+func FormatProtocolTime(t time.Time) string {
+	return t.In(jst).Format(protocolTimeFormat)
+}
+
+// clockSample は、一回の同期で得た、ローカル時刻とプロトコル時刻の差です
+type clockSample struct {
+	local  time.Time
+	offset time.Duration
+}
+
+// ProtocolClock は、サーバのプロトコル時刻(118/238)とローカル時刻の差を保持し、プロトコル時刻を返します。
+// 同期を重ねると、差が変わっていく速さ(ずれの速さ)も推定し、次の同期までの時刻を補正します。
+type ProtocolClock struct {
+	RefreshInterval time.Duration
+
+	clock   Clock
+	mu      sync.RWMutex
+	samples []clockSample
+	offset  time.Duration
+	drift   float64 // ローカル時刻1秒あたりに、差が変わる秒数
+	synced  time.Time
+}
+
+// NewProtocolClock は、clockの時刻をローカル時刻とする ProtocolClock を作ります。同期するまではローカル時刻を返します。
+// clockがnilなら SystemClock を使います。
+func NewProtocolClock(clock Clock) *ProtocolClock {
+	return &ProtocolClock{RefreshInterval: DefaultClockRefreshInterval, clock: clockOrSystem(clock)}
+}
+
+// Update は、sentに要求し、receivedに応答を受け取ったプロトコル時刻serverで同期します。
+// プロトコル時刻は秒単位なので、0.5秒を足して、往復の中間の時刻と比べます。
+func (c *ProtocolClock) Update(server, sent, received time.Time) {
+	mid := sent.Add(received.Sub(sent) / 2)
+	offset := server.Add(500 * time.Millisecond).Sub(mid)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = append(c.samples, clockSample{local: mid, offset: offset})
+	if len(c.samples) > clockMaxSamples {
+		c.samples = c.samples[len(c.samples)-clockMaxSamples:]
+	}
+	c.offset = offset
+	c.synced = mid
+	c.drift = estimateDrift(c.samples)
+	logln(`[DEBUG] プロトコル時刻 ` + FormatProtocolTime(server) + ` 差=` + offset.String())
+}
+
+// estimateDrift は、標本の差をローカル時刻に対して最小二乗で直線にあてはめ、その傾きを返します
+func estimateDrift(samples []clockSample) float64 {
+	if len(samples) < 2 || samples[len(samples)-1].local.Sub(samples[0].local) < clockMinDriftSpan {
+		return 0
+	}
+	base := samples[0].local
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x := s.local.Sub(base).Seconds()
+		y := s.offset.Seconds()
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	n := float64(len(samples))
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return 0
+	}
+	drift := (n*sxy - sx*sy) / den
+	if drift > clockMaxDrift || drift < -clockMaxDrift {
+		return 0
+	}
+	return drift
+}
+
+// Now は、現在のプロトコル時刻を返します
+func (c *ProtocolClock) Now() time.Time {
+	now := c.clock.Now()
+	return now.Add(c.offsetAt(now))
+}
+
+// offsetAt は、ローカル時刻nowでの、プロトコル時刻との差を返します
+func (c *ProtocolClock) offsetAt(now time.Time) time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.synced.IsZero() {
+		return 0
+	}
+	return c.offset + time.Duration(c.drift*float64(now.Sub(c.synced)))
+}
+
+// Offset は、プロトコル時刻からローカル時刻を引いた差を返します
+func (c *ProtocolClock) Offset() time.Duration {
+	return c.offsetAt(c.clock.Now())
+}
+
+// Drift は、推定したずれの速さ(ローカル時刻1秒あたりの秒数)を返します
+func (c *ProtocolClock) Drift() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.drift
+}
+
+// Synced は、最後に同期したローカル時刻を返します。同期していなければゼロ値です。
+func (c *ProtocolClock) Synced() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.synced
+}
+
+// NeedsRefresh は、同期していないか、前回の同期から RefreshInterval 以上経ったかを返します
+func (c *ProtocolClock) NeedsRefresh() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.synced.IsZero() || c.clock.Now().Sub(c.synced) >= c.RefreshInterval
+}
+
+// Expired は、EPSPの書式の有効期限expireが、プロトコル時刻で過ぎているかを返します。解釈できない場合も期限切れです。
+func (c *ProtocolClock) Expired(expire string) bool {
+	t, err := ParseProtocolTimeString(expire)
+	if err != nil {
+		return true
+	}
+	return c.Now().After(t)
+}
+
+// Until は、プロトコル時刻でtまでの時間を返します
+func (c *ProtocolClock) Until(t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
@@ -0,0 +1,159 @@
+package epsp
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// syncClock は、ローカル時刻で差がoffsetのプロトコル時刻を受け取ったものとして同期します。往復時間は0です。
+func syncClock(c *ProtocolClock, local time.Time, offset time.Duration) {
+	c.Update(local.Add(offset-500*time.Millisecond), local, local)
+}
+
+func TestProtocolTimeFormat(t *testing.T) {
+	utc := time.Date(2026, 1, 1, 15, 4, 5, 0, time.UTC)
+	if _, offset := utc.In(jst).Zone(); offset != 9*60*60 || jst.String() != `Asia/Tokyo` {
+		t.Errorf(`jst = %v, offset %d`, jst, offset)
+	}
+	if got := FormatProtocolTime(utc); got != `2026/01/02 00-04-05` {
+		t.Errorf(`FormatProtocolTime = %s`, got)
+	}
+	got, err := ParseProtocolTimeString(`2026/01/02 00-04-05`)
+	if err != nil || !got.Equal(utc) {
+		t.Errorf(`ParseProtocolTimeString = %v, %v`, got, err)
+	}
+	if _, err := ParseProtocolTimeString(`2026/01/02 00:04:05`); err == nil {
+		t.Error(`parsed time with colons`)
+	}
+}
+
+func TestProtocolClockUnsynced(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := NewProtocolClock(clock)
+	if !c.Now().Equal(clock.Now()) || c.Offset() != 0 || !c.Synced().IsZero() || !c.NeedsRefresh() {
+		t.Errorf(`Now = %v, Offset = %v, Synced = %v`, c.Now(), c.Offset(), c.Synced())
+	}
+}
+
+func TestProtocolClockUpdate(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := NewProtocolClock(clock)
+
+	// 往復の中間の時刻と、0.5秒を足したプロトコル時刻を比べます。
+	sent := clock.Now()
+	clock.Advance(200 * time.Millisecond)
+	c.Update(sent.Add(3*time.Second), sent, clock.Now())
+	if got := c.Offset(); got != 3400*time.Millisecond {
+		t.Errorf(`Offset = %v`, got)
+	}
+	if !c.Synced().Equal(sent.Add(100*time.Millisecond)) || c.Drift() != 0 {
+		t.Errorf(`Synced = %v, Drift = %v`, c.Synced(), c.Drift())
+	}
+	if c.NeedsRefresh() {
+		t.Error(`NeedsRefresh just after Update`)
+	}
+	clock.Advance(c.RefreshInterval - 100*time.Millisecond)
+	if !c.NeedsRefresh() {
+		t.Error(`no refresh after RefreshInterval`)
+	}
+	if !c.Now().Equal(clock.Now().Add(3400 * time.Millisecond)) {
+		t.Errorf(`Now = %v`, c.Now())
+	}
+}
+
+func TestProtocolClockDrift(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	const drift = 2e-5 // ローカル時刻1秒あたり20マイクロ秒ずつ差が増えます
+	tests := []struct {
+		name    string
+		span    time.Duration // 標本の間隔
+		n       int
+		noise   []time.Duration
+		drift   float64
+		samples int
+	}{
+		{`linear`, 10 * time.Minute, 4, nil, drift, 4},
+		{`least squares averages noise`, 10 * time.Minute, 4, []time.Duration{5 * time.Millisecond, -5 * time.Millisecond, -5 * time.Millisecond, 5 * time.Millisecond}, drift, 4},
+		{`too short span`, 5 * time.Minute, 4, nil, 0, 4},
+		{`keeps last samples`, 10 * time.Minute, clockMaxSamples + 4, nil, drift, clockMaxSamples},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(base)
+			c := NewProtocolClock(clock)
+			var elapsed time.Duration
+			for i := 0; i < tt.n; i++ {
+				offset := time.Second + time.Duration(drift*float64(elapsed))
+				if i < len(tt.noise) {
+					offset += tt.noise[i]
+				}
+				syncClock(c, clock.Now(), offset)
+				clock.Advance(tt.span)
+				elapsed += tt.span
+			}
+			if len(c.samples) != tt.samples {
+				t.Errorf(`samples = %d, want %d`, len(c.samples), tt.samples)
+			}
+			if math.Abs(c.Drift()-tt.drift) > 1e-9 {
+				t.Errorf(`Drift = %v, want %v`, c.Drift(), tt.drift)
+			}
+		})
+	}
+
+	// 最後の同期からの時間で補正します。
+	clock := NewFakeClock(base)
+	c := NewProtocolClock(clock)
+	syncClock(c, clock.Now(), time.Second)
+	clock.Advance(time.Hour)
+	syncClock(c, clock.Now(), time.Second+time.Duration(drift*float64(time.Hour)))
+	clock.Advance(time.Hour)
+	if got, want := c.Offset(), time.Second+time.Duration(2*drift*float64(time.Hour)); got < want-time.Microsecond || got > want+time.Microsecond {
+		t.Errorf(`Offset = %v, want %v`, got, want)
+	}
+
+	// 大きすぎるずれの速さは、誤差とみなします。
+	c = NewProtocolClock(clock)
+	syncClock(c, clock.Now(), 0)
+	clock.Advance(time.Hour)
+	syncClock(c, clock.Now(), 10*time.Second)
+	if c.Drift() != 0 || c.Offset() != 10*time.Second {
+		t.Errorf(`Drift = %v, Offset = %v`, c.Drift(), c.Offset())
+	}
+}
+
+func TestProtocolClockExpired(t *testing.T) {
+	// UTCでは1月1日ですが、日本時間では1月2日になる時刻です。
+	clock := NewFakeClock(time.Date(2026, 1, 1, 14, 59, 59, 0, time.UTC))
+	c := NewProtocolClock(clock)
+	tests := []struct {
+		expire string
+		want   bool
+	}{
+		{`2026/01/02 00-00-00`, false},
+		{`2026/01/01 23-59-58`, true},
+		{`2026/01/01 14-59-59`, true}, // UTCの時刻として書いたもの
+		{`2026/01/01 23-59-59`, false},
+		{`2026-01-02 00:00:00`, true}, // 解釈できない
+		{``, true},
+	}
+	for _, tt := range tests {
+		if got := c.Expired(tt.expire); got != tt.want {
+			t.Errorf(`Expired(%q) = %v, want %v`, tt.expire, got, tt.want)
+		}
+	}
+
+	clock.Advance(2 * time.Second)
+	if !c.Expired(`2026/01/02 00-00-00`) {
+		t.Error(`not expired after JST midnight`)
+	}
+
+	// プロトコル時刻が遅れていれば、ローカル時刻では過ぎていても期限内です。
+	syncClock(c, clock.Now(), -3*time.Second)
+	if c.Expired(`2026/01/02 00-00-00`) {
+		t.Error(`expired by local time`)
+	}
+	if got := c.Until(clock.Now()); got != 3*time.Second {
+		t.Errorf(`Until = %v`, got)
+	}
+}
@@ -0,0 +1,110 @@
+package epsp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProtocolVersion は、エージェント名の最初の項目にあるプロトコルバージョン(0.34r など)です。
+// 数字のあとの英字(r など)は、比較しません。
+type ProtocolVersion struct {
+	Major uint16
+	Minor uint16
+}
+
+// MinCompatibleProtocolVersion は、接続を受け入れる最低のプロトコルバージョンです。これより古い相手には 694 を返して切断します。
+var MinCompatibleProtocolVersion = ProtocolVersion{0, 30}
+
+// codeMinVersions は、コードを理解する最低のプロトコルバージョンです。これより古い相手には送りません。
+// ここにないコードは、MinCompatibleProtocolVersion 以上のすべての相手に送ります。
+// EPSPの仕様は、コードごとに対応するプロトコルバージョンを定めていないので、今は空です。
+// 加えるときは、そのコードを定めた仕様の版をコメントに書いてください。
+var codeMinVersions = map[string]ProtocolVersion{}
+
+// ParseProtocolVersion は、「0.34r」のようなプロトコルバージョンを解釈します
+func ParseProtocolVersion(s string) (v ProtocolVersion, err error) {
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return v, errors.New(`プロトコルバージョン書式異常 ` + s)
+	}
+	major, err := strconv.ParseUint(s[:i], 10, 16)
+	if err != nil {
+		return v, errors.New(`プロトコルバージョン書式異常 ` + s)
+	}
+	minor, err := strconv.ParseUint(strings.TrimRightFunc(s[i+1:], func(r rune) bool { return r < '0' || r > '9' }), 10, 16)
+	if err != nil {
+		return v, errors.New(`プロトコルバージョン書式異常 ` + s)
+	}
+	return ProtocolVersion{uint16(major), uint16(minor)}, nil
+}
+
+// AgentProtocolVersion は、エージェント名(バージョン:名前:日付)のプロトコルバージョンを返します
+func AgentProtocolVersion(agent []string) (ProtocolVersion, error) {
+	if len(agent) == 0 {
+		return ProtocolVersion{}, errors.New(`エージェント名なし`)
+	}
+	return ParseProtocolVersion(agent[0])
+}
+
+func (v ProtocolVersion) String() string {
+	return strconv.Itoa(int(v.Major)) + `.` + strconv.Itoa(int(v.Minor))
+}
+
+// Compare は、vがoより古ければ負、同じなら0、新しければ正を返します
+func (v ProtocolVersion) Compare(o ProtocolVersion) int {
+	switch {
+	case v.Major != o.Major:
+		return int(v.Major) - int(o.Major)
+	default:
+		return int(v.Minor) - int(o.Minor)
+	}
+}
+
+// IsZero は、バージョンが未定かを返します
+func (v ProtocolVersion) IsZero() bool {
+	return v == ProtocolVersion{}
+}
+
+// Compatible は、vの相手と通信できるかを返します
+func (v ProtocolVersion) Compatible() bool {
+	return v.Compare(MinCompatibleProtocolVersion) >= 0
+}
+
+// Supports は、vの相手がcodeを理解するかを返します。バージョン未定の相手は、MinCompatibleProtocolVersion とみなします。
+func (v ProtocolVersion) Supports(code string) bool {
+	if v.IsZero() {
+		v = MinCompatibleProtocolVersion
+	}
+	least, ok := codeMinVersions[code]
+	return !ok || v.Compare(least) >= 0
+}
+
+// negotiateVersion は、自分と相手のエージェント名から、その接続で使うプロトコルバージョン(古い方)を決めます。
+// 相手のバージョンが解釈できないか、MinCompatibleProtocolVersion より古ければエラーです。
+func negotiateVersion(mine, theirs []string) (ProtocolVersion, error) {
+	my, err := AgentProtocolVersion(mine)
+	if err != nil {
+		return ProtocolVersion{}, err
+	}
+	their, err := AgentProtocolVersion(theirs)
+	if err != nil {
+		return ProtocolVersion{}, err
+	}
+	if !their.Compatible() {
+		return their, errors.New(`プロトコルバージョン非互換 ` + their.String())
+	}
+	if their.Compare(my) < 0 {
+		return their, nil
+	}
+	return my, nil
+}
+
+func (v ProtocolVersion) pack() uint32 {
+	return uint32(v.Major)<<16 | uint32(v.Minor)
+}
+
+func unpackProtocolVersion(u uint32) ProtocolVersion {
+	return ProtocolVersion{uint16(u >> 16), uint16(u)}
+}
@@ -0,0 +1,134 @@
+package epsp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ProtocolVersion
+		err  bool
+	}{
+		{`0.34r`, ProtocolVersion{0, 34}, false},
+		{`0.34`, ProtocolVersion{0, 34}, false},
+		{`1.2b`, ProtocolVersion{1, 2}, false},
+		{`0.100`, ProtocolVersion{0, 100}, false},
+		{`034`, ProtocolVersion{}, true},
+		{`a.34`, ProtocolVersion{}, true},
+		{`0.r`, ProtocolVersion{}, true},
+		{``, ProtocolVersion{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProtocolVersion(tt.in)
+		if (err != nil) != tt.err || (!tt.err && got != tt.want) {
+			t.Errorf(`ParseProtocolVersion(%q) = %v, %v`, tt.in, got, err)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	mine := []string{`0.34r`, `github.com/toyo/epsp`, `20190310`}
+	tests := []struct {
+		theirs []string
+		want   ProtocolVersion
+		err    bool
+	}{
+		{[]string{`0.34r`, `P2PQ_Client`, `20190310`}, ProtocolVersion{0, 34}, false},
+		{[]string{`0.33a`}, ProtocolVersion{0, 33}, false},
+		{[]string{`0.100r`}, ProtocolVersion{0, 34}, false}, // 文字列では 0.100 < 0.34 です
+		{[]string{`1.0`}, ProtocolVersion{0, 34}, false},
+		{[]string{`0.29`}, ProtocolVersion{0, 29}, true},
+		{[]string{`unknown`}, ProtocolVersion{}, true},
+		{nil, ProtocolVersion{}, true},
+	}
+	for _, tt := range tests {
+		got, err := negotiateVersion(mine, tt.theirs)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf(`negotiateVersion(%v) = %v, %v`, tt.theirs, got, err)
+		}
+	}
+}
+
+// withCodeMinVersions は、テストの間だけ codeMinVersions を差し替えます
+func withCodeMinVersions(t *testing.T, m map[string]ProtocolVersion) {
+	saved := codeMinVersions
+	codeMinVersions = m
+	t.Cleanup(func() { codeMinVersions = saved })
+}
+
+func TestProtocolVersionSupports(t *testing.T) {
+	if !(ProtocolVersion{0, 30}).Supports(CodeTrace) || !(ProtocolVersion{}).Supports(CodeSensing) {
+		t.Error(`code gated without a table entry`)
+	}
+	withCodeMinVersions(t, map[string]ProtocolVersion{`999`: {0, 34}})
+	tests := []struct {
+		v    ProtocolVersion
+		want bool
+	}{
+		{ProtocolVersion{0, 34}, true},
+		{ProtocolVersion{1, 0}, true},
+		{ProtocolVersion{0, 33}, false},
+		{ProtocolVersion{}, false}, // 未定なら MinCompatibleProtocolVersion とみなします
+	}
+	for _, tt := range tests {
+		if got := tt.v.Supports(`999`); got != tt.want {
+			t.Errorf(`%v.Supports(999) = %v, want %v`, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestWriteExceptFrom(t *testing.T) {
+	withCodeMinVersions(t, map[string]ProtocolVersion{`999`: {0, 34}})
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := &Peer{clock: clock}
+
+	type conn struct {
+		p      *P2PPeer
+		remote *net.TCPConn
+		r      *bufio.Reader
+	}
+	newConn := func(pps *P2PPeers, peerID string, v ProtocolVersion) conn {
+		local, remote := tcpPair(t)
+		t.Cleanup(func() { local.Close(); remote.Close() })
+		p := newTestP2PPeer(clock, remote.LocalAddr().String())
+		p.PeerID = peerID
+		p.conn = local
+		p.setVersion(v)
+		pps.add(p)
+		return conn{p, remote, bufio.NewReader(remote)}
+	}
+	current := newConn(&peer.Clients, `1`, ProtocolVersion{0, 34})
+	old := newConn(&peer.Clients, `2`, ProtocolVersion{0, 33})
+	from := newConn(&peer.Servers, `3`, ProtocolVersion{0, 34})
+
+	peer.WriteExceptFrom(from.p, NewMessage(`999`, `a`, `b`))
+	peer.WriteExceptFrom(from.p, NewMessage(CodeEarthquake, `c`))
+	peer.WriteExceptFrom(nil, NewMessage(CodeTrace, `d`))
+
+	read := func(c conn) (lines []string) {
+		_ = c.remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			line, err := c.r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+		}
+	}
+	if got := read(current); len(got) != 3 || got[0] != "999 1 a:b\r\n" || got[1] != "551 1 c\r\n" || got[2] != "615 1 d\r\n" {
+		t.Errorf(`current = %q`, got)
+	}
+	if got := read(old); len(got) != 2 || got[0] != "551 1 c\r\n" {
+		t.Errorf(`old = %q`, got)
+	}
+	if got := read(from); len(got) != 1 || got[0] != "615 1 d\r\n" {
+		t.Errorf(`from = %q`, got)
+	}
+	if current.p.Tx != 3 || old.p.Tx != 2 {
+		t.Errorf(`Tx = %d, %d`, current.p.Tx, old.p.Tx)
+	}
+}
@@ -0,0 +1,73 @@
+package epsp
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPublishExpire は、Publisher が送出するメッセージの有効期間です
+const DefaultPublishExpire = 10 * time.Minute
+
+// Publisher は、サーバ保証用の秘密鍵で署名した地震情報(551)、津波予報(552)、地域ピア数(561)を、接続中のピアから送出します。
+// 隔離されたネットワークでの訓練などに使います。
+type Publisher struct {
+	Expire time.Duration
+
+	peer *Peer
+	key  *rsa.PrivateKey
+}
+
+// NewPublisher は、Publisher のコンストラクタです。keyは、peerのサーバ公開鍵と対になる秘密鍵でなければなりません。
+func NewPublisher(peer *Peer, key *rsa.PrivateKey) (*Publisher, error) {
+	if peer.serverKey == nil || peer.serverKey.N.Cmp(key.N) != 0 || peer.serverKey.E != key.E {
+		return nil, errors.New(`署名鍵がサーバ公開鍵と対になっていません`)
+	}
+	return &Publisher{Expire: DefaultPublishExpire, peer: peer, key: key}, nil
+}
+
+// Earthquake は、地震情報(551)を送出します
+func (p *Publisher) Earthquake(e *EarthquakeInfo) error {
+	summary, detail, err := EncodeEarthquake(e)
+	if err != nil {
+		return err
+	}
+	return p.publish(CodeEarthquake, summary, detail)
+}
+
+// Tsunami は、津波予報(552)を送出します
+func (p *Publisher) Tsunami(t *TsunamiInfo) error {
+	body, err := EncodeTsunami(t)
+	if err != nil {
+		return err
+	}
+	return p.publish(CodeTsunami, body)
+}
+
+// PeerCounts は、地域ピア数(561)を送出します
+func (p *Publisher) PeerCounts(pc PeerCounts) error {
+	return p.publish(CodeRegionPeers, pc.Encode())
+}
+
+// publish は、「データ署名:有効期限:データ...」を作って署名し、接続中のすべてのピアに送出します。
+// 自分にも受理したものとして配信し、戻ってきたものは重複として捨てます。
+func (p *Publisher) publish(code string, data ...string) error {
+	if p.peer.NumOfConnectedPeers() == 0 {
+		return errors.New(`接続中のピアがありません`)
+	}
+	expDate := FormatProtocolTime(p.peer.protocolClock.Now().Add(p.Expire))
+	sig, err := SignData(p.key, expDate, data[0])
+	if err != nil {
+		return err
+	}
+	m := NewMessage(code, append([]string{sig, expDate}, data...)...)
+	p.peer.sigmap.Store(sig, struct{}{})
+	p.peer.publish(m)
+	if code == CodeRegionPeers {
+		p.peer.code561(m.Fields)
+	}
+	p.peer.WriteExceptFrom(nil, m)
+	logln(`[INFO] 送出 ` + code)
+	return nil
+}
@@ -0,0 +1,198 @@
+package epsp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// durationMS は、ミリ秒に換算します
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type apiPeer struct {
+	PeerID             string    `json:"peer_id"`
+	State              PeerState `json:"state"`
+	Region             string    `json:"region"`
+	Area               string    `json:"area"`
+	Global             bool      `json:"global"`
+	Agent              []string  `json:"agent"`
+	BootTime           time.Time `json:"boot_time"`
+	KeyExpire          time.Time `json:"key_expire"`
+	KeyValid           bool      `json:"key_valid"`
+	LastEcho           time.Time `json:"last_echo"`
+	ProtocolTimeDiffMS float64   `json:"protocol_time_diff_ms"`
+	ProtocolDriftPPM   float64   `json:"protocol_drift_ppm"`
+	ConnectedPeers     uint64    `json:"connected_peers"`
+	Serverless         bool      `json:"serverless"`
+	AddressBook        int       `json:"address_book"` // アドレス帳の件数
+}
+
+type apiConn struct {
+	Side           string     `json:"side"` // client または server
+	PeerID         string     `json:"peer_id"`
+	Address        string     `json:"address"`
+	Connected      bool       `json:"connected"`
+	ConnectedAt    *time.Time `json:"connected_at"`
+	DisconnectedAt *time.Time `json:"disconnected_at"`
+	LastRXAt       *time.Time `json:"last_rx_at"`
+	RTTMS          *float64   `json:"rtt_ms"`
+	Agent          []string   `json:"agent"`
+	Version        string     `json:"version,omitempty"` // 取り決めたプロトコルバージョン
+	Tx             uint64     `json:"tx"`
+	Rx             uint64     `json:"rx"`
+	RxUniq         uint64     `json:"rx_uniq"`
+	RxDup          uint64     `json:"rx_dup"`
+}
+
+type apiPeers struct {
+	Clients []apiConn `json:"clients"`
+	Servers []apiConn `json:"servers"`
+}
+
+type apiRegion struct {
+	Region string `json:"region"`
+	Area   string `json:"area"`
+	Count  uint64 `json:"count"`
+}
+
+type apiRegions struct {
+	Total   uint64      `json:"total"`
+	Regions []apiRegion `json:"regions"`
+}
+
+type apiServer struct {
+	Server    string    `json:"server"`
+	Agent     []string  `json:"agent"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	State     PeerState `json:"state"`
+	EchoRTTMS *float64  `json:"echo_rtt_ms"`
+	Error     string    `json:"error,omitempty"`
+	OK        bool      `json:"ok"`
+}
+
+func newAPIConns(side string, ps []*P2PPeer) []apiConn {
+	conns := make([]apiConn, 0, len(ps))
+	for _, p := range ps {
+		t := p.Times()
+		c := apiConn{
+			Side:           side,
+			PeerID:         p.PeerID,
+			Address:        p.IPPort,
+			Connected:      t.Disc.IsZero(),
+			ConnectedAt:    timePtr(t.Conn),
+			DisconnectedAt: timePtr(t.Disc),
+			LastRXAt:       timePtr(t.LastRX),
+			Agent:          p.Agent,
+			Tx:             atomic.LoadUint64(&p.Tx),
+			Rx:             atomic.LoadUint64(&p.Rx),
+			RxUniq:         atomic.LoadUint64(&p.RxUniq),
+			RxDup:          atomic.LoadUint64(&p.RxDup),
+		}
+		if !t.Pong.IsZero() {
+			ms := durationMS(t.PingPong)
+			c.RTTMS = &ms
+		}
+		if v := p.Version(); !v.IsZero() {
+			c.Version = v.String()
+		}
+		if c.Agent == nil {
+			c.Agent = []string{}
+		}
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// apiHandler は、GETとHEADだけを受け付け、fの結果をJSONで返します。fがnilを返した場合は404です。
+func apiHandler(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set(`Allow`, `GET, HEAD`)
+			http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+			return
+		}
+		v := f()
+		if v == nil {
+			http.Error(w, `not found`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+		w.Header().Set(`Cache-Control`, `no-cache`)
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			logln(`[WARN] API応答 ` + err.Error())
+		}
+	}
+}
+
+// RestAPI は、読み取り専用のJSON APIを登録します。
+// /api/peer はこのピアの情報、/api/peers は接続中のピア、/api/regions は地域ごとのピア数、/api/peercounts は地域ごとのピア数の時系列、/api/server は最後のEPSPサーバとの通信を返します。
+func (peer *Peer) RestAPI(hs *http.ServeMux) {
+	hs.HandleFunc(`/api/peer`, apiHandler(func() interface{} {
+		st := peer.Status()
+		return apiPeer{
+			PeerID:             st.PeerID,
+			State:              st.State,
+			Region:             peer.region,
+			Area:               Area(peer.region),
+			Global:             st.Global,
+			Agent:              peer.MyAgent,
+			BootTime:           peer.BootTime,
+			KeyExpire:          st.KeyExpire,
+			KeyValid:           st.KeyValid,
+			LastEcho:           st.LastEcho,
+			ProtocolTimeDiffMS: durationMS(st.ProtocolTimeDiff),
+			ProtocolDriftPPM:   st.ProtocolDrift * 1e6,
+			ConnectedPeers:     peer.NumOfConnectedPeers(),
+			Serverless:         st.Serverless,
+			AddressBook:        peer.addressBook.Len(),
+		}
+	}))
+
+	hs.HandleFunc(`/api/peers`, apiHandler(func() interface{} {
+		return apiPeers{
+			Clients: newAPIConns(`client`, peer.Clients.Snapshot()),
+			Servers: newAPIConns(`server`, peer.Servers.Snapshot()),
+		}
+	}))
+
+	hs.HandleFunc(`/api/regions`, apiHandler(func() interface{} {
+		pc := peer.RegionCounts()
+		rs := apiRegions{Total: pc.NumOfAllPeers(), Regions: make([]apiRegion, 0, len(pc))}
+		for _, c := range pc {
+			rs.Regions = append(rs.Regions, apiRegion{Region: c.GetRegion(), Area: Area(c.GetRegion()), Count: c.GetCount()})
+		}
+		return rs
+	}))
+
+	hs.Handle(`/api/peercounts`, peer.peerCounts)
+
+	hs.HandleFunc(`/api/server`, apiHandler(func() interface{} {
+		s, ok := peer.LastServerSession()
+		if !ok {
+			return nil
+		}
+		as := apiServer{
+			Server:    s.Server,
+			Agent:     s.Agent,
+			StartedAt: s.Started,
+			EndedAt:   s.Ended,
+			State:     s.State,
+			OK:        s.Err == nil,
+		}
+		if as.Agent == nil {
+			as.Agent = []string{}
+		}
+		if s.EchoRTT != nil {
+			ms := durationMS(*s.EchoRTT)
+			as.EchoRTTMS = &ms
+		}
+		if s.Err != nil {
+			as.Error = s.Err.Error()
+		}
+		return as
+	}))
+}
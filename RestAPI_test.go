@@ -0,0 +1,135 @@
+package epsp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newRestTestPeer は、参加中で、クライアント1つと切断済のサーバ1つを持つ Peer を返します
+func newRestTestPeer() (*Peer, *FakeClock) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	protocolClock := NewProtocolClock(clock)
+	peer := &Peer{
+		clock:         clock,
+		protocolClock: protocolClock,
+		keys:          NewKeyManager(clock, protocolClock),
+		addressBook:   NewAddressBook(clock),
+		peerCounts:    NewPeerCountSeries(clock),
+		events:        NewEventStream(clock),
+		region:        `250`,
+		MyAgent:       []string{`0.34r`, `github.com/toyo/epsp`, `20190310`},
+		BootTime:      clock.Now(),
+	}
+	peer.setPeerID(`100`)
+	peer.setGlobal(true)
+	peer.transit(PeerStateJoined)
+	peer.keys.restore(PeerKey{SecKey: `c2Vj`, PubKey: `cHVi`, Expire: clock.Now().Add(time.Hour), KeySig: `c2ln`})
+	peer.addressBook.Add(`192.0.2.9,6911,9`)
+
+	client := newTestP2PPeer(clock, `192.0.2.1:6911`)
+	client.PeerID = `1`
+	client.Agent = []string{`0.34`, `p2pquake`, `1.0`}
+	client.setVersion(ProtocolVersion{0, 34})
+	client.SetConnTime()
+	client.Tx, client.Rx, client.RxUniq, client.RxDup = 5, 4, 3, 1
+	peer.Clients.add(client)
+
+	server := newTestP2PPeer(clock, `[2001:db8::2]:6911`)
+	server.PeerID = `2`
+	server.SetConnTime()
+	peer.Servers.add(server)
+
+	clock.Advance(time.Minute)
+	client.SetPingTime()
+	client.SetLastRXTime()
+	clock.Advance(25 * time.Millisecond)
+	client.SetPongTime()
+	server.SetDiscTime()
+	peer.setLastEcho(clock.Now())
+	peer.setPeerCounts(NewPeerCountsFromMap(map[string]uint64{`250`: 3, `901`: 1}))
+
+	rtt := 80 * time.Millisecond
+	peer.recordServerSession(ServerSession{
+		Server:  `192.0.2.100:6910`,
+		Agent:   []string{`0.34`, `epspserver`, `1.0`},
+		Started: clock.Now().Add(-time.Second),
+		Ended:   clock.Now(),
+		State:   PeerStateJoined,
+		EchoRTT: &rtt,
+		Err:     errors.New(`key request failed`),
+	})
+	return peer, clock
+}
+
+func TestRestAPIGolden(t *testing.T) {
+	peer, _ := newRestTestPeer()
+	mux := http.NewServeMux()
+	peer.RestAPI(mux)
+
+	for _, name := range []string{`peer`, `peers`, `regions`, `peercounts`, `server`} {
+		want, err := ioutil.ReadFile(filepath.Join(`testdata`, `api`, name+`.json`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/api/`+name, nil))
+		if w.Code != http.StatusOK || w.Header().Get(`Content-Type`) != `application/json; charset=utf-8` {
+			t.Errorf(`/api/%s: status = %d, Content-Type = %q`, name, w.Code, w.Header().Get(`Content-Type`))
+		}
+		if w.Body.String() != string(want) {
+			t.Errorf("/api/%s:\n%s\nwant\n%s", name, w.Body.String(), want)
+		}
+	}
+}
+
+func TestRestAPIMethods(t *testing.T) {
+	peer, _ := newRestTestPeer()
+	mux := http.NewServeMux()
+	peer.RestAPI(mux)
+
+	for _, path := range []string{`/api/peer`, `/api/peers`, `/api/regions`, `/api/peercounts`, `/api/server`} {
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			want := http.StatusMethodNotAllowed
+			if method == http.MethodGet || method == http.MethodHead {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf(`%s %s = %d, want %d`, method, path, w.Code, want)
+			}
+			if allow := w.Header().Get(`Allow`); (allow == `GET, HEAD`) != (want == http.StatusMethodNotAllowed) {
+				t.Errorf(`%s %s: Allow = %q`, method, path, allow)
+			}
+		}
+	}
+}
+
+func TestRestAPINoServerSession(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := &Peer{clock: clock, peerCounts: NewPeerCountSeries(clock)}
+	mux := http.NewServeMux()
+	peer.RestAPI(mux)
+
+	// まだサーバと通信していなければ404、接続も地域ごとのピア数もなければ空の配列です。
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/api/server`, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf(`/api/server = %d`, w.Code)
+	}
+	for path, want := range map[string]string{
+		`/api/peers`:   `{"clients":[],"servers":[]}` + "\n",
+		`/api/regions`: `{"total":0,"regions":[]}` + "\n",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf(`%s = %d %s`, path, w.Code, w.Body.String())
+		}
+	}
+}
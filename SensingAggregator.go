@@ -0,0 +1,196 @@
+package epsp
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SensingEventCode は、SensingAggregator が EventStream に発行するイベントのコードです
+const SensingEventCode = `sensing`
+
+const (
+	// DefaultSensingWindow は、地震感知情報をまとめる時間です。この時間、新たな感知がなければ、まとまりを終えます。
+	DefaultSensingWindow = 20 * time.Second
+	// DefaultSensingMinReports は、地震と判断するのに必要な感知の数です
+	DefaultSensingMinReports = 3
+	// DefaultSensingRatio は、地域のピア数に対する感知の割合のうち、地震が確実と見なす割合です
+	DefaultSensingRatio = 0.1
+	// DefaultSensingConfidence は、SensingEvent を発行する信頼度です
+	DefaultSensingConfidence = 0.5
+)
+
+// SensingRegion は、地域ごとの地震感知情報の集計です
+type SensingRegion struct {
+	Region  string  `json:"region"`
+	Area    string  `json:"area"`
+	Reports int     `json:"reports"`
+	Peers   uint64  `json:"peers"` // 地域のピア数(不明なら0)
+	Ratio   float64 `json:"ratio"` // 地域のピア数に対する感知の割合
+}
+
+// SensingEvent は、地震感知情報(555)をまとめて推定した、体感された地震です
+type SensingEvent struct {
+	Started    time.Time       `json:"started"` // 最初の感知を受信した時刻
+	Updated    time.Time       `json:"updated"` // 最後の感知を受信した時刻
+	Reports    int             `json:"reports"`
+	Confidence float64         `json:"confidence"` // 0から1
+	Region     string          `json:"region"`     // 震央地域の推定(割合が最も高い地域)
+	Area       string          `json:"area"`
+	Latitude   float64         `json:"latitude,omitempty"` // 割合で重みづけした、感知地域の中心
+	Longitude  float64         `json:"longitude,omitempty"`
+	Regions    []SensingRegion `json:"regions"` // 割合の高い順
+}
+
+type sensingReport struct {
+	received time.Time
+	region   string
+}
+
+// SensingAggregator は、地震感知情報(555)を時間と地域でまとめ、地震が体感された信頼度を求めます。
+// 信頼度が一定を超えると、SensingEventCode のイベントを発行します。
+// 同じ公開鍵からの感知は、一つのまとまりの中で一度だけ数えます。
+type SensingAggregator struct {
+	Window     time.Duration
+	MinReports int
+	Ratio      float64
+	Confidence float64
+
+	peer      *Peer
+	mu        sync.Mutex
+	reports   []sensingReport
+	seen      map[string]bool
+	published *SensingEvent
+	handlers  []func(*SensingEvent)
+	last      *SensingEvent
+}
+
+// NewSensingAggregator は、SensingAggregator のコンストラクタです。peerのピア数で正規化し、peerのEventStreamに発行します。
+func NewSensingAggregator(peer *Peer) *SensingAggregator {
+	return &SensingAggregator{
+		Window:     DefaultSensingWindow,
+		MinReports: DefaultSensingMinReports,
+		Ratio:      DefaultSensingRatio,
+		Confidence: DefaultSensingConfidence,
+		peer:       peer,
+		seen:       make(map[string]bool),
+	}
+}
+
+// OnEvent は、SensingEvent を受け取る関数を登録します
+func (a *SensingAggregator) OnEvent(f func(*SensingEvent)) {
+	a.mu.Lock()
+	a.handlers = append(a.handlers, f)
+	a.mu.Unlock()
+}
+
+// Last は、最後に発行した SensingEvent を返します。まだなければnilです。
+func (a *SensingAggregator) Last() *SensingEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+// Add は、受信時刻atの地震感知情報を加えます
+func (a *SensingAggregator) Add(r *SensingReport, at time.Time) {
+	a.mu.Lock()
+	if n := len(a.reports); n != 0 && at.Sub(a.reports[n-1].received) > a.Window {
+		a.reports = nil // 前のまとまりを終えます
+		a.seen = make(map[string]bool)
+		a.published = nil
+	}
+	if a.seen[r.PubKey] {
+		a.mu.Unlock()
+		return
+	}
+	a.seen[r.PubKey] = true
+	a.reports = append(a.reports, sensingReport{received: at, region: r.Region})
+
+	ev := a.evaluate(a.peer.RegionCounts())
+	if ev.Confidence < a.Confidence || !a.changed(ev) {
+		a.mu.Unlock()
+		return
+	}
+	a.published = ev
+	a.last = ev
+	handlers := a.handlers
+	a.mu.Unlock()
+
+	if a.peer.events != nil {
+		a.peer.events.Publish(SensingEventCode, ``, ev)
+	}
+	for _, f := range handlers {
+		f(ev)
+	}
+	logln(`[INFO] 地震感知 ` + ev.Area + ` 信頼度 ` + strconv.FormatFloat(ev.Confidence, 'f', 2, 64) + ` 感知数 ` + strconv.Itoa(ev.Reports))
+}
+
+// changed は、前回発行したものから、信頼度が0.1以上上がったか、震央地域か感知地域が変わったかを返します
+func (a *SensingAggregator) changed(ev *SensingEvent) bool {
+	p := a.published
+	return p == nil || ev.Confidence >= p.Confidence+0.1 || ev.Region != p.Region || len(ev.Regions) != len(p.Regions)
+}
+
+// evaluate は、現在のまとまりを集計します。
+// 地域ごとに、地域のピア数に対する感知の割合を求め、信頼度を
+// (1 - exp(-感知数/MinReports)) × min(1, 最大の割合/Ratio) とします。
+// 地域のピア数が不明な場合は、割合を1とします。
+func (a *SensingAggregator) evaluate(counts PeerCounts) *SensingEvent {
+	peers := make(map[string]uint64, len(counts))
+	for _, c := range counts {
+		peers[c.GetRegion()] = c.GetCount()
+	}
+
+	byRegion := make(map[string]*SensingRegion)
+	for _, r := range a.reports {
+		sr, ok := byRegion[r.region]
+		if !ok {
+			sr = &SensingRegion{Region: r.region, Area: Area(r.region), Peers: peers[r.region]}
+			byRegion[r.region] = sr
+		}
+		sr.Reports++
+	}
+
+	ev := &SensingEvent{
+		Started: a.reports[0].received,
+		Updated: a.reports[len(a.reports)-1].received,
+		Reports: len(a.reports),
+	}
+	var maxRatio, wsum, lat, lng float64
+	for _, sr := range byRegion {
+		sr.Ratio = 1
+		if sr.Peers > uint64(sr.Reports) {
+			sr.Ratio = float64(sr.Reports) / float64(sr.Peers)
+		}
+		if sr.Ratio > maxRatio {
+			maxRatio = sr.Ratio
+		}
+		if ll := AreaForRegLatLng(sr.Region); len(ll) == 3 {
+			la, err1 := strconv.ParseFloat(ll[0], 64)
+			lo, err2 := strconv.ParseFloat(ll[1], 64)
+			if err1 == nil && err2 == nil {
+				lat += la * sr.Ratio
+				lng += lo * sr.Ratio
+				wsum += sr.Ratio
+			}
+		}
+		ev.Regions = append(ev.Regions, *sr)
+	}
+	sort.Slice(ev.Regions, func(i, j int) bool {
+		if ev.Regions[i].Ratio != ev.Regions[j].Ratio {
+			return ev.Regions[i].Ratio > ev.Regions[j].Ratio
+		}
+		return ev.Regions[i].Region < ev.Regions[j].Region
+	})
+	ev.Region = ev.Regions[0].Region
+	ev.Area = ev.Regions[0].Area
+	if wsum != 0 {
+		ev.Latitude = lat / wsum
+		ev.Longitude = lng / wsum
+	}
+
+	ev.Confidence = (1 - math.Exp(-float64(ev.Reports)/float64(a.MinReports))) * math.Min(1, maxRatio/a.Ratio)
+	return ev
+}
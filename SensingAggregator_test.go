@@ -0,0 +1,106 @@
+package epsp
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSensingAggregatorEvaluate(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	k := 1 - math.Exp(-1) // 感知数がMinReportsと同じときの係数
+	tests := []struct {
+		name       string
+		regions    []string
+		counts     map[string]uint64
+		confidence float64
+		region     string
+		ratio      float64
+		lat, lng   float64
+	}{
+		{`unknown peer count`, []string{`250`, `250`, `250`}, nil, k, `250`, 1, 35.699, 139.502},
+		{`fewer peers than reports`, []string{`250`, `250`, `250`}, map[string]uint64{`250`: 2}, k, `250`, 1, 35.699, 139.502},
+		{`as many peers as reports`, []string{`250`, `250`, `250`}, map[string]uint64{`250`: 3}, k, `250`, 1, 35.699, 139.502},
+		{`large peer count`, []string{`250`, `250`, `250`}, map[string]uint64{`250`: 100}, k * 0.3, `250`, 0.03, 35.699, 139.502},
+		{`ratio at threshold`, []string{`250`}, map[string]uint64{`250`: 10}, 1 - math.Exp(-1.0/3), `250`, 0.1, 35.699, 139.502},
+		{`many reports`, []string{`250`, `250`, `250`, `250`, `250`, `250`}, nil, 1 - math.Exp(-2), `250`, 1, 35.699, 139.502},
+		{`highest ratio region wins`, []string{`250`, `250`, `275`}, map[string]uint64{`250`: 1000}, k, `275`, 1,
+			(35.699*0.002 + 35.348) / 1.002, (139.502*0.002 + 139.139) / 1.002},
+		{`region without location`, []string{`901`, `901`, `901`}, nil, k, `901`, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewSensingAggregator(nil)
+			for i, r := range tt.regions {
+				a.reports = append(a.reports, sensingReport{received: base.Add(time.Duration(i) * time.Second), region: r})
+			}
+			ev := a.evaluate(NewPeerCountsFromMap(tt.counts))
+			if ev.Reports != len(tt.regions) || !ev.Started.Equal(base) || !ev.Updated.Equal(base.Add(time.Duration(len(tt.regions)-1)*time.Second)) {
+				t.Errorf(`event = %+v`, ev)
+			}
+			if !almostEqual(ev.Confidence, tt.confidence) {
+				t.Errorf(`Confidence = %v, want %v`, ev.Confidence, tt.confidence)
+			}
+			if ev.Region != tt.region || ev.Area != Area(tt.region) || !almostEqual(ev.Regions[0].Ratio, tt.ratio) {
+				t.Errorf(`Region = %s %s ratio %v, want %s ratio %v`, ev.Region, ev.Area, ev.Regions[0].Ratio, tt.region, tt.ratio)
+			}
+			if !almostEqual(ev.Latitude, tt.lat) || !almostEqual(ev.Longitude, tt.lng) {
+				t.Errorf(`Location = %v, %v, want %v, %v`, ev.Latitude, ev.Longitude, tt.lat, tt.lng)
+			}
+		})
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestSensingAggregatorAdd(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := &Peer{clock: clock, events: NewEventStream(clock)}
+	peer.regionCounts = NewPeerCountsFromMap(map[string]uint64{`250`: 10})
+	a := NewSensingAggregator(peer)
+	var got []*SensingEvent
+	a.OnEvent(func(ev *SensingEvent) { got = append(got, ev) })
+
+	add := func(pubkey string) {
+		a.Add(&SensingReport{PubKey: pubkey, Region: `250`}, clock.Now())
+	}
+	add(`a`)
+	add(`a`) // 同じ公開鍵は一度だけ数えます
+	if len(got) != 0 {
+		t.Fatalf(`published below confidence: %+v`, got[0])
+	}
+	add(`b`)
+	add(`c`)
+	if len(got) != 1 || got[0].Reports != 3 || a.Last() != got[0] {
+		t.Fatalf(`events = %v`, got)
+	}
+	if evs := peer.events.Recent(1, SensingEventCode); len(evs) != 1 {
+		t.Errorf(`EventStream events = %v`, evs)
+	}
+
+	// 信頼度が0.1以上上がったら、発行しなおします。
+	clock.Advance(time.Second)
+	add(`d`) // 0.632 -> 0.736
+	if len(got) != 2 || got[1].Reports != 4 {
+		t.Fatalf(`events = %v`, got)
+	}
+	add(`e`) // 0.736 -> 0.811
+	if len(got) != 2 {
+		t.Errorf(`republished with small confidence change: %+v`, got[len(got)-1])
+	}
+	add(`f`) // 0.736 -> 0.865
+	if len(got) != 3 || got[2].Reports != 6 {
+		t.Fatalf(`events = %v`, got)
+	}
+
+	// Window を過ぎると、新しいまとまりになり、同じ公開鍵も数えます。
+	clock.Advance(a.Window + time.Second)
+	add(`a`)
+	add(`b`)
+	add(`c`)
+	if len(got) != 4 || got[3].Reports != 3 || !got[3].Started.Equal(clock.Now()) {
+		t.Fatalf(`events = %v`, got)
+	}
+}
@@ -3,6 +3,7 @@ package epsp
 import (
 	"crypto"
 	"crypto/md5" // #nosec G501
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1" // #nosec G505
 	"crypto/x509"
@@ -91,3 +92,25 @@ func DataSignatureCheck(key *rsa.PublicKey, dataSig, expDate, dataBody string) e
 	}
 	return nil // データ署名確認
 }
+
+// SignData は、DataSignatureCheck で照合できるデータ署名を、秘密鍵keyで作ります
+func SignData(key *rsa.PrivateKey, expDate, dataBody string) (string, error) {
+	dataBodyhasher := md5.New() // #nosec G401
+	if _, err := dataBodyhasher.Write([]byte(dataBody)); err != nil {
+		return ``, errors.Wrap(err, `データハッシュ不可`)
+	}
+
+	tokenHasher := sha1.New() // #nosec G401
+	if _, err := tokenHasher.Write([]byte(expDate)); err != nil {
+		return ``, errors.Wrap(err, `鍵日付ハッシュ不可`)
+	}
+	if _, err := tokenHasher.Write(dataBodyhasher.Sum(nil)); err != nil {
+		return ``, errors.Wrap(err, `データハッシュの再ハッシュ不可`)
+	}
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, tokenHasher.Sum(nil))
+	if err != nil {
+		return ``, errors.Wrap(err, `データ署名不可`)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,250 @@
+package epsp
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusSubscriberBuffer は、購読者ごとの送信待ちメッセージの数です。溢れた購読者は切断します。
+const statusSubscriberBuffer = 64
+
+// ConnStatus は、ピア接続一つの状況です。フィールド名は /ws/Clients, /ws/Servers のJSONと同じです。
+type ConnStatus struct {
+	Key        string         `json:"key"`  // side/IPPort
+	Side       string         `json:"side"` // client または server
+	PeerID     string         `json:"PeerID"`
+	IPPort     string         `json:"IPPort"`
+	ConnTime   *time.Time     `json:"ConnTime"`
+	PingPong   *time.Duration `json:"PingPong"`
+	LastRXTime *time.Time     `json:"LastRXTime"`
+	DiscTime   *time.Time     `json:"DiscTime"`
+	Agent      []string       `json:"Agent"`
+	Tx         uint64         `json:"Tx"`
+	Rx         uint64         `json:"Rx"`
+	RxUniq     uint64         `json:"RxUniq"`
+	RxDup      uint64         `json:"RxDup"`
+}
+
+func newConnStatus(side string, p *P2PPeer) ConnStatus {
+	t := p.Times()
+	cs := ConnStatus{
+		Key:        side + `/` + p.IPPort,
+		Side:       side,
+		PeerID:     p.PeerID,
+		IPPort:     p.IPPort,
+		ConnTime:   timePtr(t.Conn),
+		LastRXTime: timePtr(t.LastRX),
+		DiscTime:   timePtr(t.Disc),
+		Agent:      p.Agent,
+		Tx:         atomic.LoadUint64(&p.Tx),
+		Rx:         atomic.LoadUint64(&p.Rx),
+		RxUniq:     atomic.LoadUint64(&p.RxUniq),
+		RxDup:      atomic.LoadUint64(&p.RxDup),
+	}
+	if !t.Pong.IsZero() {
+		cs.PingPong = &t.PingPong
+	}
+	return cs
+}
+
+// StatusCounters は、ピア全体の状況です
+type StatusCounters struct {
+	State        PeerState `json:"state"`
+	PeerID       string    `json:"peer_id"`
+	Clients      uint64    `json:"clients"`       // 接続中のクライアント数
+	Servers      uint64    `json:"servers"`       // 接続中のサーバ数
+	NetworkPeers uint64    `json:"network_peers"` // ネットワーク全体のピア数
+}
+
+// StatusMessage は、/ws/status で配信するメッセージです。
+// Typeは snapshot, peer_added, peer_updated, peer_removed, counters, regions のいずれかです。
+type StatusMessage struct {
+	Type     string          `json:"type"`
+	Peers    []ConnStatus    `json:"peers,omitempty"`    // snapshot
+	Peer     *ConnStatus     `json:"peer,omitempty"`     // peer_added, peer_updated
+	Key      string          `json:"key,omitempty"`      // peer_removed
+	Counters *StatusCounters `json:"counters,omitempty"` // snapshot, counters
+	Regions  json.RawMessage `json:"regions,omitempty"`  // snapshot, regions (GoogleChart形式)
+}
+
+// statusHub は、ピア接続と参加状態の変化を受け取り、変化分だけを購読者に配信します
+type statusHub struct {
+	peer *Peer
+
+	mu       sync.Mutex
+	closed   bool
+	peers    map[string]ConnStatus
+	owners   map[string]*P2PPeer // 同じキーで接続しなおした場合に、古い接続の削除で消さないためです
+	counters StatusCounters
+	regions  []byte
+	subs     map[chan StatusMessage]struct{}
+}
+
+func newStatusHub(peer *Peer) *statusHub {
+	h := &statusHub{
+		peer:   peer,
+		peers:  make(map[string]ConnStatus),
+		owners: make(map[string]*P2PPeer),
+		subs:   make(map[chan StatusMessage]struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// 登録してから現在の状況を読むので、その間の変化は、このロックを待ってから反映されます。
+	peer.Clients.OnChange(func(change string, p *P2PPeer) { h.peerChanged(`client`, change, p) })
+	peer.Servers.OnChange(func(change string, p *P2PPeer) { h.peerChanged(`server`, change, p) })
+	peer.OnStateChange(func(from, to PeerState) { h.statusChanged(false) })
+	peer.onStatusChange(h.statusChanged)
+	for _, p := range peer.Clients.Snapshot() {
+		h.setPeerLocked(newConnStatus(`client`, p), p)
+	}
+	for _, p := range peer.Servers.Snapshot() {
+		h.setPeerLocked(newConnStatus(`server`, p), p)
+	}
+	h.counters = h.currentCounters()
+	h.regions = peer.RegionCounts().GoogleChart()
+	return h
+}
+
+// run は、ctxが終了したら、購読者のチャネルを閉じます
+func (h *statusHub) run(ctx context.Context) {
+	<-ctx.Done()
+	h.mu.Lock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+	h.mu.Unlock()
+}
+
+func (h *statusHub) setPeerLocked(cs ConnStatus, p *P2PPeer) {
+	h.peers[cs.Key] = cs
+	h.owners[cs.Key] = p
+}
+
+func (h *statusHub) currentCounters() StatusCounters {
+	peer := h.peer
+	return StatusCounters{
+		State:        peer.State(),
+		PeerID:       peer.PeerID(),
+		Clients:      peer.Clients.NumOfConnectedPeers(),
+		Servers:      peer.Servers.NumOfConnectedPeers(),
+		NetworkPeers: peer.RegionCounts().NumOfAllPeers(),
+	}
+}
+
+// peerChanged は、ピア接続の追加、変化、削除を配信します
+func (h *statusHub) peerChanged(side, change string, p *P2PPeer) {
+	cs := newConnStatus(side, p)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	var msgs []StatusMessage
+	switch change {
+	case PeerRemoved:
+		if h.owners[cs.Key] != p {
+			break
+		}
+		delete(h.peers, cs.Key)
+		delete(h.owners, cs.Key)
+		msgs = append(msgs, StatusMessage{Type: PeerRemoved, Key: cs.Key})
+	default:
+		typ := PeerUpdated
+		if _, ok := h.peers[cs.Key]; !ok {
+			typ = PeerAdded
+		}
+		h.setPeerLocked(cs, p)
+		msgs = append(msgs, StatusMessage{Type: typ, Peer: &cs})
+	}
+	msgs = append(msgs, h.countersLocked()...)
+	h.broadcastLocked(msgs)
+}
+
+// statusChanged は、参加状態かピアID、地域ごとのピア数(regionsがtrue)の変化を配信します
+func (h *statusHub) statusChanged(regions bool) {
+	var rs []byte
+	if regions {
+		rs = h.peer.RegionCounts().GoogleChart()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	msgs := h.countersLocked()
+	if regions {
+		h.regions = rs
+		msgs = append(msgs, StatusMessage{Type: `regions`, Regions: json.RawMessage(rs)})
+	}
+	h.broadcastLocked(msgs)
+}
+
+// countersLocked は、ピア全体の状況が変わっていれば、そのメッセージを返します
+func (h *statusHub) countersLocked() []StatusMessage {
+	counters := h.currentCounters()
+	if counters == h.counters {
+		return nil
+	}
+	h.counters = counters
+	return []StatusMessage{{Type: `counters`, Counters: &counters}}
+}
+
+// broadcastLocked は、購読者にmsgsを配信します。受信が遅れた購読者は切断します。
+func (h *statusHub) broadcastLocked(msgs []StatusMessage) {
+	for _, m := range msgs {
+		for ch := range h.subs {
+			select {
+			case ch <- m:
+			default:
+				logln(`[WARN] 状況購読者の受信遅延、切断`)
+				delete(h.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// snapshotLocked は、現在の状況全体をメッセージにします
+func (h *statusHub) snapshotLocked() StatusMessage {
+	m := StatusMessage{Type: `snapshot`, Peers: make([]ConnStatus, 0, len(h.peers))}
+	for _, cs := range h.peers {
+		m.Peers = append(m.Peers, cs)
+	}
+	sort.Slice(m.Peers, func(i, j int) bool { return m.Peers[i].Key < m.Peers[j].Key })
+	c := h.counters
+	m.Counters = &c
+	if len(h.regions) != 0 {
+		m.Regions = json.RawMessage(h.regions)
+	}
+	return m
+}
+
+// subscribe は、現在の状況全体と、以降の差分を受け取るチャネルを返します。不要になったらcancelを呼んでください。
+func (h *statusHub) subscribe() (snapshot StatusMessage, updates <-chan StatusMessage, cancel func()) {
+	ch := make(chan StatusMessage, statusSubscriberBuffer)
+	h.mu.Lock()
+	snapshot = h.snapshotLocked()
+	if h.closed {
+		close(ch)
+	} else {
+		h.subs[ch] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	cancel = func() {
+		h.mu.Lock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+		h.mu.Unlock()
+	}
+	return snapshot, ch, cancel
+}
@@ -0,0 +1,174 @@
+package epsp
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newStatusTestPeer() (*Peer, *FakeClock) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	return &Peer{clock: clock, peerCounts: NewPeerCountSeries(clock)}, clock
+}
+
+func newTestP2PPeer(clock Clock, ipport string) *P2PPeer {
+	p := &P2PPeer{}
+	p.clock = clock
+	p.IPPort = ipport
+	return p
+}
+
+// nextStatus は、配信されたメッセージを一つ受け取ります。なければ失敗です。
+func nextStatus(t *testing.T, updates <-chan StatusMessage) StatusMessage {
+	t.Helper()
+	select {
+	case m := <-updates:
+		return m
+	default:
+		t.Fatal(`no status message`)
+		return StatusMessage{}
+	}
+}
+
+func noStatus(t *testing.T, updates <-chan StatusMessage) {
+	t.Helper()
+	select {
+	case m := <-updates:
+		t.Fatalf(`unexpected status message %+v`, m)
+	default:
+	}
+}
+
+func TestStatusHubPeerChanges(t *testing.T) {
+	peer, clock := newStatusTestPeer()
+	existing := newTestP2PPeer(clock, `192.0.2.9:6911`)
+	existing.SetConnTime()
+	peer.Servers.add(existing)
+
+	hub := newStatusHub(peer)
+	snapshot, updates, cancel := hub.subscribe()
+	defer cancel()
+	if len(snapshot.Peers) != 1 || snapshot.Peers[0].Key != `server/192.0.2.9:6911` || snapshot.Counters.Servers != 1 {
+		t.Fatalf(`snapshot = %+v`, snapshot)
+	}
+	noStatus(t, updates)
+
+	p := newTestP2PPeer(clock, `192.0.2.1:6911`)
+	p.SetConnTime()
+	peer.Clients.add(p)
+	if m := nextStatus(t, updates); m.Type != PeerAdded || m.Peer.Key != `client/192.0.2.1:6911` || m.Peer.ConnTime == nil {
+		t.Fatalf(`message = %+v`, m)
+	}
+	if m := nextStatus(t, updates); m.Type != `counters` || m.Counters.Clients != 1 {
+		t.Fatalf(`message = %+v`, m)
+	}
+	noStatus(t, updates)
+
+	// 接続情報が変わるたびに配信します。往復時間は、返答を受け取るまでありません。
+	clock.Advance(time.Second)
+	p.SetPingTime()
+	if m := nextStatus(t, updates); m.Type != PeerUpdated || m.Peer.PingPong != nil {
+		t.Fatalf(`message = %+v`, m)
+	}
+	clock.Advance(40 * time.Millisecond)
+	p.SetPongTime()
+	if m := nextStatus(t, updates); m.Type != PeerUpdated || m.Peer.PingPong == nil || *m.Peer.PingPong != 40*time.Millisecond {
+		t.Fatalf(`message = %+v`, m)
+	}
+	p.AddRxUniq()
+	if m := nextStatus(t, updates); m.Type != PeerUpdated || m.Peer.RxUniq != 1 {
+		t.Fatalf(`message = %+v`, m)
+	}
+	noStatus(t, updates)
+
+	p.Close()
+	if m := nextStatus(t, updates); m.Type != PeerUpdated || m.Peer.DiscTime == nil {
+		t.Fatalf(`message = %+v`, m)
+	}
+	if m := nextStatus(t, updates); m.Type != `counters` || m.Counters.Clients != 0 {
+		t.Fatalf(`message = %+v`, m)
+	}
+
+	// 同じアドレスに接続しなおした後で古い接続を削除しても、新しい接続は消しません。
+	again := newTestP2PPeer(clock, `192.0.2.1:6911`)
+	peer.Clients.add(again)
+	if m := nextStatus(t, updates); m.Type != PeerUpdated || m.Peer.DiscTime != nil {
+		t.Fatalf(`message = %+v`, m)
+	}
+	nextStatus(t, updates) // counters
+	clock.Advance(2 * time.Minute)
+	peer.Clients.deleteClosedFromList()
+	noStatus(t, updates)
+	if got := peer.Clients.Snapshot(); len(got) != 1 || got[0] != again {
+		t.Fatalf(`Clients = %v`, got)
+	}
+
+	// 一覧から除かれた接続の変化は、配信しません。
+	peer.Clients.remove(again)
+	if m := nextStatus(t, updates); m.Type != PeerRemoved || m.Key != `client/192.0.2.1:6911` {
+		t.Fatalf(`message = %+v`, m)
+	}
+	nextStatus(t, updates) // counters
+	again.AddTx()
+	noStatus(t, updates)
+}
+
+func TestStatusHubPeerStatus(t *testing.T) {
+	peer, _ := newStatusTestPeer()
+	hub := newStatusHub(peer)
+	_, updates, cancel := hub.subscribe()
+	defer cancel()
+
+	peer.transit(PeerStateTemporaryID)
+	if m := nextStatus(t, updates); m.Type != `counters` || m.Counters.State != PeerStateTemporaryID {
+		t.Fatalf(`message = %+v`, m)
+	}
+	peer.setPeerID(`123`)
+	if m := nextStatus(t, updates); m.Type != `counters` || m.Counters.PeerID != `123` {
+		t.Fatalf(`message = %+v`, m)
+	}
+	peer.setPeerID(`123`)
+	noStatus(t, updates)
+
+	peer.setPeerCounts(NewPeerCountsFromMap(map[string]uint64{`101`: 3, `901`: 2}))
+	if m := nextStatus(t, updates); m.Type != `counters` || m.Counters.NetworkPeers != 5 {
+		t.Fatalf(`message = %+v`, m)
+	}
+	if m := nextStatus(t, updates); m.Type != `regions` || len(m.Regions) == 0 {
+		t.Fatalf(`message = %+v`, m)
+	}
+	noStatus(t, updates)
+}
+
+func TestStatusHubConcurrentUpdates(t *testing.T) {
+	peer, clock := newStatusTestPeer()
+	hub := newStatusHub(peer)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := newTestP2PPeer(clock, `192.0.2.1:6911`)
+			peer.Clients.add(p)
+			for j := 0; j < 50; j++ {
+				p.AddTx()
+				p.SetLastRXTime()
+			}
+			p.Close()
+			peer.Clients.remove(p)
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		snapshot, _, cancel := hub.subscribe()
+		cancel()
+		_ = snapshot
+		_ = newAPIConns(`client`, peer.Clients.Snapshot())
+	}
+	wg.Wait()
+	if snapshot, _, cancel := hub.subscribe(); len(snapshot.Peers) != 0 {
+		t.Errorf(`snapshot after removal = %+v`, snapshot.Peers)
+	} else {
+		cancel()
+	}
+}
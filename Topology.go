@@ -0,0 +1,107 @@
+package epsp
+
+import (
+	"sort"
+	"time"
+)
+
+// Topology は、調査エコー(615/635)で得られたネットワーク構成です
+type Topology struct {
+	TraceID string
+	Origin  string
+	Started time.Time
+	Nodes   []TopologyNode
+	Edges   []TopologyEdge
+}
+
+// TopologyNode は、ネットワーク構成中のピアです
+type TopologyNode struct {
+	PeerID  string
+	Hops    uint64        // 調査元からの経由数。調査元は0です。
+	Latency time.Duration // 調査エコーリプライが届くまでの時間
+	Replied bool          // 調査エコーリプライを返したかどうか
+	Agent   []string      // エージェント名。調査元と直接接続しているピアのみ分かります。
+}
+
+// TopologyEdge は、ピア間の接続です。接続は無向で、From < To に正規化されています。
+type TopologyEdge struct {
+	From string
+	To   string
+}
+
+func newTopologyEdge(a, b string) TopologyEdge {
+	if b < a {
+		a, b = b, a
+	}
+	return TopologyEdge{From: a, To: b}
+}
+
+// Node は、peerIDのノードを返します
+func (t *Topology) Node(peerID string) (TopologyNode, bool) {
+	for _, n := range t.Nodes {
+		if n.PeerID == peerID {
+			return n, true
+		}
+	}
+	return TopologyNode{}, false
+}
+
+// newTopology は、調査元のピアと、調査エコーリプライからネットワーク構成を作ります
+func newTopology(traceID, origin string, started time.Time, connected []string, replies map[string]traceReply) *Topology {
+	t := &Topology{TraceID: traceID, Origin: origin, Started: started}
+	edges := make(map[TopologyEdge]struct{})
+	addEdge := func(a, b string) {
+		if a != b {
+			edges[newTopologyEdge(a, b)] = struct{}{}
+		}
+	}
+
+	nodes := map[string]*TopologyNode{origin: {PeerID: origin, Replied: true}}
+	addNode := func(peerID string, hops uint64) *TopologyNode {
+		n, ok := nodes[peerID]
+		if !ok {
+			n = &TopologyNode{PeerID: peerID, Hops: hops}
+			nodes[peerID] = n
+		} else if peerID != origin && n.Hops > hops {
+			n.Hops = hops
+		}
+		return n
+	}
+
+	for _, to := range connected {
+		addNode(to, 1)
+		addEdge(origin, to)
+	}
+	for from, r := range replies {
+		n := addNode(from, r.hops)
+		n.Replied = true
+		n.Hops = r.hops
+		n.Latency = r.latency
+	}
+	for from, r := range replies {
+		for _, to := range r.connected {
+			addNode(to, r.hops+1)
+			addEdge(from, to)
+		}
+	}
+
+	for _, n := range nodes {
+		t.Nodes = append(t.Nodes, *n)
+	}
+	sort.Slice(t.Nodes, func(i, j int) bool {
+		if t.Nodes[i].Hops != t.Nodes[j].Hops {
+			return t.Nodes[i].Hops < t.Nodes[j].Hops
+		}
+		return t.Nodes[i].PeerID < t.Nodes[j].PeerID
+	})
+	for e := range edges {
+		t.Edges = append(t.Edges, e)
+	}
+	sort.Slice(t.Edges, func(i, j int) bool {
+		if t.Edges[i].From != t.Edges[j].From {
+			return t.Edges[i].From < t.Edges[j].From
+		}
+		return t.Edges[i].To < t.Edges[j].To
+	})
+	return t
+}
@@ -0,0 +1,270 @@
+package epsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TopologyJSONSchema は、Topology.WriteJSON が出力するJSONのスキーマ(JSON Schema draft-07)です
+const TopologyJSONSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "EPSP topology",
+  "type": "object",
+  "required": ["trace_id", "origin", "started", "nodes", "edges", "stats"],
+  "properties": {
+    "trace_id": {"type": "string", "description": "調査エコーの一意な数"},
+    "origin": {"type": "string", "description": "調査元のピアID"},
+    "started": {"type": "string", "format": "date-time", "description": "調査エコー送信時刻"},
+    "nodes": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["id", "hops", "replied"],
+        "properties": {
+          "id": {"type": "string", "description": "ピアID"},
+          "hops": {"type": "integer", "minimum": 0, "description": "調査元からの経由数"},
+          "latency_ms": {"type": "number", "description": "調査エコーリプライが届くまでの時間(ミリ秒)"},
+          "replied": {"type": "boolean", "description": "調査エコーリプライを返したかどうか"},
+          "agent": {"type": "string", "description": "エージェント名(コロン区切り)"}
+        }
+      }
+    },
+    "edges": {
+      "type": "array",
+      "description": "無向の接続。重複はありません。",
+      "items": {
+        "type": "object",
+        "required": ["source", "target"],
+        "properties": {
+          "source": {"type": "string"},
+          "target": {"type": "string"}
+        }
+      }
+    },
+    "stats": {
+      "type": "object",
+      "properties": {
+        "nodes": {"type": "integer"},
+        "edges": {"type": "integer"},
+        "diameter": {"type": "integer"},
+        "components": {"type": "integer"},
+        "articulation_peers": {"type": "array", "items": {"type": "string"}}
+      }
+    }
+  }
+}`
+
+type topologyJSONNode struct {
+	ID        string  `json:"id"`
+	Hops      uint64  `json:"hops"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Replied   bool    `json:"replied"`
+	Agent     string  `json:"agent,omitempty"`
+}
+
+type topologyJSONEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type topologyJSONStats struct {
+	Nodes             int      `json:"nodes"`
+	Edges             int      `json:"edges"`
+	Diameter          int      `json:"diameter"`
+	Components        int      `json:"components"`
+	ArticulationPeers []string `json:"articulation_peers"`
+}
+
+type topologyJSON struct {
+	TraceID string             `json:"trace_id"`
+	Origin  string             `json:"origin"`
+	Started time.Time          `json:"started"`
+	Nodes   []topologyJSONNode `json:"nodes"`
+	Edges   []topologyJSONEdge `json:"edges"`
+	Stats   topologyJSONStats  `json:"stats"`
+}
+
+// MarshalJSON は、接続を source, target で表現します
+func (e TopologyEdge) MarshalJSON() ([]byte, error) {
+	return json.Marshal(topologyJSONEdge{Source: e.From, Target: e.To})
+}
+
+// MarshalJSON は、TopologyJSONSchema の形式でJSONにします
+func (t *Topology) MarshalJSON() ([]byte, error) {
+	s := t.Stats()
+	tj := topologyJSON{
+		TraceID: t.TraceID,
+		Origin:  t.Origin,
+		Started: t.Started,
+		Nodes:   make([]topologyJSONNode, 0, len(t.Nodes)),
+		Edges:   make([]topologyJSONEdge, 0, len(t.Edges)),
+		Stats: topologyJSONStats{
+			Nodes:             s.Nodes,
+			Edges:             s.Edges,
+			Diameter:          s.Diameter,
+			Components:        s.Components,
+			ArticulationPeers: s.ArticulationPeers,
+		},
+	}
+	for _, n := range t.Nodes {
+		tj.Nodes = append(tj.Nodes, topologyJSONNode{
+			ID:        n.PeerID,
+			Hops:      n.Hops,
+			LatencyMS: float64(n.Latency) / float64(time.Millisecond),
+			Replied:   n.Replied,
+			Agent:     strings.Join(n.Agent, `:`),
+		})
+	}
+	for _, e := range t.Edges {
+		tj.Edges = append(tj.Edges, topologyJSONEdge{Source: e.From, Target: e.To})
+	}
+	return json.Marshal(tj)
+}
+
+// UnmarshalJSON は、TopologyJSONSchema の形式のJSONを読み込みます
+func (t *Topology) UnmarshalJSON(b []byte) error {
+	var tj topologyJSON
+	if err := json.Unmarshal(b, &tj); err != nil {
+		return err
+	}
+	*t = Topology{TraceID: tj.TraceID, Origin: tj.Origin, Started: tj.Started}
+	for _, n := range tj.Nodes {
+		var agent []string
+		if n.Agent != `` {
+			agent = strings.Split(n.Agent, `:`)
+		}
+		t.Nodes = append(t.Nodes, TopologyNode{
+			PeerID:  n.ID,
+			Hops:    n.Hops,
+			Latency: time.Duration(n.LatencyMS * float64(time.Millisecond)),
+			Replied: n.Replied,
+			Agent:   agent,
+		})
+	}
+	for _, e := range tj.Edges {
+		t.Edges = append(t.Edges, newTopologyEdge(e.Source, e.Target))
+	}
+	return nil
+}
+
+// WriteJSON は、TopologyJSONSchema の形式のJSONを書き出します
+func (t *Topology) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(t)
+}
+
+// dotEscape は、DOTの文字列中の「\」と「"」をエスケープします
+func dotEscape(s string) string {
+	return strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1)
+}
+
+// dotQuote は、DOTのID文字列にします
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
+
+// WriteDOT は、Graphviz DOT形式で書き出します
+func (t *Topology) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("graph epsp {\n")
+	bw.WriteString("\tlabel=" + dotQuote(`trace `+t.TraceID+` from `+t.Origin) + ";\n")
+	for _, n := range t.Nodes {
+		attrs := []string{
+			`label="` + dotEscape(n.PeerID) + `\nhops=` + strconv.FormatUint(n.Hops, 10) + `"`,
+			`hops=` + strconv.FormatUint(n.Hops, 10),
+		}
+		if n.Replied {
+			attrs = append(attrs, `latency_ms=`+strconv.FormatFloat(float64(n.Latency)/float64(time.Millisecond), 'f', 1, 64))
+		} else {
+			attrs = append(attrs, `style=dashed`)
+		}
+		if len(n.Agent) != 0 {
+			attrs = append(attrs, `agent=`+dotQuote(strings.Join(n.Agent, `:`)))
+		}
+		if n.PeerID == t.Origin {
+			attrs = append(attrs, `shape=doublecircle`)
+		}
+		bw.WriteString("\t" + dotQuote(n.PeerID) + ` [` + strings.Join(attrs, `, `) + "];\n")
+	}
+	for _, e := range t.Edges {
+		bw.WriteString("\t" + dotQuote(e.From) + ` -- ` + dotQuote(e.To) + ";\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+type graphmlKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphmlData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphmlNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphmlData `xml:"data"`
+}
+
+type graphmlEdge struct {
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+}
+
+type graphml struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphmlKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphmlNode `xml:"node"`
+		Edges       []graphmlEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// WriteGraphML は、GraphML形式で書き出します
+func (t *Topology) WriteGraphML(w io.Writer) error {
+	g := graphml{
+		XMLNS: `http://graphml.graphdrawing.org/xmlns`,
+		Keys: []graphmlKey{
+			{ID: `hops`, For: `node`, Name: `hops`, Type: `int`},
+			{ID: `latency_ms`, For: `node`, Name: `latency_ms`, Type: `double`},
+			{ID: `replied`, For: `node`, Name: `replied`, Type: `boolean`},
+			{ID: `agent`, For: `node`, Name: `agent`, Type: `string`},
+			{ID: `origin`, For: `node`, Name: `origin`, Type: `boolean`},
+		},
+	}
+	g.Graph.ID = t.TraceID
+	g.Graph.EdgeDefault = `undirected`
+	for _, n := range t.Nodes {
+		g.Graph.Nodes = append(g.Graph.Nodes, graphmlNode{
+			ID: n.PeerID,
+			Data: []graphmlData{
+				{Key: `hops`, Value: strconv.FormatUint(n.Hops, 10)},
+				{Key: `latency_ms`, Value: strconv.FormatFloat(float64(n.Latency)/float64(time.Millisecond), 'f', -1, 64)},
+				{Key: `replied`, Value: strconv.FormatBool(n.Replied)},
+				{Key: `agent`, Value: strings.Join(n.Agent, `:`)},
+				{Key: `origin`, Value: strconv.FormatBool(n.PeerID == t.Origin)},
+			},
+		})
+	}
+	for _, e := range t.Edges {
+		g.Graph.Edges = append(g.Graph.Edges, graphmlEdge{Source: e.From, Target: e.To})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent(``, `  `)
+	return enc.Encode(g)
+}
@@ -0,0 +1,95 @@
+package epsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// exportTestTopology は、調査元1から、2(直接接続)、3(2の先)、4(応答なし)が見えるネットワーク構成です
+func exportTestTopology() *Topology {
+	return &Topology{
+		TraceID: `1767225600000000001`,
+		Origin:  `1`,
+		Started: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Nodes: []TopologyNode{
+			{PeerID: `1`, Replied: true, Agent: []string{`0.34`, `p2pquake`, `Go`}},
+			{PeerID: `2`, Hops: 1, Latency: 12500 * time.Microsecond, Replied: true, Agent: []string{`0.34`, `say "hi"`, `1.0`}},
+			{PeerID: `3`, Hops: 2, Latency: 40 * time.Millisecond, Replied: true},
+			{PeerID: `4`, Hops: 3},
+		},
+		Edges: []TopologyEdge{{`1`, `2`}, {`2`, `3`}, {`3`, `4`}},
+	}
+}
+
+func TestTopologyExport(t *testing.T) {
+	tests := []struct {
+		golden string
+		write  func(*Topology, io.Writer) error
+	}{
+		{`topology.dot`, (*Topology).WriteDOT},
+		{`topology.graphml`, (*Topology).WriteGraphML},
+		{`topology.json`, (*Topology).WriteJSON},
+	}
+	for _, tt := range tests {
+		want, err := ioutil.ReadFile(filepath.Join(`testdata`, `topology`, tt.golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err = tt.write(exportTestTopology(), &b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != string(want) {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.golden, b.String(), want)
+		}
+	}
+}
+
+func TestTopologyGraphMLWellFormed(t *testing.T) {
+	var b bytes.Buffer
+	if err := exportTestTopology().WriteGraphML(&b); err != nil {
+		t.Fatal(err)
+	}
+	var g graphml
+	if err := xml.Unmarshal(b.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Graph.Nodes) != 4 || len(g.Graph.Edges) != 3 || g.Graph.Nodes[1].Data[3].Value != `0.34:say "hi":1.0` {
+		t.Errorf(`graphml = %+v`, g.Graph)
+	}
+}
+
+func TestTopologyJSONRoundTrip(t *testing.T) {
+	want := exportTestTopology()
+	var b bytes.Buffer
+	if err := want.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	got := new(Topology)
+	if err := json.Unmarshal(b.Bytes(), got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Topology = %+v\nwant %+v", got, want)
+	}
+
+	// 逆向きの接続は、From < To に正規化します。統計は読み込みません。
+	reversed := `{"trace_id":"1","origin":"2","started":"2026-01-01T00:00:00Z","nodes":[{"id":"2","hops":0,"replied":true},{"id":"10","hops":1,"replied":false}],` +
+		`"edges":[{"source":"2","target":"10"}],"stats":{"nodes":99}}`
+	if err := json.Unmarshal([]byte(reversed), got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Edges, []TopologyEdge{{`10`, `2`}}) || got.Stats().Nodes != 2 {
+		t.Errorf(`Topology = %+v`, got)
+	}
+	if err := json.Unmarshal([]byte(`{"nodes":{}}`), got); err == nil {
+		t.Error(`unmarshaled broken nodes`)
+	}
+}
@@ -0,0 +1,292 @@
+package epsp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MinTopologySnapshotInterval は、スナップショットの最小間隔です。ネットワークに調査エコーを送りすぎないよう、これより短い間隔は切り上げます。
+const MinTopologySnapshotInterval = MinTraceInterval
+
+const topologySnapshotTimeout = 5 * time.Second
+
+// TopologySnapshot は、保存されたネットワーク構成の情報です
+type TopologySnapshot struct {
+	TraceID string    `json:"trace_id"`
+	Time    time.Time `json:"time"`
+	Nodes   int       `json:"nodes"`
+	Edges   int       `json:"edges"`
+	file    string
+}
+
+// TopologyDiff は、二つのネットワーク構成の差分です
+type TopologyDiff struct {
+	From         string         `json:"from"`
+	To           string         `json:"to"`
+	FromTime     time.Time      `json:"from_time"`
+	ToTime       time.Time      `json:"to_time"`
+	Joined       []string       `json:"joined"`
+	Left         []string       `json:"left"`
+	EdgesAdded   []TopologyEdge `json:"edges_added"`
+	EdgesRemoved []TopologyEdge `json:"edges_removed"`
+	Components   int            `json:"components"`
+	Partitioned  bool           `json:"partitioned"` // 新たにネットワークの分断を検出した場合true
+}
+
+// DiffTopology は、ネットワーク構成aからbへの差分を返します
+func DiffTopology(a, b *Topology) *TopologyDiff {
+	d := &TopologyDiff{
+		From:     a.TraceID,
+		To:       b.TraceID,
+		FromTime: a.Started,
+		ToTime:   b.Started,
+		Joined:   []string{},
+		Left:     []string{},
+	}
+
+	an := make(map[string]bool, len(a.Nodes))
+	for _, n := range a.Nodes {
+		an[n.PeerID] = true
+	}
+	bn := make(map[string]bool, len(b.Nodes))
+	for _, n := range b.Nodes {
+		bn[n.PeerID] = true
+		if !an[n.PeerID] {
+			d.Joined = append(d.Joined, n.PeerID)
+		}
+	}
+	for _, n := range a.Nodes {
+		if !bn[n.PeerID] {
+			d.Left = append(d.Left, n.PeerID)
+		}
+	}
+
+	ae := make(map[TopologyEdge]bool, len(a.Edges))
+	for _, e := range a.Edges {
+		ae[e] = true
+	}
+	be := make(map[TopologyEdge]bool, len(b.Edges))
+	for _, e := range b.Edges {
+		be[e] = true
+		if !ae[e] {
+			d.EdgesAdded = append(d.EdgesAdded, e)
+		}
+	}
+	for _, e := range a.Edges {
+		if !be[e] {
+			d.EdgesRemoved = append(d.EdgesRemoved, e)
+		}
+	}
+
+	d.Components = len(b.Components())
+	d.Partitioned = d.Components > 1 && len(a.Components()) <= 1
+	sort.Strings(d.Joined)
+	sort.Strings(d.Left)
+	return d
+}
+
+// TopologyRecorder は、定期的に調査エコーを行い、ネットワーク構成をディスクに保存します
+type TopologyRecorder struct {
+	peer      *Peer
+	dir       string
+	interval  time.Duration
+	mu        sync.RWMutex
+	snapshots []TopologySnapshot
+	onDiff    []func(*TopologyDiff)
+}
+
+// NewTopologyRecorder は、TopologyRecorder のコンストラクタです。dirに保存済みのスナップショットを読み込みます。
+func NewTopologyRecorder(peer *Peer, dir string, interval time.Duration) (*TopologyRecorder, error) {
+	if interval < MinTopologySnapshotInterval {
+		logln(`[WARN] スナップショット間隔を切り上げ `, interval, ` -> `, MinTopologySnapshotInterval)
+		interval = MinTopologySnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, `スナップショット保存先`)
+	}
+	r := &TopologyRecorder{peer: peer, dir: dir, interval: interval}
+
+	files, err := filepath.Glob(filepath.Join(dir, `topology-*.json`))
+	if err != nil {
+		return nil, errors.Wrap(err, `スナップショット一覧`)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		t, err := loadTopology(f)
+		if err != nil {
+			logln(`[WARN] スナップショット読込 ` + f + ` ` + err.Error())
+			continue
+		}
+		r.snapshots = append(r.snapshots, TopologySnapshot{TraceID: t.TraceID, Time: t.Started, Nodes: len(t.Nodes), Edges: len(t.Edges), file: f})
+	}
+	return r, nil
+}
+
+// OnDiff は、スナップショットを取るたびに、前回との差分を受け取る関数を登録します
+func (r *TopologyRecorder) OnDiff(f func(*TopologyDiff)) {
+	r.mu.Lock()
+	r.onDiff = append(r.onDiff, f)
+	r.mu.Unlock()
+}
+
+// Run は、ctxが終了するまで、一定間隔でスナップショットを取ります
+func (r *TopologyRecorder) Run(ctx context.Context) error {
+	ticker := r.peer.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+			if _, err := r.Snapshot(ctx); err != nil {
+				logln(`[WARN] スナップショット ` + err.Error())
+			}
+		}
+	}
+}
+
+// Snapshot は、調査エコーを行い、ネットワーク構成を保存します。手動の調査エコーを含めて、前回から最小間隔が経っていなければ ErrTraceTooSoon を返します。
+func (r *TopologyRecorder) Snapshot(ctx context.Context) (*Topology, error) {
+	t, err := r.peer.TraceLimited(ctx, topologySnapshotTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, `調査エコー`)
+	}
+
+	file := filepath.Join(r.dir, `topology-`+t.Started.UTC().Format(`20060102T150405`)+`-`+t.TraceID+`.json`)
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, errors.Wrap(err, `スナップショット保存`)
+	}
+	if err = t.WriteJSON(f); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, `スナップショット保存`)
+	}
+	if err = f.Close(); err != nil {
+		return nil, errors.Wrap(err, `スナップショット保存`)
+	}
+
+	r.mu.Lock()
+	var prev *TopologySnapshot
+	if len(r.snapshots) != 0 {
+		p := r.snapshots[len(r.snapshots)-1]
+		prev = &p
+	}
+	r.snapshots = append(r.snapshots, TopologySnapshot{TraceID: t.TraceID, Time: t.Started, Nodes: len(t.Nodes), Edges: len(t.Edges), file: file})
+	handlers := r.onDiff
+	r.mu.Unlock()
+
+	if prev != nil {
+		if pt, err := loadTopology(prev.file); err == nil {
+			d := DiffTopology(pt, t)
+			if d.Partitioned {
+				logln(`[WARN] ネットワーク分断を検出 連結成分数: `, d.Components)
+			}
+			for _, f := range handlers {
+				f(d)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Snapshots は、保存済みのスナップショットを古い順に返します
+func (r *TopologyRecorder) Snapshots() []TopologySnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]TopologySnapshot(nil), r.snapshots...)
+}
+
+// Load は、traceIDのスナップショットを読み込みます。traceIDが空の場合は最新のものを読み込みます。
+func (r *TopologyRecorder) Load(traceID string) (*Topology, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := len(r.snapshots) - 1; i >= 0; i-- {
+		if traceID == `` || r.snapshots[i].TraceID == traceID {
+			return loadTopology(r.snapshots[i].file)
+		}
+	}
+	return nil, errors.New(`スナップショットがありません: ` + traceID)
+}
+
+// Diff は、二つのスナップショットの差分を返します。toが空の場合は最新のもの、fromが空の場合はtoの一つ前のものと比較します。
+func (r *TopologyRecorder) Diff(from, to string) (*TopologyDiff, error) {
+	r.mu.RLock()
+	ti := r.index(to, len(r.snapshots)-1)
+	fi := r.index(from, ti-1)
+	if ti < 0 || fi < 0 {
+		r.mu.RUnlock()
+		return nil, errors.New(`比較するスナップショットがありません`)
+	}
+	ff, tf := r.snapshots[fi].file, r.snapshots[ti].file
+	r.mu.RUnlock()
+
+	a, err := loadTopology(ff)
+	if err != nil {
+		return nil, err
+	}
+	b, err := loadTopology(tf)
+	if err != nil {
+		return nil, err
+	}
+	return DiffTopology(a, b), nil
+}
+
+// index は、traceIDのスナップショットの位置を返します。traceIDが空の場合はdefを返し、見つからなければ-1を返します。
+func (r *TopologyRecorder) index(traceID string, def int) int {
+	if traceID == `` {
+		return def
+	}
+	for i := range r.snapshots {
+		if r.snapshots[i].TraceID == traceID {
+			return i
+		}
+	}
+	return -1
+}
+
+// ServeHTTP は、スナップショットの一覧(/snapshots)、内容(/snapshot?id=)、差分(/diff?from=&to=)を返します
+func (r *TopologyRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var v interface{}
+	var err error
+	switch {
+	case strings.HasSuffix(req.URL.Path, `/snapshots`):
+		v = r.Snapshots()
+	case strings.HasSuffix(req.URL.Path, `/snapshot`):
+		v, err = r.Load(req.URL.Query().Get(`id`))
+	case strings.HasSuffix(req.URL.Path, `/diff`):
+		v, err = r.Diff(req.URL.Query().Get(`from`), req.URL.Query().Get(`to`))
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	if err = json.NewEncoder(w).Encode(v); err != nil {
+		logln(`[WARN] スナップショット応答 ` + err.Error())
+	}
+}
+
+func loadTopology(file string) (*Topology, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := new(Topology)
+	if err = json.NewDecoder(f).Decode(t); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	return t, nil
+}
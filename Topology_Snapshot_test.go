@@ -0,0 +1,227 @@
+package epsp
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newTraceTestPeer は、ピアID 1 で、ピア2とだけ接続している Peer と、ピア2が受け取るメッセージを読む Reader を返します
+func newTraceTestPeer(t *testing.T, clock Clock) (*Peer, *bufio.Reader) {
+	t.Helper()
+	local, remote := tcpPair(t)
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	peer := &Peer{clock: clock}
+	peer.setPeerID(`1`)
+	p := newTestP2PPeer(clock, remote.LocalAddr().String())
+	p.PeerID = `2`
+	p.conn = local
+	p.SetConnTime()
+	peer.Clients.add(p)
+	return peer, bufio.NewReader(remote)
+}
+
+// answerTrace は、送られた調査エコーを読み、replies の調査エコーリプライ(報告ピア, 接続先, 経由数)を届けて、timeout を進めます
+func answerTrace(t *testing.T, clock *FakeClock, peer *Peer, r *bufio.Reader, timeout time.Duration, replies ...[3]string) {
+	t.Helper()
+	var m Message
+	if err := m.Unmarshal(readLine(t, r)); err != nil {
+		t.Fatal(err)
+	}
+	req, err := ParseTraceRequest(m.Fields)
+	if err != nil || m.Code != CodeTrace || req.Origin != peer.PeerID() {
+		t.Fatalf(`trace = %s, %v`, m.Marshal(), err)
+	}
+	for _, reply := range replies {
+		peer.deliverTrace([]string{req.Origin, req.TraceID, reply[0], reply[1], reply[2]})
+	}
+	waitUntil(t, func() bool { return clock.Waiters() == 1 })
+	clock.Advance(timeout)
+}
+
+// writeTestTopology は、dirにスナップショットのファイルを書き込みます
+func writeTestTopology(t *testing.T, dir string, topo *Topology) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, `topology-`+topo.Started.UTC().Format(`20060102T150405`)+`-`+topo.TraceID+`.json`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = topo.WriteJSON(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopologyRecorderSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer, r := newTraceTestPeer(t, clock)
+
+	// 最小間隔より短い間隔は、切り上げます。
+	recorder, err := NewTopologyRecorder(peer, dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.interval != MinTopologySnapshotInterval {
+		t.Errorf(`interval = %v`, recorder.interval)
+	}
+	var diffs []*TopologyDiff
+	recorder.OnDiff(func(d *TopologyDiff) { diffs = append(diffs, d) })
+
+	snapshot := func(replies ...[3]string) *Topology {
+		t.Helper()
+		done := make(chan *Topology, 1)
+		errc := make(chan error, 1)
+		go func() {
+			topo, err := recorder.Snapshot(context.Background())
+			done <- topo
+			errc <- err
+		}()
+		answerTrace(t, clock, peer, r, topologySnapshotTimeout, replies...)
+		topo := <-done
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		return topo
+	}
+	first := snapshot([3]string{`2`, `1,3`, `1`}, [3]string{`3`, `2`, `2`})
+	if want := []TopologyEdge{{`1`, `2`}, {`2`, `3`}}; !reflect.DeepEqual(first.Edges, want) {
+		t.Errorf(`Edges = %v`, first.Edges)
+	}
+
+	// 手動の調査エコーと合わせて、最小間隔が経つまでは送りません。
+	clock.Advance(MinTraceInterval - topologySnapshotTimeout - traceIntervalSlack - time.Second)
+	if _, err := recorder.Snapshot(context.Background()); errors.Cause(err) != ErrTraceTooSoon {
+		t.Errorf(`Snapshot = %v`, err)
+	}
+	if _, err := peer.TraceLimited(context.Background(), time.Second); err != ErrTraceTooSoon {
+		t.Errorf(`TraceLimited = %v`, err)
+	}
+	clock.Advance(time.Second)
+
+	// ピア3が応答しなくなり、分断を検出します。
+	second := snapshot([3]string{`2`, `1`, `1`}, [3]string{`3`, ``, `2`})
+	ss := recorder.Snapshots()
+	if len(ss) != 2 || ss[1].TraceID != second.TraceID || ss[1].Nodes != 3 || ss[1].Edges != 1 {
+		t.Fatalf(`Snapshots = %+v`, ss)
+	}
+	if len(diffs) != 1 || !diffs[0].Partitioned || diffs[0].Components != 2 || diffs[0].From != first.TraceID ||
+		!reflect.DeepEqual(diffs[0].EdgesRemoved, []TopologyEdge{{`2`, `3`}}) {
+		t.Errorf(`diffs = %+v`, diffs)
+	}
+
+	// 保存したスナップショットは、作りなおしても読み込みます。
+	reloaded, err := NewTopologyRecorder(peer, dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Snapshots(); !reflect.DeepEqual(got, ss) || reloaded.interval != time.Hour {
+		t.Errorf(`reloaded = %+v, interval %v`, got, reloaded.interval)
+	}
+}
+
+func TestTraceLimitedPrecondition(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := &Peer{clock: clock}
+
+	// 送信できなければ、間隔の計算に含めません。
+	if _, err := peer.TraceLimited(context.Background(), time.Second); err == nil || err == ErrTraceTooSoon {
+		t.Errorf(`TraceLimited without peer ID = %v`, err)
+	}
+	peer.setPeerID(`1`)
+	if _, err := peer.TraceLimited(context.Background(), time.Second); err == nil || err == ErrTraceTooSoon {
+		t.Errorf(`TraceLimited without peers = %v`, err)
+	}
+	if !peer.lastTrace.IsZero() {
+		t.Errorf(`lastTrace = %v`, peer.lastTrace)
+	}
+}
+
+func TestTopologyRecorderDiff(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	nodes := func(ids ...string) (ns []TopologyNode) {
+		for _, id := range ids {
+			ns = append(ns, TopologyNode{PeerID: id, Replied: true})
+		}
+		return
+	}
+	split := &Topology{TraceID: `10`, Origin: `1`, Started: started, Nodes: nodes(`1`, `2`, `3`), Edges: []TopologyEdge{{`1`, `2`}}}
+	ring := &Topology{TraceID: `20`, Origin: `1`, Started: started.Add(10 * time.Minute), Nodes: nodes(`1`, `2`, `3`), Edges: []TopologyEdge{{`1`, `2`}, {`1`, `3`}, {`2`, `3`}}}
+	line := &Topology{TraceID: `30`, Origin: `1`, Started: started.Add(20 * time.Minute), Nodes: nodes(`1`, `2`, `4`), Edges: []TopologyEdge{{`1`, `2`}, {`2`, `4`}}}
+	for _, topo := range []*Topology{line, split, ring} {
+		writeTestTopology(t, dir, topo)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, `topology-20260101T000500-broken.json`), []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 読めないファイルは飛ばし、古い順に並べます。
+	recorder, err := NewTopologyRecorder(nil, dir, MinTopologySnapshotInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, s := range recorder.Snapshots() {
+		ids = append(ids, s.TraceID)
+	}
+	if !reflect.DeepEqual(ids, []string{`10`, `20`, `30`}) {
+		t.Fatalf(`Snapshots = %v`, ids)
+	}
+
+	tests := []struct {
+		from, to             string
+		wantFrom, wantTo     string
+		joined, left         []string
+		components           int
+		partitioned, wantErr bool
+	}{
+		{``, ``, `20`, `30`, []string{`4`}, []string{`3`}, 1, false, false}, // 最新とその一つ前
+		{``, `20`, `10`, `20`, []string{}, []string{}, 1, false, false},     // toの一つ前
+		{`20`, `10`, `20`, `10`, []string{}, []string{}, 2, true, false},    // 分断
+		{`10`, `10`, `10`, `10`, []string{}, []string{}, 2, false, false},   // 分断したままなら、新たな分断ではありません
+		{``, `10`, ``, ``, nil, nil, 0, false, true},                        // 一つ前がありません
+		{`99`, ``, ``, ``, nil, nil, 0, false, true},
+		{``, `99`, ``, ``, nil, nil, 0, false, true},
+	}
+	for _, tt := range tests {
+		d, err := recorder.Diff(tt.from, tt.to)
+		if (err != nil) != tt.wantErr {
+			t.Errorf(`Diff(%q, %q) err = %v`, tt.from, tt.to, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if d.From != tt.wantFrom || d.To != tt.wantTo || !reflect.DeepEqual(d.Joined, tt.joined) || !reflect.DeepEqual(d.Left, tt.left) ||
+			d.Components != tt.components || d.Partitioned != tt.partitioned {
+			t.Errorf(`Diff(%q, %q) = %+v`, tt.from, tt.to, d)
+		}
+	}
+
+	if topo, err := recorder.Load(``); err != nil || topo.TraceID != `30` {
+		t.Errorf(`Load latest = %+v, %v`, topo, err)
+	}
+	if _, err := recorder.Load(`99`); err == nil {
+		t.Error(`loaded an unknown snapshot`)
+	}
+}
@@ -0,0 +1,158 @@
+package epsp
+
+import "sort"
+
+// TopologyStats は、ネットワーク構成のグラフ統計です
+type TopologyStats struct {
+	Nodes             int
+	Edges             int
+	Diameter          int      // 連結成分内の最短経路長の最大値
+	Components        int      // 連結成分の数。1より大きい場合はネットワークが分断されています。
+	ArticulationPeers []string // 切断するとネットワークが分断されるピア(関節点)
+}
+
+// adjacency は、ピアIDごとの隣接ピアを返します
+func (t *Topology) adjacency() map[string][]string {
+	adj := make(map[string][]string, len(t.Nodes))
+	for _, n := range t.Nodes {
+		adj[n.PeerID] = nil
+	}
+	for _, e := range t.Edges {
+		adj[e.From] = append(adj[e.From], e.To)
+		adj[e.To] = append(adj[e.To], e.From)
+	}
+	return adj
+}
+
+// Stats は、ネットワーク構成のグラフ統計を計算します
+func (t *Topology) Stats() TopologyStats {
+	adj := t.adjacency()
+	s := TopologyStats{Nodes: len(adj), Edges: len(t.Edges)}
+
+	for _, c := range t.Components() {
+		s.Components++
+		for _, v := range c {
+			if d := eccentricity(adj, v); d > s.Diameter {
+				s.Diameter = d
+			}
+		}
+	}
+	s.ArticulationPeers = articulationPoints(adj)
+	return s
+}
+
+// Components は、連結成分ごとのピアIDを返します。調査元を含む成分が先頭です。
+func (t *Topology) Components() (cs [][]string) {
+	adj := t.adjacency()
+	seen := make(map[string]bool, len(adj))
+
+	ids := make([]string, 0, len(adj))
+	for id := range adj {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == t.Origin) != (ids[j] == t.Origin) {
+			return ids[i] == t.Origin
+		}
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		var c []string
+		queue := []string{id}
+		seen[id] = true
+		for len(queue) != 0 {
+			v := queue[0]
+			queue = queue[1:]
+			c = append(c, v)
+			for _, w := range adj[v] {
+				if !seen[w] {
+					seen[w] = true
+					queue = append(queue, w)
+				}
+			}
+		}
+		sort.Strings(c)
+		cs = append(cs, c)
+	}
+	return
+}
+
+// eccentricity は、vから到達できるピアまでの最短経路長の最大値です
+func eccentricity(adj map[string][]string, v string) (max int) {
+	dist := map[string]int{v: 0}
+	queue := []string{v}
+	for len(queue) != 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for _, w := range adj[u] {
+			if _, ok := dist[w]; !ok {
+				dist[w] = dist[u] + 1
+				if dist[w] > max {
+					max = dist[w]
+				}
+				queue = append(queue, w)
+			}
+		}
+	}
+	return
+}
+
+// articulationPoints は、関節点をTarjanの方法で求めます
+func articulationPoints(adj map[string][]string) []string {
+	order := make(map[string]int, len(adj))
+	low := make(map[string]int, len(adj))
+	points := make(map[string]bool)
+	counter := 0
+
+	var visit func(v, parent string)
+	visit = func(v, parent string) {
+		counter++
+		order[v] = counter
+		low[v] = counter
+		children := 0
+		for _, w := range adj[v] {
+			if w == parent {
+				continue
+			}
+			if order[w] != 0 {
+				if order[w] < low[v] {
+					low[v] = order[w]
+				}
+				continue
+			}
+			children++
+			visit(w, v)
+			if low[w] < low[v] {
+				low[v] = low[w]
+			}
+			if parent != `` && low[w] >= order[v] {
+				points[v] = true
+			}
+		}
+		if parent == `` && children > 1 {
+			points[v] = true
+		}
+	}
+
+	ids := make([]string, 0, len(adj))
+	for id := range adj {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if order[id] == 0 {
+			visit(id, ``)
+		}
+	}
+
+	ss := make([]string, 0, len(points))
+	for id := range points {
+		ss = append(ss, id)
+	}
+	sort.Strings(ss)
+	return ss
+}
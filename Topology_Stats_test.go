@@ -0,0 +1,67 @@
+package epsp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testTopology は、"1-2" 形式の接続から、originを調査元とするネットワーク構成を作ります。nodesは接続のないピアです。
+func testTopology(origin string, edges []string, nodes ...string) *Topology {
+	t := &Topology{TraceID: `100`, Origin: origin}
+	seen := make(map[string]bool)
+	addNode := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			t.Nodes = append(t.Nodes, TopologyNode{PeerID: id, Replied: true})
+		}
+	}
+	addNode(origin)
+	for _, id := range nodes {
+		addNode(id)
+	}
+	for _, e := range edges {
+		ids := strings.SplitN(e, `-`, 2)
+		addNode(ids[0])
+		addNode(ids[1])
+		t.Edges = append(t.Edges, newTopologyEdge(ids[0], ids[1]))
+	}
+	return t
+}
+
+func TestTopologyStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		topo       *Topology
+		want       TopologyStats
+		components [][]string
+	}{
+		{`path`, testTopology(`1`, []string{`1-2`, `2-3`, `3-4`}),
+			TopologyStats{Nodes: 4, Edges: 3, Diameter: 3, Components: 1, ArticulationPeers: []string{`2`, `3`}},
+			[][]string{{`1`, `2`, `3`, `4`}}},
+		{`cycle`, testTopology(`1`, []string{`1-2`, `2-3`, `3-4`, `1-4`}),
+			TopologyStats{Nodes: 4, Edges: 4, Diameter: 2, Components: 1, ArticulationPeers: []string{}},
+			[][]string{{`1`, `2`, `3`, `4`}}},
+		{`two components`, testTopology(`4`, []string{`1-2`, `2-3`, `4-5`}), // 調査元を含む成分が先頭です
+			TopologyStats{Nodes: 5, Edges: 3, Diameter: 2, Components: 2, ArticulationPeers: []string{`2`}},
+			[][]string{{`4`, `5`}, {`1`, `2`, `3`}}},
+		// 1を中心とする星形に、4で三角形がつながります
+		{`star`, testTopology(`2`, []string{`1-2`, `1-3`, `1-4`, `4-5`, `4-6`, `5-6`}),
+			TopologyStats{Nodes: 6, Edges: 6, Diameter: 3, Components: 1, ArticulationPeers: []string{`1`, `4`}},
+			[][]string{{`1`, `2`, `3`, `4`, `5`, `6`}}},
+		{`isolated`, testTopology(`1`, []string{`2-3`}, `4`),
+			TopologyStats{Nodes: 4, Edges: 1, Diameter: 1, Components: 3, ArticulationPeers: []string{}},
+			[][]string{{`1`}, {`2`, `3`}, {`4`}}},
+		{`origin only`, testTopology(`1`, nil),
+			TopologyStats{Nodes: 1, Components: 1, ArticulationPeers: []string{}},
+			[][]string{{`1`}}},
+	}
+	for _, tt := range tests {
+		if got := tt.topo.Stats(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf(`%s: Stats = %+v, want %+v`, tt.name, got, tt.want)
+		}
+		if got := tt.topo.Components(); !reflect.DeepEqual(got, tt.components) {
+			t.Errorf(`%s: Components = %v, want %v`, tt.name, got, tt.components)
+		}
+	}
+}
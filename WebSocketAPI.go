@@ -1,139 +1,158 @@
 package epsp
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// WebSocketAPI is handler for websocket api.
-func (peer *Peer) WebSocketAPI(ctx context.Context, hs *http.ServeMux) {
-	hs.HandleFunc(`/ws/Clients`, func(w http.ResponseWriter, r *http.Request) {
-		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-		}
+// wsWriteTimeout は、WebSocketの書き込み期限です
+const wsWriteTimeout = 10 * time.Second
 
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			logln(`Upgrade`, err)
-			return
+// wsPump は、WebSocketに接続し、nextが返したものを、nextがfalseを返すまでsendで送信します。
+// nextは、stopが閉じられたらfalseを返してください。受信側を読み捨てて切断を検出し、clockの一定間隔でPingを送ります。
+// 書き込みには wsWriteTimeout の期限をつけます。期限はソケットに設定するので、clockではなく実時間です。
+func wsPump(ctx context.Context, clock Clock, w http.ResponseWriter, r *http.Request, next func(stop <-chan struct{}) (interface{}, bool), send func(*websocket.Conn, interface{}) error) {
+	var upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logln(`[WARN] Upgrade ` + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() { // 受信側を読み捨て、切断を検出します
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
 		}
+	}()
 
-		var lastclients []byte
-		ticker := time.NewTicker(3 * time.Second)
+	go func() { // WriteControl は、他の書き込みと並行して呼べます
+		defer cancel()
+		ticker := clock.NewTicker(eventHeartbeat)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				clients, err := json.Marshal(peer.Clients)
-				if err != nil {
-					logln(`Marshal`, err)
-				}
-				if !bytes.Equal(clients, lastclients) {
-					if err = conn.WriteMessage(websocket.TextMessage, clients); err != nil {
-						//logln(`WriteMessage`, err)
-						err = conn.Close()
-						if err != nil {
-							logln(`Close`, err)
-						}
-						return
-					}
-					lastclients = clients
-
+			case <-ticker.C():
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
 				}
 			case <-ctx.Done():
-				err = conn.Close()
-				if err != nil {
-					logln(`Close`, err)
-				}
 				return
 			}
 		}
-	})
+	}()
 
-	hs.HandleFunc(`/ws/Servers`, func(w http.ResponseWriter, r *http.Request) {
-		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+	for {
+		v, ok := next(ctx.Done())
+		if !ok {
+			return
 		}
-
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			logln(`Upgrade`, err)
+		if err = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
 			return
 		}
+		if err = send(conn, v); err != nil {
+			return
+		}
+	}
+}
 
-		var lastservers []byte
-		ticker := time.NewTicker(3 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				servers, err := json.Marshal(peer.Servers)
-				if err != nil {
-					logln(`Marshal`, err)
-				}
-				if !bytes.Equal(servers, lastservers) {
-					if err = conn.WriteMessage(websocket.TextMessage, servers); err != nil {
-						//logln(`WriteMessage`, err)
-						err = conn.Close()
-						if err != nil {
-							logln(`Close`, err)
-						}
-						return
-					}
-					lastservers = servers
-				}
-			case <-ctx.Done():
-				err = conn.Close()
-				if err != nil {
-					logln(`Close`, err)
+// serveStatus は、WebSocketに接続し、状況全体を送った後、状況の変化をsendで送信します
+func serveStatus(ctx context.Context, clock Clock, hub *statusHub, w http.ResponseWriter, r *http.Request, send func(*websocket.Conn, StatusMessage) error) {
+	snapshot, updates, cancel := hub.subscribe()
+	defer cancel()
+
+	first := true
+	next := func(stop <-chan struct{}) (interface{}, bool) {
+		if first {
+			first = false
+			return snapshot, true
+		}
+		select {
+		case m, ok := <-updates:
+			return m, ok
+		case <-stop:
+			return nil, false
+		}
+	}
+	wsPump(ctx, clock, w, r, next, func(conn *websocket.Conn, v interface{}) error {
+		return send(conn, v.(StatusMessage))
+	})
+}
+
+// connListSender は、sideの接続一覧全体を、変化があるたびに送信します。/ws/Clients, /ws/Servers 用です。
+func connListSender(side string) func(*websocket.Conn, StatusMessage) error {
+	conns := make(map[string]ConnStatus)
+	return func(conn *websocket.Conn, m StatusMessage) error {
+		switch m.Type {
+		case `snapshot`:
+			for _, cs := range m.Peers {
+				if cs.Side == side {
+					conns[cs.Key] = cs
 				}
-				return
 			}
+		case `peer_added`, `peer_updated`:
+			if m.Peer.Side != side {
+				return nil
+			}
+			conns[m.Peer.Key] = *m.Peer
+		case `peer_removed`:
+			if _, ok := conns[m.Key]; !ok {
+				return nil
+			}
+			delete(conns, m.Key)
+		default:
+			return nil
+		}
+		list := make([]ConnStatus, 0, len(conns))
+		for _, cs := range conns {
+			list = append(list, cs)
 		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+		return conn.WriteJSON(list)
+	}
+}
+
+// WebSocketAPI is handler for websocket api.
+// /ws/status は、接続時に状況全体(snapshot)を送り、以降は変化分(peer_added, peer_updated, peer_removed, counters, regions)だけを送ります。
+// /ws/Clients, /ws/Servers, /ws/PeerCountByRegion は、従来どおり一覧全体を送りますが、変化があった時だけ送ります。
+func (peer *Peer) WebSocketAPI(ctx context.Context, hs *http.ServeMux) {
+	hub := newStatusHub(peer)
+	go hub.run(ctx)
+
+	hs.HandleFunc(`/ws/status`, func(w http.ResponseWriter, r *http.Request) {
+		serveStatus(ctx, peer.clock, hub, w, r, func(conn *websocket.Conn, m StatusMessage) error {
+			return conn.WriteJSON(m)
+		})
 	})
 
-	hs.HandleFunc(`/ws/PeerCountByRegion`, func(w http.ResponseWriter, r *http.Request) {
-		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-		}
+	hs.HandleFunc(`/ws/Clients`, func(w http.ResponseWriter, r *http.Request) {
+		serveStatus(ctx, peer.clock, hub, w, r, connListSender(`client`))
+	})
 
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Println(`Upgrade`, err)
-			return
-		}
+	hs.HandleFunc(`/ws/Servers`, func(w http.ResponseWriter, r *http.Request) {
+		serveStatus(ctx, peer.clock, hub, w, r, connListSender(`server`))
+	})
 
-		var lastbs []byte
-		ticker := time.NewTicker(3 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				bs := peer.PeerCountsByRegion.GoogleChart()
-				if !bytes.Equal(bs, lastbs) {
-					if err = conn.WriteMessage(websocket.TextMessage, bs); err != nil {
-						//log.Println(`WriteMessage`, err)
-						err = conn.Close()
-						if err != nil {
-							logln(`Close`, err)
-						}
-						return
-					}
-					lastbs = bs
-				}
-			case <-ctx.Done():
-				err = conn.Close()
-				if err != nil {
-					logln(`Close`, err)
-				}
-				return
+	hs.HandleFunc(`/ws/PeerCountByRegion`, func(w http.ResponseWriter, r *http.Request) {
+		serveStatus(ctx, peer.clock, hub, w, r, func(conn *websocket.Conn, m StatusMessage) error {
+			if len(m.Regions) == 0 {
+				return nil
 			}
-		}
+			return conn.WriteMessage(websocket.TextMessage, m.Regions)
+		})
 	})
 }
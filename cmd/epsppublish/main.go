@@ -0,0 +1,193 @@
+// epsppublish は、隔離されたEPSPネットワークでの訓練のために、署名した地震情報(551)、津波予報(552)、地域ピア数(561)を送出します。
+//
+// ピアとしてネットワークに参加し、接続できたら、引数のファイルの内容を順に送出して終了します。
+// 受信するピアには、-sign-key の公開鍵(初回起動時に <sign-key>.pub として書き出します)を、サーバ公開鍵として設定してください。
+//
+// ファイルは、気象庁防災情報XML(拡張子 .xml。震度速報、震源・震度に関する情報、津波警報・注意報・予報など)か、次のいずれかを含むJSONです。
+//
+//	{"earthquake": {"time": "...", "max_scale": "45", "hypocenter": "...", "points": [...], ...}}
+//	{"tsunami": {"areas": [{"grade": "津波警報", "name": "...", "immediate": true}]}}
+//	{"peer_counts": {"250": 10, "300": 4}}
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/logutils"
+	"github.com/pkg/errors"
+	"github.com/toyo/epsp"
+)
+
+// message は、送出するファイルの内容です
+type message struct {
+	Earthquake *epsp.EarthquakeInfo `json:"earthquake"`
+	Tsunami    *epsp.TsunamiInfo    `json:"tsunami"`
+	PeerCounts map[string]uint64    `json:"peer_counts"`
+}
+
+func main() {
+	servers := flag.String(`servers`, `127.0.0.1:6910`, `EPSPサーバ(カンマ区切り)`)
+	region := flag.String(`region`, `250`, `地域コード`)
+	port := flag.Int(`port`, 6911, `ピア接続を待ち受けるポート`)
+	incoming := flag.Uint64(`incoming`, 4, `受け入れるピア数`)
+	signKeyFile := flag.String(`sign-key`, `epsppublish.pem`, `署名に使うサーバ保証用の秘密鍵(PEM)。なければ作ります。`)
+	keyFile := flag.String(`key-file`, `epsppublish.json`, `ピアIDと鍵を保存するファイル`)
+	peerKeyFile := flag.String(`peer-key`, `epspserver-ca.pem.pub`, `ピア公開鍵(PEM)`)
+	expire := flag.Duration(`expire`, epsp.DefaultPublishExpire, `送出するメッセージの有効期間`)
+	wait := flag.Duration(`wait`, 1*time.Minute, `ピアと接続できるまで待つ時間`)
+	interval := flag.Duration(`interval`, 1*time.Second, `ファイルごとの送出間隔`)
+	debug := flag.Bool(`d`, false, `デバッグログを出力する`)
+	flag.Parse()
+
+	if *debug {
+		logger := log.New(os.Stderr, ``, log.LstdFlags)
+		logger.SetOutput(&logutils.LevelFilter{
+			Levels:   []logutils.LogLevel{"ECHO", "DEBUG", "INFO", "WARN", "ERROR"},
+			MinLevel: logutils.LogLevel("DEBUG"),
+			Writer:   os.Stderr,
+		})
+		epsp.SetLogger(logger)
+	}
+
+	signKey, created, err := epsp.LoadOrCreatePrivateKey(*signKeyFile, 2048)
+	if err != nil {
+		log.Fatal(`署名鍵 `, err)
+	}
+	if created {
+		log.Println(`署名鍵を作りました。受信するピアには ` + *signKeyFile + `.pub をサーバ公開鍵として設定してください。`)
+	}
+
+	messages := make([]message, 0, flag.NArg())
+	for _, filename := range flag.Args() {
+		m, err := readMessage(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+	if len(messages) == 0 {
+		log.Fatal(`送出するファイルを指定してください`)
+	}
+
+	serverKey, err := epsp.EncodePublicKey(&signKey.PublicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	peerKey, err := ioutil.ReadFile(*peerKeyFile)
+	if err != nil {
+		log.Fatal(`ピア公開鍵 `, err)
+	}
+
+	peer, err := epsp.NewPeer(strings.Split(*servers, `,`), *region, *incoming, serverKey, peerKey, func(string, ...string) {})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = peer.SetKeyFile(*keyFile); err != nil {
+		log.Println(`鍵ファイル `, err)
+	}
+	publisher, err := epsp.NewPublisher(peer, signKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	publisher.Expire = *expire
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := peer.Loop(ctx, *port); err != nil && err != context.Canceled {
+			log.Println(err)
+		}
+	}()
+
+	deadline := time.Now().Add(*wait)
+	for peer.NumOfConnectedPeers() == 0 {
+		if time.Now().After(deadline) {
+			log.Fatal(`ピアと接続できませんでした`)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	for i, m := range messages {
+		if i != 0 {
+			time.Sleep(*interval)
+		}
+		if err = publish(publisher, m); err != nil {
+			log.Fatal(flag.Arg(i), ` `, err)
+		}
+		log.Println(`送出しました ` + flag.Arg(i))
+	}
+}
+
+// readMessage は、ファイルを読み込みます。"-" は標準入力です。
+func readMessage(filename string) (m message, err error) {
+	if strings.EqualFold(filepath.Ext(filename), `.xml`) {
+		var r *epsp.JMAReport
+		if r, err = epsp.ParseJMAXMLFile(filename); err != nil {
+			err = errors.Wrap(err, filename)
+			return
+		}
+		m.Earthquake, m.Tsunami = r.Earthquake, r.Tsunami
+		return
+	}
+
+	var b []byte
+	if filename == `-` {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&m); err != nil {
+		err = errors.Wrap(err, filename)
+	}
+	return
+}
+
+// publisher は、epsp.Publisher の送出する部分です
+type publisher interface {
+	Earthquake(e *epsp.EarthquakeInfo) error
+	Tsunami(t *epsp.TsunamiInfo) error
+	PeerCounts(pc epsp.PeerCounts) error
+}
+
+// publish は、mに含まれるものを、地震情報、津波予報、地域ピア数の順にすべて送出します。
+// 送出に失敗しても残りを送出し、失敗をまとめて返します。
+func publish(p publisher, m message) error {
+	sent := 0
+	var errs []string
+	try := func(name string, err error) {
+		sent++
+		if err != nil {
+			errs = append(errs, name+`: `+err.Error())
+		}
+	}
+	if m.Earthquake != nil {
+		try(`earthquake`, p.Earthquake(m.Earthquake))
+	}
+	if m.Tsunami != nil {
+		try(`tsunami`, p.Tsunami(m.Tsunami))
+	}
+	if m.PeerCounts != nil {
+		try(`peer_counts`, p.PeerCounts(epsp.NewPeerCountsFromMap(m.PeerCounts)))
+	}
+	if sent == 0 {
+		return errors.New(`earthquake, tsunami, peer_counts のいずれもありません`)
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, `; `))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/toyo/epsp"
+)
+
+// fakePublisher は、送出したものを記録し、failのものを失敗させます
+type fakePublisher struct {
+	sent []string
+	fail map[string]bool
+}
+
+func (p *fakePublisher) record(name string) error {
+	p.sent = append(p.sent, name)
+	if p.fail[name] {
+		return errors.New(`送出失敗`)
+	}
+	return nil
+}
+
+func (p *fakePublisher) Earthquake(*epsp.EarthquakeInfo) error { return p.record(`earthquake`) }
+func (p *fakePublisher) Tsunami(*epsp.TsunamiInfo) error       { return p.record(`tsunami`) }
+func (p *fakePublisher) PeerCounts(epsp.PeerCounts) error      { return p.record(`peer_counts`) }
+
+func TestPublish(t *testing.T) {
+	all := message{Earthquake: &epsp.EarthquakeInfo{}, Tsunami: &epsp.TsunamiInfo{}, PeerCounts: map[string]uint64{`250`: 1}}
+	tests := []struct {
+		name string
+		m    message
+		fail map[string]bool
+		sent []string
+		err  string
+	}{
+		{`earthquake only`, message{Earthquake: &epsp.EarthquakeInfo{}}, nil, []string{`earthquake`}, ``},
+		{`earthquake and tsunami`, message{Earthquake: &epsp.EarthquakeInfo{}, Tsunami: &epsp.TsunamiInfo{}}, nil, []string{`earthquake`, `tsunami`}, ``},
+		{`all`, all, nil, []string{`earthquake`, `tsunami`, `peer_counts`}, ``},
+		{`continue after failure`, all, map[string]bool{`earthquake`: true}, []string{`earthquake`, `tsunami`, `peer_counts`}, `earthquake: 送出失敗`},
+		{`combine failures`, all, map[string]bool{`earthquake`: true, `peer_counts`: true}, []string{`earthquake`, `tsunami`, `peer_counts`}, `earthquake: 送出失敗; peer_counts: 送出失敗`},
+		{`nothing`, message{}, nil, nil, `earthquake, tsunami, peer_counts のいずれもありません`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakePublisher{fail: tt.fail}
+			err := publish(p, tt.m)
+			if !reflect.DeepEqual(p.sent, tt.sent) {
+				t.Errorf(`sent = %v, want %v`, p.sent, tt.sent)
+			}
+			if got := errString(err); got != tt.err {
+				t.Errorf(`err = %q, want %q`, got, tt.err)
+			}
+		})
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ``
+	}
+	return err.Error()
+}
+
+func TestReadMessage(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `epsppublish`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, body string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	m, err := readMessage(write(`both.json`, `{"earthquake": {"max_scale": "45"}, "tsunami": {"areas": [{"grade": "津波注意報", "name": "東京湾内湾"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Earthquake == nil || m.Earthquake.MaxScale != `45` || m.Tsunami == nil || m.PeerCounts != nil {
+		t.Errorf(`message = %+v`, m)
+	}
+
+	if _, err = readMessage(write(`unknown.json`, `{"quake": {}}`)); err == nil || !strings.Contains(err.Error(), `unknown.json`) {
+		t.Errorf(`unknown field err = %v`, err)
+	}
+}
@@ -0,0 +1,71 @@
+// epspserver は、プライベートなEPSPネットワーク(訓練や組織内)のためのEPSPサーバです。
+//
+// ピアには、-ca-key の公開鍵(初回起動時に <ca-key>.pub として書き出します)を、ピア公開鍵として設定してください。
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hashicorp/logutils"
+	"github.com/toyo/epsp"
+)
+
+func main() {
+	listen := flag.String(`listen`, `:6910`, `待ち受けるアドレス`)
+	registry := flag.String(`registry`, `epspserver.json`, `ピア登録簿のファイル(空ならメモリのみ)`)
+	caKeyFile := flag.String(`ca-key`, `epspserver-ca.pem`, `ピア鍵認証局の秘密鍵(PEM)。なければ作ります。`)
+	keyLifetime := flag.Duration(`key-lifetime`, epsp.DefaultServerKeyLifetime, `発行する鍵の有効期間`)
+	keyBits := flag.Int(`key-bits`, epsp.DefaultServerKeyBits, `発行する鍵の長さ`)
+	echoTimeout := flag.Duration(`echo-timeout`, epsp.DefaultServerEchoTimeout, `エコーがないピアを消すまでの時間`)
+	peerList := flag.Int(`peer-list`, epsp.DefaultServerPeerListSize, `接続先として紹介するピアの数`)
+	temporaryPerHost := flag.Int(`temporary-per-host`, epsp.DefaultServerTemporaryPerHost, `接続元ごとの、本割当前の暫定ピアIDの上限(0なら無制限)`)
+	debug := flag.Bool(`d`, false, `デバッグログを出力する`)
+	flag.Parse()
+
+	if *debug {
+		logger := log.New(os.Stderr, ``, log.LstdFlags)
+		logger.SetOutput(&logutils.LevelFilter{
+			Levels:   []logutils.LogLevel{"ECHO", "DEBUG", "INFO", "WARN", "ERROR"},
+			MinLevel: logutils.LogLevel("DEBUG"),
+			Writer:   os.Stderr,
+		})
+		epsp.SetLogger(logger)
+	}
+
+	caKey, created, err := epsp.LoadOrCreatePrivateKey(*caKeyFile, 2048)
+	if err != nil {
+		log.Fatal(`ピア鍵認証局 `, err)
+	}
+	if created {
+		log.Println(`ピア鍵認証局の鍵を作りました。ピアには ` + *caKeyFile + `.pub をピア公開鍵として設定してください。`)
+	}
+	reg, err := epsp.LoadRegistry(*registry)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := epsp.NewP2SServer(reg, caKey)
+	s.KeyLifetime = *keyLifetime
+	s.KeyBits = *keyBits
+	s.EchoTimeout = *echoTimeout
+	s.PeerListSize = *peerList
+	s.TemporaryPerHost = *temporaryPerHost
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	log.Println(`EPSPサーバ ` + *listen)
+	if err = s.ListenAndServe(ctx, *listen); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toyo/epsp"
+)
+
+const (
+	csrfCookie   = `p2pquake_csrf`
+	csrfHeader   = `X-CSRF-Token`
+	csrfLifetime = 12 * time.Hour // CSRFトークンの有効期間です。過ぎたらページを開きなおすと新しくなります
+)
+
+// Admin は、ピアを操作するエンドポイント(/cancel, /send615 など)を保護します。
+// 操作はPOSTだけを受け付け、Bearerトークンか、Basic認証で認証します。
+// 認証情報を設定しない場合は、ループバックアドレスからの、Hostヘッダがlocalhostか待ち受けアドレスの操作だけを受け付けます(DNSリバインディング対策)。
+// ブラウザが自動で送る認証(Basic認証、ループバック)の場合は、Origin(なければReferer)が同じホストであることと、CSRFトークンも確認します。
+type Admin struct {
+	token    string
+	user     string
+	password string
+	secure   bool            // CSRFクッキーにSecure属性をつける(TLS使用時)
+	hosts    map[string]bool // ループバックからの操作で受け付けるHostヘッダのホスト名
+	csrfKey  []byte
+	clock    epsp.Clock
+}
+
+// NewAdmin は、Admin のコンストラクタです。addrは統計ページを待ち受けるアドレスです。
+func NewAdmin(token, user, password, addr string, secure bool) (*Admin, error) {
+	a := &Admin{token: token, user: user, password: password, secure: secure, csrfKey: make([]byte, 32), clock: epsp.SystemClock}
+	a.hosts = map[string]bool{`localhost`: true}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != `` {
+		a.hosts[strings.ToLower(host)] = true
+	}
+	if _, err := rand.Read(a.csrfKey); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// csrfSign は、nonceの署名を返します
+func (a *Admin) csrfSign(nonce string) string {
+	m := hmac.New(sha256.New, a.csrfKey)
+	m.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// newCSRFToken は、「発行時刻.乱数.署名」のCSRFトークンを返します
+func (a *Admin) newCSRFToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+	nonce := strconv.FormatInt(a.clock.Now().Unix(), 10) + `.` + base64.RawURLEncoding.EncodeToString(b)
+	return nonce + `.` + a.csrfSign(nonce), nil
+}
+
+// validCSRFToken は、CSRFトークンの署名が正しく、有効期間内かを返します
+func (a *Admin) validCSRFToken(token string) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i <= 0 || !equal(token[i+1:], a.csrfSign(token[:i])) {
+		return false
+	}
+	issued, err := strconv.ParseInt(token[:strings.IndexByte(token, '.')], 10, 64)
+	if err != nil {
+		return false
+	}
+	age := a.clock.Now().Sub(time.Unix(issued, 0))
+	return age >= 0 && age < csrfLifetime
+}
+
+// Page は、HTMLページに、CSRFトークンのクッキーを付けます。ページのJavaScriptは、操作時にこの値を X-CSRF-Token ヘッダで送ります。
+func (a *Admin) Page(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(csrfCookie); err != nil || !a.validCSRFToken(c.Value) {
+			token, err := a.newCSRFToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    token,
+				Path:     `/`,
+				Secure:   a.secure,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate は、リクエストを認証します。ブラウザが自動で送る認証の場合はcsrfをtrueにします。
+func (a *Admin) authenticate(r *http.Request) (ok, csrf bool) {
+	auth := r.Header.Get(`Authorization`)
+	if a.token != `` && strings.HasPrefix(auth, `Bearer `) {
+		return equal(strings.TrimPrefix(auth, `Bearer `), a.token), false
+	}
+	if a.user != `` {
+		user, password, found := r.BasicAuth()
+		return found && equal(user, a.user) && equal(password, a.password), true
+	}
+	if a.token != `` {
+		return false, false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false, false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && a.allowedHost(r.Host), true
+}
+
+// allowedHost は、Hostヘッダのホスト名が、ループバックアドレスか、localhostか待ち受けアドレスかを返します
+func (a *Admin) allowedHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, `[`), `]`)
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return a.hosts[strings.ToLower(host)]
+}
+
+// sameOrigin は、Originヘッダ(なければRefererヘッダ)のホストが、Hostヘッダと同じかを返します。どちらもなければfalseです。
+func (a *Admin) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get(`Origin`)
+	if origin == `` {
+		origin = r.Header.Get(`Referer`)
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != `` && strings.EqualFold(u.Host, r.Host)
+}
+
+// checkCSRF は、X-CSRF-Token ヘッダがクッキーと一致し、正しく署名されていることを確認します
+func (a *Admin) checkCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || !a.validCSRFToken(c.Value) {
+		return false
+	}
+	return equal(r.Header.Get(csrfHeader), c.Value)
+}
+
+// Handler は、ピアを操作するハンドラを保護します
+func (a *Admin) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set(`Allow`, http.MethodPost)
+			http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+			return
+		}
+		ok, csrf := a.authenticate(r)
+		if !ok {
+			if a.user != `` {
+				w.Header().Set(`WWW-Authenticate`, `Basic realm="p2pquake admin"`)
+			}
+			http.Error(w, `unauthorized`, http.StatusUnauthorized)
+			return
+		}
+		if csrf && !a.sameOrigin(r) {
+			http.Error(w, `cross-origin request`, http.StatusForbidden)
+			return
+		}
+		if csrf && !a.checkCSRF(r) {
+			http.Error(w, `invalid CSRF token`, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// HandleFunc は、保護したハンドラをhsに登録します
+func (a *Admin) HandleFunc(hs *http.ServeMux, pattern string, f func(http.ResponseWriter, *http.Request)) {
+	hs.Handle(pattern, a.Handler(http.HandlerFunc(f)))
+}
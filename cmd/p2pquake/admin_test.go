@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toyo/epsp"
+)
+
+func newTestAdmin(t *testing.T, token, user, password string) (*Admin, *epsp.FakeClock) {
+	t.Helper()
+	a, err := NewAdmin(token, user, password, `127.0.0.1:6980`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := epsp.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	a.clock = clock
+	return a, clock
+}
+
+func TestAdminHandler(t *testing.T) {
+	const (
+		token    = `secret`
+		user     = `admin`
+		password = `pass`
+		loopback = `127.0.0.1:50000`
+		remote   = `192.0.2.1:50000`
+		host     = `localhost:6980`
+		origin   = `http://localhost:6980`
+	)
+	tests := []struct {
+		name                  string
+		token, user, password string
+		method                string
+		remote, host          string
+		bearer                string
+		basicUser, basicPass  string
+		origin, referer       string
+		csrf                  string // csrfValid なら正しいトークン、csrfForged なら署名の違うトークンです
+		header                string // 空なら csrf と同じ値を X-CSRF-Token で送ります
+		age                   time.Duration
+		want                  int
+	}{
+		{name: `GET`, method: http.MethodGet, remote: loopback, host: host, origin: origin, csrf: csrfValid, want: http.StatusMethodNotAllowed},
+		{name: `no bearer`, token: token, remote: remote, host: host, want: http.StatusUnauthorized},
+		{name: `wrong bearer`, token: token, remote: remote, host: host, bearer: `wrong`, want: http.StatusUnauthorized},
+		{name: `bearer skips CSRF`, token: token, remote: remote, host: `p2pquake.example:6980`, bearer: token, want: http.StatusOK},
+		{name: `token disables loopback`, token: token, remote: loopback, host: host, origin: origin, csrf: csrfValid, want: http.StatusUnauthorized},
+		{name: `wrong basic`, user: user, password: password, remote: remote, host: host, basicUser: user, basicPass: `wrong`, origin: origin, csrf: csrfValid, want: http.StatusUnauthorized},
+		{name: `basic without CSRF header`, user: user, password: password, remote: remote, host: host, basicUser: user, basicPass: password, origin: origin, want: http.StatusForbidden},
+		{name: `basic with CSRF`, user: user, password: password, remote: remote, host: host, basicUser: user, basicPass: password, origin: origin, csrf: csrfValid, want: http.StatusOK},
+		{name: `non-loopback without credentials`, remote: remote, host: host, origin: origin, csrf: csrfValid, want: http.StatusUnauthorized},
+		{name: `loopback`, remote: loopback, host: host, origin: origin, csrf: csrfValid, want: http.StatusOK},
+		{name: `loopback by address`, remote: `[::1]:50000`, host: `127.0.0.1:6980`, origin: `http://127.0.0.1:6980`, csrf: csrfValid, want: http.StatusOK},
+		{name: `DNS rebinding`, remote: loopback, host: `attacker.example:6980`, origin: `http://attacker.example:6980`, csrf: csrfValid, want: http.StatusUnauthorized},
+		{name: `cross origin`, remote: loopback, host: host, origin: `http://attacker.example`, csrf: csrfValid, want: http.StatusForbidden},
+		{name: `referer`, remote: loopback, host: host, referer: origin + `/index.html`, csrf: csrfValid, want: http.StatusOK},
+		{name: `no origin nor referer`, remote: loopback, host: host, csrf: csrfValid, want: http.StatusForbidden},
+		{name: `forged CSRF token`, remote: loopback, host: host, origin: origin, csrf: csrfForged, want: http.StatusForbidden},
+		{name: `CSRF header mismatch`, remote: loopback, host: host, origin: origin, csrf: csrfValid, header: `other`, want: http.StatusForbidden},
+		{name: `expired CSRF token`, remote: loopback, host: host, origin: origin, csrf: csrfValid, age: csrfLifetime, want: http.StatusForbidden},
+		{name: `CSRF token within lifetime`, remote: loopback, host: host, origin: origin, csrf: csrfValid, age: csrfLifetime - time.Second, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, clock := newTestAdmin(t, tt.token, tt.user, tt.password)
+			called := false
+			h := a.Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+
+			method := tt.method
+			if method == `` {
+				method = http.MethodPost
+			}
+			r := httptest.NewRequest(method, `http://`+tt.host+`/cancel`, nil)
+			r.RemoteAddr = tt.remote
+			r.Host = tt.host
+			if tt.bearer != `` {
+				r.Header.Set(`Authorization`, `Bearer `+tt.bearer)
+			}
+			if tt.basicUser != `` {
+				r.SetBasicAuth(tt.basicUser, tt.basicPass)
+			}
+			if tt.origin != `` {
+				r.Header.Set(`Origin`, tt.origin)
+			}
+			if tt.referer != `` {
+				r.Header.Set(`Referer`, tt.referer)
+			}
+			if tt.csrf != `` {
+				value := testCSRFToken(t, a, tt.csrf)
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: value})
+				header := tt.header
+				if header == `` {
+					header = value
+				}
+				r.Header.Set(csrfHeader, header)
+			}
+			clock.Advance(tt.age)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want || called != (tt.want == http.StatusOK) {
+				t.Errorf(`status = %d (called %v), want %d: %s`, w.Code, called, tt.want, w.Body.String())
+			}
+			if w.Code == http.StatusMethodNotAllowed && w.Header().Get(`Allow`) != http.MethodPost {
+				t.Errorf(`Allow = %q`, w.Header().Get(`Allow`))
+			}
+			if got := w.Header().Get(`WWW-Authenticate`); (got != ``) != (w.Code == http.StatusUnauthorized && tt.user != ``) {
+				t.Errorf(`WWW-Authenticate = %q`, got)
+			}
+		})
+	}
+}
+
+const (
+	csrfValid  = `valid`
+	csrfForged = `forged`
+)
+
+// testCSRFToken は、aが発行したCSRFトークンか、署名を差し替えたものを返します
+func testCSRFToken(t *testing.T, a *Admin, kind string) string {
+	t.Helper()
+	token, err := a.newCSRFToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind == csrfForged {
+		other, _ := newTestAdmin(t, ``, ``, ``)
+		i := strings.LastIndexByte(token, '.')
+		token = token[:i+1] + other.csrfSign(token[:i])
+	}
+	return token
+}
+
+func TestAdminPage(t *testing.T) {
+	a, clock := newTestAdmin(t, ``, ``, ``)
+	h := a.Page(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	get := func(cookie string) *http.Cookie {
+		r := httptest.NewRequest(http.MethodGet, `http://localhost:6980/`, nil)
+		if cookie != `` {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == csrfCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	c := get(``)
+	if c == nil || !a.validCSRFToken(c.Value) || c.SameSite != http.SameSiteStrictMode || c.HttpOnly {
+		t.Fatalf(`cookie = %+v`, c)
+	}
+	if get(c.Value) != nil {
+		t.Error(`reissued a valid token`)
+	}
+	if get(testCSRFToken(t, a, csrfForged)) == nil {
+		t.Error(`kept a forged token`)
+	}
+	clock.Advance(csrfLifetime)
+	if renewed := get(c.Value); renewed == nil || renewed.Value == c.Value {
+		t.Errorf(`expired token not reissued: %+v`, renewed)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/toyo/epsp"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix は、設定を上書きする環境変数の接頭辞です。-snapshot-dir は P2PQUAKE_SNAPSHOT_DIR で上書きします。
+const envPrefix = `P2PQUAKE_`
+
+const defaultServerKey = `-----BEGIN PUBLIC KEY-----
+MIGdMA0GCSqGSIb3DQEBAQUAA4GLADCBhwKBgQC8p/vth2yb/k9x2/PcXKdb6oI3gAbhvr
+/HPTOwla5tQHB83LXNF4Y+Sv/Mu4Uu0tKWz02FrLgA5cuJZfba9QNULTZLTNUgUXIB0m/d
+q5Rx17IyCfLQ2XngmfFkfnRdRSK7kGnIXvO2/LOKD50JsTf2vz0RQIdw6cEmdl+Aga7i8Q
+IBEQ==
+-----END PUBLIC KEY-----`
+
+const defaultPeerKey = `-----BEGIN PUBLIC KEY-----
+MIGdMA0GCSqGSIb3DQEBAQUAA4GLADCBhwKBgQDTJKLLO7wjCHz80kpnisqcPDQvA9voNY
+5QuAA+bOWeqvl4gmPSiylzQZzldS+n/M5p4o1PRS24WAO+kPBHCf4ETAns8M02MFwxH/Fl
+QnbvMfi9zutJkQAu3Hq4293rHz+iCQW/MWYB5IfzFBnWtEdjkhqHsGy6sZMMe+qx/F1rcQ
+IBEQ==
+-----END PUBLIC KEY-----`
+
+// integrations は、有効にできる機能です
+var integrations = map[string]string{
+	`websocket`: `/ws/status などのWebSocket`,
+	`events`:    `/events, /ws/events のイベント配信`,
+	`api`:       `/api/ の読み取り専用API`,
+	`upnp`:      `UPnP-IGDによるポート転送`,
+	`natpmp`:    `NAT-PMPによるポート転送(natpmp_gatewayが必要)`,
+}
+
+// Duration は、設定ファイルで "1h" のように書ける時間です
+type Duration struct {
+	time.Duration
+}
+
+// MarshalText は、"1h0m0s" の形式にします
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText は、"1h" の形式を読み込みます
+func (d *Duration) UnmarshalText(b []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(b))
+	return
+}
+
+// MarshalYAML は、"1h0m0s" の形式にします
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// UnmarshalYAML は、"1h" の形式を読み込みます
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// Config は、p2pquakeの設定です。既定値、設定ファイル、環境変数、フラグの順に上書きします。
+type Config struct {
+	Debug            bool     `json:"debug" yaml:"debug" toml:"debug"`
+	Servers          []string `json:"servers" yaml:"servers" toml:"servers"`
+	Region           string   `json:"region" yaml:"region" toml:"region"`
+	Incoming         uint64   `json:"incoming" yaml:"incoming" toml:"incoming"`
+	Port             int      `json:"port" yaml:"port" toml:"port"`
+	ListenAddrs      []string `json:"listen_addrs" yaml:"listen_addrs" toml:"listen_addrs"`
+	AdvertisedPort   int      `json:"advertised_port" yaml:"advertised_port" toml:"advertised_port"`
+	HTTP             string   `json:"http" yaml:"http" toml:"http"`
+	ServerKey        string   `json:"server_key" yaml:"server_key" toml:"server_key"` // PEM またはファイル名
+	PeerKey          string   `json:"peer_key" yaml:"peer_key" toml:"peer_key"`       // PEM またはファイル名
+	KeyFile          string   `json:"key_file" yaml:"key_file" toml:"key_file"`
+	SnapshotDir      string   `json:"snapshot_dir" yaml:"snapshot_dir" toml:"snapshot_dir"`
+	SnapshotInterval Duration `json:"snapshot_interval" yaml:"snapshot_interval" toml:"snapshot_interval"`
+	AdminToken       string   `json:"admin_token" yaml:"admin_token" toml:"admin_token"`
+	AdminUser        string   `json:"admin_user" yaml:"admin_user" toml:"admin_user"`
+	AdminPassword    string   `json:"admin_password" yaml:"admin_password" toml:"admin_password"`
+	TLSCert          string   `json:"tls_cert" yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey           string   `json:"tls_key" yaml:"tls_key" toml:"tls_key"`
+	NATPMPGateway    string   `json:"natpmp_gateway" yaml:"natpmp_gateway" toml:"natpmp_gateway"`
+	Integrations     []string `json:"integrations" yaml:"integrations" toml:"integrations"`
+
+	File  string `json:"-" yaml:"-" toml:"-"` // 設定ファイル
+	Print bool   `json:"-" yaml:"-" toml:"-"` // 設定を表示して終了する
+}
+
+// DefaultConfig は、既定の設定を返します
+func DefaultConfig() *Config {
+	return &Config{
+		Servers: []string{
+			`www.p2pquake.net:6910`, `p2pquake.dnsalias.net:6910`,
+			`p2pquake.dyndns.info:6910`, `p2pquake.ddo.jp:6910`},
+		Region:           `250`,
+		Incoming:         20,
+		Port:             6911,
+		HTTP:             `127.0.0.1:6980`,
+		ServerKey:        defaultServerKey,
+		PeerKey:          defaultPeerKey,
+		SnapshotInterval: Duration{1 * time.Hour},
+		Integrations:     []string{`websocket`, `events`, `api`},
+	}
+}
+
+// Enabled は、機能nameが有効かどうかを返します
+func (c *Config) Enabled(name string) bool {
+	for _, i := range c.Integrations {
+		if i == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Key は、PEMまたはファイル名から公開鍵のPEMを返します
+func Key(v string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(v), `-----BEGIN`) {
+		return []byte(v), nil
+	}
+	return ioutil.ReadFile(v)
+}
+
+// Validate は、設定の整合性を確認します
+func (c *Config) Validate() error {
+	if len(c.Servers) == 0 {
+		return errors.New(`servers が空です`)
+	}
+	if epsp.Area(c.Region) == `Undefined` {
+		return errors.New(`region が不明です: ` + c.Region)
+	}
+	if c.Incoming == 0 {
+		return errors.New(`incoming は1以上にしてください`)
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return errors.New(`port が範囲外です: ` + strconv.Itoa(c.Port))
+	}
+	if c.AdvertisedPort < 0 || c.AdvertisedPort > 65535 {
+		return errors.New(`advertised_port が範囲外です: ` + strconv.Itoa(c.AdvertisedPort))
+	}
+	if (c.TLSCert == ``) != (c.TLSKey == ``) {
+		return errors.New(`tls_cert と tls_key は両方指定してください`)
+	}
+	if (c.AdminUser == ``) != (c.AdminPassword == ``) {
+		return errors.New(`admin_user と admin_password は両方指定してください`)
+	}
+	for _, i := range c.Integrations {
+		if _, ok := integrations[i]; !ok {
+			return errors.New(`integrations が不明です: ` + i)
+		}
+	}
+	if c.Enabled(`natpmp`) && c.NATPMPGateway == `` {
+		return errors.New(`natpmp には natpmp_gateway が必要です`)
+	}
+	return nil
+}
+
+// configFormat は、ファイル名の拡張子から設定ファイルの形式を返します
+func configFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case `.json`:
+		return `json`
+	case `.yaml`, `.yml`:
+		return `yaml`
+	default:
+		return `toml`
+	}
+}
+
+// Load は、設定ファイルを読み込みます。書かれていない項目はそのままです。知らない項目はエラーにします。
+func (c *Config) Load(file string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, `設定ファイル`)
+	}
+	switch configFormat(file) {
+	case `json`:
+		dec := json.NewDecoder(bytes.NewReader(bs))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case `yaml`:
+		err = yaml.UnmarshalStrict(bs, c)
+	default:
+		var md toml.MetaData
+		if md, err = toml.Decode(string(bs), c); err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) != 0 {
+				err = errors.Errorf(`不明な項目 %v`, undecoded)
+			}
+		}
+	}
+	return errors.Wrap(err, file)
+}
+
+// Write は、設定をformat(json, yaml, toml)で書き出します
+func (c *Config) Write(w io.Writer, format string) error {
+	switch format {
+	case `json`:
+		enc := json.NewEncoder(w)
+		enc.SetIndent(``, `  `)
+		return enc.Encode(c)
+	case `yaml`:
+		bs, err := yaml.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bs)
+		return err
+	default:
+		return toml.NewEncoder(w).Encode(c)
+	}
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) Set(s string) error { *v.p = s; return nil }
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ``
+	}
+	return *v.p
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) Set(s string) (err error) { *v.p, err = strconv.ParseBool(s); return }
+func (v boolValue) String() string           { return strconv.FormatBool(v.p != nil && *v.p) }
+func (v boolValue) IsBoolFlag() bool         { return true }
+
+type intValue struct{ p *int }
+
+func (v intValue) Set(s string) (err error) { *v.p, err = strconv.Atoi(s); return }
+func (v intValue) String() string {
+	if v.p == nil {
+		return `0`
+	}
+	return strconv.Itoa(*v.p)
+}
+
+type uint64Value struct{ p *uint64 }
+
+func (v uint64Value) Set(s string) (err error) { *v.p, err = strconv.ParseUint(s, 10, 64); return }
+func (v uint64Value) String() string {
+	if v.p == nil {
+		return `0`
+	}
+	return strconv.FormatUint(*v.p, 10)
+}
+
+type durationValue struct{ p *Duration }
+
+func (v durationValue) Set(s string) error { return v.p.UnmarshalText([]byte(s)) }
+func (v durationValue) String() string {
+	if v.p == nil {
+		return `0s`
+	}
+	return v.p.String()
+}
+
+// listValue は、カンマ区切りのリストです
+type listValue struct{ p *[]string }
+
+func (v listValue) Set(s string) error {
+	*v.p = []string{}
+	for _, e := range strings.Split(s, `,`) {
+		if e = strings.TrimSpace(e); e != `` {
+			*v.p = append(*v.p, e)
+		}
+	}
+	return nil
+}
+func (v listValue) String() string {
+	if v.p == nil {
+		return ``
+	}
+	return strings.Join(*v.p, `,`)
+}
+
+// setting は、フラグと環境変数で上書きできる設定項目です
+type setting struct {
+	name  string
+	usage string
+	value func(*Config) flag.Value
+}
+
+func (s setting) env() string {
+	return envPrefix + strings.ToUpper(strings.Replace(s.name, `-`, `_`, -1))
+}
+
+var settings = []setting{
+	{`d`, `debug flag`, func(c *Config) flag.Value { return boolValue{&c.Debug} }},
+	{`servers`, `EPSPサーバ(カンマ区切り)`, func(c *Config) flag.Value { return listValue{&c.Servers} }},
+	{`region`, `地域コード`, func(c *Config) flag.Value { return stringValue{&c.Region} }},
+	{`incoming`, `最大接続数`, func(c *Config) flag.Value { return uint64Value{&c.Incoming} }},
+	{`port`, `ピア接続を待ち受けるポート`, func(c *Config) flag.Value { return intValue{&c.Port} }},
+	{`listen`, `ピア接続を待ち受けるアドレス(カンマ区切り、空ならすべて)`, func(c *Config) flag.Value { return listValue{&c.ListenAddrs} }},
+	{`advertised-port`, `サーバに通知するポート(0ならport)`, func(c *Config) flag.Value { return intValue{&c.AdvertisedPort} }},
+	{`http`, `統計ページを待ち受けるアドレス`, func(c *Config) flag.Value { return stringValue{&c.HTTP} }},
+	{`server-key`, `サーバ公開鍵(PEMまたはファイル名)`, func(c *Config) flag.Value { return stringValue{&c.ServerKey} }},
+	{`peer-key`, `ピア公開鍵(PEMまたはファイル名)`, func(c *Config) flag.Value { return stringValue{&c.PeerKey} }},
+	{`key-file`, `鍵ファイル(空なら一時ディレクトリ)`, func(c *Config) flag.Value { return stringValue{&c.KeyFile} }},
+	{`snapshot-dir`, `ネットワーク構成のスナップショット保存先(空なら取らない)`, func(c *Config) flag.Value { return stringValue{&c.SnapshotDir} }},
+	{`snapshot-interval`, `ネットワーク構成のスナップショット間隔`, func(c *Config) flag.Value { return durationValue{&c.SnapshotInterval} }},
+	{`admin-token`, `操作用のBearerトークン`, func(c *Config) flag.Value { return stringValue{&c.AdminToken} }},
+	{`admin-user`, `操作用のBasic認証ユーザ名`, func(c *Config) flag.Value { return stringValue{&c.AdminUser} }},
+	{`admin-password`, `操作用のBasic認証パスワード`, func(c *Config) flag.Value { return stringValue{&c.AdminPassword} }},
+	{`tls-cert`, `TLS証明書ファイル(指定するとHTTPSで待ち受ける)`, func(c *Config) flag.Value { return stringValue{&c.TLSCert} }},
+	{`tls-key`, `TLS秘密鍵ファイル`, func(c *Config) flag.Value { return stringValue{&c.TLSKey} }},
+	{`natpmp-gateway`, `NAT-PMPのゲートウェイ`, func(c *Config) flag.Value { return stringValue{&c.NATPMPGateway} }},
+	{`integrations`, `有効にする機能(カンマ区切り: websocket,events,api,upnp,natpmp)`, func(c *Config) flag.Value { return listValue{&c.Integrations} }},
+}
+
+// ParseConfig は、既定値、設定ファイル(-config または P2PQUAKE_CONFIG)、環境変数、フラグの順に設定を読み込みます
+func ParseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	flagged := DefaultConfig() // フラグの値を受け取ります。既定値は -help の表示用です。
+	for _, s := range settings {
+		fs.Var(s.value(flagged), s.name, s.usage+` (`+s.env()+`)`)
+	}
+	file := fs.String(`config`, os.Getenv(envPrefix+`CONFIG`), `設定ファイル(.toml, .yaml, .json) (`+envPrefix+`CONFIG)`)
+	printConfig := fs.Bool(`print-config`, false, `設定を表示して終了する`)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := DefaultConfig()
+	c.File = *file
+	c.Print = *printConfig
+	if c.File != `` {
+		if err := c.Load(c.File); err != nil {
+			return nil, err
+		}
+	}
+
+	byName := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byName[s.name] = s
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.value(c).Set(v); err != nil {
+				return nil, errors.Wrap(err, s.env())
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := byName[f.Name]; ok && err == nil {
+			err = errors.Wrap(s.value(c).Set(f.Value.String()), `-`+f.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
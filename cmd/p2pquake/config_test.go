@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig は、一時ディレクトリにnameの設定ファイルを書き込み、そのパスを返します
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func parseTestConfig(args ...string) (*Config, error) {
+	fs := flag.NewFlagSet(`p2pquake`, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return ParseConfig(fs, args)
+}
+
+func TestParseConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, `p2pquake.toml`, `
+region = "300"
+port = 7000
+incoming = 5
+integrations = ["api"]
+`)
+
+	// 既定値 < 設定ファイル < 環境変数 < フラグ の順に上書きします。
+	c, err := parseTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, DefaultConfig()) {
+		t.Errorf(`defaults = %+v`, c)
+	}
+
+	c, err = parseTestConfig(`-config`, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region != `300` || c.Port != 7000 || c.Incoming != 5 || !reflect.DeepEqual(c.Integrations, []string{`api`}) || c.HTTP != `127.0.0.1:6980` || c.File != file {
+		t.Errorf(`file = %+v`, c)
+	}
+
+	t.Setenv(envPrefix+`CONFIG`, file)
+	t.Setenv(envPrefix+`REGION`, `301`)
+	t.Setenv(envPrefix+`PORT`, `7001`)
+	t.Setenv(envPrefix+`SNAPSHOT_INTERVAL`, `2h`)
+	c, err = parseTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region != `301` || c.Port != 7001 || c.Incoming != 5 || c.SnapshotInterval.Duration != 2*time.Hour || c.File != file {
+		t.Errorf(`env = %+v`, c)
+	}
+
+	c, err = parseTestConfig(`-region`, `302`, `-servers`, `a:6910, b:6910`, `-d`, `-print-config`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region != `302` || c.Port != 7001 || c.Incoming != 5 || !c.Debug || !c.Print || !reflect.DeepEqual(c.Servers, []string{`a:6910`, `b:6910`}) {
+		t.Errorf(`flag = %+v`, c)
+	}
+
+	// フラグの既定値では、環境変数と設定ファイルを上書きしません。
+	c, err = parseTestConfig(`-region`, `250`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region != `250` || c.Port != 7001 {
+		t.Errorf(`flag with default value = %+v`, c)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	if _, err := parseTestConfig(`-config`, filepath.Join(t.TempDir(), `none.toml`)); err == nil {
+		t.Error(`loaded a missing file`)
+	}
+	if _, err := parseTestConfig(`-port`, `http`); err == nil {
+		t.Error(`parsed a bad flag`)
+	}
+	if _, err := parseTestConfig(`-region`, `999`); err == nil {
+		t.Error(`accepted an invalid config`)
+	}
+
+	t.Setenv(envPrefix+`INCOMING`, `many`)
+	if _, err := parseTestConfig(); err == nil || !strings.Contains(err.Error(), envPrefix+`INCOMING`) {
+		t.Errorf(`bad env = %v`, err)
+	}
+}
+
+func TestConfigLoadFormats(t *testing.T) {
+	want := DefaultConfig()
+	want.Region = `300`
+	want.Port = 7000
+	want.SnapshotInterval = Duration{30 * time.Minute}
+	want.Integrations = []string{`api`, `upnp`}
+
+	tests := []struct {
+		name, content, unknown string
+	}{
+		{`p2pquake.toml`, "region = \"300\"\nport = 7000\nsnapshot_interval = \"30m\"\nintegrations = [\"api\", \"upnp\"]\n", "regoin = \"300\"\n"},
+		{`p2pquake.yaml`, "region: \"300\"\nport: 7000\nsnapshot_interval: 30m\nintegrations: [api, upnp]\n", "regoin: \"300\"\n"},
+		{`p2pquake.yml`, "region: \"300\"\nport: 7000\nsnapshot_interval: 30m\nintegrations: [api, upnp]\n", "regoin: \"300\"\n"},
+		{`p2pquake.json`, `{"region": "300", "port": 7000, "snapshot_interval": "30m", "integrations": ["api", "upnp"]}`, `{"regoin": "300"}`},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		if err := c.Load(writeConfig(t, tt.name, tt.content)); err != nil {
+			t.Errorf(`%s: %v`, tt.name, err)
+		} else if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s: %+v\nwant %+v", tt.name, c, want)
+		}
+
+		// 知らない項目は、書き間違いとしてエラーにします。
+		file := writeConfig(t, tt.name, tt.unknown)
+		if err := DefaultConfig().Load(file); err == nil || !strings.Contains(err.Error(), file) {
+			t.Errorf(`%s: unknown key err = %v`, tt.name, err)
+		}
+	}
+
+	// 設定例は、既定値と同じです。
+	c := DefaultConfig()
+	if err := c.Load(`p2pquake.example.toml`); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, DefaultConfig()) {
+		t.Errorf(`example = %+v`, c)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		ok     bool
+	}{
+		{`default`, func(*Config) {}, true},
+		{`no servers`, func(c *Config) { c.Servers = nil }, false},
+		{`unknown region`, func(c *Config) { c.Region = `999` }, false},
+		{`no incoming`, func(c *Config) { c.Incoming = 0 }, false},
+		{`port 0`, func(c *Config) { c.Port = 0 }, false},
+		{`port 65536`, func(c *Config) { c.Port = 65536 }, false},
+		{`advertised port`, func(c *Config) { c.AdvertisedPort = 16911 }, true},
+		{`negative advertised port`, func(c *Config) { c.AdvertisedPort = -1 }, false},
+		{`advertised port 65536`, func(c *Config) { c.AdvertisedPort = 65536 }, false},
+		{`TLS`, func(c *Config) { c.TLSCert, c.TLSKey = `cert.pem`, `key.pem` }, true},
+		{`TLS cert only`, func(c *Config) { c.TLSCert = `cert.pem` }, false},
+		{`TLS key only`, func(c *Config) { c.TLSKey = `key.pem` }, false},
+		{`admin user`, func(c *Config) { c.AdminUser, c.AdminPassword = `admin`, `pass` }, true},
+		{`admin user only`, func(c *Config) { c.AdminUser = `admin` }, false},
+		{`admin password only`, func(c *Config) { c.AdminPassword = `pass` }, false},
+		{`unknown integration`, func(c *Config) { c.Integrations = []string{`api`, `irc`} }, false},
+		{`natpmp without gateway`, func(c *Config) { c.Integrations = []string{`natpmp`} }, false},
+		{`natpmp`, func(c *Config) { c.Integrations, c.NATPMPGateway = []string{`natpmp`}, `192.168.0.1` }, true},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		tt.modify(c)
+		if err := c.Validate(); (err == nil) != tt.ok {
+			t.Errorf(`%s: Validate = %v`, tt.name, err)
+		}
+	}
+}
+
+func TestConfigWriteRoundTrip(t *testing.T) {
+	want := DefaultConfig()
+	want.Debug = true
+	want.ListenAddrs = []string{`0.0.0.0:6911`, `[::]:6911`}
+	want.AdvertisedPort = 16911
+	want.KeyFile = `/var/lib/p2pquake/key.json`
+	want.SnapshotDir = `/var/lib/p2pquake/topology`
+	want.SnapshotInterval = Duration{90 * time.Minute}
+	want.AdminToken = `token`
+	want.Integrations = []string{`natpmp`}
+	want.NATPMPGateway = `192.168.0.1`
+	want.File = `ignored.toml`
+	want.Print = true
+
+	for _, format := range []string{`toml`, `yaml`, `json`} {
+		var b bytes.Buffer
+		if err := want.Write(&b, format); err != nil {
+			t.Fatal(err)
+		}
+		file := writeConfig(t, `p2pquake.`+format, b.String())
+		got := &Config{}
+		if err := got.Load(file); err != nil {
+			t.Errorf("%s: %v\n%s", format, err, b.String())
+			continue
+		}
+		// 設定ファイルと -print-config は、書き出しません。
+		got.File, got.Print = want.File, want.Print
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v\nwant %+v", format, got, want)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	// 実行環境の設定に左右されないよう、P2PQUAKE_ で始まる環境変数を消します。
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envPrefix) {
+			os.Unsetenv(kv[:strings.IndexByte(kv, '=')])
+		}
+	}
+	os.Exit(m.Run())
+}
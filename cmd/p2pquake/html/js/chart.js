@@ -0,0 +1,52 @@
+// chart.js は、ピア数の時系列(/api/peercounts)を折れ線グラフとしてSVGに描きます。
+
+var SVGNS = "http://www.w3.org/2000/svg";
+
+// LineChart は、elに折れ線グラフを作ります
+function LineChart(el, width, height) {
+	this.width = width || 1024;
+	this.height = height || 160;
+	this.svg = document.createElementNS(SVGNS, "svg");
+	this.svg.setAttribute("viewBox", "0 0 " + this.width + " " + this.height);
+	this.svg.setAttribute("class", "linechart");
+	el.textContent = "";
+	el.appendChild(this.svg);
+}
+
+// setData は、[{time, total}, ...] を描きます。データがなければ何も描きません。
+LineChart.prototype.setData = function (samples) {
+	while (this.svg.firstChild) {
+		this.svg.removeChild(this.svg.firstChild);
+	}
+	if (!samples || samples.length == 0) {
+		return;
+	}
+	var pad = 30;
+	var t0 = new Date(samples[0].time).getTime(), t1 = new Date(samples[samples.length - 1].time).getTime();
+	var max = Math.max.apply(null, samples.map(function (s) { return s.total; })) || 1;
+	var self = this;
+	var x = function (t) { return pad + (t1 > t0 ? (t - t0) / (t1 - t0) : 1) * (self.width - 2 * pad); };
+	var y = function (v) { return self.height - pad - v / max * (self.height - 2 * pad); };
+
+	var line = document.createElementNS(SVGNS, "polyline");
+	line.setAttribute("class", "line");
+	line.setAttribute("fill", "none");
+	line.setAttribute("points", samples.map(function (s) {
+		return x(new Date(s.time).getTime()) + "," + y(s.total);
+	}).join(" "));
+	this.svg.appendChild(line);
+
+	var label = function (tx, ty, text, anchor) {
+		var t = document.createElementNS(SVGNS, "text");
+		t.setAttribute("x", tx);
+		t.setAttribute("y", ty);
+		t.setAttribute("font-size", 10);
+		t.setAttribute("text-anchor", anchor || "start");
+		t.textContent = text;
+		self.svg.appendChild(t);
+	};
+	label(2, y(max) + 4, max);
+	label(2, y(0) + 4, 0);
+	label(pad, this.height - 8, formatTime(samples[0].time, true));
+	label(this.width - pad, this.height - 8, formatTime(samples[samples.length - 1].time, true), "end");
+};
@@ -0,0 +1,138 @@
+// graph.js は、ネットワーク構成(/635.json)を力学モデルで配置して、SVGに描きます。
+
+var SVGNS = "http://www.w3.org/2000/svg";
+
+// ForceGraph は、svgにnodes({id, ...})とedges({source, target})を描きます
+function ForceGraph(svg, nodes, edges) {
+	this.svg = svg;
+	this.width = svg.clientWidth || 800;
+	this.height = svg.clientHeight || 600;
+	this.nodes = nodes;
+	this.index = {};
+	this.dragging = null;
+
+	var self = this;
+	nodes.forEach(function (n, i) {
+		var a = 2 * Math.PI * i / nodes.length;
+		n.x = self.width / 2 + self.height / 3 * Math.cos(a);
+		n.y = self.height / 2 + self.height / 3 * Math.sin(a);
+		n.vx = 0;
+		n.vy = 0;
+		self.index[n.id] = n;
+	});
+	this.edges = edges.filter(function (e) {
+		return self.index[e.source] && self.index[e.target];
+	});
+
+	this.lines = this.edges.map(function (e) {
+		var l = document.createElementNS(SVGNS, "line");
+		l.setAttribute("stroke", "black");
+		l.setAttribute("stroke-width", 1);
+		svg.appendChild(l);
+		return l;
+	});
+	this.circles = nodes.map(function (n) {
+		var g = document.createElementNS(SVGNS, "g");
+		var c = document.createElementNS(SVGNS, "circle");
+		c.setAttribute("r", 10);
+		c.setAttribute("stroke", "black");
+		c.setAttribute("fill", n.replied ? "lightSalmon" : "lightGray");
+		var t = document.createElementNS(SVGNS, "text");
+		t.setAttribute("dy", 4);
+		t.setAttribute("text-anchor", "middle");
+		t.setAttribute("fill", "#666");
+		t.setAttribute("font-family", "Helvetica");
+		t.setAttribute("font-size", 10);
+		t.style.userSelect = "none";
+		t.textContent = n.id;
+		g.appendChild(c);
+		g.appendChild(t);
+		g.addEventListener("mousedown", function (ev) {
+			self.dragging = n;
+			ev.preventDefault();
+		});
+		svg.appendChild(g);
+		return g;
+	});
+
+	svg.addEventListener("mousemove", function (ev) {
+		if (self.dragging) {
+			var r = svg.getBoundingClientRect();
+			self.dragging.x = ev.clientX - r.left;
+			self.dragging.y = ev.clientY - r.top;
+			self.alpha = Math.max(self.alpha, 0.3);
+			self.start();
+		}
+	});
+	window.addEventListener("mouseup", function () { self.dragging = null; });
+
+	this.alpha = 1;
+	this.start();
+}
+
+// tick は、反発力、接続のばね、中心への引力で、一段階だけ配置を進めます
+ForceGraph.prototype.tick = function () {
+	var nodes = this.nodes, i, j;
+	for (i = 0; i < nodes.length; i++) {
+		for (j = i + 1; j < nodes.length; j++) {
+			var dx = nodes[j].x - nodes[i].x, dy = nodes[j].y - nodes[i].y;
+			var d2 = dx * dx + dy * dy || 0.01;
+			var f = 800 / d2 * this.alpha;
+			nodes[i].vx -= dx * f; nodes[i].vy -= dy * f;
+			nodes[j].vx += dx * f; nodes[j].vy += dy * f;
+		}
+	}
+	var self = this;
+	this.edges.forEach(function (e) {
+		var s = self.index[e.source], t = self.index[e.target];
+		var dx = t.x - s.x, dy = t.y - s.y;
+		var d = Math.sqrt(dx * dx + dy * dy) || 0.01;
+		var f = (d - 50) / d * 0.1 * self.alpha;
+		s.vx += dx * f; s.vy += dy * f;
+		t.vx -= dx * f; t.vy -= dy * f;
+	});
+	nodes.forEach(function (n) {
+		n.vx += (self.width / 2 - n.x) * 0.01 * self.alpha;
+		n.vy += (self.height / 2 - n.y) * 0.01 * self.alpha;
+		if (n !== self.dragging) {
+			n.x += n.vx;
+			n.y += n.vy;
+		}
+		n.vx *= 0.6;
+		n.vy *= 0.6;
+	});
+	this.alpha *= 0.99;
+};
+
+ForceGraph.prototype.draw = function () {
+	var self = this;
+	this.edges.forEach(function (e, i) {
+		var s = self.index[e.source], t = self.index[e.target];
+		self.lines[i].setAttribute("x1", s.x);
+		self.lines[i].setAttribute("y1", s.y);
+		self.lines[i].setAttribute("x2", t.x);
+		self.lines[i].setAttribute("y2", t.y);
+	});
+	this.nodes.forEach(function (n, i) {
+		self.circles[i].setAttribute("transform", "translate(" + n.x + "," + n.y + ")");
+	});
+};
+
+// start は、配置が落ち着くまで描き続けます
+ForceGraph.prototype.start = function () {
+	if (this.running) {
+		return;
+	}
+	this.running = true;
+	var self = this;
+	var step = function () {
+		self.tick();
+		self.draw();
+		if (self.alpha > 0.005 || self.dragging) {
+			requestAnimationFrame(step);
+		} else {
+			self.running = false;
+		}
+	};
+	requestAnimationFrame(step);
+};
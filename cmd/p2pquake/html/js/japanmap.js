@@ -0,0 +1,123 @@
+// japanmap.js は、地域コードの緯度経度(/areas.json)から、日本地図をSVGで描きます。
+// 地図の形は、すべての地域の点で表します。
+
+var SVGNS = "http://www.w3.org/2000/svg";
+
+// JapanMap は、elに地図を作ります。areasは /areas.json の内容です。
+function JapanMap(el, areas) {
+	this.minLng = 122.5;
+	this.maxLat = 46;
+	this.scale = 40; // 1度あたりの画素数
+	this.kx = Math.cos(36 * Math.PI / 180);
+
+	var width = (154 - this.minLng) * this.kx * this.scale;
+	var height = (this.maxLat - 24) * this.scale;
+	this.svg = document.createElementNS(SVGNS, "svg");
+	this.svg.setAttribute("viewBox", "0 0 " + width + " " + height);
+	this.svg.setAttribute("class", "japanmap");
+
+	this.areas = areas || [];
+	var self = this;
+	var base = document.createElementNS(SVGNS, "g");
+	base.setAttribute("class", "area");
+	(areas || []).forEach(function (a) {
+		if (!a.latitude) {
+			return;
+		}
+		var p = self.project(a.latitude, a.longitude);
+		var c = document.createElementNS(SVGNS, "circle");
+		c.setAttribute("cx", p[0]);
+		c.setAttribute("cy", p[1]);
+		c.setAttribute("r", 6);
+		var title = document.createElementNS(SVGNS, "title");
+		title.textContent = a.name;
+		c.appendChild(title);
+		base.appendChild(c);
+	});
+	this.svg.appendChild(base);
+
+	this.layer = document.createElementNS(SVGNS, "g");
+	this.svg.appendChild(this.layer);
+
+	el.textContent = "";
+	el.appendChild(this.svg);
+}
+
+// project は、緯度経度を画面の座標にします
+JapanMap.prototype.project = function (lat, lng) {
+	return [(lng - this.minLng) * this.kx * this.scale, (this.maxLat - lat) * this.scale];
+};
+
+// prefecturePoint は、都道府県("青森県"、"東京都"でも可)の代表点として、最初の地域の緯度経度を返します。見つからなければnullです。
+JapanMap.prototype.prefecturePoint = function (pref) {
+	if (pref != "北海道") {
+		pref = pref.replace(/[都府県]$/, "");
+	}
+	for (var i = 0; i < this.areas.length; i++) {
+		var a = this.areas[i];
+		if (a.prefecture == pref && a.latitude) {
+			return [a.latitude, a.longitude];
+		}
+	}
+	return null;
+};
+
+// regionPoint は、地域名の緯度経度を返します。見つからなければnullです。
+JapanMap.prototype.regionPoint = function (name) {
+	for (var i = 0; i < this.areas.length; i++) {
+		var a = this.areas[i];
+		if (a.name == name && a.latitude) {
+			return [a.latitude, a.longitude];
+		}
+	}
+	return null;
+};
+
+// clear は、地図に重ねた印を消します
+JapanMap.prototype.clear = function () {
+	while (this.layer.firstChild) {
+		this.layer.removeChild(this.layer.firstChild);
+	}
+};
+
+// mark は、緯度経度に半径r、classNameの印を置きます
+JapanMap.prototype.mark = function (lat, lng, r, className, label) {
+	var p = this.project(lat, lng);
+	var c = document.createElementNS(SVGNS, "circle");
+	c.setAttribute("cx", p[0]);
+	c.setAttribute("cy", p[1]);
+	c.setAttribute("r", r);
+	c.setAttribute("class", className);
+	if (label) {
+		var title = document.createElementNS(SVGNS, "title");
+		title.textContent = label;
+		c.appendChild(title);
+	}
+	this.layer.appendChild(c);
+	return c;
+};
+
+// setPeerCounts は、GoogleChart形式([["Latitude","Longitude","Region","ピア数"], [lat, lng, name, count], ...])のピア数を描きます
+JapanMap.prototype.setPeerCounts = function (table) {
+	this.clear();
+	for (var i = 1; i < table.length; i++) {
+		var row = table[i];
+		this.mark(row[0], row[1], 4 + 3 * Math.sqrt(row[3]), "peers", row[2] + ": " + row[3]);
+	}
+};
+
+// loadJapanMap は、/areas.json を読み込んで地図を作ります
+function loadJapanMap(el, done) {
+	var xhr = new XMLHttpRequest();
+	xhr.open("GET", "/areas.json");
+	xhr.onload = function () {
+		var areas = [];
+		try {
+			areas = JSON.parse(xhr.responseText);
+		} catch (e) {
+			console.log("areas.json", e);
+		}
+		done(new JapanMap(el, areas));
+	};
+	xhr.send();
+}
@@ -0,0 +1,99 @@
+// table.js は、キーで行を追加・更新・削除できる簡単な表です。
+
+// pad2 は、2桁にします
+function pad2(n) {
+	return (n < 10 ? "0" : "") + n;
+}
+
+// formatTime は、RFC3339の時刻を "HH:mm:ss" (withDayなら "ddd HH:mm:ss") にします
+function formatTime(v, withDay) {
+	if (!v) {
+		return "";
+	}
+	var t = new Date(v);
+	if (isNaN(t.getTime())) {
+		return "";
+	}
+	var s = pad2(t.getHours()) + ":" + pad2(t.getMinutes()) + ":" + pad2(t.getSeconds());
+	if (withDay) {
+		s = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"][t.getDay()] + " " + s;
+	}
+	return s;
+}
+
+// Table は、columns({title, field, align, width, format})の表をelに作ります。行はkeyの値で区別します。
+function Table(el, columns, key, sortField) {
+	this.el = el;
+	this.columns = columns;
+	this.key = key;
+	this.sortField = sortField;
+	this.rows = {};
+
+	var table = document.createElement("table");
+	table.className = "epsp-table";
+	var tr = document.createElement("tr");
+	columns.forEach(function (c) {
+		var th = document.createElement("th");
+		th.textContent = c.title;
+		if (c.width) {
+			th.style.width = c.width + "px";
+		}
+		tr.appendChild(th);
+	});
+	var thead = document.createElement("thead");
+	thead.appendChild(tr);
+	table.appendChild(thead);
+	this.tbody = document.createElement("tbody");
+	table.appendChild(this.tbody);
+
+	el.textContent = "";
+	el.appendChild(table);
+}
+
+// setData は、すべての行を置き換えます
+Table.prototype.setData = function (rows) {
+	var self = this;
+	this.rows = {};
+	rows.forEach(function (r) { self.rows[r[self.key]] = r; });
+	this.render();
+};
+
+// updateOrAdd は、行を追加または更新します
+Table.prototype.updateOrAdd = function (row) {
+	this.rows[row[this.key]] = row;
+	this.render();
+};
+
+// remove は、行を削除します
+Table.prototype.remove = function (key) {
+	delete this.rows[key];
+	this.render();
+};
+
+Table.prototype.render = function () {
+	var self = this;
+	var rows = Object.keys(this.rows).map(function (k) { return self.rows[k]; });
+	if (this.sortField) {
+		rows.sort(function (a, b) {
+			var x = a[self.sortField], y = b[self.sortField];
+			return x < y ? -1 : x > y ? 1 : 0;
+		});
+	}
+
+	var tbody = document.createElement("tbody");
+	rows.forEach(function (r) {
+		var tr = document.createElement("tr");
+		self.columns.forEach(function (c) {
+			var td = document.createElement("td");
+			var v = r[c.field];
+			td.textContent = c.format ? c.format(v, r) : (v == null ? "" : String(v));
+			if (c.align) {
+				td.style.textAlign = c.align;
+			}
+			tr.appendChild(td);
+		});
+		tbody.appendChild(tr);
+	});
+	this.tbody.parentNode.replaceChild(tbody, this.tbody);
+	this.tbody = tbody;
+};
@@ -7,15 +7,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hashicorp/logutils"
 	"github.com/toyo/epsp"
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
 )
 
 var h = NewHandler635()
@@ -26,12 +23,18 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
-	var (
-		d = flag.Bool(`d`, false, `debug flag`)
-	)
-	flag.Parse()
+	cfg, err := ParseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Print {
+		if err = cfg.Write(os.Stdout, configFormat(cfg.File)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	if *d {
+	if cfg.Debug {
 		logger := log.New(os.Stderr, ``, log.LstdFlags)
 		logger.SetOutput(&logutils.LevelFilter{
 			Levels:   []logutils.LogLevel{"ECHO", "DEBUG", "INFO", "WARN", "ERROR"},
@@ -41,62 +44,122 @@ func main() {
 		epsp.SetLogger(logger)
 	}
 
-	peer, err := epsp.NewPeer(
-		/* servers */ []string{
-			`www.p2pquake.net:6910`, `p2pquake.dnsalias.net:6910`,
-			`p2pquake.dyndns.info:6910`, `p2pquake.ddo.jp:6910`},
-		/* region */ `250`,
-		/* incoming */ 20,
-		[]byte(`-----BEGIN PUBLIC KEY-----
-MIGdMA0GCSqGSIb3DQEBAQUAA4GLADCBhwKBgQC8p/vth2yb/k9x2/PcXKdb6oI3gAbhvr
-/HPTOwla5tQHB83LXNF4Y+Sv/Mu4Uu0tKWz02FrLgA5cuJZfba9QNULTZLTNUgUXIB0m/d
-q5Rx17IyCfLQ2XngmfFkfnRdRSK7kGnIXvO2/LOKD50JsTf2vz0RQIdw6cEmdl+Aga7i8Q
-IBEQ==
------END PUBLIC KEY-----`),
-		[]byte(`-----BEGIN PUBLIC KEY-----
-MIGdMA0GCSqGSIb3DQEBAQUAA4GLADCBhwKBgQDTJKLLO7wjCHz80kpnisqcPDQvA9voNY
-5QuAA+bOWeqvl4gmPSiylzQZzldS+n/M5p4o1PRS24WAO+kPBHCf4ETAns8M02MFwxH/Fl
-QnbvMfi9zutJkQAu3Hq4293rHz+iCQW/MWYB5IfzFBnWtEdjkhqHsGy6sZMMe+qx/F1rcQ
-IBEQ==
------END PUBLIC KEY-----`),
-		usercmd)
+	serverKey, err := Key(cfg.ServerKey)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(`サーバ公開鍵 `, err)
+	}
+	peerKey, err := Key(cfg.PeerKey)
+	if err != nil {
+		log.Fatal(`ピア公開鍵 `, err)
 	}
 
-	hs := http.NewServeMux()
-	peer.WebSocketAPI(ctx, hs)
+	peer, err := epsp.NewPeer(cfg.Servers, cfg.Region, cfg.Incoming, serverKey, peerKey, usercmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.KeyFile != `` {
+		if err = peer.SetKeyFile(cfg.KeyFile); err != nil {
+			log.Println(`鍵ファイル `, err)
+		}
+	}
+	if len(cfg.ListenAddrs) != 0 {
+		peer.SetListenAddrs(cfg.ListenAddrs...)
+	}
+	if cfg.AdvertisedPort != 0 {
+		peer.SetAdvertisedPort(cfg.AdvertisedPort)
+	}
+	switch {
+	case cfg.Enabled(`upnp`):
+		if m, err := epsp.DiscoverUPnP(ctx); err == nil {
+			peer.SetPortMapper(m)
+		} else {
+			log.Println(`UPnP `, err)
+		}
+	case cfg.Enabled(`natpmp`):
+		peer.SetPortMapper(epsp.NewNATPMPClient(cfg.NATPMPGateway))
+	}
 
-	hs.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "html/index.html")
+	peer.Sensing().OnEvent(func(ev *epsp.SensingEvent) {
+		log.Printf(`地震感知: %s 付近 信頼度%.0f%% 感知数%d 地域数%d`, ev.Area, ev.Confidence*100, ev.Reports, len(ev.Regions))
 	})
 
-	hs.HandleFunc("/635.html", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "html/635.html")
-	})
+	admin, err := NewAdmin(cfg.AdminToken, cfg.AdminUser, cfg.AdminPassword, cfg.HTTP, cfg.TLSCert != ``)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	hs.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
+	hs := http.NewServeMux()
+	if cfg.Enabled(`websocket`) {
+		peer.WebSocketAPI(ctx, hs)
+	}
+	if cfg.Enabled(`events`) {
+		peer.EventAPI(ctx, hs)
+	}
+	if cfg.Enabled(`api`) {
+		peer.RestAPI(hs)
+	}
+
+	hs.Handle("/", admin.Page(UI()))
+	hs.HandleFunc("/areas.json", areasJSON)
+
+	admin.HandleFunc(hs, "/cancel", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
 		cancel()
 	})
 
-	hs.HandleFunc("/send615", func(w http.ResponseWriter, r *http.Request) {
-		h.clean635()
-		peer.WriteExceptFrom(nil, `615`, `1`, peer.PeerID+`:`+strconv.FormatInt(time.Now().Unix(), 10))
-		time.Sleep(2 * time.Second)
-		//http.Redirect(w, r, "/635.html", 30)
+	admin.HandleFunc(hs, "/send615", func(w http.ResponseWriter, r *http.Request) {
+		t, err := peer.TraceLimited(r.Context(), 2*time.Second)
+		if err == epsp.ErrTraceTooSoon {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		h.set(t)
 		w.Header().Add(`Cache-Control`, `no-cache, no-store, must-revalidate`)
-		http.ServeFile(w, r, "html/635.html")
+		w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+		if err = t.WriteJSON(w); err != nil {
+			log.Println(err)
+		}
 	})
 
+	if cfg.SnapshotDir != `` {
+		recorder, err := epsp.NewTopologyRecorder(peer, cfg.SnapshotDir, cfg.SnapshotInterval.Duration)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recorder.OnDiff(func(d *epsp.TopologyDiff) {
+			log.Println(`ネットワーク構成変化 参加:`, len(d.Joined), ` 離脱:`, len(d.Left), ` 分断:`, d.Partitioned)
+		})
+		hs.Handle("/topology/", recorder)
+		go func() {
+			if err := recorder.Run(ctx); err != nil && err != context.Canceled {
+				log.Println(err)
+			}
+		}()
+	}
+
 	hs.Handle("/635.json", h)
+	hs.Handle("/635.dot", h)
+	hs.Handle("/635.graphml", h)
+	hs.HandleFunc("/635.schema.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `application/schema+json`)
+		_, _ = w.Write([]byte(epsp.TopologyJSONSchema))
+	})
 
 	errCh := make(chan error)
 	go func() {
-		errCh <- http.ListenAndServe(`:6980`, hs)
+		if cfg.TLSCert != `` {
+			errCh <- http.ListenAndServeTLS(cfg.HTTP, cfg.TLSCert, cfg.TLSKey, hs)
+		} else {
+			errCh <- http.ListenAndServe(cfg.HTTP, hs)
+		}
 	}()
 
 	go func() {
-		errCh <- peer.Loop(ctx, 6911 /* tcp port */)
+		errCh <- peer.Loop(ctx, cfg.Port)
 	}()
 
 	select {
@@ -118,22 +181,16 @@ IBEQ==
 func usercmd(code string, recvdata ...string) {
 
 	switch code {
-	case "551":
-		gaiyob, _, err := transform.String(japanese.ShiftJIS.NewDecoder().Transformer, recvdata[2])
-		if err != nil {
-			log.Println(err)
-		}
-		syohsaib, _, err := transform.String(japanese.ShiftJIS.NewDecoder().Transformer, recvdata[3])
+	case epsp.CodeEarthquake:
+		e, err := epsp.DecodeEarthquake(recvdata)
 		if err != nil {
 			log.Println(err)
+			return
 		}
 
-		gaiyo := strings.Split(string(gaiyob), `,`)
-		showsai := strings.Split(string(syohsaib), `,`)
-
-		log.Print("地震情報:" + gaiyo[0] + `、震度` + gaiyo[1] + `の地震がありました。` +
-			`震源は` + gaiyo[4] + `、深さは` + gaiyo[5] + `、マグニチュードは` + gaiyo[6] + `と推定されます。`)
-		switch gaiyo[2] {
+		log.Print("地震情報:" + e.Time + `、震度` + epsp.ScaleName(e.MaxScale) + `の地震がありました。` +
+			`震源は` + e.Hypocenter + `、深さは` + e.Depth + `、マグニチュードは` + e.Magnitude + `と推定されます。`)
+		switch e.Tsunami {
 		case `0`:
 			log.Print(`津波の心配はありません。`)
 		case `1`:
@@ -143,15 +200,17 @@ func usercmd(code string, recvdata ...string) {
 		case `3`:
 			log.Print(`津波について不明です。`)
 		}
-		if gaiyo[7] == `1` {
+		if e.Corrected {
 			log.Print(`震度が訂正されました。`)
 		}
-		log.Println(strings.Join(showsai, `,`))
-	case "555":
+		for _, p := range e.Points {
+			log.Println(p.Prefecture + ` ` + p.Name + ` 震度` + p.Scale)
+		}
+	case epsp.CodeSensing:
 		kanchidata := strings.Split(recvdata[5], `,`)
 		log.Println("地震感知情報 " + epsp.Area(kanchidata[1]) + `(PubKey:` + recvdata[2] + `)から` + kanchidata[0])
-	case "635":
-		h.cmd635(recvdata...)
+	case epsp.CodeTraceReply:
+		log.Println(`調査エコーリプライ ` + strings.Join(recvdata, `:`))
 	default:
 		log.Println(`未知コード受信 ` + code + ` n ` + strings.Join(recvdata, `:`))
 	}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+
+	"github.com/toyo/epsp"
+)
+
+//go:embed html
+var assets embed.FS
+
+// UI は、バイナリに埋め込んだ統計ページ(html/)を返します
+func UI() http.Handler {
+	sub, err := fs.Sub(assets, `html`)
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
+
+// areasJSON は、地図を描くための地域コードの一覧(/areas.json)を返します
+func areasJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	w.Header().Set(`Cache-Control`, `max-age=86400`)
+	_ = json.NewEncoder(w).Encode(epsp.Areas())
+}